@@ -3,13 +3,16 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
-	"os"
 	"strconv"
 	"time"
 
 	"github.com/juju/errors"
 	"go.uber.org/zap"
 
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/keystore"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 	"github.com/opentradingnetworkfoundation/otn-go/httpserver"
 	"github.com/opentradingnetworkfoundation/otn-go/secrets"
 )
@@ -42,13 +45,17 @@ type RateLimiterConfig struct {
 }
 
 type faucetConfig struct {
-	TrustedNode       string                 `json:"trusted_node"`
+	TrustedNode       nodepool.Addresses     `json:"trusted_node"`
+	NodePool          *nodepool.Config       `json:"node_pool"`
 	HTTPServer        httpserver.Config      `json:"http_server"`
 	Registrar         string                 `json:"registrar"`
 	DefaultReferrer   string                 `json:"default_referrer"`
 	ReferrerPercent   int                    `json:"referrer_percent"`
 	Keys              []string               `json:"keys"`
 	Secrets           *secrets.StorageConfig `json:"secrets"`
+	Keystore          *keystore.Config       `json:"keystore"`
+	Journal           *journal.Config        `json:"journal"`
+	Notify            *notify.Config         `json:"notify"`
 	RateLimiterConfig *RateLimiterConfig     `json:"ratelimit"`
 	Logger            zap.Config             `json:"logger"`
 }
@@ -65,6 +72,6 @@ func loadConfig(filename string, cfg *faucetConfig) error {
 	if err = json.Unmarshal(data, cfg); err != nil {
 		return err
 	}
-	cfg.TrustedNode = os.ExpandEnv(cfg.TrustedNode)
+	cfg.TrustedNode = cfg.TrustedNode.ExpandEnv()
 	return nil
 }
@@ -7,10 +7,15 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"go.uber.org/zap"
 
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 	"github.com/opentradingnetworkfoundation/otn-go/api"
 	"github.com/opentradingnetworkfoundation/otn-go/objects"
 	"github.com/opentradingnetworkfoundation/otn-go/wallet"
@@ -32,6 +37,9 @@ func createKeyAuthority(pubKey string) objects.Authority {
 	return auth
 }
 
+// consecutive failed account creations operators are notified of
+const broadcastFailureLimit = 3
+
 type accountInfo struct {
 	Name      string `json:"name"`
 	ActiveKey string `json:"active_key"`
@@ -47,8 +55,13 @@ type faucet struct {
 	wallet      wallet.Wallet
 	httpServer  *http.Server
 	router      *mux.Router
+	rpcMutex    sync.Mutex
 	rpc         api.BitsharesAPI
 	rateLimiter *RateLimiter
+	journal     *journal.Journal
+	notifier    *notify.Notifier
+	// account creations failed in a row
+	failedBroadcasts int32
 
 	registrar       *objects.Account
 	defaultReferrer *objects.Account
@@ -92,7 +105,23 @@ func NewFaucet(
 	if err != nil {
 		return nil, err
 	}
+	var j *journal.Journal
+	if cfg.Journal != nil {
+		if j, err = journal.New(cfg.Journal, "faucet"); err != nil {
+			return nil, err
+		}
+	}
+
+	var n *notify.Notifier
+	if cfg.Notify != nil {
+		if n, err = notify.New(cfg.Notify, "faucet", l.Sugar()); err != nil {
+			return nil, err
+		}
+	}
+
 	f := &faucet{
+		journal:     j,
+		notifier:    n,
 		cfg:         cfg,
 		log:         l.Sugar(),
 		wallet:      wallet,
@@ -120,7 +149,7 @@ func (f *faucet) loadAccount(rpc api.BitsharesAPI, name string) *objects.Account
 }
 
 func (f *faucet) Start(rpc api.BitsharesAPI) {
-	f.rpc = rpc
+	f.setRPC(rpc)
 
 	f.registrar = f.loadAccount(rpc, f.cfg.Registrar)
 	f.defaultReferrer = f.loadAccount(rpc, f.cfg.DefaultReferrer)
@@ -136,9 +165,51 @@ func (f *faucet) Stop() {
 	if err := f.httpServer.Shutdown(context.Background()); err != nil {
 		f.log.Errorf("Unable to shutdown server: %v", err)
 	}
+	if err := f.journal.Close(); err != nil {
+		f.log.Errorf("Unable to close journal: %v", err)
+	}
 	os.Exit(69)
 }
 
+func (f *faucet) setRPC(rpc api.BitsharesAPI) {
+	f.rpcMutex.Lock()
+	defer f.rpcMutex.Unlock()
+	f.rpc = rpc
+}
+
+func (f *faucet) getRPC() api.BitsharesAPI {
+	f.rpcMutex.Lock()
+	defer f.rpcMutex.Unlock()
+	return f.rpc
+}
+
+// followPool moves faucet to the active node on failover. Connection of
+// the node faucet was started on is kept by the starter.
+func (f *faucet) followPool(node string, events <-chan nodepool.Event) {
+	var own api.BitsharesAPI
+	for e := range events {
+		if e.Type == nodepool.EventUnavailable || e.To == node {
+			continue
+		}
+
+		f.log.Infof("Switching to API node %s", e.To)
+		rpcConn := api.NewConnection(e.To)
+		rpc := api.New(rpcConn)
+		if err := rpcConn.Connect(); err != nil {
+			// current connection is kept, next failover event retries
+			f.log.Errorf("Unable to open connection to API node %s: %v", e.To, err)
+			continue
+		}
+		node = e.To
+		f.setRPC(rpc)
+
+		if own != nil {
+			own.Close()
+		}
+		own = rpc
+	}
+}
+
 func (f *faucet) SignalHandler(s os.Signal) {
 	f.log.Warnf("Got %s signal...", s.String())
 }
@@ -210,13 +281,30 @@ func (f *faucet) accounts(w http.ResponseWriter, r *http.Request) {
 	op.Options.Extensions = objects.Extensions{}
 	op.Options.Votes = make([]objects.Vote, 0)
 
-	_, err = api.SignAndBroadcast(f.rpc, f.wallet.GetKeys(), objects.NewGrapheneID("1.3.0"), &op)
+	txID, err := api.SignAndBroadcast(f.getRPC(), f.wallet.GetKeys(), objects.NewGrapheneID("1.3.0"), &op)
+
+	rec := journal.Record{
+		Account: f.cfg.Registrar,
+		Reason:  fmt.Sprintf("registration of %s requested from %s", req.Account.Name, RemoteIP(r)),
+	}
+	if jErr := f.journal.Record(rec, []objects.Operation{&op}, txID, err); jErr != nil {
+		f.log.Errorf("Failed to write journal: %v", jErr)
+	}
+
 	if err != nil {
 		f.log.Errorw(fmt.Sprintf("Failed to create account: %v", err), "account", req.Account.Name)
+		if failed := atomic.AddInt32(&f.failedBroadcasts, 1); failed >= broadcastFailureLimit {
+			f.notifier.Notify(notify.Event{
+				Type:     notify.EventBroadcastFailing,
+				Severity: notify.SeverityError,
+				Message:  fmt.Sprintf("%d account creations failed in a row, last: %v", failed, err),
+			})
+		}
 		writeJSONResponse(w, http.StatusInternalServerError, NewErrorResponse(ErrOperationFailed, err.Error()))
 		return
 	}
 
+	atomic.StoreInt32(&f.failedBroadcasts, 0)
 	f.log.Infow(fmt.Sprintf("Created account: %#v", *req.Account), "account", req.Account.Name)
 
 	writeJSONResponse(w, http.StatusOK, req)
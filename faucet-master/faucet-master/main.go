@@ -9,6 +9,8 @@ import (
 
 	"github.com/gorilla/mux"
 
+	"github.com/opentradingnetworkfoundation/market-maker/keystore"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
 	"github.com/opentradingnetworkfoundation/otn-go/httpserver"
 	"github.com/opentradingnetworkfoundation/otn-go/secrets"
 	"github.com/opentradingnetworkfoundation/otn-go/wallet"
@@ -35,6 +37,15 @@ func NewWallet(cfg *faucetConfig) (wallet.Wallet, error) {
 		cfg.Keys = append(cfg.Keys, keys...)
 	}
 
+	if cfg.Keystore != nil {
+		keys, err := keystore.ReadKeys(cfg.Keystore)
+		if err != nil {
+			return nil, errors.Annotate(err, "read keystore")
+		}
+
+		cfg.Keys = append(cfg.Keys, keys...)
+	}
+
 	if err := wallet.AddPrivateKeys(cfg.Keys); err != nil {
 		log.Printf("Unable to add wallet private keys: %v", err)
 		return nil, err
@@ -43,8 +54,13 @@ func NewWallet(cfg *faucetConfig) (wallet.Wallet, error) {
 	return wallet, nil
 }
 
-func NewStarter(f *faucet, cfg *faucetConfig) *otn.Starter {
-	return otn.NewStarter(f, &otn.StarterConfig{TrustedNode: cfg.TrustedNode})
+func NewNodePool(cfg *faucetConfig, f *faucet) (*nodepool.Manager, error) {
+	return nodepool.New(cfg.TrustedNode, cfg.NodePool, f.log)
+}
+
+func NewStarter(f *faucet, pool *nodepool.Manager) *otn.Starter {
+	pool.Start()
+	return otn.NewStarter(f, &otn.StarterConfig{TrustedNode: pool.Active()})
 }
 
 func main() {
@@ -67,11 +83,25 @@ func main() {
 	di.Provide(httpserver.NewHTTPServer)
 	di.Provide(NewWallet)
 	di.Provide(NewFaucet)
+
+	di.Provide(NewNodePool)
 	di.Provide(NewStarter)
 
-	err := di.Invoke(func(starter *otn.Starter, cfg *faucetConfig) {
-		log.Printf("Using node %s; Serving on address %s", cfg.TrustedNode, cfg.HTTPServer.Addr)
+	err := di.Invoke(func(starter *otn.Starter, f *faucet, pool *nodepool.Manager, cfg *faucetConfig) {
+		log.Printf("Using node %s; Serving on address %s", pool.Active(), cfg.HTTPServer.Addr)
 		doneChan := make(chan struct{})
+
+		// pool handlers must not block, faucet reconnects on failover
+		events := make(chan nodepool.Event, 16)
+		pool.Subscribe(func(e nodepool.Event) {
+			select {
+			case events <- e:
+			default:
+				log.Printf("Dropped node pool event %s", e.Type)
+			}
+		})
+		go f.followPool(pool.Active(), events)
+
 		starter.Run(doneChan)
 	})
 
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"log"
+	"os"
+	"time"
+
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+)
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	// relative time, e.g. 24h means 24 hours ago
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func main() {
+	path := flag.String("file", "journal.jsonl", "Journal file, rotated files are found automatically")
+	since := flag.String("since", "", "Show entries since time (RFC3339) or duration ago, e.g. 24h")
+	until := flag.String("until", "", "Show entries before time (RFC3339) or duration ago")
+	filter := &journal.Filter{}
+	flag.StringVar(&filter.Type, "type", "", "Operation type, e.g. limit_order_create")
+	flag.StringVar(&filter.Account, "account", "", "Account that sent operation")
+	flag.StringVar(&filter.Service, "service", "", "Service name")
+	flag.StringVar(&filter.Market, "market", "", "Market, e.g. OTN/BTC")
+	flag.Parse()
+
+	var err error
+	if filter.Since, err = parseTime(*since); err != nil {
+		log.Fatalf("Invalid -since: %v", err)
+	}
+	if filter.Until, err = parseTime(*until); err != nil {
+		log.Fatalf("Invalid -until: %v", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	// print matching lines as they are, output can be processed with jq
+	err = journal.Query(*path, filter, func(e *journal.Entry, line []byte) bool {
+		out.Write(line)
+		out.WriteByte('\n')
+		return true
+	})
+	if err != nil {
+		out.Flush()
+		log.Fatal(err)
+	}
+}
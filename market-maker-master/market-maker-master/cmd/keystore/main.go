@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"github.com/opentradingnetworkfoundation/market-maker/keystore"
+)
+
+const newPassphraseEnv = "KEYSTORE_NEW_PASSPHRASE"
+
+var (
+	keystorePath string
+	passphraseFD int
+)
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, `Usage: %s [flags] command
+
+Commands:
+  create          create empty keystore
+  add             add private keys in WIF format read from stdin, one per line
+  generate        generate new private key and print its public key
+  list            list public keys, passphrase is not required
+  remove PUBKEY   remove private key
+  passwd          re-encrypt keystore with new passphrase
+
+Passphrase is read from -passphrase-fd, %s environment variable
+or terminal. New passphrase for passwd is read from %s or terminal.
+
+Key rotation: generate new key, update account authority on chain,
+restart services, then remove the old key.
+
+Flags:
+`, os.Args[0], keystore.DefaultPassphraseEnv, newPassphraseEnv)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.StringVar(&keystorePath, "file", "keystore.json", "Keystore file path")
+	flag.IntVar(&passphraseFD, "passphrase-fd", 0, "File descriptor to read passphrase from")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "create":
+		err = create()
+	case "add":
+		err = add()
+	case "generate":
+		err = generate()
+	case "list":
+		err = list()
+	case "remove":
+		if len(args) != 1 {
+			err = fmt.Errorf("remove expects public key")
+		} else {
+			err = remove(args[0])
+		}
+	case "passwd":
+		err = passwd()
+	default:
+		flag.Usage()
+		err = fmt.Errorf("Unknown command '%s'", cmd)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// readPassphrase takes passphrase from fd or env, and asks on terminal otherwise
+func readPassphrase(env, prompt string, confirm bool) ([]byte, error) {
+	if passphraseFD > 0 || os.Getenv(env) != "" {
+		cfg := &keystore.Config{PassphraseEnv: env, PassphraseFD: passphraseFD}
+		return cfg.Passphrase()
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return nil, fmt.Errorf("Passphrase is not set, use %s or -passphrase-fd", env)
+	}
+
+	fmt.Fprint(os.Stderr, prompt+": ")
+	p, err := terminal.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	if confirm {
+		fmt.Fprint(os.Stderr, "Repeat "+strings.ToLower(prompt)+": ")
+		repeated, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return nil, err
+		}
+		if string(repeated) != string(p) {
+			return nil, fmt.Errorf("Passphrases do not match")
+		}
+	}
+
+	return p, nil
+}
+
+func open() (*keystore.Keystore, error) {
+	p, err := readPassphrase(keystore.DefaultPassphraseEnv, "Passphrase", false)
+	if err != nil {
+		return nil, err
+	}
+	return keystore.Open(keystorePath, p)
+}
+
+func create() error {
+	p, err := readPassphrase(keystore.DefaultPassphraseEnv, "Passphrase", true)
+	if err != nil {
+		return err
+	}
+
+	ks, err := keystore.Create(keystorePath, p)
+	if err != nil {
+		return err
+	}
+	if err := ks.Save(); err != nil {
+		return err
+	}
+
+	log.Printf("Created keystore %s", keystorePath)
+	return nil
+}
+
+func add() error {
+	ks, err := open()
+	if err != nil {
+		return err
+	}
+
+	// keys are read from stdin to keep them out of shell history
+	if terminal.IsTerminal(int(os.Stdin.Fd())) {
+		fmt.Fprintln(os.Stderr, "Enter private keys, one per line, finish with Ctrl+D")
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		wif := strings.TrimSpace(scanner.Text())
+		if wif == "" {
+			continue
+		}
+		pub, err := ks.Add(wif)
+		if err != nil {
+			return err
+		}
+		fmt.Println(pub)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return ks.Save()
+}
+
+func generate() error {
+	ks, err := open()
+	if err != nil {
+		return err
+	}
+
+	pub, err := ks.Generate()
+	if err != nil {
+		return err
+	}
+	if err := ks.Save(); err != nil {
+		return err
+	}
+
+	fmt.Println(pub)
+	return nil
+}
+
+func list() error {
+	keys, err := keystore.ReadPublicKeys(keystorePath)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+	return nil
+}
+
+func remove(pub string) error {
+	ks, err := open()
+	if err != nil {
+		return err
+	}
+	if err := ks.Remove(pub); err != nil {
+		return err
+	}
+	return ks.Save()
+}
+
+func passwd() error {
+	ks, err := open()
+	if err != nil {
+		return err
+	}
+
+	// passphrase fd is already consumed by open
+	passphraseFD = 0
+	p, err := readPassphrase(newPassphraseEnv, "New passphrase", true)
+	if err != nil {
+		return err
+	}
+
+	if err := ks.SetPassphrase(p); err != nil {
+		return err
+	}
+	return ks.Save()
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/blockchain"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/cmc"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/dex"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/route"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+	"github.com/opentradingnetworkfoundation/otn-go/wallet"
+)
+
+// Operator commands reuse service configuration and keys.
+// Note that the running service will re-create orders after cancel-all,
+// stop it first if liquidity must be removed for good.
+
+const cancelAllTimeout = time.Minute
+
+type command struct {
+	name string
+	args string
+	help string
+	run  func(c *cli, args []string) error
+	// offline commands do not connect to the node
+	offline bool
+}
+
+var commands = []command{
+	{"status", "[market]", "show own orders per market", (*cli).status, false},
+	{"balances", "", "show account balances of market assets", (*cli).balances, false},
+	{"cancel-all", "[market]", "cancel all own orders", (*cli).cancelAll, false},
+	{"price", "[market]", "show prices reported by each price provider", (*cli).price, false},
+	{"validate", "", "check configuration against the chain", (*cli).validate, false},
+	{"progress", "[market]", "show progress of parent order execution", (*cli).progress, true},
+	{"profiles", "[market]", "show scheduled profile in force and the next one", (*cli).profiles, true},
+	{"quality", "[hour|day] [market]", "export market quality statistics as CSV", (*cli).quality, true},
+	{"config", "", "show effective configuration merged from all sources", (*cli).dumpConfig, true},
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command [args]]\n\n", os.Args[0])
+	fmt.Fprintln(out, "Without command runs market maker service.\n\nCommands:")
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %s %s\t%s\n", c.name, c.args, c.help)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nMarket is specified as BASE/QUOTE, e.g. OTN/BTC\n\nFlags:")
+	flag.PrintDefaults()
+}
+
+type cli struct {
+	loader  *ConfigLoader
+	cfg     *MarketMakerConfig
+	log     *zap.SugaredLogger
+	rpc     api.BitsharesAPI
+	wallet  wallet.Wallet
+	journal *journal.Journal
+	out     *tabwriter.Writer
+
+	balanceMutex sync.Mutex
+}
+
+func runCommand(loader *ConfigLoader, cfg *MarketMakerConfig, name string, args []string) error {
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		flag.Usage()
+		return fmt.Errorf("Unknown command '%s'", name)
+	}
+
+	c := &cli{
+		loader: loader,
+		cfg:    cfg,
+		out:    tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0),
+	}
+	defer c.out.Flush()
+
+	if !cmd.offline {
+		if err := c.connect(); err != nil {
+			return err
+		}
+		defer c.journal.Close()
+	}
+
+	return cmd.run(c, args)
+}
+
+func (c *cli) connect() error {
+	// keep output readable, service logs are only interesting on failures
+	c.cfg.Logger.Level.SetLevel(zap.WarnLevel)
+	lg, err := c.cfg.Logger.Build()
+	if err != nil {
+		return err
+	}
+	c.log = lg.Sugar()
+
+	c.wallet, err = newWallet(c.cfg)
+	if err != nil {
+		return errors.Annotate(err, "import keys")
+	}
+
+	// operator actions are journaled as well as service ones
+	c.journal, err = c.cfg.openJournal()
+	if err != nil {
+		return err
+	}
+
+	// probe configured nodes once to pick the healthy one
+	pool, err := nodepool.New(c.cfg.NodeAddr, c.cfg.NodePool, c.log)
+	if err != nil {
+		return err
+	}
+	pool.Start()
+	node := pool.Active()
+	pool.Stop()
+
+	conn := api.NewConnection(node)
+	c.rpc = api.New(conn)
+	if err := conn.Connect(); err != nil {
+		return errors.Annotatef(err, "connect to node %s", node)
+	}
+
+	return nil
+}
+
+func parseMarket(name string) (base, quote string, err error) {
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("Invalid market '%s', expected BASE/QUOTE", name)
+	}
+	return strings.ToUpper(parts[0]), strings.ToUpper(parts[1]), nil
+}
+
+// markets returns configured markets or the one given in args.
+// Markets missing from configuration are allowed, so that orders
+// left from old configuration can be inspected and cancelled.
+func (c *cli) markets(args []string) ([]mm.MarketConfig, error) {
+	if len(args) == 0 {
+		return c.cfg.Markets, nil
+	}
+	if len(args) > 1 {
+		return nil, fmt.Errorf("Expected single market argument")
+	}
+
+	base, quote, err := parseMarket(args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for _, m := range c.cfg.Markets {
+		if m.Base == base && m.Quote == quote {
+			return []mm.MarketConfig{m}, nil
+		}
+	}
+
+	return []mm.MarketConfig{{Base: base, Quote: quote}}, nil
+}
+
+func (c *cli) newMarketMaker(market mm.MarketConfig, factory mm.PriceProviderFactory) (*mm.MarketMaker, error) {
+	m := mm.NewMarketMaker(newMarketMakerConfig(c.cfg, market, c.journal, nil), c.rpc, c.wallet, factory, c.log, &c.balanceMutex)
+	if err := m.Load(); err != nil {
+		return nil, errors.Annotatef(err, "load market %s/%s", market.Base, market.Quote)
+	}
+	return m, nil
+}
+
+func (c *cli) marketMakers(args []string) ([]*mm.MarketMaker, error) {
+	markets, err := c.markets(args)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*mm.MarketMaker, 0, len(markets))
+	for _, market := range markets {
+		m, err := c.newMarketMaker(market, nil)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+func (c *cli) status(args []string) error {
+	makers, err := c.marketMakers(args)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range makers {
+		market := m.Market()
+		orderBook, err := m.OpenOrders()
+		if err != nil {
+			return errors.Annotatef(err, "load orders of %s", market.DisplayName())
+		}
+
+		fmt.Fprintf(c.out, "%s\tsell: %d\tbuy: %d\n", market.DisplayName(), len(orderBook.Sell), len(orderBook.Buy))
+		c.printOrders("SELL", orderBook.Sell, market, false)
+		c.printOrders("BUY", orderBook.Buy, market, true)
+	}
+
+	return nil
+}
+
+func (c *cli) printOrders(side string, orders objects.LimitOrders, market *mm.Market, inverse bool) {
+	for _, o := range orders {
+		price := market.GetRate(o.SellPrice).Value()
+		if inverse {
+			price = 1 / price
+		}
+
+		asset := &market.Base
+		if inverse {
+			asset = &market.Quote
+		}
+		amount := asset.GetRate(objects.AssetAmount{Asset: asset.ID, Amount: o.ForSale})
+
+		fmt.Fprintf(c.out, "  %s\t%s\t%.8f\t%f %s\texpires %s\n",
+			o.ID, side, price, amount, asset.Symbol, o.Expiration.Format(time.RFC3339))
+	}
+}
+
+func (c *cli) balances(args []string) error {
+	makers, err := c.marketMakers(nil)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range makers {
+		market := m.Market()
+		base, quote, err := m.Balances()
+		if err != nil {
+			return errors.Annotatef(err, "get balances of %s", market.DisplayName())
+		}
+
+		for _, b := range []struct {
+			asset  *objects.Asset
+			amount objects.AssetAmount
+		}{{&market.Base, base}, {&market.Quote, quote}} {
+			if !seen[b.asset.Symbol] {
+				seen[b.asset.Symbol] = true
+				fmt.Fprintf(c.out, "%s\t%f\n", b.asset.Symbol, b.asset.GetRate(b.amount))
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *cli) cancelAll(args []string) error {
+	makers, err := c.marketMakers(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelAllTimeout)
+	defer cancel()
+
+	failed := 0
+	for _, m := range makers {
+		name := m.Market().DisplayName()
+		if err := m.CancelOrders(ctx, "operator cancel-all"); err != nil {
+			fmt.Fprintf(c.out, "%s\tFAILED: %v\n", name, err)
+			failed++
+			continue
+		}
+
+		// open orders are read from the account, not the depth limited book
+		orders, err := m.OpenOrders()
+		if err != nil {
+			fmt.Fprintf(c.out, "%s\tcancelled, FAILED to check remaining: %v\n", name, err)
+			failed++
+			continue
+		}
+		remaining := len(orders.Orders())
+		fmt.Fprintf(c.out, "%s\tcancelled, %d remaining\n", name, remaining)
+		if remaining > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("Failed to cancel orders on %d market(s)", failed)
+	}
+	return nil
+}
+
+func (c *cli) progress(args []string) error {
+	markets, err := c.markets(args)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range markets {
+		market := &markets[i]
+		p, err := mm.LoadExecutionProgress(market, now)
+		if err != nil {
+			return errors.Annotatef(err, "load progress of %s/%s", market.Base, market.Quote)
+		}
+		if p == nil {
+			continue
+		}
+
+		state := "running"
+		switch {
+		case p.Done:
+			state = "done"
+		case p.Started.IsZero():
+			state = "not started"
+		}
+		fmt.Fprintf(c.out, "%s/%s\t%s\t%s\n", market.Base, market.Quote, state, p.String())
+	}
+
+	return nil
+}
+
+func (c *cli) profiles(args []string) error {
+	markets, err := c.markets(args)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i := range markets {
+		market := &markets[i]
+		p, err := mm.MarketProfile(market, now)
+		if err != nil {
+			return errors.Annotatef(err, "schedule of %s/%s", market.Base, market.Quote)
+		}
+		if p == nil {
+			continue
+		}
+		fmt.Fprintf(c.out, "%s/%s\t%s\n", market.Base, market.Quote, p.String())
+	}
+
+	return nil
+}
+
+func (c *cli) quality(args []string) error {
+	if c.cfg.Quality == nil {
+		return errors.New("Market quality reports are not configured")
+	}
+
+	period := mm.PeriodDay
+	if len(args) > 0 && (args[0] == mm.PeriodHour || args[0] == mm.PeriodDay) {
+		period, args = args[0], args[1:]
+	}
+	var market string
+	if len(args) > 0 {
+		markets, err := c.markets(args)
+		if err != nil {
+			return err
+		}
+		market = markets[0].Base + "/" + markets[0].Quote
+	}
+
+	q, err := mm.LoadQualityReport(c.cfg.Quality)
+	if err != nil {
+		return err
+	}
+	rows, err := q.Report(market, period, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+	return mm.WriteQualityCSV(os.Stdout, rows)
+}
+
+type namedFactory struct {
+	name    string
+	factory mm.PriceProviderFactory
+}
+
+// priceProviderFactories returns every provider we can use with current
+// configuration, not only the one service would choose. Route shares CMC
+// provider, background refresh runs until ctx is done.
+func (c *cli) priceProviderFactories(ctx context.Context) []namedFactory {
+	result := []namedFactory{{"blockchain", blockchain.NewFactory(c.rpc)}}
+
+	var cmcFactory mm.PriceProviderFactory
+	if c.cfg.PriceProvider.CMC != nil {
+		f, err := cmc.NewFactory(ctx, c.cfg.PriceProvider.CMC, c.log)
+		if err != nil {
+			fmt.Fprintf(c.out, "cmc\tFAILED: %v\n", err)
+		} else {
+			cmcFactory = f
+			result = append(result, namedFactory{"cmc", f})
+		}
+	}
+
+	if c.cfg.PriceProvider.Route != nil {
+		if c.cfg.PriceProvider.CMC != nil && cmcFactory == nil {
+			fmt.Fprintf(c.out, "route\tFAILED: CMC provider is not available\n")
+		} else {
+			sources := newQuoteSources(c.rpc, cmcFactory)
+			result = append(result, namedFactory{"route", route.NewFactory(c.cfg.PriceProvider.Route, sources, c.log)})
+		}
+	}
+
+	if c.cfg.PriceProvider.DEX != nil {
+		f, err := dex.NewFactory(c.cfg.PriceProvider.DEX, c.rpc, c.log)
+		if err != nil {
+			fmt.Fprintf(c.out, "dex\tFAILED: %v\n", err)
+		} else {
+			result = append(result, namedFactory{"dex", f})
+		}
+	}
+
+	return result
+}
+
+func (c *cli) price(args []string) error {
+	makers, err := c.marketMakers(args)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factories := c.priceProviderFactories(ctx)
+
+	for _, m := range makers {
+		market := m.Market()
+		for _, f := range factories {
+			p, err := f.factory.GetProvider(market)
+			if err != nil {
+				fmt.Fprintf(c.out, "%s\t%s\tFAILED: %v\n", market.DisplayName(), f.name, err)
+				continue
+			}
+
+			rate := market.GetRate(p.GetPrice()).Value()
+			if rate == 0 {
+				fmt.Fprintf(c.out, "%s\t%s\tno price\n", market.DisplayName(), f.name)
+				continue
+			}
+			fmt.Fprintf(c.out, "%s\t%s\t%.8f\tinverse: %.8f\n", market.DisplayName(), f.name, rate, 1/rate)
+		}
+	}
+
+	return nil
+}
+
+func (c *cli) validate(args []string) error {
+	var problems []string
+
+	if err := validateConfig(c.cfg, c.rpc); err != nil {
+		if errs, ok := err.(mm.ValidationErrors); ok {
+			for _, e := range errs {
+				problems = append(problems, e.Error())
+			}
+		} else {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	factory, err := newPriceProviderFactory(ctx, c.cfg, c.rpc, c.log)
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	for _, market := range c.cfg.Markets {
+		m, err := c.newMarketMaker(market, factory)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+
+		// grid markets are not priced
+		if factory == nil || market.Grid != nil {
+			continue
+		}
+
+		p, err := factory.GetProvider(m.Market())
+		if err != nil {
+			problems = append(problems, errors.Annotatef(err, "price provider for %s", m.Market().DisplayName()).Error())
+		} else if m.Market().GetRate(p.GetPrice()).Value() == 0 {
+			problems = append(problems, fmt.Sprintf("no price for %s", m.Market().DisplayName()))
+		}
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintf(c.out, "ERROR\t%s\n", p)
+		}
+		return fmt.Errorf("Configuration has %d problem(s)", len(problems))
+	}
+
+	fmt.Fprintln(c.out, "OK")
+	return nil
+}
+
+func (c *cli) dumpConfig(args []string) error {
+	return c.loader.Dump(os.Stdout, hiddenFields...)
+}
@@ -3,28 +3,48 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
+	"io"
+	"log"
 	"strings"
 	"sync"
+	"time"
 
-	"github.com/hashicorp/consul/api"
 	"github.com/juju/errors"
 	"github.com/shopspring/decimal"
 	"go.uber.org/zap"
 
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/keystore"
 	"github.com/opentradingnetworkfoundation/market-maker/mm"
 	"github.com/opentradingnetworkfoundation/market-maker/mm/cmc"
-	"github.com/opentradingnetworkfoundation/otn-go/consul"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/dex"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/route"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 	"github.com/opentradingnetworkfoundation/otn-go/secrets"
 )
 
 type PriceProviderConfig struct {
-	CMC *cmc.Config
+	CMC   *cmc.Config
+	DEX   *dex.Config
+	Route *route.Config
+}
+
+// hiddenFields are masked when configuration is dumped: private keys, API
+// keys, secret storage with its token, instance lock DSN with password and
+// webhook URLs with tokens
+var hiddenFields = []string{
+	"keys",
+	"price_provider.cmc.apikey",
+	"secrets",
+	"instance_lock",
+	"notify.webhooks.url",
+	"notify.webhooks.chat_id",
 }
 
 type MarketMakerConfig struct {
-	NodeAddr      string                 `json:"node_addr"`
+	NodeAddr      nodepool.Addresses     `json:"node_addr"`
+	NodePool      *nodepool.Config       `json:"node_pool"`
 	Account       string                 `json:"account"`
 	InstanceLock  string                 `json:"instance_lock"`
 	FeeReserve    decimal.Decimal        `json:"fee_reserve"`
@@ -32,11 +52,63 @@ type MarketMakerConfig struct {
 	PriceProvider PriceProviderConfig    `json:"price_provider"`
 	Keys          []string               `json:"keys"`
 	Secrets       *secrets.StorageConfig `json:"secrets"`
+	Keystore      *keystore.Config       `json:"keystore"`
+	Journal       *journal.Config        `json:"journal"`
+	Notify        *notify.Config         `json:"notify"`
 	Logger        zap.Config             `json:"logger"`
+	// Time in seconds given to cancel all orders on shutdown
+	ShutdownTimeout int `json:"shutdown_timeout"`
+	// Time in seconds to wait after taking instance lock, so that
+	// previous holder has time to cancel its orders
+	TakeoverDelay int               `json:"takeover_delay"`
+	DeadMan       *mm.DeadManConfig `json:"dead_man"`
+	// Address to serve metrics on, e.g. :9100
+	MetricsAddr string `json:"metrics_addr"`
+	// Market quality reports, served on metrics address
+	Quality *mm.QualityConfig `json:"quality"`
+	// Call positions kept within collateral ratio band
+	Collateral *mm.CollateralConfig `json:"collateral"`
+}
+
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	// time for lock holder to notice lock loss on top of shutdown timeout
+	lockLossDetection = 5 * time.Second
+	lockRetryInterval = 5 * time.Second
+)
+
+const serviceName = "market-maker"
+
+func (c *MarketMakerConfig) openJournal() (*journal.Journal, error) {
+	if c.Journal == nil {
+		return nil, nil
+	}
+	return journal.New(c.Journal, serviceName)
+}
+
+func (c *MarketMakerConfig) openNotifier(log *zap.SugaredLogger) (*notify.Notifier, error) {
+	if c.Notify == nil {
+		return nil, nil
+	}
+	return notify.New(c.Notify, serviceName, log)
+}
+
+func (c *MarketMakerConfig) shutdownTimeout() time.Duration {
+	if c.ShutdownTimeout <= 0 {
+		return defaultShutdownTimeout
+	}
+	return time.Duration(c.ShutdownTimeout) * time.Second
+}
+
+func (c *MarketMakerConfig) takeoverDelay() time.Duration {
+	if c.TakeoverDelay <= 0 {
+		return c.shutdownTimeout() + lockLossDetection
+	}
+	return time.Duration(c.TakeoverDelay) * time.Second
 }
 
 func postProcessConfig(cfg *MarketMakerConfig) error {
-	cfg.NodeAddr = os.ExpandEnv(cfg.NodeAddr)
+	cfg.NodeAddr = cfg.NodeAddr.ExpandEnv()
 
 	if cfg.Secrets != nil {
 		stg, err := secrets.NewSecretStorage(cfg.Secrets)
@@ -52,87 +124,150 @@ func postProcessConfig(cfg *MarketMakerConfig) error {
 		cfg.Keys = append(cfg.Keys, keys...)
 	}
 
+	if cfg.Keystore != nil {
+		keys, err := keystore.ReadKeys(cfg.Keystore)
+		if err != nil {
+			return errors.Annotate(err, "read keystore")
+		}
+
+		cfg.Keys = append(cfg.Keys, keys...)
+	}
+
 	return nil
 }
 
-const consulPrefix = "consul://"
-
+// ConfigLoader merges documents of configuration sources: later sources
+// override values of earlier ones
 type ConfigLoader struct {
-	sources  []string
+	sources  []Source
 	onChange func()
 
-	keyVersions map[string]uint64
-	client      *api.Client
-	keyWatch    *consul.KeyWatch
-	mutex       sync.Mutex
+	effective map[string]interface{}
+	mutex     sync.Mutex
 }
 
-func NewConfigLoader(sources []string) (*ConfigLoader, error) {
-	client, err := consul.NewClient()
-	if err != nil {
-		return nil, err
+func NewConfigLoader(specs []string) (*ConfigLoader, error) {
+	sources := make([]Source, 0, len(specs))
+	for _, spec := range specs {
+		src, err := NewSource(spec)
+		if err != nil {
+			for _, s := range sources {
+				s.Close()
+			}
+			return nil, errors.Annotatef(err, "create source %s", spec)
+		}
+		sources = append(sources, src)
 	}
-	return &ConfigLoader{
-		sources:     sources,
-		client:      client,
-		keyVersions: make(map[string]uint64),
-		keyWatch:    consul.NewKeyWatch(client),
-	}, nil
+
+	return &ConfigLoader{sources: sources}, nil
 }
 
-func (c *ConfigLoader) Load(cfg interface{}) (err error) {
+func (c *ConfigLoader) Load(cfg interface{}) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	var doc interface{} = map[string]interface{}{}
 	for _, src := range c.sources {
-		var data []byte
-		if strings.HasPrefix(src, consulPrefix) {
-			key := strings.TrimPrefix(src, consulPrefix)
-			kv, _, err := c.client.KV().Get(key, nil)
-			if err != nil {
-				return errors.Annotatef(err, "Failed to read consul key %s", key)
-			}
-			if kv == nil {
-				return fmt.Errorf("consul key %s does not exist", key)
-			}
-			data = kv.Value
-			c.keyVersions[key] = kv.ModifyIndex
-		} else {
-			data, err = ioutil.ReadFile(src)
-			if err != nil {
-				return err
-			}
+		srcDoc, err := src.Load()
+		if err != nil {
+			return errors.Annotatef(err, "Failed to load configuration from %s", src)
 		}
 
-		if err := json.Unmarshal(data, cfg); err != nil {
-			return errors.Annotatef(err, "Failed to parse configuration from %s", src)
+		doc, err = mergeDocuments(doc, srcDoc)
+		if err != nil {
+			return errors.Annotatef(err, "Failed to merge configuration from %s", src)
 		}
 	}
 
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return errors.Annotate(err, "Failed to parse configuration")
+	}
+
+	c.effective = doc.(map[string]interface{})
 	return nil
 }
 
+// Dump writes merged configuration document, as it was last loaded.
+// Values of hidden fields are masked, nested fields are separated by dot.
+func (c *ConfigLoader) Dump(w io.Writer, hidden ...string) error {
+	c.mutex.Lock()
+	doc := make(map[string]interface{}, len(c.effective))
+	for k, v := range c.effective {
+		doc[k] = v
+	}
+	c.mutex.Unlock()
+
+	for _, k := range hidden {
+		doc = mask(doc, strings.Split(k, "."))
+	}
+
+	data, err := json.MarshalIndent(doc, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(data))
+	return err
+}
+
+// mask replaces value at path, nested objects are copied so that the loaded
+// document stays intact. Keys match case-insensitively like json.Unmarshal,
+// path continues into every object of an array.
+func mask(doc map[string]interface{}, path []string) map[string]interface{} {
+	res := make(map[string]interface{}, len(doc))
+	for k, v := range doc {
+		if !strings.EqualFold(k, path[0]) {
+			res[k] = v
+		} else if len(path) == 1 {
+			res[k] = "***"
+		} else {
+			res[k] = maskValue(v, path[1:])
+		}
+	}
+	return res
+}
+
+func maskValue(v interface{}, path []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return mask(v, path)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, item := range v {
+			res[i] = maskValue(item, path)
+		}
+		return res
+	default:
+		return v
+	}
+}
+
 func (c *ConfigLoader) Watch(onChange func()) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
 	c.onChange = onChange
-	for key := range c.keyVersions {
-		c.keyWatch.AddHandler(key, c.onKeyChange)
+	for _, src := range c.sources {
+		if err := src.Watch(c.onSourceChange); err != nil {
+			log.Printf("Unable to watch %s: %v", src, err)
+		}
 	}
 }
 
-func (c *ConfigLoader) onKeyChange(kv *consul.KVPair) {
+func (c *ConfigLoader) onSourceChange() {
 	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	onChange := c.onChange
+	c.mutex.Unlock()
 
-	currentVersion := c.keyVersions[kv.Key]
-	if kv.ModifyIndex > currentVersion {
-		c.keyVersions[kv.Key] = kv.ModifyIndex
-		c.onChange()
-	}
+	// called without lock, so that handler can reload configuration
+	onChange()
 }
 
 func (c *ConfigLoader) Shutdown() {
-	c.keyWatch.Shutdown()
+	for _, src := range c.sources {
+		src.Close()
+	}
 }
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/hashicorp/consul/api"
+	"github.com/juju/errors"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/opentradingnetworkfoundation/otn-go/consul"
+)
+
+// Source provides configuration document. Documents of all sources are
+// merged in the order sources are given, see mergeDocuments.
+type Source interface {
+	String() string
+	// Load returns configuration document as a tree of maps, slices and scalars
+	Load() (map[string]interface{}, error)
+	// Watch calls onChange every time source data changes
+	Watch(onChange func()) error
+	Close()
+}
+
+const (
+	consulPrefix = "consul://"
+	envPrefix    = "env://"
+)
+
+// NewSource creates source by its specification:
+//
+//	consul://path/to/key - Consul key
+//	env://PREFIX_        - environment variables starting with PREFIX_
+//	path/to/file         - local file
+//
+// Documents are parsed as YAML if the name ends with .yaml or .yml, JSON otherwise.
+func NewSource(spec string) (Source, error) {
+	switch {
+	case strings.HasPrefix(spec, consulPrefix):
+		return newConsulSource(strings.TrimPrefix(spec, consulPrefix))
+	case strings.HasPrefix(spec, envPrefix):
+		prefix := strings.TrimPrefix(spec, envPrefix)
+		if prefix == "" {
+			return nil, fmt.Errorf("Environment prefix is required in %s", spec)
+		}
+		return &envSource{prefix: prefix}, nil
+	default:
+		return &fileSource{path: filepath.Clean(spec)}, nil
+	}
+}
+
+func parseDocument(name string, data []byte) (map[string]interface{}, error) {
+	var doc interface{}
+
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &doc); err != nil {
+			return nil, err
+		}
+		doc = normalizeYAML(doc)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		// keep numbers as they are written, float64 loses precision of big amounts
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if doc == nil {
+		return map[string]interface{}{}, nil
+	}
+
+	result, ok := doc.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Configuration must be an object, got %T", doc)
+	}
+	return result, nil
+}
+
+// normalizeYAML converts map[interface{}]interface{} produced by yaml
+// to map[string]interface{} expected by encoding/json
+func normalizeYAML(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[interface{}]interface{}:
+		result := make(map[string]interface{}, len(value))
+		for k, item := range value {
+			result[fmt.Sprint(k)] = normalizeYAML(item)
+		}
+		return result
+	case []interface{}:
+		for i := range value {
+			value[i] = normalizeYAML(value[i])
+		}
+	}
+	return v
+}
+
+// mergeDocuments merges src into dst. Objects are merged key by key,
+// everything else is replaced by the value from src. Object with numeric
+// keys merged into array updates array elements with these indices.
+func mergeDocuments(dst, src interface{}) (interface{}, error) {
+	srcMap, ok := src.(map[string]interface{})
+	if !ok {
+		return src, nil
+	}
+
+	switch d := dst.(type) {
+	case map[string]interface{}:
+		for k, v := range srcMap {
+			merged, err := mergeDocuments(d[k], v)
+			if err != nil {
+				return nil, errors.Annotate(err, k)
+			}
+			d[k] = merged
+		}
+		return d, nil
+
+	case []interface{}:
+		for k, v := range srcMap {
+			i, err := strconv.Atoi(k)
+			if err != nil || i < 0 || i >= len(d) {
+				return nil, fmt.Errorf("index %s is out of array bounds [0, %d)", k, len(d))
+			}
+			merged, err := mergeDocuments(d[i], v)
+			if err != nil {
+				return nil, errors.Annotate(err, k)
+			}
+			d[i] = merged
+		}
+		return d, nil
+	}
+
+	return src, nil
+}
+
+// fileSource reads local file and watches it with fsnotify
+type fileSource struct {
+	path    string
+	hash    [sha256.Size]byte
+	watcher *fsnotify.Watcher
+	mutex   sync.Mutex
+}
+
+func (s *fileSource) String() string {
+	return s.path
+}
+
+func (s *fileSource) Load() (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mutex.Lock()
+	s.hash = sha256.Sum256(data)
+	s.mutex.Unlock()
+
+	return parseDocument(s.path, data)
+}
+
+// changed reports if file content differs from the last loaded one.
+// Editors generate several events on save, most of them do not change content.
+func (s *fileSource) changed() bool {
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		// file is being replaced, wait for the next event
+		return false
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return sha256.Sum256(data) != s.hash
+}
+
+func (s *fileSource) Watch(onChange func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	// watch directory to survive file replacement by editors and config management
+	if err := watcher.Add(filepath.Dir(s.path)); err != nil {
+		watcher.Close()
+		return err
+	}
+	s.watcher = watcher
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == s.path && s.changed() {
+					onChange()
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (s *fileSource) Close() {
+	if s.watcher != nil {
+		s.watcher.Close()
+	}
+}
+
+// consulSource reads Consul key and watches its modify index
+type consulSource struct {
+	key      string
+	client   *api.Client
+	keyWatch *consul.KeyWatch
+	version  uint64
+	onChange func()
+	mutex    sync.Mutex
+}
+
+func newConsulSource(key string) (*consulSource, error) {
+	client, err := consul.NewClient()
+	if err != nil {
+		return nil, err
+	}
+	return &consulSource{key: key, client: client}, nil
+}
+
+func (s *consulSource) String() string {
+	return consulPrefix + s.key
+}
+
+func (s *consulSource) Load() (map[string]interface{}, error) {
+	kv, _, err := s.client.KV().Get(s.key, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Failed to read consul key %s", s.key)
+	}
+	if kv == nil {
+		return nil, fmt.Errorf("consul key %s does not exist", s.key)
+	}
+
+	s.mutex.Lock()
+	s.version = kv.ModifyIndex
+	s.mutex.Unlock()
+
+	return parseDocument(s.key, kv.Value)
+}
+
+func (s *consulSource) Watch(onChange func()) error {
+	s.mutex.Lock()
+	s.onChange = onChange
+	s.keyWatch = consul.NewKeyWatch(s.client)
+	s.mutex.Unlock()
+
+	s.keyWatch.AddHandler(s.key, s.onKeyChange)
+	return nil
+}
+
+func (s *consulSource) onKeyChange(kv *consul.KVPair) {
+	s.mutex.Lock()
+	changed := kv.ModifyIndex > s.version
+	if changed {
+		s.version = kv.ModifyIndex
+	}
+	s.mutex.Unlock()
+
+	// called without lock, so that handler can reload configuration
+	if changed {
+		s.onChange()
+	}
+}
+
+func (s *consulSource) Close() {
+	if s.keyWatch != nil {
+		s.keyWatch.Shutdown()
+	}
+}
+
+// envSource overrides values with environment variables. Name of variable is
+// prefix followed by the field path in upper case with levels separated by
+// double underscore, e.g. MM_MARKETS__0__SPREAD=0.03 or MM_NODE_ADDR=ws://node.
+// Values are parsed as JSON, anything that is not valid JSON is a string.
+type envSource struct {
+	prefix string
+}
+
+func (s *envSource) String() string {
+	return envPrefix + s.prefix
+}
+
+func (s *envSource) Load() (map[string]interface{}, error) {
+	doc := make(map[string]interface{})
+
+	env := os.Environ()
+	sort.Strings(env)
+
+	for _, item := range env {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], s.prefix) {
+			continue
+		}
+
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(parts[0], s.prefix)), "__")
+		if err := setPath(doc, path, parseEnvValue(parts[1])); err != nil {
+			return nil, errors.Annotate(err, parts[0])
+		}
+	}
+
+	return doc, nil
+}
+
+func parseEnvValue(s string) interface{} {
+	var value interface{}
+	dec := json.NewDecoder(strings.NewReader(s))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil || dec.More() {
+		return s
+	}
+	return value
+}
+
+func setPath(doc map[string]interface{}, path []string, value interface{}) error {
+	for i, key := range path {
+		if key == "" {
+			return fmt.Errorf("empty field name")
+		}
+
+		if i == len(path)-1 {
+			doc[key] = value
+			break
+		}
+
+		next, ok := doc[key].(map[string]interface{})
+		if !ok {
+			if _, exists := doc[key]; exists {
+				return fmt.Errorf("field %s is set both as value and as object", key)
+			}
+			next = make(map[string]interface{})
+			doc[key] = next
+		}
+		doc = next
+	}
+	return nil
+}
+
+func (s *envSource) Watch(onChange func()) error {
+	// environment of running process does not change
+	return nil
+}
+
+func (s *envSource) Close() {}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+)
+
+func writeFile(t *testing.T, dir, name, data string) string {
+	path := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func TestMergeDocuments(t *testing.T) {
+	dst := map[string]interface{}{
+		"account": "a",
+		"price_provider": map[string]interface{}{
+			"cmc": map[string]interface{}{"url": "x", "bulksize": 50},
+		},
+		"markets": []interface{}{
+			map[string]interface{}{"base": "OTN", "spread": 0.05},
+			map[string]interface{}{"base": "BTC", "spread": 0.05},
+		},
+	}
+
+	src := map[string]interface{}{
+		"account": "b",
+		"price_provider": map[string]interface{}{
+			"cmc": map[string]interface{}{"url": "y"},
+		},
+		"markets": map[string]interface{}{
+			"1": map[string]interface{}{"spread": 0.03},
+		},
+	}
+
+	merged, err := mergeDocuments(dst, src)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"account": "b",
+		"price_provider": map[string]interface{}{
+			"cmc": map[string]interface{}{"url": "y", "bulksize": 50},
+		},
+		"markets": []interface{}{
+			map[string]interface{}{"base": "OTN", "spread": 0.05},
+			map[string]interface{}{"base": "BTC", "spread": 0.03},
+		},
+	}, merged)
+
+	// arrays are replaced as a whole
+	merged, err = mergeDocuments(merged, map[string]interface{}{"markets": []interface{}{}})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{}, merged.(map[string]interface{})["markets"])
+
+	_, err = mergeDocuments(dst, map[string]interface{}{
+		"markets": map[string]interface{}{"2": map[string]interface{}{}},
+	})
+	assert.Error(t, err)
+}
+
+func TestConfigLoaderSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "market-maker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jsonFile := writeFile(t, dir, "base.json", `{
+		"node_addr": "ws://node",
+		"account": "market-maker",
+		"fee_reserve": 100,
+		"markets": [{"base": "OTN", "quote": "BTC", "spread": 0.05, "amount": 60000}]
+	}`)
+	yamlFile := writeFile(t, dir, "local.yaml", `
+account: local-maker
+markets:
+  - base: OTN
+    quote: ETH
+    spread: 0.04
+    amount: 123456789012
+`)
+
+	os.Setenv("MMTEST_MARKETS__0__SPREAD", "0.02")
+	os.Setenv("MMTEST_ACCOUNT", "env-maker")
+	defer os.Unsetenv("MMTEST_MARKETS__0__SPREAD")
+	defer os.Unsetenv("MMTEST_ACCOUNT")
+
+	loader, err := NewConfigLoader([]string{jsonFile, yamlFile, "env://MMTEST_"})
+	require.NoError(t, err)
+	defer loader.Shutdown()
+
+	cfg := &MarketMakerConfig{}
+	require.NoError(t, loader.Load(cfg))
+
+	assert.Equal(t, nodepool.Addresses{"ws://node"}, cfg.NodeAddr)
+	assert.Equal(t, "env-maker", cfg.Account)
+	assert.Equal(t, "100", cfg.FeeReserve.String())
+	if assert.Len(t, cfg.Markets, 1) {
+		assert.Equal(t, "ETH", cfg.Markets[0].Quote)
+		assert.Equal(t, 0.02, cfg.Markets[0].Spread)
+		assert.Equal(t, 123456789012.0, cfg.Markets[0].Amount)
+	}
+}
+
+func TestEnvSourceValues(t *testing.T) {
+	os.Setenv("MMTEST_KEYS", `["a", "b"]`)
+	os.Setenv("MMTEST_PRICE_PROVIDER__CMC__URL", "http://localhost:8080")
+	defer os.Unsetenv("MMTEST_KEYS")
+	defer os.Unsetenv("MMTEST_PRICE_PROVIDER__CMC__URL")
+
+	doc, err := (&envSource{prefix: "MMTEST_"}).Load()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"keys": []interface{}{"a", "b"},
+		"price_provider": map[string]interface{}{
+			"cmc": map[string]interface{}{"url": "http://localhost:8080"},
+		},
+	}, doc)
+}
+
+func TestFileSourceWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "market-maker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := writeFile(t, dir, "cfg.json", `{"account": "a"}`)
+	src, err := NewSource(path)
+	require.NoError(t, err)
+	defer src.Close()
+
+	_, err = src.Load()
+	require.NoError(t, err)
+
+	changed := make(chan struct{}, 10)
+	require.NoError(t, src.Watch(func() { changed <- struct{}{} }))
+
+	// same content is not a change
+	writeFile(t, dir, "cfg.json", `{"account": "a"}`)
+	writeFile(t, dir, "other.json", `{}`)
+	select {
+	case <-changed:
+		t.Fatal("unexpected change notification")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	writeFile(t, dir, "cfg.json", `{"account": "b"}`)
+	select {
+	case <-changed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no change notification")
+	}
+}
+
+func TestDumpMasksHidden(t *testing.T) {
+	dir, err := ioutil.TempDir("", "market-maker")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	file := writeFile(t, dir, "base.json", `{
+		"account": "market-maker",
+		"keys": ["5K..."],
+		"price_provider": {"cmc": {"apiKey": "CMCKEY", "interval": "1m"}},
+		"secrets": {"vault": {"token": "s.VAULT"}},
+		"instance_lock": "postgres://mm:dbpass@db/mm",
+		"notify": {"webhooks": [
+			{"name": "ops", "url": "https://api.telegram.org/botTOKEN/sendMessage", "chat_id": "-100"},
+			{"name": "slack", "url": "https://hooks.slack.com/services/HOOK"}
+		]},
+		"markets": [{"base": "OTN", "quote": "BTC", "spread": 0.05, "amount": 60000}]
+	}`)
+
+	loader, err := NewConfigLoader([]string{file})
+	require.NoError(t, err)
+	defer loader.Shutdown()
+	require.NoError(t, loader.Load(&MarketMakerConfig{}))
+
+	var out bytes.Buffer
+	require.NoError(t, loader.Dump(&out, hiddenFields...))
+	for _, secret := range []string{"5K...", "CMCKEY", "VAULT", "dbpass", "TOKEN", "-100", "HOOK"} {
+		assert.NotContains(t, out.String(), secret)
+	}
+	assert.Contains(t, out.String(), `"interval": "1m"`)
+	assert.Contains(t, out.String(), `"name": "slack"`)
+
+	// loaded document is not changed
+	out.Reset()
+	require.NoError(t, loader.Dump(&out))
+	assert.Contains(t, out.String(), "CMCKEY")
+}
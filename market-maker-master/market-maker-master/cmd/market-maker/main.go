@@ -1,16 +1,28 @@
 package main
 
 import (
+	"context"
+	// metrics are served on /debug/vars
+	_ "expvar"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/juju/errors"
+
+	"github.com/opentradingnetworkfoundation/market-maker/instancelock"
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
 	"github.com/opentradingnetworkfoundation/market-maker/mm/blockchain"
 	"github.com/opentradingnetworkfoundation/market-maker/mm/cmc"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/dex"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/route"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 
 	"github.com/opentradingnetworkfoundation/market-maker/mm"
 	"github.com/opentradingnetworkfoundation/otn-go/api"
@@ -24,14 +36,94 @@ type App struct {
 
 	cfg          *MarketMakerConfig
 	log          *zap.SugaredLogger
+	journal      *journal.Journal
+	notifier     *notify.Notifier
 	api          api.BitsharesAPI
 	balanceMutex sync.Mutex
 	signalled    bool
+	// set while service is stopped to switch API node
+	pausing bool
+	// stops background refresh of price providers
+	stopPrices context.CancelFunc
+	// optional market quality sampling
+	quality     *mm.QualityReporter
+	stopQuality func()
+	// optional management of call positions
+	collateral     *mm.CollateralManager
+	stopCollateral func()
 }
 
-func NewApp(cfg *MarketMakerConfig) (*App, error) {
+// validateConfig checks configuration values. If rpc is not nil, account
+// and market assets are also checked on chain.
+func validateConfig(cfg *MarketMakerConfig, rpc api.BitsharesAPI) error {
+	var errs mm.ValidationErrors
+
+	if len(cfg.NodeAddr) == 0 {
+		errs.Add("node_addr", "is empty", "set websocket address of trusted node or a list of them")
+	}
+	for i, addr := range cfg.NodeAddr {
+		if addr == "" {
+			errs.Add(fmt.Sprintf("node_addr[%d]", i), "is empty", "")
+		}
+	}
+	if cfg.Account == "" {
+		errs.Add("account", "is empty", "set name of market maker account")
+	}
+	if cfg.FeeReserve.IsNegative() {
+		errs.Add("fee_reserve", "must not be negative", "")
+	}
+	if cfg.ShutdownTimeout < 0 {
+		errs.Add("shutdown_timeout", "must not be negative", "omit it to use default")
+	}
+	if cfg.TakeoverDelay < 0 {
+		errs.Add("takeover_delay", "must not be negative", "omit it to use default")
+	}
+	if dm := cfg.DeadMan; dm != nil && (dm.Heartbeat <= 0 || dm.Heartbeat >= dm.Expiration) {
+		errs.Add("dead_man.heartbeat", "must be positive and less than dead_man.expiration",
+			"orders must be refreshed before they expire")
+	}
+	if q := cfg.Quality; q != nil {
+		if q.Interval < 0 || q.Retention < 0 {
+			errs.Add("quality", "interval and retention must not be negative", "omit them to use defaults")
+		}
+		if q.Band < 0 || q.Band >= 1 {
+			errs.Add("quality.band", "must be between 0 and 1", "e.g. 0.02 counts depth within 2% of mid")
+		}
+	}
 	if len(cfg.Markets) == 0 {
-		return nil, fmt.Errorf("No markets configured")
+		errs.Add("markets", "no markets configured", "")
+	}
+
+	var assets mm.AssetLookup
+	var access mm.ValidationErrors
+	if rpc != nil {
+		dbAPI, err := rpc.DatabaseAPI()
+		if err != nil {
+			return errors.Annotate(err, "get database API")
+		}
+
+		assets = api.NewAssetCache(dbAPI)
+		if cfg.Account != "" {
+			if account, err := dbAPI.GetAccountByName(cfg.Account); err != nil {
+				errs.Add("account", fmt.Sprintf("cannot load account %q: %v", cfg.Account, err),
+					"check that account exists on chain")
+			} else {
+				access = mm.ValidateMarketAccess(cfg.Markets, account, assets)
+			}
+		}
+	}
+
+	errs = append(errs, mm.ValidateMarkets(cfg.Markets, assets)...)
+	errs = append(errs, access...)
+	if cfg.Collateral != nil {
+		errs = append(errs, mm.ValidateCollateral(cfg.Collateral, assets)...)
+	}
+	return errs.Err()
+}
+
+func NewApp(cfg *MarketMakerConfig) (*App, error) {
+	if err := validateConfig(cfg, nil); err != nil {
+		return nil, err
 	}
 
 	lg, err := cfg.Logger.Build()
@@ -39,61 +131,392 @@ func NewApp(cfg *MarketMakerConfig) (*App, error) {
 		return nil, err
 	}
 	zap.RedirectStdLog(lg)
+
+	j, err := cfg.openJournal()
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := cfg.openNotifier(lg.Sugar())
+	if err != nil {
+		return nil, errors.Annotate(err, "create notifier")
+	}
+
 	app := &App{
-		cfg: cfg,
-		log: lg.Sugar(),
+		cfg:      cfg,
+		log:      lg.Sugar(),
+		journal:  j,
+		notifier: n,
+	}
+
+	if cfg.Quality != nil {
+		if app.quality, err = mm.NewQualityReporter(cfg.Quality, app.log); err != nil {
+			return nil, err
+		}
 	}
 
 	return app, nil
 }
 
-func (a *App) Start(rpc api.BitsharesAPI) {
-	wallet := wallet.NewWallet()
-	if err := wallet.AddPrivateKeys(a.cfg.Keys); err != nil {
-		a.log.Fatal("Failed to import keys")
+func newWallet(cfg *MarketMakerConfig) (wallet.Wallet, error) {
+	w := wallet.NewWallet()
+	if err := w.AddPrivateKeys(cfg.Keys); err != nil {
+		return nil, err
 	}
+	return w, nil
+}
 
-	marketMakers := make([]*mm.MarketMaker, len(a.cfg.Markets))
-	var provFactory mm.PriceProviderFactory
+// newPriceProviderFactory creates configured provider, background
+// refresh of providers runs until ctx is done
+func newPriceProviderFactory(ctx context.Context, cfg *MarketMakerConfig, rpc api.BitsharesAPI, log *zap.SugaredLogger) (mm.PriceProviderFactory, error) {
+	var cmcFactory mm.PriceProviderFactory
+	if cfg.PriceProvider.CMC != nil {
+		f, err := cmc.NewFactory(ctx, cfg.PriceProvider.CMC, log)
+		if err != nil {
+			return nil, errors.Annotate(err, "create CMC provider")
+		}
+		cmcFactory = f
+	}
 
-	if a.cfg.PriceProvider.CMC != nil {
-		f, err := cmc.NewFactory(a.cfg.PriceProvider.CMC, a.log)
+	if cfg.PriceProvider.Route != nil {
+		return route.NewFactory(cfg.PriceProvider.Route, newQuoteSources(rpc, cmcFactory), log), nil
+	}
+
+	if cmcFactory != nil {
+		return cmcFactory, nil
+	}
+
+	if cfg.PriceProvider.DEX != nil {
+		f, err := dex.NewFactory(cfg.PriceProvider.DEX, rpc, log)
 		if err != nil {
-			a.log.Fatal("Failed to create CMC provider: %s", err)
+			return nil, errors.Annotate(err, "create DEX provider")
 		}
-		provFactory = f
-	} else {
-		provFactory = blockchain.NewFactory(rpc)
+		return f, nil
+	}
+
+	return blockchain.NewFactory(rpc), nil
+}
+
+// newQuoteSources returns providers prices are routed through,
+// cmcFactory is nil if CMC is not configured
+func newQuoteSources(rpc api.BitsharesAPI, cmcFactory mm.PriceProviderFactory) []route.QuoteSource {
+	sources := []route.QuoteSource{blockchain.NewFactory(rpc).(route.QuoteSource)}
+	if cmcFactory != nil {
+		sources = append(sources, cmcFactory.(route.QuoteSource))
+	}
+	return sources
+}
+
+func newMarketMakerConfig(cfg *MarketMakerConfig, market mm.MarketConfig, j *journal.Journal, n *notify.Notifier) *mm.Config {
+	return &mm.Config{
+		Market:         market,
+		UpdateInterval: time.Second * 3,
+		Account:        cfg.Account,
+		FeeReserve:     cfg.FeeReserve,
+		DeadMan:        cfg.DeadMan,
+		Journal:        j,
+		Notifier:       n,
+	}
+}
+
+func (a *App) Start(rpc api.BitsharesAPI) {
+	a.api = rpc
+
+	// do not start any market if configuration does not match the chain
+	if err := validateConfig(a.cfg, rpc); err != nil {
+		a.log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	wallet, err := newWallet(a.cfg)
+	if err != nil {
+		a.log.Fatal("Failed to import keys")
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
+	a.stopPrices = cancel
+	provFactory, err := newPriceProviderFactory(ctx, a.cfg, rpc, a.log)
+	if err != nil {
+		a.log.Fatal(err)
+	}
+
+	a.startCollateral(rpc, wallet)
+
+	marketMakers := make([]*mm.MarketMaker, len(a.cfg.Markets))
 	for i, marketCfg := range a.cfg.Markets {
-		marketMakerConfig := &mm.Config{
-			Market:         marketCfg,
-			UpdateInterval: time.Second * 3,
-			Account:        a.cfg.Account,
-			FeeReserve:     a.cfg.FeeReserve,
-		}
-		marketMakers[i] = mm.NewMarketMaker(
-			marketMakerConfig, rpc, wallet, provFactory, a.log, &a.balanceMutex)
+		mmCfg := newMarketMakerConfig(a.cfg, marketCfg, a.journal, a.notifier)
+		mmCfg.Collateral = a.collateral
+		marketMakers[i] = mm.NewMarketMaker(mmCfg, rpc, wallet, provFactory, a.log, &a.balanceMutex)
 	}
 
 	a.marketMakers = marketMakers
 	a.log.Info("Start markets")
 
 	startedCount := 0
-	for _, market := range a.marketMakers {
+	for i, market := range a.marketMakers {
 		if err := market.Start(); err != nil {
 			a.log.Errorf("Failed to start market %s: %s", market.Market().DisplayName(), err)
+			a.notifier.Notify(notify.Event{
+				Type:     notify.EventMarketHalted,
+				Severity: notify.SeverityError,
+				Market:   a.cfg.Markets[i].Base + "/" + a.cfg.Markets[i].Quote,
+				Message:  fmt.Sprintf("failed to start: %v", err),
+			})
 		} else {
 			startedCount++
 		}
 	}
+
+	a.startQuality(rpc)
+}
+
+// startCollateral checks positions once before markets start, so that
+// bitassets near margin call are not quoted at all
+func (a *App) startCollateral(rpc api.BitsharesAPI, w wallet.Wallet) {
+	if a.cfg.Collateral == nil {
+		return
+	}
+
+	c := mm.NewCollateralManager(a.cfg.Collateral, a.cfg.Account, a.cfg.FeeReserve, rpc, w, a.log, &a.balanceMutex)
+	c.Journal = a.journal
+	c.Notifier = a.notifier
+	c.Check()
+	a.collateral = c
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+	a.stopCollateral = func() {
+		cancel()
+		<-done
+	}
+}
+
+// startQuality samples all configured markets, those failed to start
+// are reported as down
+func (a *App) startQuality(rpc api.BitsharesAPI) {
+	if a.quality == nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		a.quality.Run(ctx, rpc, a.cfg.Account, a.cfg.Markets)
+	}()
+	a.stopQuality = func() {
+		cancel()
+		<-done
+	}
 }
 
 func (a *App) Stop() {
+	if a.pausing {
+		a.pause()
+		return
+	}
+
 	a.log.Info("Stop markets")
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.shutdownTimeout())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, market := range a.marketMakers {
+		wg.Add(1)
+		go func(market *mm.MarketMaker) {
+			defer wg.Done()
+			if err := market.Stop(ctx); err != nil {
+				a.log.Errorf("Failed to stop market %s: %s", market.Market().DisplayName(), err)
+			}
+		}(market)
+	}
+	wg.Wait()
+	a.stopPriceProviders()
+	a.stopQualitySampling()
+	a.stopCollateralManager()
+
+	a.log.Info("All markets stopped")
+}
+
+// pause stops quoting without cancelling orders, the node being left
+// may be unable to broadcast anything anyway
+func (a *App) pause() {
+	a.log.Info("Pause markets")
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.shutdownTimeout())
+	defer cancel()
+
 	for _, market := range a.marketMakers {
-		market.Stop()
+		if err := market.Pause(ctx); err != nil {
+			a.log.Errorf("Failed to pause market %s: %s", market.Market().DisplayName(), err)
+		}
+	}
+	a.marketMakers = nil
+	a.stopPriceProviders()
+	a.stopQualitySampling()
+	a.stopCollateralManager()
+}
+
+func (a *App) stopPriceProviders() {
+	if a.stopPrices != nil {
+		a.stopPrices()
+		a.stopPrices = nil
+	}
+}
+
+func (a *App) stopCollateralManager() {
+	if a.stopCollateral != nil {
+		a.stopCollateral()
+		a.stopCollateral = nil
+	}
+}
+
+func (a *App) stopQualitySampling() {
+	if a.stopQuality != nil {
+		a.stopQuality()
+		a.stopQuality = nil
+	}
+}
+
+// Run holds instance lock and serves on the active node of the pool until
+// done is signalled. When the lock is lost, markets are stopped and their
+// orders cancelled before trying to take the lock again. When pool fails
+// over, markets are paused and the service is restarted on the new node.
+func (a *App) Run(lock instancelock.Lock, pool *nodepool.Manager, done chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	events := make(chan nodepool.Event, 16)
+	pool.Subscribe(func(e nodepool.Event) {
+		select {
+		case events <- e:
+		default:
+			a.log.Warnf("Dropped node pool event %s", e.Type)
+		}
+	})
+
+	for ctx.Err() == nil {
+		a.log.Infof("Acquiring instance lock %s", lock)
+		lost, err := lock.Acquire(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				a.log.Errorf("Failed to acquire instance lock %s: %v", lock, err)
+				sleep(ctx, lockRetryInterval)
+			}
+			continue
+		}
+
+		// previous holder may still be cancelling its orders
+		if a.cfg.InstanceLock != "" {
+			delay := a.cfg.takeoverDelay()
+			a.log.Infof("Instance lock acquired, starting in %s", delay)
+			select {
+			case <-ctx.Done():
+			case <-lost:
+			case <-time.After(delay):
+			}
+		}
+
+		select {
+		case <-lost:
+			a.log.Errorf("Instance lock %s lost before start", lock)
+		default:
+			if ctx.Err() == nil {
+				a.serve(ctx, pool.Active(), events, lost)
+			}
+		}
+
+		if err := lock.Release(); err != nil {
+			a.log.Errorf("Failed to release instance lock %s: %v", lock, err)
+		}
+	}
+}
+
+// serve runs service starting on the given node, following pool events
+// until ctx is done or lock is lost
+func (a *App) serve(ctx context.Context, node string, events chan nodepool.Event, lost <-chan struct{}) {
+	for {
+		if node == "" {
+			// no healthy node, wait for one
+			select {
+			case <-ctx.Done():
+				return
+			case <-lost:
+				a.log.Errorf("Instance lock lost")
+				return
+			case e := <-events:
+				node = e.To
+			}
+			continue
+		}
+
+		starter := otn.NewStarter(a, &otn.StarterConfig{TrustedNode: node})
+		stop := make(chan struct{})
+		finished := make(chan struct{})
+		go func() {
+			starter.Run(stop)
+			close(finished)
+		}()
+
+		halt := func() {
+			select {
+			case stop <- struct{}{}:
+				<-finished
+			case <-finished:
+			}
+		}
+
+		var e nodepool.Event
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				halt()
+				return
+			case <-finished:
+				return
+			case <-lost:
+				// stop quoting and cancel orders while other instances
+				// are kept out by the takeover delay
+				a.log.Errorf("Instance lock lost, stopping markets")
+				a.notifier.Notify(notify.Event{
+					Type:     notify.EventMarketHalted,
+					Severity: notify.SeverityError,
+					Message:  "instance lock lost, all markets stopped",
+				})
+				halt()
+				return
+			case e = <-events:
+				// already running on recovered node
+				if e.Type != nodepool.EventRecovered {
+					break wait
+				}
+			}
+		}
+
+		a.log.Infof("Switching away from API node %s: %s", node, e.Type)
+		a.pausing = true
+		halt()
+		a.pausing = false
+		node = e.To
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
 	}
 }
 
@@ -107,7 +530,9 @@ var (
 )
 
 func main() {
-	flag.StringVar(&configPath, "cfg", "otn-market-maker.json", "Configuration file path")
+	flag.StringVar(&configPath, "cfg", "otn-market-maker.json",
+		"Comma separated configuration sources: file (JSON or YAML), consul://key, env://PREFIX_. Later sources override earlier ones")
+	flag.Usage = usage
 	flag.Parse()
 
 	log.Println("Loading configuration from", configPath)
@@ -125,25 +550,78 @@ func main() {
 	if err := cfgLoader.Load(cfg); err != nil {
 		log.Fatal("Failed to load configuration: ", err)
 	}
-	postProcessConfig(cfg)
+	if err := postProcessConfig(cfg); err != nil {
+		log.Fatal("Failed to process configuration: ", err)
+	}
+
+	if flag.NArg() > 0 {
+		if err := runCommand(cfgLoader, cfg, flag.Arg(0), flag.Args()[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	app, err := NewApp(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	sc := &otn.StarterConfig{
-		InstanceLock: app.cfg.InstanceLock,
-		TrustedNode:  app.cfg.NodeAddr,
+	if cfg.MetricsAddr != "" {
+		if app.quality != nil {
+			http.Handle("/quality", app.quality)
+			http.Handle("/quality.csv", app.quality)
+		}
+		go func() {
+			if err := http.ListenAndServe(cfg.MetricsAddr, nil); err != nil {
+				app.log.Errorf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	pool, err := nodepool.New(cfg.NodeAddr, cfg.NodePool, app.log)
+	if err != nil {
+		log.Fatal(err)
 	}
-	starter := otn.NewStarter(app, sc)
+	pool.Start()
+	defer pool.Stop()
+
+	lock, err := instancelock.New(cfg.InstanceLock, serviceName+"/"+cfg.Account)
+	if err != nil {
+		log.Fatal("Failed to create instance lock: ", err)
+	}
+
 	doneChan := make(chan struct{})
 
 	cfgLoader.Watch(func() {
+		// keep running with current config if the new one is broken
+		newCfg := &MarketMakerConfig{}
+		newCfg.Logger = zap.NewProductionConfig()
+		if err := cfgLoader.Load(newCfg); err != nil {
+			log.Printf("Failed to load changed config, ignoring it: %v", err)
+			return
+		}
+		if err := postProcessConfig(newCfg); err != nil {
+			log.Printf("Failed to process changed config, ignoring it: %v", err)
+			return
+		}
+		if err := validateConfig(newCfg, app.api); err != nil {
+			log.Printf("Changed config is invalid, ignoring it: %v", err)
+			return
+		}
+
 		// stop service if we got new config
 		log.Printf("Config changed, stopping service")
+		app.notifier.Notify(notify.Event{
+			Type:    notify.EventConfigReloaded,
+			Message: "configuration changed, restarting service",
+		})
 		doneChan <- struct{}{}
 	})
 
-	starter.Run(doneChan)
+	app.Run(lock, pool, doneChan)
+	// not closed in Stop, which also runs before restart on regained lock
+	if err := app.journal.Close(); err != nil {
+		log.Printf("Failed to close journal: %v", err)
+	}
+	app.notifier.Close()
 }
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/market-maker/recorder"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+)
+
+type recorderConfig struct {
+	NodeAddr nodepool.Addresses `json:"node_addr"`
+	NodePool *nodepool.Config   `json:"node_pool"`
+	Logger   zap.Config         `json:"logger"`
+	recorder.Config
+}
+
+func loadConfig(filename string, cfg *recorderConfig) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return errors.Annotate(err, "Error reading file")
+	}
+	cfg.Logger = zap.NewProductionConfig()
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return errors.Annotate(err, "Failed to parse json")
+	}
+
+	cfg.NodeAddr = cfg.NodeAddr.ExpandEnv()
+	cfg.Dir = os.ExpandEnv(cfg.Dir)
+	return nil
+}
+
+func connect(node string) api.BitsharesAPI {
+	rpcConn := api.NewConnection(node)
+	rpc := api.New(rpcConn)
+	if err := rpcConn.Connect(); err != nil {
+		log.Printf("Unable to open connection to API node %s: %v", node, err)
+	}
+	return rpc
+}
+
+func main() {
+	configPath := flag.String("cfg", "market-recorder.json", "Configuration file path")
+	flag.Parse()
+
+	cfg := &recorderConfig{}
+	log.Println("Loading configuration from", *configPath)
+	if err := loadConfig(*configPath, cfg); err != nil {
+		log.Fatalln("Failed to load configuration:", err)
+	}
+
+	lg, err := cfg.Logger.Build()
+	if err != nil {
+		log.Fatal("Unable to create logger: ", err)
+	}
+	pool, err := nodepool.New(cfg.NodeAddr, cfg.NodePool, lg.Sugar())
+	if err != nil {
+		log.Fatal("Unable to create node pool: ", err)
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	node := pool.Active()
+	rpc := connect(node)
+	rec, err := recorder.New(&cfg.Config, rpc, lg.Sugar())
+	if err != nil {
+		log.Fatal("Unable to create recorder: ", err)
+	}
+
+	// pool handlers must not block, events are handled below
+	events := make(chan nodepool.Event, 16)
+	pool.Subscribe(func(e nodepool.Event) {
+		select {
+		case events <- e:
+		default:
+			log.Printf("Dropped node pool event %s", e.Type)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		rec.Run(ctx)
+		close(done)
+	}()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	// snapshots fail while node is unhealthy, reconnect on failover
+wait:
+	for {
+		select {
+		case <-signalChan:
+			break wait
+		case e := <-events:
+			if e.Type == nodepool.EventUnavailable || e.To == node {
+				continue
+			}
+			old := rpc
+			node = e.To
+			rpc = connect(node)
+			rec.SetRPC(rpc)
+			old.Close()
+		}
+	}
+
+	cancel()
+	<-done
+	if err := rec.Close(); err != nil {
+		log.Printf("Failed to close data files: %v", err)
+	}
+}
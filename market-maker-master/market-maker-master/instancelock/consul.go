@@ -0,0 +1,72 @@
+package instancelock
+
+import (
+	"context"
+
+	"github.com/hashicorp/consul/api"
+	"github.com/juju/errors"
+	"github.com/opentradingnetworkfoundation/otn-go/consul"
+)
+
+// consulLock holds Consul key with session. Lock is lost when session
+// expires or is invalidated. Consul lock-delay keeps other instances
+// from taking the key right after that.
+type consulLock struct {
+	key    string
+	name   string
+	client *api.Client
+	lock   *api.Lock
+}
+
+func newConsulLock(key, name string) (*consulLock, error) {
+	client, err := consul.NewClient()
+	if err != nil {
+		return nil, errors.Annotate(err, "create consul client")
+	}
+	return &consulLock{key: key, name: name, client: client}, nil
+}
+
+func (l *consulLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	lock, err := l.client.LockOpts(&api.LockOptions{
+		Key:         l.key,
+		SessionName: l.name,
+	})
+	if err != nil {
+		return nil, errors.Annotatef(err, "create lock %s", l.key)
+	}
+
+	stopCh := make(chan struct{})
+	acquired := make(chan struct{})
+	defer close(acquired)
+	go func() {
+		select {
+		case <-ctx.Done():
+			close(stopCh)
+		case <-acquired:
+		}
+	}()
+
+	lost, err := lock.Lock(stopCh)
+	if err != nil {
+		return nil, errors.Annotatef(err, "lock %s", l.key)
+	}
+	if lost == nil {
+		return nil, ctx.Err()
+	}
+
+	l.lock = lock
+	return lost, nil
+}
+
+func (l *consulLock) Release() error {
+	if l.lock == nil {
+		return nil
+	}
+	lock := l.lock
+	l.lock = nil
+	return lock.Unlock()
+}
+
+func (l *consulLock) String() string {
+	return consulPrefix + l.key
+}
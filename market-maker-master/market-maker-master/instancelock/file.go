@@ -0,0 +1,38 @@
+package instancelock
+
+import (
+	"context"
+
+	"github.com/gofrs/flock"
+	"github.com/juju/errors"
+)
+
+// fileLock is flock on local file, it only protects against instances
+// running on the same host. Lock is held until process exits, so it is
+// never lost.
+type fileLock struct {
+	lock *flock.Flock
+}
+
+func newFileLock(path string) *fileLock {
+	return &fileLock{lock: flock.New(path)}
+}
+
+func (l *fileLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	ok, err := l.lock.TryLockContext(ctx, retryInterval)
+	if err != nil {
+		return nil, errors.Annotatef(err, "lock %s", l.lock.Path())
+	}
+	if !ok {
+		return nil, errors.Errorf("Failed to lock %s", l.lock.Path())
+	}
+	return make(chan struct{}), nil
+}
+
+func (l *fileLock) Release() error {
+	return l.lock.Unlock()
+}
+
+func (l *fileLock) String() string {
+	return filePrefix + l.lock.Path()
+}
@@ -0,0 +1,86 @@
+package instancelock
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSpec(t *testing.T) {
+	l, err := New("", "mm")
+	require.NoError(t, err)
+	assert.IsType(t, &nopLock{}, l)
+
+	l, err = New("file:///tmp/mm.lock", "mm")
+	require.NoError(t, err)
+	assert.Equal(t, "file:///tmp/mm.lock", l.String())
+
+	_, err = New("redis://localhost/lock", "mm")
+	assert.Error(t, err)
+}
+
+func TestPostgresSpec(t *testing.T) {
+	l, err := New("postgres://user:secret@db:5432/mm?sslmode=disable&lock_key=42", "mm")
+	require.NoError(t, err)
+
+	pl := l.(*postgresLock)
+	assert.Equal(t, int64(42), pl.key)
+	assert.Equal(t, "postgres://user:secret@db:5432/mm?sslmode=disable", pl.dsn)
+	assert.Equal(t, "postgres://db:5432/mm?sslmode=disable#42", pl.String())
+
+	// key defaults to hash of the name, so instances of the same
+	// service compete for the same lock
+	a, err := newPostgresLock("postgres://db/mm", "market-maker/alice")
+	require.NoError(t, err)
+	b, err := newPostgresLock("postgres://db/mm", "market-maker/alice")
+	require.NoError(t, err)
+	c, err := newPostgresLock("postgres://db/mm", "market-maker/bob")
+	require.NoError(t, err)
+	assert.Equal(t, a.key, b.key)
+	assert.NotEqual(t, a.key, c.key)
+
+	_, err = New("postgres://db/mm?lock_key=x", "mm")
+	assert.Error(t, err)
+}
+
+func TestFileLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "instancelock")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	spec := "file://" + filepath.Join(dir, "mm.lock")
+	first, err := New(spec, "mm")
+	require.NoError(t, err)
+	second, err := New(spec, "mm")
+	require.NoError(t, err)
+
+	_, err = first.Acquire(context.Background())
+	require.NoError(t, err)
+
+	// second instance waits while lock is held
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = second.Acquire(ctx)
+	cancel()
+	assert.Error(t, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		if _, err := second.Acquire(context.Background()); err == nil {
+			close(acquired)
+		}
+	}()
+
+	require.NoError(t, first.Release())
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock was not taken over after release")
+	}
+	assert.NoError(t, second.Release())
+}
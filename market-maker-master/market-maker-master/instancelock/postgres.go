@@ -0,0 +1,174 @@
+package instancelock
+
+import (
+	"context"
+	"database/sql"
+	"hash/fnv"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/juju/errors"
+	// register postgres driver
+	_ "github.com/lib/pq"
+)
+
+const (
+	lockKeyParam = "lock_key"
+	// how often held advisory lock is verified
+	postgresCheckInterval = 2 * time.Second
+)
+
+// postgresLock is session level advisory lock. It is held by single
+// connection and released by server as soon as connection breaks, so the
+// connection is checked regularly and lock is considered lost on failure.
+type postgresLock struct {
+	dsn string
+	key int64
+
+	db   *sql.DB
+	conn *sql.Conn
+	stop chan struct{}
+	done chan struct{}
+}
+
+// lockKey derives advisory lock key from service name
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
+
+func newPostgresLock(spec, name string) (*postgresLock, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse postgres lock")
+	}
+
+	key := lockKey(name)
+	query := u.Query()
+	if s := query.Get(lockKeyParam); s != "" {
+		if key, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return nil, errors.Annotatef(err, "parse %s", lockKeyParam)
+		}
+		// driver passes unknown parameters to server
+		query.Del(lockKeyParam)
+		u.RawQuery = query.Encode()
+	}
+
+	return &postgresLock{dsn: u.String(), key: key}, nil
+}
+
+func (l *postgresLock) Acquire(ctx context.Context) (<-chan struct{}, error) {
+	db, err := sql.Open("postgres", l.dsn)
+	if err != nil {
+		return nil, errors.Annotate(err, "open database")
+	}
+
+	conn, err := l.lock(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	l.db = db
+	l.conn = conn
+	l.stop = make(chan struct{})
+	l.done = make(chan struct{})
+
+	lost := make(chan struct{})
+	go l.monitor(lost)
+	return lost, nil
+}
+
+// lock polls until advisory lock is taken on dedicated connection
+func (l *postgresLock) lock(ctx context.Context, db *sql.DB) (*sql.Conn, error) {
+	for {
+		conn, err := db.Conn(ctx)
+		if err != nil {
+			return nil, errors.Annotate(err, "connect to database")
+		}
+
+		var locked bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", l.key).Scan(&locked)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Annotate(err, "take advisory lock")
+		}
+		if locked {
+			return conn, nil
+		}
+		conn.Close()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// held checks that connection is alive and still holds the lock
+func (l *postgresLock) held(ctx context.Context) (bool, error) {
+	// bigint key is stored as two halves
+	var held bool
+	err := l.conn.QueryRowContext(ctx, `SELECT EXISTS (
+		SELECT 1 FROM pg_locks
+		WHERE locktype = 'advisory' AND pid = pg_backend_pid() AND granted
+			AND classid = $1 AND objid = $2 AND objsubid = 1)`,
+		uint32(uint64(l.key)>>32), uint32(l.key)).Scan(&held)
+	return held, err
+}
+
+func (l *postgresLock) monitor(lost chan struct{}) {
+	defer close(l.done)
+
+	ticker := time.NewTicker(postgresCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), postgresCheckInterval)
+			held, err := l.held(ctx)
+			cancel()
+			if err != nil || !held {
+				close(lost)
+				return
+			}
+		}
+	}
+}
+
+func (l *postgresLock) Release() error {
+	if l.conn == nil {
+		return nil
+	}
+
+	close(l.stop)
+	<-l.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), postgresCheckInterval)
+	defer cancel()
+
+	// lock is released by server anyway when connection is closed
+	_, err := l.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", l.key)
+	l.conn.Close()
+	l.db.Close()
+	l.conn = nil
+	l.db = nil
+
+	return err
+}
+
+func (l *postgresLock) String() string {
+	// do not log credentials
+	u, err := url.Parse(l.dsn)
+	if err != nil {
+		return postgresPrefix
+	}
+	u.User = nil
+	return u.String() + "#" + strconv.FormatInt(l.key, 10)
+}
@@ -0,0 +1,245 @@
+// Package journal keeps append-only audit log of broadcast operations.
+// Every line of the journal is a JSON object describing single operation.
+package journal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	defaultMaxSize = 100 // megabytes
+	fileMode       = 0640
+
+	ResultOK    = "ok"
+	ResultError = "error"
+	// Broadcast was abandoned before the node replied, the transaction
+	// may still be included
+	ResultPending = "pending"
+
+	rotatedTimeFormat = "20060102T150405.000"
+)
+
+type Config struct {
+	// Journal file path, rotated files get timestamp suffix
+	Path string `json:"path"`
+	// Size in megabytes at which journal is rotated
+	MaxSize int `json:"max_size"`
+}
+
+// Entry is a single line of the journal
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Service string    `json:"service"`
+	Account string    `json:"account,omitempty"`
+	Market  string    `json:"market,omitempty"`
+	Asset   string    `json:"asset,omitempty"`
+	// Operation type, e.g. limit_order_create
+	Type      string          `json:"type"`
+	Operation json.RawMessage `json:"operation"`
+	TxID      string          `json:"tx_id,omitempty"`
+	Result    string          `json:"result"`
+	Error     string          `json:"error,omitempty"`
+	// Why operation was sent, e.g. "price moved 1.3%"
+	Reason string `json:"reason"`
+	// Reference price of trades, quote per base, used for PnL
+	RefPrice float64 `json:"ref_price,omitempty"`
+}
+
+// Record describes broadcast transaction
+type Record struct {
+	Account string
+	Market  string
+	Asset   string
+	Reason  string
+	// Reference price of trades, quote per base
+	RefPrice float64
+	// Result is not known yet, it is recorded again when known
+	Pending bool
+}
+
+// Journal writes entries to file. Nil journal discards everything,
+// so services do not check if journal is configured.
+type Journal struct {
+	path    string
+	maxSize int64
+	service string
+
+	file  *os.File
+	size  int64
+	mutex sync.Mutex
+}
+
+func New(cfg *Config, service string) (*Journal, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("Journal path is not set")
+	}
+
+	maxSize := cfg.MaxSize
+	if maxSize <= 0 {
+		maxSize = defaultMaxSize
+	}
+
+	j := &Journal{
+		path:    cfg.Path,
+		maxSize: int64(maxSize) << 20,
+		service: service,
+	}
+
+	if err := j.open(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Path returns journal file path, empty for nil journal
+func (j *Journal) Path() string {
+	if j == nil {
+		return ""
+	}
+	return j.path
+}
+
+func (j *Journal) open() error {
+	f, err := os.OpenFile(j.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, fileMode)
+	if err != nil {
+		return errors.Annotate(err, "open journal")
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	j.file = f
+	j.size = info.Size()
+	return nil
+}
+
+// rotatedPath returns name for rotated file: journal.jsonl -> journal-<time>.jsonl
+func rotatedPath(path string, t time.Time) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(path, ext), t.UTC().Format(rotatedTimeFormat), ext)
+}
+
+func (j *Journal) rotate() error {
+	if err := j.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(j.path, rotatedPath(j.path, time.Now())); err != nil {
+		return err
+	}
+	return j.open()
+}
+
+// Record writes one entry per operation. txID and err are results of broadcast.
+func (j *Journal) Record(r Record, ops []objects.Operation, txID string, err error) error {
+	if j == nil {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	var lines []byte
+
+	for _, op := range ops {
+		data, mErr := json.Marshal(op)
+		if mErr != nil {
+			return errors.Annotate(mErr, "serialize operation")
+		}
+
+		e := &Entry{
+			Time:      now,
+			Service:   j.service,
+			Account:   r.Account,
+			Market:    r.Market,
+			Asset:     r.Asset,
+			Type:      OperationType(op),
+			Operation: data,
+			TxID:      txID,
+			Result:    ResultOK,
+			Reason:    r.Reason,
+			RefPrice:  r.RefPrice,
+		}
+		if err != nil {
+			e.Result = ResultError
+			e.Error = err.Error()
+		}
+		if r.Pending {
+			e.Result = ResultPending
+		}
+
+		line, mErr := json.Marshal(e)
+		if mErr != nil {
+			return mErr
+		}
+		lines = append(lines, line...)
+		lines = append(lines, '\n')
+	}
+
+	return j.write(lines)
+}
+
+func (j *Journal) write(data []byte) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return errors.New("Journal is closed")
+	}
+
+	if j.size > 0 && j.size+int64(len(data)) > j.maxSize {
+		if err := j.rotate(); err != nil {
+			return errors.Annotate(err, "rotate journal")
+		}
+	}
+
+	n, err := j.file.Write(data)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+
+	// entries must survive crash of the service
+	return j.file.Sync()
+}
+
+func (j *Journal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
+
+var camelCase = regexp.MustCompile("([a-z0-9])([A-Z])")
+
+// OperationType returns name of operation as in chain API,
+// e.g. limit_order_create for *objects.LimitOrderCreateOperation
+func OperationType(op objects.Operation) string {
+	t := reflect.TypeOf(op)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	name := strings.TrimSuffix(t.Name(), "Operation")
+	return strings.ToLower(camelCase.ReplaceAllString(name, "${1}_${2}"))
+}
@@ -0,0 +1,73 @@
+package journal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func TestOperationType(t *testing.T) {
+	assert.Equal(t, "limit_order_create", OperationType(&objects.LimitOrderCreateOperation{}))
+	assert.Equal(t, "limit_order_cancel", OperationType(&objects.LimitOrderCancelOperation{}))
+	assert.Equal(t, "asset_publish_feed", OperationType(objects.NewAssetPublishFeedOperation()))
+}
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "journal.jsonl")
+	j, err := New(&Config{Path: path}, "market-maker")
+	require.NoError(t, err)
+	// rotate on every write
+	j.maxSize = 1
+
+	seller := *objects.NewGrapheneID("1.2.17")
+	ops := []objects.Operation{
+		objects.NewLimitOrderCancelOperation(*objects.NewGrapheneID("1.7.1"), seller),
+		&objects.LimitOrderCreateOperation{Seller: seller},
+	}
+
+	rec := Record{Account: "maker", Market: "OTN/BTC", Reason: "price moved 1.30%"}
+	require.NoError(t, j.Record(rec, ops, "abc", nil))
+	require.NoError(t, j.Record(Record{Account: "other", Reason: "expiration refresh"}, ops[:1], "", fmt.Errorf("timeout")))
+	require.NoError(t, j.Record(Record{Account: "other", Reason: "shutdown", Pending: true}, ops[:1], "", fmt.Errorf("context canceled")))
+	require.NoError(t, j.Close())
+
+	files, err := Files(path)
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	var entries []*Entry
+	collect := func(e *Entry, line []byte) bool {
+		entries = append(entries, e)
+		return true
+	}
+
+	require.NoError(t, Query(path, &Filter{}, collect))
+	require.Len(t, entries, 4)
+	assert.Equal(t, "market-maker", entries[0].Service)
+	assert.Equal(t, "limit_order_cancel", entries[0].Type)
+	assert.Equal(t, "abc", entries[1].TxID)
+	assert.Equal(t, ResultError, entries[2].Result)
+	assert.Equal(t, "timeout", entries[2].Error)
+	assert.Equal(t, ResultPending, entries[3].Result)
+
+	entries = nil
+	require.NoError(t, Query(path, &Filter{Type: "limit_order_cancel", Account: "maker"}, collect))
+	require.Len(t, entries, 1)
+	assert.Equal(t, "price moved 1.30%", entries[0].Reason)
+
+	entries = nil
+	require.NoError(t, Query(path, &Filter{Since: time.Now().Add(time.Hour)}, collect))
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,102 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// Filter selects journal entries, zero fields match everything
+type Filter struct {
+	Since   time.Time
+	Until   time.Time
+	Type    string
+	Account string
+	Service string
+	Market  string
+}
+
+func (f *Filter) Match(e *Entry) bool {
+	switch {
+	case !f.Since.IsZero() && e.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !e.Time.Before(f.Until):
+		return false
+	case f.Type != "" && e.Type != f.Type:
+		return false
+	case f.Account != "" && e.Account != f.Account:
+		return false
+	case f.Service != "" && e.Service != f.Service:
+		return false
+	case f.Market != "" && e.Market != f.Market:
+		return false
+	}
+	return true
+}
+
+// Files returns journal file and all its rotated files, oldest first
+func Files(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	rotated, err := filepath.Glob(strings.TrimSuffix(path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+
+	// timestamp suffix sorts in chronological order
+	sort.Strings(rotated)
+
+	if _, err := os.Stat(path); err == nil {
+		rotated = append(rotated, path)
+	}
+	return rotated, nil
+}
+
+// Query calls fn for every entry matching filter, in order of writing.
+// Returning false from fn stops the query.
+func Query(path string, filter *Filter, fn func(e *Entry, line []byte) bool) error {
+	files, err := Files(path)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range files {
+		stop, err := queryFile(name, filter, fn)
+		if err != nil {
+			return errors.Annotatef(err, "read %s", name)
+		}
+		if stop {
+			break
+		}
+	}
+	return nil
+}
+
+func queryFile(name string, filter *Filter, fn func(e *Entry, line []byte) bool) (bool, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// operations with many fields may exceed default line limit
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// skip damaged line, e.g. truncated by crash
+			continue
+		}
+		if filter.Match(&e) && !fn(&e, scanner.Bytes()) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
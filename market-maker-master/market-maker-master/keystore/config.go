@@ -0,0 +1,94 @@
+package keystore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/juju/errors"
+)
+
+// DefaultPassphraseEnv is environment variable with passphrase used if
+// neither PassphraseEnv nor PassphraseFD are configured
+const DefaultPassphraseEnv = "KEYSTORE_PASSPHRASE"
+
+// Config describes keystore in service configuration
+type Config struct {
+	// Path to keystore file
+	Path string `json:"path"`
+	// Environment variable with passphrase
+	PassphraseEnv string `json:"passphrase_env"`
+	// File descriptor to read passphrase from, takes precedence over environment
+	PassphraseFD int `json:"passphrase_fd"`
+}
+
+var (
+	// passphrase can be read from file descriptor only once, services
+	// read keys again on configuration reload
+	passphraseCache = make(map[string][]byte)
+	passphraseMutex sync.Mutex
+)
+
+// Passphrase reads passphrase from configured source
+func (c *Config) Passphrase() ([]byte, error) {
+	passphraseMutex.Lock()
+	defer passphraseMutex.Unlock()
+
+	source := c.passphraseSource()
+	if p, ok := passphraseCache[source]; ok {
+		return p, nil
+	}
+
+	var p []byte
+	if c.PassphraseFD > 0 {
+		f := os.NewFile(uintptr(c.PassphraseFD), "passphrase")
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Annotatef(err, "read passphrase from fd %d", c.PassphraseFD)
+		}
+		p = []byte(strings.TrimRight(string(data), "\r\n"))
+	} else {
+		name := c.PassphraseEnv
+		if name == "" {
+			name = DefaultPassphraseEnv
+		}
+		p = []byte(os.Getenv(name))
+		// do not leak passphrase to child processes
+		os.Unsetenv(name)
+	}
+
+	if len(p) == 0 {
+		return nil, fmt.Errorf("Keystore passphrase is not set (%s)", source)
+	}
+
+	passphraseCache[source] = p
+	return p, nil
+}
+
+func (c *Config) passphraseSource() string {
+	if c.PassphraseFD > 0 {
+		return fmt.Sprintf("fd %d", c.PassphraseFD)
+	}
+	if c.PassphraseEnv != "" {
+		return "env " + c.PassphraseEnv
+	}
+	return "env " + DefaultPassphraseEnv
+}
+
+// ReadKeys decrypts keystore and returns private keys in WIF format
+func ReadKeys(cfg *Config) ([]string, error) {
+	passphrase, err := cfg.Passphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	ks, err := Open(cfg.Path, passphrase)
+	if err != nil {
+		return nil, errors.Annotatef(err, "open keystore %s", cfg.Path)
+	}
+
+	return ks.Keys(), nil
+}
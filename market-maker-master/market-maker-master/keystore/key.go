@@ -0,0 +1,43 @@
+package keystore
+
+import (
+	"github.com/btcsuite/btcd/btcec"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/juju/errors"
+	"golang.org/x/crypto/ripemd160"
+)
+
+// PublicKeyPrefix is address prefix of the OTN chain
+const PublicKeyPrefix = "OTN"
+
+// PublicKey returns public key in chain format for private key in WIF format
+func PublicKey(wif string) (string, error) {
+	w, err := btcutil.DecodeWIF(wif)
+	if err != nil {
+		return "", errors.Annotate(err, "decode private key")
+	}
+
+	pub := w.PrivKey.PubKey().SerializeCompressed()
+
+	h := ripemd160.New()
+	h.Write(pub)
+	checksum := h.Sum(nil)[:4]
+
+	return PublicKeyPrefix + base58.Encode(append(pub, checksum...)), nil
+}
+
+// GenerateKey returns new random private key in WIF format
+func GenerateKey() (string, error) {
+	priv, err := btcec.NewPrivateKey(btcec.S256())
+	if err != nil {
+		return "", err
+	}
+
+	w, err := btcutil.NewWIF(priv, &chaincfg.MainNetParams, false)
+	if err != nil {
+		return "", err
+	}
+	return w.String(), nil
+}
@@ -0,0 +1,293 @@
+// Package keystore keeps service private keys in a file encrypted with
+// AES-256-GCM, encryption key is derived from passphrase with scrypt.
+package keystore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/juju/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	fileVersion = 1
+	kdfScrypt   = "scrypt"
+	cipherAES   = "aes-256-gcm"
+
+	scryptN    = 1 << 15
+	scryptR    = 8
+	scryptP    = 1
+	keyLength  = 32
+	saltLength = 32
+	fileMode   = 0600
+)
+
+// ErrWrongPassphrase is returned when keystore cannot be decrypted
+var ErrWrongPassphrase = errors.New("wrong passphrase or corrupted keystore")
+
+type kdfParams struct {
+	Name string `json:"name"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+	Salt []byte `json:"salt"`
+}
+
+type cipherParams struct {
+	Name  string `json:"name"`
+	Nonce []byte `json:"nonce"`
+}
+
+// file is stored on disk. Public keys are not secret and kept in clear text,
+// so they can be listed without passphrase. They are authenticated as
+// additional data, any change makes keystore undecryptable.
+type file struct {
+	Version    int          `json:"version"`
+	PublicKeys []string     `json:"public_keys"`
+	KDF        kdfParams    `json:"kdf"`
+	Cipher     cipherParams `json:"cipher"`
+	Data       []byte       `json:"data"`
+}
+
+// Key is a private key stored in keystore
+type Key struct {
+	WIF       string    `json:"wif"`
+	PublicKey string    `json:"public_key"`
+	Added     time.Time `json:"added"`
+}
+
+type payload struct {
+	Keys []Key `json:"keys"`
+}
+
+type Keystore struct {
+	path       string
+	passphrase []byte
+	keys       []Key
+}
+
+// Create returns new empty keystore, it is written to disk on Save
+func Create(path string, passphrase []byte) (*Keystore, error) {
+	if _, err := os.Stat(path); err == nil {
+		return nil, fmt.Errorf("Keystore %s already exists", path)
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("Empty passphrase")
+	}
+	return &Keystore{path: path, passphrase: passphrase}, nil
+}
+
+func readFile(path string) (*file, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &file{}
+	if err := json.Unmarshal(data, f); err != nil {
+		return nil, errors.Annotatef(err, "parse keystore %s", path)
+	}
+
+	if f.Version != fileVersion {
+		return nil, fmt.Errorf("Unsupported keystore version %d", f.Version)
+	}
+	if f.KDF.Name != kdfScrypt || f.Cipher.Name != cipherAES {
+		return nil, fmt.Errorf("Unsupported keystore encryption %s/%s", f.KDF.Name, f.Cipher.Name)
+	}
+
+	return f, nil
+}
+
+// Open reads and decrypts keystore
+func Open(path string, passphrase []byte) (*Keystore, error) {
+	f, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(passphrase, &f.KDF)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, f.Cipher.Nonce, f.Data, additionalData(f.PublicKeys))
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+
+	var p payload
+	if err := json.Unmarshal(plain, &p); err != nil {
+		return nil, errors.Annotate(err, "parse keystore data")
+	}
+
+	return &Keystore{path: path, passphrase: passphrase, keys: p.Keys}, nil
+}
+
+// ReadPublicKeys lists public keys without decrypting keystore
+func ReadPublicKeys(path string) ([]string, error) {
+	f, err := readFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return f.PublicKeys, nil
+}
+
+func newAEAD(passphrase []byte, kdf *kdfParams) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, kdf.Salt, kdf.N, kdf.R, kdf.P, keyLength)
+	if err != nil {
+		return nil, errors.Annotate(err, "derive key")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func additionalData(publicKeys []string) []byte {
+	data, _ := json.Marshal(publicKeys)
+	return data
+}
+
+// Save encrypts keystore with fresh salt and nonce and replaces the file atomically
+func (k *Keystore) Save() error {
+	p := payload{Keys: k.keys}
+	if p.Keys == nil {
+		p.Keys = []Key{}
+	}
+	plain, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	f := &file{
+		Version:    fileVersion,
+		PublicKeys: k.PublicKeys(),
+		KDF:        kdfParams{Name: kdfScrypt, N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, saltLength)},
+		Cipher:     cipherParams{Name: cipherAES},
+	}
+
+	if _, err := rand.Read(f.KDF.Salt); err != nil {
+		return err
+	}
+
+	aead, err := newAEAD(k.passphrase, &f.KDF)
+	if err != nil {
+		return err
+	}
+
+	f.Cipher.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Cipher.Nonce); err != nil {
+		return err
+	}
+	f.Data = aead.Seal(nil, f.Cipher.Nonce, plain, additionalData(f.PublicKeys))
+
+	data, err := json.MarshalIndent(f, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(k.path, data)
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(fileMode); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// SetPassphrase changes passphrase used by the next Save
+func (k *Keystore) SetPassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("Empty passphrase")
+	}
+	k.passphrase = passphrase
+	return nil
+}
+
+// Keys returns private keys in WIF format
+func (k *Keystore) Keys() []string {
+	result := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		result[i] = key.WIF
+	}
+	return result
+}
+
+// PublicKeys returns sorted public keys of stored private keys
+func (k *Keystore) PublicKeys() []string {
+	result := make([]string, len(k.keys))
+	for i, key := range k.keys {
+		result[i] = key.PublicKey
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Add stores private key, adding the same key twice is not an error
+func (k *Keystore) Add(wif string) (string, error) {
+	pub, err := PublicKey(wif)
+	if err != nil {
+		return "", err
+	}
+
+	for _, key := range k.keys {
+		if key.PublicKey == pub {
+			return pub, nil
+		}
+	}
+
+	k.keys = append(k.keys, Key{WIF: wif, PublicKey: pub, Added: time.Now().UTC()})
+	return pub, nil
+}
+
+// Generate creates and stores new private key
+func (k *Keystore) Generate() (string, error) {
+	wif, err := GenerateKey()
+	if err != nil {
+		return "", err
+	}
+	return k.Add(wif)
+}
+
+// Remove deletes private key by its public key
+func (k *Keystore) Remove(publicKey string) error {
+	for i, key := range k.keys {
+		if key.PublicKey == publicKey {
+			k.keys = append(k.keys[:i], k.keys[i+1:]...)
+			return nil
+		}
+	}
+	return errors.NotFoundf("Key %s", publicKey)
+}
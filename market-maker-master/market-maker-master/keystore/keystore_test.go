@@ -0,0 +1,101 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testWIF       = "5KQwrPbwdL6PhXujxW37FSSQZ1JiwsST4cqQzDeyXtP79zkvFD3"
+	testPublicKey = "OTN6MRyAjQq8ud7hVNYcfnVPJqcVpscN5So8BhtHuGYqET5GDW5CV"
+)
+
+func TestPublicKey(t *testing.T) {
+	pub, err := PublicKey(testWIF)
+	require.NoError(t, err)
+	assert.Equal(t, testPublicKey, pub)
+
+	_, err = PublicKey("invalid")
+	assert.Error(t, err)
+}
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+
+	ks, err := Create(path, []byte("secret"))
+	require.NoError(t, err)
+
+	pub, err := ks.Add(testWIF)
+	require.NoError(t, err)
+	assert.Equal(t, testPublicKey, pub)
+
+	generated, err := ks.Generate()
+	require.NoError(t, err)
+	require.NoError(t, ks.Save())
+
+	_, err = Create(path, []byte("secret"))
+	assert.Error(t, err)
+
+	// public keys are readable without passphrase
+	pubs, err := ReadPublicKeys(path)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{testPublicKey, generated}, pubs)
+
+	_, err = Open(path, []byte("wrong"))
+	assert.Equal(t, ErrWrongPassphrase, err)
+
+	ks, err = Open(path, []byte("secret"))
+	require.NoError(t, err)
+	assert.Contains(t, ks.Keys(), testWIF)
+
+	// rotate passphrase and drop old key
+	require.NoError(t, ks.Remove(testPublicKey))
+	require.NoError(t, ks.SetPassphrase([]byte("new secret")))
+	require.NoError(t, ks.Save())
+
+	_, err = Open(path, []byte("secret"))
+	assert.Equal(t, ErrWrongPassphrase, err)
+
+	ks, err = Open(path, []byte("new secret"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{generated}, ks.PublicKeys())
+
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestReadKeysFromEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keys.json")
+	ks, err := Create(path, []byte("secret"))
+	require.NoError(t, err)
+	_, err = ks.Add(testWIF)
+	require.NoError(t, err)
+	require.NoError(t, ks.Save())
+
+	os.Setenv("TEST_KEYSTORE_PASSPHRASE", "secret")
+	cfg := &Config{Path: path, PassphraseEnv: "TEST_KEYSTORE_PASSPHRASE"}
+
+	keys, err := ReadKeys(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{testWIF}, keys)
+
+	// passphrase is removed from environment but still available for reload
+	assert.Empty(t, os.Getenv("TEST_KEYSTORE_PASSPHRASE"))
+	keys, err = ReadKeys(cfg)
+	require.NoError(t, err)
+	assert.Equal(t, []string{testWIF}, keys)
+}
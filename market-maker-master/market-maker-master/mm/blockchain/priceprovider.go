@@ -4,6 +4,7 @@ import (
 	"math/big"
 
 	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/route"
 	"github.com/opentradingnetworkfoundation/otn-go/api"
 	"github.com/opentradingnetworkfoundation/otn-go/objects"
 )
@@ -36,6 +37,47 @@ func (f *assetProviderFactory) GetProvider(market *mm.Market) (mm.PriceProvider,
 	}, nil
 }
 
+// Quotes implements route.QuoteSource, bitassets are quoted in core asset
+// by their current feed
+func (f *assetProviderFactory) Quotes(assets []objects.Asset) []route.Quote {
+	dbAPI, err := f.rpc.DatabaseAPI()
+	if err != nil {
+		return nil
+	}
+	core := api.NewAssetCache(dbAPI).GetByID(coreAsset)
+	if core == nil {
+		return nil
+	}
+
+	var result []route.Quote
+	seen := make(map[objects.GrapheneID]bool)
+	for _, asset := range assets {
+		if !asset.BitassetDataID.Valid() || seen[asset.ID] {
+			continue
+		}
+		seen[asset.ID] = true
+
+		data, err := dbAPI.GetObjects(asset.BitassetDataID)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		feed, ok := data[0].(objects.BitAssetData)
+		if !ok || !feed.CurrentFeed.SettlementPrice.Valid() {
+			continue
+		}
+
+		market := mm.Market{Base: asset, Quote: *core}
+		result = append(result, route.Quote{
+			Base:   asset.Symbol,
+			Quote:  core.Symbol,
+			Rate:   market.GetRate(feed.CurrentFeed.SettlementPrice).Value(),
+			Time:   feed.CurrentFeedPublicationTime.Time,
+			Source: "blockchain",
+		})
+	}
+	return result
+}
+
 type assetPriceProvider struct {
 	rpc    api.DatabaseAPI
 	market *mm.Market
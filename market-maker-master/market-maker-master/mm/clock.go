@@ -0,0 +1,20 @@
+package mm
+
+import "time"
+
+// Clock is the time source of market maker, tests replace it
+// with a manual one
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
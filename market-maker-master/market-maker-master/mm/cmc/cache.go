@@ -0,0 +1,69 @@
+package cmc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DefaultCacheMaxAge is the age of cache file it is still used at
+const DefaultCacheMaxAge = 7 * 24 * time.Hour
+
+// cache keeps listings and last tickers on disk, so that the service can
+// start while Coinmarketcap is unavailable
+type cache struct {
+	Saved    time.Time       `json:"saved"`
+	Listings []*proListing   `json:"listings"`
+	Tickers  []*cachedTicker `json:"tickers"`
+}
+
+type cachedTicker struct {
+	Ticker  *proTicker `json:"ticker"`
+	Fetched time.Time  `json:"fetched"`
+}
+
+// loadCache reads cache file which is not older than maxAge
+func loadCache(path string, maxAge time.Duration, now time.Time) (*cache, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &cache{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errors.Annotatef(err, "parse %s", path)
+	}
+	if now.Sub(c.Saved) > maxAge {
+		return nil, fmt.Errorf("Cache %s saved at %s is older than %s", path, c.Saved.Format(time.RFC3339), maxAge)
+	}
+	return c, nil
+}
+
+// saveCache writes cache to a temporary file and renames it, so that
+// crash never leaves a partial file
+func saveCache(path string, c *cache) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
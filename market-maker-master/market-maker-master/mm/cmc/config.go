@@ -1,10 +1,34 @@
 package cmc
 
+import "os"
+
 type Config struct {
-	// Coinmarketcap API URL
+	// Coinmarketcap Pro API URL, DefaultURL if empty
 	URL string
-	// Number of tickers to get in one request
+	// Pro API key, taken from APIKeyEnv environment variable if empty
+	APIKey string
+	// Number of top tickers to get in one request, zero disables
 	BulkSize int
 	// Interval for polling
 	Interval string
+	// Tickers not refreshed for this long are stale and not used,
+	// three intervals by default
+	MaxAge string
+	// Number of tickers missing from the bulk list requested at once
+	BatchSize int
+	// Credits the provider may use per UTC day and month, zero is unlimited
+	DailyCredits   int
+	MonthlyCredits int
+	// File keeping listings and last tickers, used to start while
+	// Coinmarketcap is unavailable
+	Cache string
+	// Cache older than this is not used, DefaultCacheMaxAge if empty
+	CacheMaxAge string
+}
+
+func (c *Config) apiKey() string {
+	if c.APIKey != "" {
+		return c.APIKey
+	}
+	return os.Getenv(APIKeyEnv)
 }
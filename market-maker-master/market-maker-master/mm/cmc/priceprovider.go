@@ -1,33 +1,101 @@
 package cmc
 
 import (
+	"context"
 	"fmt"
 	"math"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/juju/errors"
 	"go.uber.org/zap"
 
-	"github.com/opentradingnetworkfoundation/otn-go/coinmarketcap"
 	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/route"
 	"github.com/opentradingnetworkfoundation/otn-go/objects"
 )
 
 const (
-	DefaultInterval = time.Minute
+	DefaultInterval  = time.Minute
+	DefaultBatchSize = 100
+
+	// USD is quoted by every ticker, so it can be a market quote
+	// although it is not listed
+	USD = "USD"
+
+	// delay after failed refresh doubles from minRetry up to maxRetry
+	minRetry = 5 * time.Second
+	maxRetry = 10 * time.Minute
+
+	// GetProvider waits this long for tickers of new symbols
+	providerWait = 30 * time.Second
 )
 
+// every ticker is converted to these, cost of a call grows with their number
+var converts = []string{"BTC", USD}
+
+type entry struct {
+	ticker  *proTicker
+	fetched time.Time
+	stale   bool
+	// loaded from cache file and not refreshed since
+	cached bool
+}
+
+// snapshot is published as a whole by the refresher and never changed,
+// so that readers do not lock
+type snapshot struct {
+	entries map[string]*entry
+	quotes  []route.Quote
+	// symbol registry version the snapshot was refreshed with
+	version int
+	// error of the refresh
+	err error
+	// refresh failed or cached listings or tickers are used
+	degraded bool
+	// closed when newer snapshot is published
+	next chan struct{}
+}
+
+func (s *snapshot) has(symbols []string) bool {
+	for _, sym := range symbols {
+		if e, ok := s.entries[sym]; !ok || e.stale {
+			return false
+		}
+	}
+	return true
+}
+
 type priceProviderFactory struct {
-	cfg      *Config
-	client   *coinmarketcap.Client
-	interval time.Duration
-	log      *zap.SugaredLogger
+	cfg       *Config
+	client    *proClient
+	quota     *quota
+	interval  time.Duration
+	maxAge    time.Duration
+	batchSize int
+	log       *zap.SugaredLogger
+	// ids of listed symbols
+	symbolMap map[string]int
+	listings  []*proListing
+	// cache file and age it is still used at
+	cachePath   string
+	cacheMaxAge time.Duration
+	// started from cache and not refreshed yet, used by refresher only
+	fromCache bool
+	now       func() time.Time
+	after     func(time.Duration) <-chan time.Time
+
+	snapshot atomic.Value
+	wake     chan struct{}
+	done     <-chan struct{}
 
-	providers   map[string]bool
-	priceCache  map[string]*coinmarketcap.Ticker
-	symbolMap   map[string]*coinmarketcap.Listing
-	lastUpdated time.Time
-	mutex       sync.Mutex
+	// symbols to refresh
+	mutex     sync.Mutex
+	providers map[string]bool
+	version   int
 }
 
 // PriceProviderFactory interface
@@ -35,68 +103,380 @@ func (f *priceProviderFactory) GetProvider(market *mm.Market) (mm.PriceProvider,
 	if _, ok := f.symbolMap[market.Base.Symbol]; !ok {
 		return nil, fmt.Errorf("Unknown asset '%s'", market.Base.Symbol)
 	}
-	if _, ok := f.symbolMap[market.Quote.Symbol]; !ok {
+	if _, ok := f.symbolMap[market.Quote.Symbol]; !ok && market.Quote.Symbol != USD {
 		return nil, fmt.Errorf("Unknown asset '%s'", market.Quote.Symbol)
 	}
-	f.mutex.Lock()
-	f.lastUpdated = time.Time{}
-	f.providers[market.Base.Symbol] = true
-	f.providers[market.Quote.Symbol] = true
-	f.mutex.Unlock()
+
+	symbols := []string{market.Base.Symbol}
+	if market.Quote.Symbol != USD {
+		symbols = append(symbols, market.Quote.Symbol)
+	}
+	version := f.register(symbols)
+	if !f.load().has(symbols) {
+		f.refreshNow()
+		f.waitFor(version, symbols)
+	}
+
 	return &priceProvider{market: market, factory: f}, nil
 }
 
-func (f *priceProviderFactory) getTicker(symbol string) *coinmarketcap.Ticker {
+// register adds symbols to refresh, returned registry version includes them
+func (f *priceProviderFactory) register(symbols []string) int {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
-	if f.lastUpdated.Add(f.interval).Before(time.Now()) {
-		f.update()
-		f.lastUpdated = time.Now()
+	for _, sym := range symbols {
+		if !f.providers[sym] {
+			f.providers[sym] = true
+			f.version++
+		}
+	}
+	return f.version
+}
+
+// refreshNow wakes the refresher unless it is backing off
+func (f *priceProviderFactory) refreshNow() {
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+// waitFor blocks until refresh of the registry version is published.
+// It does not wait while prices are degraded, markets start without price
+// instead of each waiting for Coinmarketcap.
+func (f *priceProviderFactory) waitFor(version int, symbols []string) {
+	timeout := time.After(providerWait)
+	for {
+		s := f.load()
+		if s.version >= version || s.degraded {
+			return
+		}
+		select {
+		case <-s.next:
+		case <-f.done:
+			return
+		case <-timeout:
+			f.log.Warnw("No tickers yet", "symbols", symbols)
+			return
+		}
 	}
+}
 
-	return f.priceCache[symbol]
+func (f *priceProviderFactory) load() *snapshot {
+	return f.snapshot.Load().(*snapshot)
 }
 
-func mapTickersBySymbol(tickers map[string]*coinmarketcap.Ticker) map[string]*coinmarketcap.Ticker {
-	result := make(map[string]*coinmarketcap.Ticker)
-	for _, t := range tickers {
-		result[t.Symbol] = t
+// ticker returns fresh ticker from the snapshot, entries age out even if
+// refresher is stuck
+func (f *priceProviderFactory) ticker(s *snapshot, symbol string) *proTicker {
+	e, ok := s.entries[symbol]
+	if !ok || e.stale || f.now().Sub(e.fetched) > f.maxAge {
+		return nil
 	}
-	return result
+	return e.ticker
 }
 
-func (f *priceProviderFactory) update() {
-	bulk, err := f.client.Tickers(&coinmarketcap.TickersOptions{
-		Limit:   f.cfg.BulkSize,
-		Convert: "BTC",
-	})
+// run refreshes tickers until ctx is done. Every interval all tickers are
+// refreshed, new symbols are fetched at once on their own.
+func (f *priceProviderFactory) run(ctx context.Context) {
+	var (
+		retry time.Duration
+		timer <-chan time.Time
+	)
+	full := true
+	for {
+		entries, version, err := f.refresh(full)
 
-	if err != nil {
-		f.log.Errorw("Failed to get tickers", "error", err)
-		return
+		delay := f.interval
+		if err != nil {
+			retry *= 2
+			if retry < minRetry {
+				retry = minRetry
+			} else if retry > maxRetry {
+				retry = maxRetry
+			}
+			delay = retry
+
+			switch e := errors.Cause(err).(type) {
+			case *rateLimitError:
+				if e.retryAfter > delay {
+					delay = e.retryAfter
+				}
+			case *quotaError:
+				delay = e.until.Sub(f.now())
+			}
+			f.log.Errorw("Failed to refresh tickers", "error", err, "retry", delay)
+		} else {
+			retry = 0
+		}
+
+		// next refresh is scheduled before waiters see the snapshot
+		if full || err != nil {
+			timer = f.after(delay)
+		}
+		if full && err == nil {
+			f.fromCache = false
+		}
+		f.publish(entries, version, err)
+		if full && err == nil {
+			f.saveCache(entries)
+		}
+
+	wait:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer:
+				full = true
+				break wait
+			case <-f.wake:
+				// new symbols do not cut backoff short
+				if retry == 0 && f.pending(version) {
+					full = false
+					break wait
+				}
+			}
+		}
 	}
+}
 
-	tickers := mapTickersBySymbol(bulk)
+// pending checks if symbols were registered after refresh of version
+func (f *priceProviderFactory) pending(version int) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.version > version
+}
+
+// refresh gets bulk list and tickers of registered symbols missing from it,
+// or only symbols which have no fresh ticker unless full. Entries which were
+// not refreshed are kept until they get stale.
+func (f *priceProviderFactory) refresh(full bool) (map[string]*entry, int, error) {
+	old := f.load()
+	entries := make(map[string]*entry, len(old.entries))
+	for sym, e := range old.entries {
+		entries[sym] = e
+	}
 
+	f.mutex.Lock()
+	version := f.version
+	var symbols []string
 	for sym := range f.providers {
-		t, ok := tickers[sym]
-		if !ok {
-			f.log.Infow("Fetching separate info", "symbol", sym)
-			t, err = f.client.Ticker(&coinmarketcap.TickerOptions{
-				ID:      f.symbolMap[sym].ID,
-				Convert: "BTC",
-			})
-			if err != nil {
-				f.log.Errorw("Failed to get ticker", "symbol", sym, "error", err)
+		if full || !old.has([]string{sym}) {
+			symbols = append(symbols, sym)
+		}
+	}
+	f.mutex.Unlock()
+	sort.Strings(symbols)
+
+	if full && f.cfg.BulkSize > 0 {
+		bulk, err := f.latest()
+		if err != nil {
+			return entries, version, err
+		}
+
+		// every ticker can be a hop of price route
+		now := f.now()
+		for _, t := range bulk {
+			entries[t.Symbol] = &entry{ticker: t, fetched: now}
+		}
+
+		var missing []string
+		for _, sym := range symbols {
+			if e := entries[sym]; e == nil || !e.fetched.Equal(now) {
+				missing = append(missing, sym)
+			}
+		}
+		symbols = missing
+	}
+
+	return entries, version, f.fetchMissing(symbols, entries)
+}
+
+// latest gets top tickers, listed symbols take precedence over others
+// with the same symbol
+func (f *priceProviderFactory) latest() (map[string]*proTicker, error) {
+	cost := quotesCost(f.cfg.BulkSize, 200, len(converts))
+	if err := f.quota.check(f.now(), cost); err != nil {
+		return nil, err
+	}
+
+	bulk, credits, err := f.client.latest(f.cfg.BulkSize, converts)
+	f.quota.charge(f.now(), credits, err)
+	if err != nil {
+		return nil, errors.Annotate(err, "get tickers")
+	}
+
+	res := make(map[string]*proTicker, len(bulk))
+	for _, t := range bulk {
+		if _, ok := res[t.Symbol]; !ok || f.symbolMap[t.Symbol] == t.ID {
+			res[t.Symbol] = t
+		}
+	}
+	return res, nil
+}
+
+// fetchMissing requests tickers of symbols, tickers of all markets are
+// requested together, batchSize of them in one call
+func (f *priceProviderFactory) fetchMissing(symbols []string, entries map[string]*entry) error {
+	for start := 0; start < len(symbols); start += f.batchSize {
+		end := start + f.batchSize
+		if end > len(symbols) {
+			end = len(symbols)
+		}
+		batch := symbols[start:end]
+
+		ids := make([]int, len(batch))
+		for i, sym := range batch {
+			ids[i] = f.symbolMap[sym]
+		}
+
+		if err := f.quota.check(f.now(), quotesCost(len(ids), 100, len(converts))); err != nil {
+			return err
+		}
+		f.log.Debugw("Fetching quotes", "symbols", batch)
+		tickers, credits, err := f.client.quotes(ids, converts)
+		f.quota.charge(f.now(), credits, err)
+		if err != nil {
+			return errors.Annotatef(err, "get tickers of %s", strings.Join(batch, ", "))
+		}
+
+		now := f.now()
+		for _, t := range tickers {
+			entries[t.Symbol] = &entry{ticker: t, fetched: now}
+		}
+	}
+	return nil
+}
+
+// publish marks stale entries and replaces the snapshot
+func (f *priceProviderFactory) publish(entries map[string]*entry, version int, err error) {
+	now := f.now()
+	quotes := make([]route.Quote, 0, 2*len(entries))
+	degraded := err != nil || f.fromCache
+
+	for sym, e := range entries {
+		if stale := now.Sub(e.fetched) > f.maxAge; stale != e.stale {
+			e = &entry{ticker: e.ticker, fetched: e.fetched, stale: stale, cached: e.cached}
+			entries[sym] = e
+			if stale {
+				f.log.Warnw("Ticker is stale", "symbol", sym, "fetched", e.fetched)
 			}
 		}
+		if e.stale {
+			continue
+		}
+
+		source := "cmc"
+		if e.cached {
+			source = "cmc-cache"
+			degraded = true
+		}
+
+		for _, currency := range []string{"BTC", USD} {
+			q, ok := e.ticker.Quote[currency]
+			if !ok || sym == currency {
+				continue
+			}
+			quotes = append(quotes, route.Quote{
+				Base:   sym,
+				Quote:  currency,
+				Rate:   q.Price,
+				Time:   e.ticker.LastUpdated,
+				Source: source,
+			})
+		}
+	}
+
+	old := f.load()
+	if degraded && !old.degraded {
+		f.log.Warn("Coinmarketcap prices are degraded")
+	} else if !degraded && old.degraded {
+		f.log.Info("Coinmarketcap prices are refreshed again")
+	}
+
+	f.snapshot.Store(&snapshot{
+		entries:  entries,
+		quotes:   quotes,
+		version:  version,
+		err:      err,
+		degraded: degraded,
+		next:     make(chan struct{}),
+	})
+	close(old.next)
+}
+
+// saveCache writes listings and fresh tickers to the cache file
+func (f *priceProviderFactory) saveCache(entries map[string]*entry) {
+	if f.cachePath == "" {
+		return
+	}
+
+	c := &cache{Saved: f.now(), Listings: f.listings}
+	for _, e := range entries {
+		if !e.stale {
+			c.Tickers = append(c.Tickers, &cachedTicker{Ticker: e.ticker, Fetched: e.fetched})
+		}
+	}
+	if err := saveCache(f.cachePath, c); err != nil {
+		f.log.Errorw("Failed to save cache", "path", f.cachePath, "error", err)
+	}
+}
+
+// loadCache starts from listings and tickers of the cache file
+func (f *priceProviderFactory) loadCache() error {
+	if f.cachePath == "" {
+		return fmt.Errorf("Cache is not configured")
+	}
+	c, err := loadCache(f.cachePath, f.cacheMaxAge, f.now())
+	if err != nil {
+		return err
+	}
+
+	f.listings = c.Listings
+	f.fromCache = true
+	entries := make(map[string]*entry, len(c.Tickers))
+	for _, t := range c.Tickers {
+		entries[t.Ticker.Symbol] = &entry{ticker: t.Ticker, fetched: t.Fetched, cached: true}
+	}
+	f.publish(entries, 0, nil)
+	f.log.Warnw("Started from cache", "path", f.cachePath, "saved", c.Saved, "tickers", len(entries))
+	return nil
+}
+
+// status reports state of the last refresh
+func (f *priceProviderFactory) status() Status {
+	s := f.load()
+	res := Status{Degraded: s.degraded, Tickers: len(s.entries)}
+	if s.err != nil {
+		res.Error = s.err.Error()
+	}
+	for _, e := range s.entries {
+		if e.stale {
+			res.Stale++
+		} else if e.cached {
+			res.Cached++
+		}
+	}
+	return res
+}
 
-		// place result into cache
-		if t != nil {
-			f.priceCache[sym] = t
+// Quotes implements route.QuoteSource, every fresh ticker is quoted in BTC
+// and USD. Assets seen for the first time are quoted after next refresh.
+func (f *priceProviderFactory) Quotes(assets []objects.Asset) []route.Quote {
+	var symbols []string
+	for _, a := range assets {
+		if _, ok := f.symbolMap[a.Symbol]; ok {
+			symbols = append(symbols, a.Symbol)
 		}
 	}
+
+	s := f.load()
+	if f.register(symbols) > s.version {
+		f.refreshNow()
+	}
+	return s.quotes
 }
 
 type priceProvider struct {
@@ -105,18 +485,33 @@ type priceProvider struct {
 }
 
 func (p *priceProvider) GetPrice() (price objects.Price) {
-	baseTicker := p.factory.getTicker(p.market.Base.Symbol)
-	quoteTicker := p.factory.getTicker(p.market.Quote.Symbol)
-
-	if baseTicker == nil || quoteTicker == nil {
+	s := p.factory.load()
+	baseTicker := p.factory.ticker(s, p.market.Base.Symbol)
+	if baseTicker == nil {
 		return
 	}
 
-	baseBtc := baseTicker.Quotes["BTC"].Price
-	quoteBtc := quoteTicker.Quotes["BTC"].Price
+	var rate float64
+	if p.market.Quote.Symbol == USD {
+		q, ok := baseTicker.Quote[USD]
+		if !ok {
+			return
+		}
+		rate = q.Price
+	} else {
+		quoteTicker := p.factory.ticker(s, p.market.Quote.Symbol)
+		if quoteTicker == nil {
+			return
+		}
+		base, quote := baseTicker.Quote["BTC"], quoteTicker.Quote["BTC"]
+		if base == nil || quote == nil || quote.Price == 0 {
+			return
+		}
+		rate = base.Price / quote.Price
+	}
 
 	baseAmount := math.Pow10(p.market.Base.Precision)
-	quoteAmount := baseAmount * baseBtc / quoteBtc
+	quoteAmount := baseAmount * rate
 
 	return objects.Price{
 		Base: objects.AssetAmount{
@@ -130,11 +525,24 @@ func (p *priceProvider) GetPrice() (price objects.Price) {
 	}
 }
 
-func NewFactory(cfg *Config, log *zap.SugaredLogger) (prov mm.PriceProviderFactory, err error) {
-	client := coinmarketcap.NewClient(&coinmarketcap.Options{
-		URL: cfg.URL,
-	})
+// NewFactory creates provider refreshing tickers in background until ctx is done
+func NewFactory(ctx context.Context, cfg *Config, log *zap.SugaredLogger) (mm.PriceProviderFactory, error) {
+	f, err := newFactory(cfg, newProClient(cfg), log)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.init(); err != nil {
+		return nil, err
+	}
+	f.start(ctx)
+	registerMetrics(ctx, f)
+	return f, nil
+}
+
+func newFactory(cfg *Config, client *proClient, log *zap.SugaredLogger) (*priceProviderFactory, error) {
+	metricsOnce.Do(publishMetrics)
 
+	var err error
 	interval := DefaultInterval
 	if cfg.Interval != "" {
 		interval, err = time.ParseDuration(cfg.Interval)
@@ -143,20 +551,80 @@ func NewFactory(cfg *Config, log *zap.SugaredLogger) (prov mm.PriceProviderFacto
 		}
 	}
 
-	lst, err := client.Listings()
+	maxAge := 3 * interval
+	if cfg.MaxAge != "" {
+		maxAge, err = time.ParseDuration(cfg.MaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	cacheMaxAge := DefaultCacheMaxAge
+	if cfg.CacheMaxAge != "" {
+		cacheMaxAge, err = time.ParseDuration(cfg.CacheMaxAge)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	batchSize := DefaultBatchSize
+	if cfg.BatchSize > 0 {
+		batchSize = cfg.BatchSize
+	}
+
+	f := &priceProviderFactory{
+		cfg:         cfg,
+		client:      client,
+		quota:       &quota{dailyLimit: cfg.DailyCredits, monthlyLimit: cfg.MonthlyCredits},
+		log:         log,
+		interval:    interval,
+		maxAge:      maxAge,
+		batchSize:   batchSize,
+		cachePath:   cfg.Cache,
+		cacheMaxAge: cacheMaxAge,
+		now:         time.Now,
+		after:       time.After,
+		wake:        make(chan struct{}, 1),
+		providers:   make(map[string]bool),
+	}
+	f.snapshot.Store(&snapshot{next: make(chan struct{})})
+	return f, nil
+}
+
+// init takes credits used by the key so far and loads listed symbols
+func (f *priceProviderFactory) init() error {
+	usage, err := f.client.usage()
 	if err != nil {
-		return
+		f.log.Warnw("Failed to get API key usage, credits are counted from zero", "error", err)
+	} else {
+		f.quota.seed(f.now(), usage)
+	}
+
+	err = f.quota.check(f.now(), 1)
+	if err == nil {
+		var credits int
+		f.listings, credits, err = f.client.listings()
+		f.quota.charge(f.now(), credits, err)
+	}
+	if err != nil {
+		if cacheErr := f.loadCache(); cacheErr != nil {
+			f.log.Errorw("Failed to load cache", "error", cacheErr)
+			return errors.Annotate(err, "get listings")
+		}
+		f.log.Warnw("Coinmarketcap is unavailable, listings are taken from cache", "error", err)
 	}
 
-	prov = &priceProviderFactory{
-		cfg:        cfg,
-		client:     client,
-		log:        log,
-		interval:   interval,
-		providers:  make(map[string]bool),
-		priceCache: make(map[string]*coinmarketcap.Ticker),
-		symbolMap:  coinmarketcap.MapListingsBySymbol(lst),
+	// symbols are not unique, the first listed is the oldest one
+	f.symbolMap = make(map[string]int, len(f.listings))
+	for _, l := range f.listings {
+		if _, ok := f.symbolMap[l.Symbol]; !ok && l.IsActive != 0 {
+			f.symbolMap[l.Symbol] = l.ID
+		}
 	}
+	return nil
+}
 
-	return
+func (f *priceProviderFactory) start(ctx context.Context) {
+	f.done = ctx.Done()
+	go f.run(ctx)
 }
@@ -1,15 +1,24 @@
 package cmc
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 
 	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/mmtest"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
-	"github.com/opentradingnetworkfoundation/otn-go/objects"
 )
 
 var (
@@ -29,8 +38,11 @@ var (
 )
 
 func TestProvider(t *testing.T) {
+	if os.Getenv(APIKeyEnv) == "" {
+		t.Skipf("%s is not set", APIKeyEnv)
+	}
 	cfg := &Config{BulkSize: 10}
-	f, err := NewFactory(cfg, zap.NewNop().Sugar())
+	f, err := NewFactory(context.Background(), cfg, zap.NewNop().Sugar())
 	require.NoError(t, err)
 
 	p1, err := f.GetProvider(&marketOTNBTC)
@@ -41,3 +53,342 @@ func TestProvider(t *testing.T) {
 	assert.Equal(t, otnBtcPrice.Base.Asset, idOTN)
 	assert.Equal(t, otnBtcPrice.Quote.Asset, idBTC)
 }
+
+func newTestFactory(t *testing.T, server *standIn, cfg *Config) (*priceProviderFactory, *mmtest.Clock, context.CancelFunc) {
+	clock := mmtest.NewClock(time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC))
+	f, cancel, err := startTestFactory(server, cfg, clock)
+	require.NoError(t, err)
+	return f, clock, cancel
+}
+
+func startTestFactory(server *standIn, cfg *Config, clock *mmtest.Clock) (*priceProviderFactory, context.CancelFunc, error) {
+	cfg.URL = server.url
+	cfg.APIKey = testKey
+	if cfg.Interval == "" {
+		cfg.Interval = "1m"
+	}
+	if cfg.BulkSize == 0 {
+		cfg.BulkSize = 1
+	}
+
+	client := newProClient(cfg)
+	f, err := newFactory(cfg, client, zap.NewNop().Sugar())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f.now = clock.Now
+	f.after = clock.After
+	client.now = clock.Now
+	if err := f.init(); err != nil {
+		return nil, nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	f.start(ctx)
+	return f, cancel, nil
+}
+
+// step advances clock and waits for the refresh it triggers
+func step(t *testing.T, f *priceProviderFactory, clock *mmtest.Clock, d time.Duration) {
+	require.True(t, clock.WaitTimers(1, time.Second))
+	s := f.load()
+	clock.Advance(d)
+	select {
+	case <-s.next:
+	case <-time.After(time.Second):
+		t.Fatal("tickers were not refreshed")
+	}
+}
+
+func rate(market *mm.Market, p mm.PriceProvider) float64 {
+	return market.GetRate(p.GetPrice()).Value()
+}
+
+func TestBackgroundRefresh(t *testing.T) {
+	server := newStandIn(t)
+	f, clock, cancel := newTestFactory(t, server, &Config{})
+	defer cancel()
+
+	// first tickers are fetched before provider is returned
+	p1, err := f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.0001, rate(&marketOTNBTC, p1), 1e-12)
+
+	// only new symbol is fetched for the next market
+	p2, err := f.GetProvider(&marketETHBTC)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.05, rate(&marketETHBTC, p2), 1e-12)
+	assert.Equal(t, []string{"3", "2"}, server.quoted())
+
+	// symbols of all markets missing from the bulk list are requested together
+	server.set("OTN", 0.0002, 1.2)
+	assert.InDelta(t, 0.0001, rate(&marketOTNBTC, p1), 1e-12)
+	step(t, f, clock, time.Minute)
+	assert.InDelta(t, 0.0002, rate(&marketOTNBTC, p1), 1e-12)
+	assert.Equal(t, []string{"3", "2", "2,3"}, server.quoted())
+	assert.Equal(t, 2, server.calls("/v1/cryptocurrency/listings/latest"))
+}
+
+func TestGetPriceDoesNotWaitForRefresh(t *testing.T) {
+	server := newStandIn(t)
+	f, clock, cancel := newTestFactory(t, server, &Config{})
+	defer cancel()
+
+	p, err := f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+
+	block := make(chan struct{})
+	server.mutex.Lock()
+	server.block = block
+	server.mutex.Unlock()
+
+	s := f.load()
+	require.True(t, clock.WaitTimers(1, time.Second))
+	clock.Advance(time.Minute)
+
+	done := make(chan float64)
+	go func() {
+		done <- rate(&marketOTNBTC, p)
+	}()
+	select {
+	case r := <-done:
+		assert.InDelta(t, 0.0001, r, 1e-12)
+	case <-time.After(time.Second):
+		t.Fatal("GetPrice is blocked by refresh")
+	}
+
+	close(block)
+	<-s.next
+}
+
+func TestBackoffAndStale(t *testing.T) {
+	server := newStandIn(t)
+	f, clock, cancel := newTestFactory(t, server, &Config{})
+	defer cancel()
+
+	p, err := f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+
+	server.fail(http.StatusServiceUnavailable, "")
+	step(t, f, clock, time.Minute)
+	bulk := server.calls("/v1/cryptocurrency/listings/latest")
+
+	// retries after 5s, 10s and 20s
+	for _, d := range []time.Duration{5 * time.Second, 10 * time.Second, 20 * time.Second} {
+		clock.Advance(d - time.Second)
+		assert.Equal(t, bulk, server.calls("/v1/cryptocurrency/listings/latest"), "retried before %s", d)
+		step(t, f, clock, time.Second)
+		bulk++
+	}
+	// last tickers are 95s old
+	assert.NotZero(t, rate(&marketOTNBTC, p))
+
+	// older than three intervals
+	step(t, f, clock, 40*time.Second)
+	step(t, f, clock, 80*time.Second)
+	step(t, f, clock, 160*time.Second)
+	assert.Zero(t, rate(&marketOTNBTC, p))
+	assert.Empty(t, f.Quotes([]objects.Asset{assetOTN}))
+
+	server.fail(0, "")
+	step(t, f, clock, 320*time.Second)
+	assert.InDelta(t, 0.0001, rate(&marketOTNBTC, p), 1e-12)
+	assert.NotEmpty(t, f.Quotes([]objects.Asset{assetOTN}))
+}
+
+func TestRetryAfter(t *testing.T) {
+	server := newStandIn(t)
+	f, clock, cancel := newTestFactory(t, server, &Config{})
+	defer cancel()
+
+	_, err := f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+
+	server.fail(http.StatusTooManyRequests, "120")
+	step(t, f, clock, time.Minute)
+	bulk := server.calls("/v1/cryptocurrency/listings/latest")
+	assert.Equal(t, 1, f.quota.status().RateLimited)
+
+	// Retry-After is longer than backoff
+	clock.Advance(time.Minute)
+	assert.Equal(t, bulk, server.calls("/v1/cryptocurrency/listings/latest"))
+
+	server.fail(0, "")
+	step(t, f, clock, time.Minute)
+	assert.Equal(t, bulk+1, server.calls("/v1/cryptocurrency/listings/latest"))
+}
+
+func TestCreditQuota(t *testing.T) {
+	server := newStandIn(t)
+	server.usedDay = 90
+	f, clock, cancel := newTestFactory(t, server, &Config{DailyCredits: 100})
+	defer cancel()
+
+	// listings, bulk list and quotes of OTN with two converts each
+	_, err := f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+	status := f.quota.status()
+	assert.Equal(t, 95, status.CreditsDay)
+	assert.Equal(t, 100, status.DailyLimit)
+
+	step(t, f, clock, time.Minute)
+	assert.Equal(t, 99, f.quota.status().CreditsDay)
+
+	// no calls until the next UTC day
+	step(t, f, clock, time.Minute)
+	bulk := server.calls("/v1/cryptocurrency/listings/latest")
+	clock.Advance(11*time.Hour + 57*time.Minute)
+	assert.Equal(t, bulk, server.calls("/v1/cryptocurrency/listings/latest"))
+
+	step(t, f, clock, time.Minute)
+	assert.Equal(t, bulk+1, server.calls("/v1/cryptocurrency/listings/latest"))
+	assert.Equal(t, 4, f.quota.status().CreditsDay)
+}
+
+func TestAPIKey(t *testing.T) {
+	server := newStandIn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	os.Setenv(APIKeyEnv, testKey)
+	defer os.Unsetenv(APIKeyEnv)
+	f, err := NewFactory(ctx, &Config{URL: server.url}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	_, err = f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+
+	_, err = NewFactory(ctx, &Config{URL: server.url, APIKey: "wrong"}, zap.NewNop().Sugar())
+	assert.Error(t, err)
+}
+func TestMetricsPerFactory(t *testing.T) {
+	server := newStandIn(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	other, cancelOther := context.WithCancel(ctx)
+
+	_, err := NewFactory(ctx, &Config{URL: server.url, APIKey: testKey, DailyCredits: 100}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	_, err = NewFactory(other, &Config{URL: server.url, APIKey: testKey, DailyCredits: 200}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	// daily limits of published factories
+	limits := func() map[int]bool {
+		var credits map[string]QuotaStatus
+		require.NoError(t, json.Unmarshal([]byte(expvar.Get("cmc_credits").String()), &credits))
+		res := make(map[int]bool)
+		for _, q := range credits {
+			res[q.DailyLimit] = true
+		}
+		return res
+	}
+	assert.True(t, limits()[100])
+	assert.True(t, limits()[200])
+
+	// stopped factory is not published
+	cancelOther()
+	for i := 0; i < 100 && limits()[200]; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.False(t, limits()[200])
+	assert.True(t, limits()[100])
+}
+
+func TestQuotes(t *testing.T) {
+	server := newStandIn(t)
+	f, clock, cancel := newTestFactory(t, server, &Config{BulkSize: 2})
+	defer cancel()
+
+	// assets missing from the bulk list are requested by the next refresh
+	for _, q := range f.Quotes([]objects.Asset{assetOTN, assetBTC}) {
+		assert.NotEqual(t, "OTN", q.Base)
+	}
+	step(t, f, clock, time.Minute)
+
+	byPair := make(map[string]float64)
+	for _, q := range f.Quotes([]objects.Asset{assetOTN, assetBTC}) {
+		byPair[q.Base+"/"+q.Quote] = q.Rate
+	}
+	assert.Equal(t, map[string]float64{
+		"OTN/BTC": 0.0001,
+		"OTN/USD": 0.6,
+		"ETH/BTC": 0.05,
+		"ETH/USD": 300,
+		"BTC/USD": 6000,
+	}, byPair)
+}
+
+func TestStartFromCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cmc.json")
+
+	server := newStandIn(t)
+	f, clock, cancel := newTestFactory(t, server, &Config{Cache: path})
+	_, err = f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+	step(t, f, clock, time.Minute)
+	cancel()
+
+	// Coinmarketcap is down after restart
+	server.fail(http.StatusServiceUnavailable, "")
+	clock = mmtest.NewClock(clock.Now().Add(time.Minute))
+	f, cancel, err = startTestFactory(server, &Config{Cache: path}, clock)
+	require.NoError(t, err)
+	defer cancel()
+
+	p, err := f.GetProvider(&marketOTNBTC)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.0001, rate(&marketOTNBTC, p), 1e-12)
+	assert.True(t, f.status().Degraded)
+	for _, q := range f.Quotes([]objects.Asset{assetOTN}) {
+		assert.Equal(t, "cmc-cache", q.Source)
+	}
+
+	// cached prices get too old, market stays idle
+	step(t, f, clock, 5*time.Second)
+	step(t, f, clock, 10*time.Second)
+	step(t, f, clock, 20*time.Second)
+	step(t, f, clock, 40*time.Second)
+	step(t, f, clock, 80*time.Second)
+	assert.Zero(t, rate(&marketOTNBTC, p))
+
+	server.fail(0, "")
+	step(t, f, clock, 160*time.Second)
+	assert.InDelta(t, 0.0001, rate(&marketOTNBTC, p), 1e-12)
+	assert.False(t, f.status().Degraded)
+
+	saved, err := loadCache(path, DefaultCacheMaxAge, clock.Now())
+	require.NoError(t, err)
+	assert.Equal(t, clock.Now(), saved.Saved)
+	assert.Len(t, saved.Listings, 3)
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cmc")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cmc.json")
+
+	server := newStandIn(t)
+	server.fail(http.StatusServiceUnavailable, "")
+	clock := mmtest.NewClock(time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC))
+
+	// no cache
+	_, _, err = startTestFactory(server, &Config{Cache: path}, clock)
+	assert.Error(t, err)
+
+	require.NoError(t, saveCache(path, &cache{
+		Saved:    clock.Now().Add(-25 * time.Hour),
+		Listings: []*proListing{{ID: 3, Symbol: "OTN", IsActive: 1}},
+	}))
+	_, _, err = startTestFactory(server, &Config{Cache: path, CacheMaxAge: "24h"}, clock)
+	assert.Error(t, err)
+
+	f, cancel, err := startTestFactory(server, &Config{Cache: path}, clock)
+	require.NoError(t, err)
+	defer cancel()
+	_, err = f.GetProvider(&mm.Market{Base: assetOTN, Quote: objects.Asset{Symbol: USD}})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,194 @@
+package cmc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	DefaultURL = "https://pro-api.coinmarketcap.com"
+	// APIKeyEnv is used when API key is not configured
+	APIKeyEnv = "CMC_PRO_API_KEY"
+
+	requestTimeout = 30 * time.Second
+)
+
+// proClient is a minimal Coinmarketcap Pro API client, unlike the one of
+// otn-go it reports credits charged for every call and rate limits
+type proClient struct {
+	url  string
+	key  string
+	http *http.Client
+	now  func() time.Time
+}
+
+type proStatus struct {
+	ErrorCode    int    `json:"error_code"`
+	ErrorMessage string `json:"error_message"`
+	CreditCount  int    `json:"credit_count"`
+}
+
+type proQuote struct {
+	Price       float64   `json:"price"`
+	LastUpdated time.Time `json:"last_updated"`
+}
+
+type proTicker struct {
+	ID          int                  `json:"id"`
+	Symbol      string               `json:"symbol"`
+	LastUpdated time.Time            `json:"last_updated"`
+	Quote       map[string]*proQuote `json:"quote"`
+}
+
+type proListing struct {
+	ID       int    `json:"id"`
+	Symbol   string `json:"symbol"`
+	IsActive int    `json:"is_active"`
+}
+
+type proUsage struct {
+	CurrentDay struct {
+		CreditsUsed int `json:"credits_used"`
+	} `json:"current_day"`
+	CurrentMonth struct {
+		CreditsUsed int `json:"credits_used"`
+	} `json:"current_month"`
+}
+
+// rateLimitError is returned on HTTP 429, retryAfter is zero when
+// server did not say how long to wait
+type rateLimitError struct {
+	retryAfter time.Duration
+	message    string
+}
+
+func (e *rateLimitError) Error() string {
+	return fmt.Sprintf("Rate limited: %s, retry after %s", e.message, e.retryAfter)
+}
+
+func newProClient(cfg *Config) *proClient {
+	u := DefaultURL
+	if cfg.URL != "" {
+		u = strings.TrimRight(cfg.URL, "/")
+	}
+	return &proClient{
+		url:  u,
+		key:  cfg.apiKey(),
+		http: &http.Client{Timeout: requestTimeout},
+		now:  time.Now,
+	}
+}
+
+// get calls API method and decodes data of the response into v,
+// returns credits charged for the call
+func (c *proClient) get(path string, params url.Values, v interface{}) (int, error) {
+	req, err := http.NewRequest("GET", c.url+path+"?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.key != "" {
+		req.Header.Set("X-CMC_PRO_API_KEY", c.key)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, errors.Annotate(err, "read response")
+	}
+
+	var res struct {
+		Status proStatus       `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	// error responses may come from a proxy and not be JSON
+	jsonErr := json.Unmarshal(body, &res)
+	message := res.Status.ErrorMessage
+	if message == "" {
+		message = resp.Status
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return res.Status.CreditCount, &rateLimitError{
+			retryAfter: c.retryAfter(resp.Header.Get("Retry-After")),
+			message:    message,
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return res.Status.CreditCount, fmt.Errorf("Coinmarketcap error %d: %s", resp.StatusCode, message)
+	}
+	if jsonErr != nil {
+		return 0, errors.Annotate(jsonErr, "decode response")
+	}
+
+	return res.Status.CreditCount, errors.Annotate(json.Unmarshal(res.Data, v), "decode data")
+}
+
+// retryAfter parses Retry-After header, which is either seconds or HTTP date
+func (c *proClient) retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(header); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(c.now()) {
+		return t.Sub(c.now())
+	}
+	return 0
+}
+
+func (c *proClient) listings() ([]*proListing, int, error) {
+	var res []*proListing
+	credits, err := c.get("/v1/cryptocurrency/map", url.Values{}, &res)
+	return res, credits, err
+}
+
+// latest returns top tickers by market cap
+func (c *proClient) latest(limit int, convert []string) ([]*proTicker, int, error) {
+	var res []*proTicker
+	credits, err := c.get("/v1/cryptocurrency/listings/latest", url.Values{
+		"limit":   {strconv.Itoa(limit)},
+		"convert": {strings.Join(convert, ",")},
+	}, &res)
+	return res, credits, err
+}
+
+// quotes returns tickers by id
+func (c *proClient) quotes(ids []int, convert []string) (map[string]*proTicker, int, error) {
+	list := make([]string, len(ids))
+	for i, id := range ids {
+		list[i] = strconv.Itoa(id)
+	}
+
+	var res map[string]*proTicker
+	credits, err := c.get("/v1/cryptocurrency/quotes/latest", url.Values{
+		"id":      {strings.Join(list, ",")},
+		"convert": {strings.Join(convert, ",")},
+	}, &res)
+	return res, credits, err
+}
+
+// usage returns credits used by the key, the call itself is free
+func (c *proClient) usage() (*proUsage, error) {
+	var res struct {
+		Usage proUsage `json:"usage"`
+	}
+	if _, err := c.get("/v1/key/info", url.Values{}, &res); err != nil {
+		return nil, err
+	}
+	return &res.Usage, nil
+}
@@ -0,0 +1,166 @@
+package cmc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKey = "test-key"
+
+// standIn serves the part of Pro API used by the provider,
+// ETH is listed between BTC and OTN
+type standIn struct {
+	url string
+
+	mutex   sync.Mutex
+	tickers []*proTicker
+	usedDay int
+	// status and Retry-After of every response while status is set
+	status     int
+	retryAfter string
+	// requests block while it is set
+	block  chan struct{}
+	paths  map[string]int
+	quotes []string
+}
+
+func newStandIn(t *testing.T) *standIn {
+	s := &standIn{paths: make(map[string]int)}
+	for i, sym := range []string{"BTC", "ETH", "OTN"} {
+		s.tickers = append(s.tickers, &proTicker{ID: i + 1, Symbol: sym})
+	}
+	s.set("BTC", 1, 6000)
+	s.set("ETH", 0.05, 300)
+	s.set("OTN", 0.0001, 0.6)
+
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+	s.url = server.URL
+	return s
+}
+
+func (s *standIn) set(symbol string, btc, usd float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, t := range s.tickers {
+		if t.Symbol == symbol {
+			t.Quote = map[string]*proQuote{
+				"BTC": {Price: btc},
+				USD:   {Price: usd},
+			}
+			t.LastUpdated = time.Now()
+		}
+	}
+}
+
+func (s *standIn) fail(status int, retryAfter string) {
+	s.mutex.Lock()
+	s.status = status
+	s.retryAfter = retryAfter
+	s.mutex.Unlock()
+}
+
+func (s *standIn) calls(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.paths[path]
+}
+
+// quoted returns ids of every quotes call
+func (s *standIn) quoted() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]string(nil), s.quotes...)
+}
+
+func (s *standIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	block := s.block
+	s.mutex.Unlock()
+	if block != nil {
+		<-block
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	write := func(status, credits int, message string, data interface{}) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		res := map[string]interface{}{
+			"status": map[string]interface{}{"credit_count": credits, "error_message": message},
+			"data":   data,
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+
+	if r.Header.Get("X-CMC_PRO_API_KEY") != testKey {
+		write(http.StatusUnauthorized, 0, "This API Key is invalid.", nil)
+		return
+	}
+	s.paths[r.URL.Path]++
+	if s.status != 0 {
+		if s.retryAfter != "" {
+			w.Header().Set("Retry-After", s.retryAfter)
+		}
+		write(s.status, 0, http.StatusText(s.status), nil)
+		return
+	}
+
+	converts := len(strings.Split(r.FormValue("convert"), ","))
+	switch r.URL.Path {
+	case "/v1/key/info":
+		usage := proUsage{}
+		usage.CurrentDay.CreditsUsed = s.usedDay
+		usage.CurrentMonth.CreditsUsed = s.usedDay
+		write(http.StatusOK, 0, "", map[string]interface{}{"usage": usage})
+
+	case "/v1/cryptocurrency/map":
+		var res []*proListing
+		for _, t := range s.tickers {
+			res = append(res, &proListing{ID: t.ID, Symbol: t.Symbol, IsActive: 1})
+		}
+		write(http.StatusOK, 1, "", res)
+
+	case "/v1/cryptocurrency/listings/latest":
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		if limit > len(s.tickers) {
+			limit = len(s.tickers)
+		}
+		write(http.StatusOK, quotesCost(limit, 200, converts), "", s.tickers[:limit])
+
+	case "/v1/cryptocurrency/quotes/latest":
+		ids := r.FormValue("id")
+		s.quotes = append(s.quotes, ids)
+		res := make(map[string]*proTicker)
+		for _, id := range strings.Split(ids, ",") {
+			for _, t := range s.tickers {
+				if strconv.Itoa(t.ID) == id {
+					res[id] = t
+				}
+			}
+		}
+		write(http.StatusOK, quotesCost(len(res), 100, converts), "", res)
+
+	default:
+		write(http.StatusNotFound, 0, "Not found", nil)
+	}
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	c := &proClient{now: func() time.Time { return now }}
+
+	assert.Equal(t, 30*time.Second, c.retryAfter("30"))
+	assert.Equal(t, 2*time.Minute, c.retryAfter(now.Add(2*time.Minute).Format(http.TimeFormat)))
+	assert.Zero(t, c.retryAfter(""))
+	assert.Zero(t, c.retryAfter("soon"))
+}
@@ -0,0 +1,177 @@
+package cmc
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// QuotaStatus is published in cmc_credits metric
+type QuotaStatus struct {
+	CreditsDay   int `json:"credits_day"`
+	CreditsMonth int `json:"credits_month"`
+	DailyLimit   int `json:"daily_limit"`
+	MonthlyLimit int `json:"monthly_limit"`
+	Requests     int `json:"requests"`
+	RateLimited  int `json:"rate_limited"`
+}
+
+// Status is published in cmc_status metric
+type Status struct {
+	Degraded bool   `json:"degraded"`
+	Error    string `json:"error,omitempty"`
+	Tickers  int    `json:"tickers"`
+	Cached   int    `json:"cached"`
+	Stale    int    `json:"stale"`
+}
+
+var (
+	metricsOnce  sync.Once
+	metricsMutex sync.Mutex
+	// running factories by metric key, each counts its own credits
+	metricsFactories = make(map[string]*priceProviderFactory)
+)
+
+func publishMetrics() {
+	expvar.Publish("cmc_credits", expvar.Func(func() interface{} {
+		metricsMutex.Lock()
+		defer metricsMutex.Unlock()
+
+		res := make(map[string]QuotaStatus, len(metricsFactories))
+		for k, f := range metricsFactories {
+			res[k] = f.quota.status()
+		}
+		return res
+	}))
+	expvar.Publish("cmc_status", expvar.Func(func() interface{} {
+		metricsMutex.Lock()
+		defer metricsMutex.Unlock()
+
+		res := make(map[string]Status, len(metricsFactories))
+		for k, f := range metricsFactories {
+			res[k] = f.status()
+		}
+		return res
+	}))
+}
+
+// registerMetrics publishes metrics of f until ctx is done. The first
+// running factory is published as cmc, the next ones as cmc-2, cmc-3...
+func registerMetrics(ctx context.Context, f *priceProviderFactory) {
+	metricsMutex.Lock()
+	key := "cmc"
+	for i := 2; metricsFactories[key] != nil; i++ {
+		key = fmt.Sprintf("cmc-%d", i)
+	}
+	metricsFactories[key] = f
+	metricsMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		metricsMutex.Lock()
+		delete(metricsFactories, key)
+		metricsMutex.Unlock()
+	}()
+}
+
+// quotaError is returned when a call would exceed configured credits
+type quotaError struct {
+	until time.Time
+}
+
+func (e *quotaError) Error() string {
+	return fmt.Sprintf("Credit quota exhausted until %s", e.until.Format(time.RFC3339))
+}
+
+// quota counts credits charged in the current UTC day and month,
+// zero limits are not checked
+type quota struct {
+	mutex        sync.Mutex
+	dailyLimit   int
+	monthlyLimit int
+	day          time.Time
+	usedDay      int
+	usedMonth    int
+	requests     int
+	rateLimited  int
+}
+
+// roll resets counters when day or month is over
+func (q *quota) roll(now time.Time) {
+	day := now.UTC().Truncate(24 * time.Hour)
+	if day.Equal(q.day) {
+		return
+	}
+	if day.Year() != q.day.Year() || day.Month() != q.day.Month() {
+		q.usedMonth = 0
+	}
+	q.usedDay = 0
+	q.day = day
+}
+
+// check returns quotaError if call costing credits does not fit
+func (q *quota) check(now time.Time, cost int) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.roll(now)
+
+	if q.monthlyLimit > 0 && q.usedMonth+cost > q.monthlyLimit {
+		return &quotaError{until: time.Date(q.day.Year(), q.day.Month()+1, 1, 0, 0, 0, 0, time.UTC)}
+	}
+	if q.dailyLimit > 0 && q.usedDay+cost > q.dailyLimit {
+		return &quotaError{until: q.day.Add(24 * time.Hour)}
+	}
+	return nil
+}
+
+// charge accounts a call
+func (q *quota) charge(now time.Time, credits int, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.roll(now)
+
+	q.usedDay += credits
+	q.usedMonth += credits
+	q.requests++
+	if _, ok := errors.Cause(err).(*rateLimitError); ok {
+		q.rateLimited++
+	}
+}
+
+// seed takes credits used by the key before start, e.g. by previous run
+func (q *quota) seed(now time.Time, u *proUsage) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.roll(now)
+
+	if u.CurrentDay.CreditsUsed > q.usedDay {
+		q.usedDay = u.CurrentDay.CreditsUsed
+	}
+	if u.CurrentMonth.CreditsUsed > q.usedMonth {
+		q.usedMonth = u.CurrentMonth.CreditsUsed
+	}
+}
+
+func (q *quota) status() QuotaStatus {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return QuotaStatus{
+		CreditsDay:   q.usedDay,
+		CreditsMonth: q.usedMonth,
+		DailyLimit:   q.dailyLimit,
+		MonthlyLimit: q.monthlyLimit,
+		Requests:     q.requests,
+		RateLimited:  q.rateLimited,
+	}
+}
+
+// quotesCost is credit cost of quotes call, listings are charged
+// per 200 tickers instead of 100
+func quotesCost(tickers, per, converts int) int {
+	return (tickers+per-1)/per + converts - 1
+}
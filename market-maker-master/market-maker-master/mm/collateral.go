@@ -0,0 +1,521 @@
+package mm
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"github.com/shopspring/decimal"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+	"github.com/opentradingnetworkfoundation/otn-go/wallet"
+)
+
+const (
+	defaultCollateralInterval = 60 // seconds
+	// quoting is paused this much above maintenance ratio by default
+	defaultPauseMargin = 0.1
+	// call orders are sorted by collateral ratio, own position must be
+	// among the least collateralized ones
+	callOrdersLimit = 300
+	// adjustment holds balance mutex of all markets, hung node call must
+	// not block them
+	collateralBroadcastTimeout = 30 * time.Second
+)
+
+// CollateralConfig enables management of call positions of the account
+type CollateralConfig struct {
+	// Seconds between checks
+	Interval  int              `json:"interval"`
+	Positions []PositionConfig `json:"positions"`
+}
+
+// PositionConfig keeps collateral ratio of a bitasset debt within
+// [MinRatio, MaxRatio]
+type PositionConfig struct {
+	Asset    string  `json:"asset"`
+	MinRatio float64 `json:"min_ratio"`
+	MaxRatio float64 `json:"max_ratio"`
+	// Ratio restored when position leaves the band, middle of the band by default
+	TargetRatio float64 `json:"target_ratio"`
+	// Markets of the asset are not quoted below this ratio,
+	// 10% above maintenance ratio of the feed by default
+	PauseRatio float64 `json:"pause_ratio"`
+}
+
+func (c *PositionConfig) target() float64 {
+	if c.TargetRatio > 0 {
+		return c.TargetRatio
+	}
+	return (c.MinRatio + c.MaxRatio) / 2
+}
+
+func (c *CollateralConfig) validate(errs *ValidationErrors) {
+	if c.Interval < 0 {
+		errs.Add("collateral.interval", "must not be negative", "omit it to use default")
+	}
+	if len(c.Positions) == 0 {
+		errs.Add("collateral.positions", "no positions configured", "")
+	}
+
+	seen := make(map[string]bool)
+	for i := range c.Positions {
+		p := &c.Positions[i]
+		field := func(name string) string {
+			return fmt.Sprintf("collateral.positions[%d].%s", i, name)
+		}
+
+		if p.Asset == "" {
+			errs.Add(field("asset"), "is empty", "set symbol of the bitasset")
+		} else if seen[p.Asset] {
+			errs.Add(field("asset"), fmt.Sprintf("%s is configured twice", p.Asset), "")
+		}
+		seen[p.Asset] = true
+
+		if p.MinRatio <= 1 || p.MaxRatio <= p.MinRatio {
+			errs.Add(field("min_ratio"), "must be above 1 and below max_ratio", "e.g. 2.0 and 3.0")
+			continue
+		}
+		if p.TargetRatio != 0 && (p.TargetRatio < p.MinRatio || p.TargetRatio > p.MaxRatio) {
+			errs.Add(field("target_ratio"), "must be between min_ratio and max_ratio", "omit it to use the middle")
+		}
+		if p.PauseRatio < 0 || p.PauseRatio >= p.MinRatio {
+			errs.Add(field("pause_ratio"), "must be below min_ratio", "omit it to pause near maintenance ratio")
+		}
+	}
+}
+
+// ValidateCollateral checks collateral configuration, assets are checked
+// if lookup is not nil
+func ValidateCollateral(cfg *CollateralConfig, assets AssetLookup) ValidationErrors {
+	var errs ValidationErrors
+	cfg.validate(&errs)
+
+	if assets != nil {
+		for i, p := range cfg.Positions {
+			if p.Asset == "" {
+				continue
+			}
+			field := fmt.Sprintf("collateral.positions[%d].asset", i)
+			if a := assets.GetBySymbol(p.Asset); a == nil {
+				errs.Add(field, fmt.Sprintf("asset %s not found", p.Asset), "")
+			} else if !a.BitassetDataID.Valid() {
+				errs.Add(field, fmt.Sprintf("%s is not a bitasset", p.Asset), "")
+			}
+		}
+	}
+	return errs
+}
+
+// PositionStatus is the last known state of a call position
+type PositionStatus struct {
+	Debt       float64   `json:"debt"`
+	Collateral float64   `json:"collateral"`
+	Ratio      float64   `json:"ratio"`
+	Paused     bool      `json:"paused"`
+	Checked    time.Time `json:"checked"`
+}
+
+var (
+	collateralMetricsOnce sync.Once
+	collateralMutex       sync.Mutex
+	collateralMetrics     = make(map[string]PositionStatus)
+)
+
+func publishCollateralMetrics() {
+	expvar.Publish("collateral", expvar.Func(func() interface{} {
+		collateralMutex.Lock()
+		defer collateralMutex.Unlock()
+
+		res := make(map[string]PositionStatus, len(collateralMetrics))
+		for k, v := range collateralMetrics {
+			res[k] = v
+		}
+		return res
+	}))
+}
+
+// CollateralAssets finds bitassets and their backing assets,
+// api.AssetCache implements it
+type CollateralAssets interface {
+	AssetLookup
+	GetByID(id objects.GrapheneObject) *objects.Asset
+}
+
+// CollateralManager adjusts call positions of the account with
+// call_order_update and tells market makers which bitassets must not be
+// quoted. Nil manager pauses nothing.
+type CollateralManager struct {
+	cfg          *CollateralConfig
+	account      string
+	rpc          api.BitsharesAPI
+	wallet       wallet.Wallet
+	log          *zap.SugaredLogger
+	balanceMutex *sync.Mutex
+	interval     time.Duration
+	feeAsset     objects.GrapheneID
+	feeReserve   decimal.Decimal
+
+	// Optional, set before Run
+	Journal  *journal.Journal
+	Notifier *notify.Notifier
+	// Optional, chain asset cache is used by default
+	Assets CollateralAssets
+
+	mutex  sync.Mutex
+	paused map[string]bool
+}
+
+func NewCollateralManager(
+	cfg *CollateralConfig,
+	account string,
+	feeReserve decimal.Decimal,
+	rpc api.BitsharesAPI,
+	wallet wallet.Wallet,
+	logger *zap.SugaredLogger,
+	balanceMutex *sync.Mutex,
+) *CollateralManager {
+	interval := time.Duration(cfg.Interval) * time.Second
+	if cfg.Interval <= 0 {
+		interval = defaultCollateralInterval * time.Second
+	}
+
+	collateralMetricsOnce.Do(publishCollateralMetrics)
+	return &CollateralManager{
+		cfg:          cfg,
+		account:      account,
+		rpc:          rpc,
+		wallet:       wallet,
+		log:          logger.With("collateral", account),
+		balanceMutex: balanceMutex,
+		interval:     interval,
+		feeAsset:     *objects.NewGrapheneID("1.3.0"),
+		feeReserve:   feeReserve,
+		paused:       make(map[string]bool),
+	}
+}
+
+// Paused tells if markets of the asset must not be quoted
+func (c *CollateralManager) Paused(symbol string) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.paused[symbol]
+}
+
+func (c *CollateralManager) setPaused(symbol string, paused bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.paused[symbol] = paused
+}
+
+// Run checks positions every interval until ctx is done. The first check
+// is after interval, call Check before starting markets.
+func (c *CollateralManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			c.Check()
+		}
+	}
+}
+
+// Check adjusts every position once. Quoting of an asset is paused when
+// its position can not be checked.
+func (c *CollateralManager) Check() {
+	db, err := c.rpc.DatabaseAPI()
+	if err == nil {
+		var account *objects.Account
+		if account, err = db.GetAccountByName(c.account); err == nil {
+			assets := c.Assets
+			if assets == nil {
+				assets = api.NewAssetCache(db)
+			}
+			for i := range c.cfg.Positions {
+				c.checkPosition(db, assets, account, &c.cfg.Positions[i])
+			}
+			return
+		}
+	}
+
+	c.log.Errorf("Failed to check collateral: %v", err)
+	for _, p := range c.cfg.Positions {
+		c.setPaused(p.Asset, true)
+	}
+}
+
+// position is a call order with its assets and feed
+type position struct {
+	debtAsset       *objects.Asset
+	collateralAsset *objects.Asset
+	// amounts in satoshi
+	debt       int64
+	collateral int64
+	// collateral asset per debt asset
+	feed float64
+	// maintenance collateral ratio of the feed
+	maintenance float64
+}
+
+func (p *position) ratio(debt, collateral int64) float64 {
+	if debt <= 0 {
+		return math.Inf(1)
+	}
+	debtValue := float64(debt) / math.Pow10(p.debtAsset.Precision) * p.feed
+	return float64(collateral) / math.Pow10(p.collateralAsset.Precision) / debtValue
+}
+
+// collateralFor returns collateral giving debt the ratio, in satoshi
+func (p *position) collateralFor(debt int64, ratio float64) int64 {
+	value := float64(debt) / math.Pow10(p.debtAsset.Precision) * p.feed * ratio
+	return int64(math.Ceil(value * math.Pow10(p.collateralAsset.Precision)))
+}
+
+// debtFor returns debt the collateral covers at the ratio, in satoshi
+func (p *position) debtFor(collateral int64, ratio float64) int64 {
+	value := float64(collateral) / math.Pow10(p.collateralAsset.Precision) / p.feed / ratio
+	return int64(math.Floor(value * math.Pow10(p.debtAsset.Precision)))
+}
+
+func (c *CollateralManager) loadPosition(db api.DatabaseAPI, assets CollateralAssets,
+	account *objects.Account, cfg *PositionConfig) (*position, error) {
+	asset := assets.GetBySymbol(cfg.Asset)
+	if asset == nil {
+		return nil, errors.NotFoundf("Asset %s", cfg.Asset)
+	}
+	if !asset.BitassetDataID.Valid() {
+		return nil, fmt.Errorf("%s is not a bitasset", cfg.Asset)
+	}
+
+	data, err := db.GetObjects(asset.BitassetDataID)
+	if err != nil {
+		return nil, errors.Annotate(err, "get bitasset data")
+	}
+	if len(data) == 0 {
+		return nil, errors.NotFoundf("Bitasset data of %s", cfg.Asset)
+	}
+	bitasset, ok := data[0].(objects.BitAssetData)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected bitasset data %T", data[0])
+	}
+
+	feed := bitasset.CurrentFeed
+	if !feed.SettlementPrice.Valid() {
+		return nil, fmt.Errorf("%s has no price feed", cfg.Asset)
+	}
+	backingID := feed.SettlementPrice.Quote.Asset
+	if backingID == asset.ID {
+		backingID = feed.SettlementPrice.Base.Asset
+	}
+	backing := assets.GetByID(backingID)
+	if backing == nil {
+		return nil, errors.NotFoundf("Asset %s", backingID)
+	}
+
+	market := Market{Base: *asset, Quote: *backing}
+	p := &position{
+		debtAsset:       asset,
+		collateralAsset: backing,
+		feed:            market.GetRate(feed.SettlementPrice).Value(),
+		maintenance:     float64(feed.MaintenanceCollateralRatio) / 1000,
+	}
+
+	orders, err := db.GetCallOrders(asset.ID, callOrdersLimit)
+	if err != nil {
+		return nil, errors.Annotate(err, "get call orders")
+	}
+	for _, o := range orders {
+		if o.Borrower == account.ID {
+			p.debt, p.collateral = int64(o.Debt), int64(o.Collateral)
+			return p, nil
+		}
+	}
+	if len(orders) == callOrdersLimit {
+		c.log.Warnf("No position of %s among %d least collateralized ones", cfg.Asset, callOrdersLimit)
+	}
+	return p, nil
+}
+
+func (c *CollateralManager) checkPosition(db api.DatabaseAPI, assets CollateralAssets,
+	account *objects.Account, cfg *PositionConfig) {
+	p, err := c.loadPosition(db, assets, account, cfg)
+	if err != nil {
+		c.log.Errorf("Failed to load position of %s: %v", cfg.Asset, err)
+		c.setPaused(cfg.Asset, true)
+		return
+	}
+
+	ratio := p.ratio(p.debt, p.collateral)
+	if p.debt > 0 && (ratio < cfg.MinRatio || ratio > cfg.MaxRatio) {
+		if debt, collateral, err := c.adjust(db, account, p, cfg); err != nil {
+			c.log.Errorf("Failed to adjust position of %s: %v", cfg.Asset, err)
+			c.notify(notify.EventCollateralLow, notify.SeverityWarning, cfg.Asset,
+				fmt.Sprintf("collateral ratio %.3f is out of [%.3f, %.3f]: %v", ratio, cfg.MinRatio, cfg.MaxRatio, err))
+		} else {
+			p.debt, p.collateral = debt, collateral
+			ratio = p.ratio(debt, collateral)
+		}
+	}
+
+	pauseRatio := cfg.PauseRatio
+	if pauseRatio == 0 {
+		pauseRatio = p.maintenance * (1 + defaultPauseMargin)
+	}
+	paused := ratio < pauseRatio
+	if paused != c.Paused(cfg.Asset) {
+		if paused {
+			c.log.Warnf("Collateral ratio of %s %.3f is below %.3f, quoting paused", cfg.Asset, ratio, pauseRatio)
+			c.notify(notify.EventMarginCall, notify.SeverityError, cfg.Asset,
+				fmt.Sprintf("collateral ratio %.3f is near margin call, quoting paused", ratio))
+		} else {
+			c.log.Infof("Collateral ratio of %s %.3f, quoting resumed", cfg.Asset, ratio)
+		}
+	}
+	c.setPaused(cfg.Asset, paused)
+
+	collateralMutex.Lock()
+	collateralMetrics[cfg.Asset] = PositionStatus{
+		Debt:       p.debtAsset.GetRate(objects.AssetAmount{Asset: p.debtAsset.ID, Amount: objects.Int64(p.debt)}),
+		Collateral: p.collateralAsset.GetRate(objects.AssetAmount{Asset: p.collateralAsset.ID, Amount: objects.Int64(p.collateral)}),
+		Ratio:      ratio,
+		Paused:     paused,
+		Checked:    time.Now().UTC(),
+	}
+	collateralMutex.Unlock()
+}
+
+// adjust moves position to the target ratio. Collateral is added from
+// balance first, debt is repaid when it is not enough. Returns new debt
+// and collateral.
+func (c *CollateralManager) adjust(db api.DatabaseAPI, account *objects.Account,
+	p *position, cfg *PositionConfig) (int64, int64, error) {
+	c.balanceMutex.Lock()
+	defer c.balanceMutex.Unlock()
+
+	balances, err := db.GetAccountBalances(account.ID, p.collateralAsset.ID, p.debtAsset.ID)
+	if err != nil {
+		return 0, 0, errors.Annotate(err, "get balances")
+	}
+	var collateralBalance, debtBalance int64
+	for _, b := range balances {
+		switch b.Asset {
+		case p.collateralAsset.ID:
+			collateralBalance = int64(b.Amount)
+		case p.debtAsset.ID:
+			debtBalance = int64(b.Amount)
+		}
+	}
+	if p.collateralAsset.ID == c.feeAsset {
+		collateralBalance -= c.feeReserve.Shift(int32(p.collateralAsset.Precision)).IntPart()
+	}
+
+	target := cfg.target()
+	deltaCollateral := p.collateralFor(p.debt, target) - p.collateral
+	var deltaDebt int64
+	if deltaCollateral > collateralBalance {
+		deltaCollateral = max64(collateralBalance, 0)
+		deltaDebt = -min64(p.debt-p.debtFor(p.collateral+deltaCollateral, target), debtBalance)
+	}
+	if deltaCollateral == 0 && deltaDebt == 0 {
+		return 0, 0, errors.New("no funds to add collateral or repay debt")
+	}
+
+	op := &objects.CallOrderUpdateOperation{
+		FundingAccount:  account.ID,
+		DeltaCollateral: objects.AssetAmount{Asset: p.collateralAsset.ID, Amount: objects.Int64(deltaCollateral)},
+		DeltaDebt:       objects.AssetAmount{Asset: p.debtAsset.ID, Amount: objects.Int64(deltaDebt)},
+		Extensions:      objects.Extensions{},
+	}
+	ratio := p.ratio(p.debt, p.collateral)
+	reason := fmt.Sprintf("collateral ratio %.3f, target %.3f", ratio, target)
+	c.log.Infof("Adjust position of %s: %s, collateral %+d, debt %+d", p.debtAsset.Symbol, reason, deltaCollateral, deltaDebt)
+
+	rec := journal.Record{Account: c.account, Asset: p.debtAsset.Symbol, Reason: reason}
+	if err := c.broadcast(rec, op); err != nil {
+		return 0, 0, errors.Annotate(err, "SignAndBroadcast")
+	}
+
+	// not all of the way to target if funds are short
+	if ratio := p.ratio(p.debt+deltaDebt, p.collateral+deltaCollateral); ratio < cfg.MinRatio {
+		c.notify(notify.EventCollateralLow, notify.SeverityWarning, p.debtAsset.Symbol,
+			fmt.Sprintf("collateral ratio %.3f is below %.3f, no funds left to restore it", ratio, cfg.MinRatio))
+	}
+	return p.debt + deltaDebt, p.collateral + deltaCollateral, nil
+}
+
+// broadcast gives up waiting for the node after collateralBroadcastTimeout.
+// The result is journaled as pending then and recorded again when known.
+func (c *CollateralManager) broadcast(rec journal.Record, op objects.Operation) error {
+	type broadcastResult struct {
+		txID string
+		err  error
+	}
+
+	result := make(chan broadcastResult, 1)
+	go func() {
+		txID, err := c.rpc.SignAndBroadcast(c.wallet.GetKeys(), &c.feeAsset, op)
+		result <- broadcastResult{txID, err}
+	}()
+
+	select {
+	case r := <-result:
+		c.record(rec, op, r.txID, r.err)
+		return r.err
+	case <-time.After(collateralBroadcastTimeout):
+		err := errors.Timeoutf("broadcast")
+		pending := rec
+		pending.Pending = true
+		c.record(pending, op, "", err)
+		go func() {
+			late := <-result
+			c.record(rec, op, late.txID, late.err)
+		}()
+		return err
+	}
+}
+
+// record writes broadcast result to journal
+func (c *CollateralManager) record(rec journal.Record, op objects.Operation, txID string, err error) {
+	if jErr := c.Journal.Record(rec, []objects.Operation{op}, txID, err); jErr != nil {
+		c.log.Errorf("Failed to write journal: %v", jErr)
+	}
+}
+
+func (c *CollateralManager) notify(eventType, severity, asset, message string) {
+	c.Notifier.Notify(notify.Event{
+		Type:     eventType,
+		Severity: severity,
+		Asset:    asset,
+		Message:  message,
+	})
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
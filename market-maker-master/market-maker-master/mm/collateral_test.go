@@ -0,0 +1,193 @@
+package mm_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/mmtest"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+// newCollateralChain has USD backed by OTN at 2 OTN per USD and a position
+// of 100 USD with 400 OTN collateral
+func newCollateralChain(balances map[string]float64) *mmtest.Chain {
+	chain := mmtest.NewChain()
+	chain.AddAsset("OTN", 8)
+	chain.AddAsset("BTC", 8)
+	chain.AddBitasset("USD", 4, "OTN", 2, 1.75)
+	chain.AddAccount("maker", balances)
+	chain.AddCallOrder("maker", "USD", "OTN", 100, 400)
+	return chain
+}
+
+func newCollateralManager(chain *mmtest.Chain, position mm.PositionConfig) *mm.CollateralManager {
+	cfg := &mm.CollateralConfig{Positions: []mm.PositionConfig{position}}
+	c := mm.NewCollateralManager(cfg, "maker", decimal.New(1, 0), chain, fakeWallet{}, zap.NewNop().Sugar(), &sync.Mutex{})
+	c.Assets = chain
+	return c
+}
+
+func lastCallUpdate(t *testing.T, chain *mmtest.Chain) *objects.CallOrderUpdateOperation {
+	require.NotEmpty(t, chain.Transactions)
+	ops := chain.Transactions[len(chain.Transactions)-1]
+	require.Len(t, ops, 1)
+	op, ok := ops[0].(*objects.CallOrderUpdateOperation)
+	require.True(t, ok, "%T", ops[0])
+	return op
+}
+
+func TestCollateralAdjust(t *testing.T) {
+	chain := newCollateralChain(map[string]float64{"OTN": 1000, "USD": 50})
+	c := newCollateralManager(chain, mm.PositionConfig{Asset: "USD", MinRatio: 2.5, MaxRatio: 3.5})
+
+	// ratio 2.0 is restored to 3.0 from balance
+	c.Check()
+	op := lastCallUpdate(t, chain)
+	assert.Equal(t, objects.Int64(200e8), op.DeltaCollateral.Amount)
+	assert.Equal(t, objects.Int64(0), op.DeltaDebt.Amount)
+	debt, collateral := chain.CallOrder("maker", "USD")
+	assert.Equal(t, objects.Int64(100e4), debt)
+	assert.Equal(t, objects.Int64(600e8), collateral)
+	assert.False(t, c.Paused("USD"))
+
+	// within the band nothing is done
+	c.Check()
+	assert.Len(t, chain.Transactions, 1)
+
+	// ratio 2.0 with 101 OTN, 1 is kept for fees, the rest is debt repaid
+	chain.SetFeed("USD", "OTN", 3)
+	chain.SetBalance("maker", "OTN", 101e8)
+	c.Check()
+	op = lastCallUpdate(t, chain)
+	assert.Equal(t, objects.Int64(100e8), op.DeltaCollateral.Amount)
+	assert.Equal(t, objects.Int64(-222223), op.DeltaDebt.Amount)
+	assert.Equal(t, objects.Int64(50e4-222223), chain.Balance("maker", "USD"))
+
+	// ratio above the band releases collateral
+	chain.SetFeed("USD", "OTN", 1)
+	c.Check()
+	op = lastCallUpdate(t, chain)
+	debt, collateral = chain.CallOrder("maker", "USD")
+	assert.True(t, op.DeltaCollateral.Amount < 0)
+	assert.InDelta(t, 3.0, float64(collateral)/1e8/(float64(debt)/1e4), 1e-6)
+}
+
+func TestCollateralPause(t *testing.T) {
+	chain := newCollateralChain(map[string]float64{"OTN": 10000, "BTC": 1})
+	c := newCollateralManager(chain, mm.PositionConfig{Asset: "USD", MinRatio: 2.5, MaxRatio: 3.5, PauseRatio: 2.2})
+	assert.False(t, (*mm.CollateralManager)(nil).Paused("USD"))
+
+	clock := mmtest.NewClock(time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC))
+	prices := &fakePrices{rates: map[string]float64{"USD/OTN": 2}}
+	market := scenarioMarket()
+	market.Base, market.Quote = "USD", "OTN"
+	cfg := &mm.Config{
+		Market:         market,
+		UpdateInterval: updateInterval,
+		Account:        "maker",
+		Clock:          clock,
+		Assets:         chain,
+		Collateral:     c,
+	}
+	maker := mm.NewMarketMaker(cfg, chain, fakeWallet{}, prices, zap.NewNop().Sugar(), &sync.Mutex{})
+	require.NoError(t, maker.Start())
+	s := &scenario{t: t, chain: chain, clock: clock, price: prices, maker: maker}
+	defer s.stop()
+
+	s.tick()
+	require.NotEmpty(t, chain.Orders())
+	txs := s.txCount()
+
+	// no funds to restore ratio 1.0, quoting is paused
+	chain.SetFeed("USD", "OTN", 4)
+	chain.SetBalance("maker", "OTN", 0)
+	c.Check()
+	assert.True(t, c.Paused("USD"))
+	assert.Equal(t, txs, s.txCount())
+
+	s.tick()
+	assert.Empty(t, chain.Orders())
+	assert.Equal(t, txs+1, s.txCount())
+
+	// orders are cancelled once while paused
+	s.tick()
+	assert.Equal(t, txs+1, s.txCount())
+
+	chain.SetFeed("USD", "OTN", 1)
+	chain.SetBalance("maker", "OTN", 10000e8)
+	c.Check()
+	assert.False(t, c.Paused("USD"))
+	s.tick()
+	assert.NotEmpty(t, chain.Orders())
+}
+
+func TestCollateralMarginCallNotified(t *testing.T) {
+	var mutex sync.Mutex
+	var events []notify.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		mutex.Lock()
+		events = append(events, e)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	notifier, err := notify.New(&notify.Config{Webhooks: []notify.WebhookConfig{
+		{URL: server.URL, MinSeverity: notify.SeverityError},
+	}}, "market-maker", zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	chain := newCollateralChain(map[string]float64{"OTN": 10000})
+	c := newCollateralManager(chain, mm.PositionConfig{Asset: "USD", MinRatio: 2.5, MaxRatio: 3.5, PauseRatio: 2.2})
+	c.Notifier = notifier
+
+	// failed adjustment does not hide the pause that follows it
+	chain.SetFeed("USD", "OTN", 4)
+	chain.BroadcastErr = fmt.Errorf("node is down")
+	c.Check()
+	notifier.Close()
+	require.True(t, c.Paused("USD"))
+
+	require.Len(t, events, 1)
+	assert.Equal(t, notify.EventMarginCall, events[0].Type)
+	assert.Equal(t, "USD", events[0].Asset)
+}
+
+func TestValidateCollateral(t *testing.T) {
+	chain := newCollateralChain(nil)
+
+	errs := mm.ValidateCollateral(&mm.CollateralConfig{Positions: []mm.PositionConfig{
+		{Asset: "USD", MinRatio: 2, MaxRatio: 3, TargetRatio: 2.5, PauseRatio: 1.9},
+	}}, chain)
+	assert.Empty(t, errs)
+
+	errs = mm.ValidateCollateral(&mm.CollateralConfig{Positions: []mm.PositionConfig{
+		{Asset: "BTC", MinRatio: 2, MaxRatio: 3},
+		{Asset: "USD", MinRatio: 3, MaxRatio: 2},
+		{Asset: "USD", MinRatio: 2, MaxRatio: 3, TargetRatio: 4, PauseRatio: 2},
+	}}, chain)
+	fields := make([]string, 0, len(errs))
+	for _, e := range errs {
+		fields = append(fields, e.Field)
+	}
+	assert.Equal(t, []string{
+		"collateral.positions[1].min_ratio",
+		"collateral.positions[2].asset",
+		"collateral.positions[2].target_ratio",
+		"collateral.positions[2].pause_ratio",
+		"collateral.positions[0].asset",
+	}, fields)
+}
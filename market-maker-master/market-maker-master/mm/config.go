@@ -9,4 +9,35 @@ type MarketConfig struct {
 	Amount     float64 `json:"amount"`
 	OrderCount int     `json:"orders"`
 	SpreadStep float64 `json:"spread_step"`
+	// Optional volume in a reference currency or as a share of balance,
+	// replaces amount
+	Sizing *SizingConfig `json:"sizing"`
+	// Optional randomization of order sizes, spreads, timing and levels
+	Randomize *RandomizeConfig `json:"randomize"`
+	// Optional taker orders bringing inventory back to target
+	Rebalance *RebalanceConfig `json:"rebalance"`
+	// Fixed price levels instead of the reference price ladder
+	Grid *GridConfig `json:"grid"`
+	// Works a parent order instead of making market
+	Execution *ExecutionConfig `json:"execution"`
+	// Optional profiles overriding ladder parameters by time of day and week
+	Schedule *ScheduleConfig `json:"schedule"`
+	// Optional balances operators are notified below
+	LowBalance *LowBalanceConfig `json:"low_balance"`
+}
+
+// LowBalanceConfig sets balances counting own open orders, in asset units,
+// zero is not checked
+type LowBalanceConfig struct {
+	Base  float64 `json:"base"`
+	Quote float64 `json:"quote"`
+}
+
+// DeadManConfig keeps order expiration short and refreshes orders on every
+// heartbeat, so orders of a dead process disappear from the book by themselves
+type DeadManConfig struct {
+	// Order expiration in seconds
+	Expiration int `json:"expiration"`
+	// Order refresh interval in seconds, must be less than Expiration
+	Heartbeat int `json:"heartbeat"`
 }
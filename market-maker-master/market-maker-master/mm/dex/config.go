@@ -0,0 +1,25 @@
+package dex
+
+const (
+	// SourceMid is the middle between best bid and best ask
+	SourceMid = "mid"
+	// SourceLast is the price of the last trade
+	SourceLast = "last"
+	// SourceVWAP is volume weighted average price of recent trades
+	SourceVWAP = "vwap"
+)
+
+type Config struct {
+	// Price source: mid, last or vwap
+	Source string `json:"source"`
+	// Market to take price from by quoted market, e.g. {"UIA/OTN": "BTC/OTN"}.
+	// Market is priced from its own book by default.
+	Markets map[string]string `json:"markets"`
+	// Minimum amount of base asset on each side of the book for mid,
+	// or traded within the window for vwap
+	MinDepth float64 `json:"min_depth"`
+	// Maximum age in seconds of the last trade for last and vwap
+	MaxAge int `json:"max_age"`
+	// VWAP window in seconds, max_age by default
+	Window int `json:"window"`
+}
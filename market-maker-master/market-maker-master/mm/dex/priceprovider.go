@@ -0,0 +1,222 @@
+package dex
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	DefaultMaxAge = time.Hour
+
+	orderBookLimit    = 50
+	tradeHistoryLimit = 100
+)
+
+type priceProviderFactory struct {
+	cfg    *Config
+	rpc    api.BitsharesAPI
+	log    *zap.SugaredLogger
+	maxAge time.Duration
+	window time.Duration
+}
+
+func NewFactory(cfg *Config, rpc api.BitsharesAPI, log *zap.SugaredLogger) (mm.PriceProviderFactory, error) {
+	switch cfg.Source {
+	case SourceMid, SourceLast, SourceVWAP:
+	default:
+		return nil, fmt.Errorf("Unknown DEX price source '%s', expected mid, last or vwap", cfg.Source)
+	}
+
+	maxAge := DefaultMaxAge
+	if cfg.MaxAge > 0 {
+		maxAge = time.Duration(cfg.MaxAge) * time.Second
+	}
+	window := maxAge
+	if cfg.Window > 0 {
+		window = time.Duration(cfg.Window) * time.Second
+	}
+
+	return &priceProviderFactory{
+		cfg:    cfg,
+		rpc:    rpc,
+		log:    log,
+		maxAge: maxAge,
+		window: window,
+	}, nil
+}
+
+// sourceMarket returns market price is taken from
+func (f *priceProviderFactory) sourceMarket(dbAPI api.DatabaseAPI, market *mm.Market) (*mm.Market, error) {
+	name, ok := f.cfg.Markets[market.DisplayName()]
+	if !ok {
+		return market, nil
+	}
+
+	parts := strings.Split(name, "/")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Invalid source market '%s', expected BASE/QUOTE", name)
+	}
+
+	assets := api.NewAssetCache(dbAPI)
+	base := assets.GetBySymbol(parts[0])
+	if base == nil {
+		return nil, fmt.Errorf("Unknown asset '%s'", parts[0])
+	}
+	quote := assets.GetBySymbol(parts[1])
+	if quote == nil {
+		return nil, fmt.Errorf("Unknown asset '%s'", parts[1])
+	}
+
+	return &mm.Market{Base: *base, Quote: *quote}, nil
+}
+
+// PriceProviderFactory interface
+func (f *priceProviderFactory) GetProvider(market *mm.Market) (mm.PriceProvider, error) {
+	dbAPI, err := f.rpc.DatabaseAPI()
+	if err != nil {
+		return nil, errors.Annotate(err, "get database API")
+	}
+
+	source, err := f.sourceMarket(dbAPI, market)
+	if err != nil {
+		return nil, err
+	}
+
+	return &priceProvider{
+		db:      dbAPI,
+		market:  market,
+		source:  source,
+		factory: f,
+		now:     time.Now,
+	}, nil
+}
+
+type priceProvider struct {
+	db      api.DatabaseAPI
+	market  *mm.Market
+	source  *mm.Market
+	factory *priceProviderFactory
+	now     func() time.Time
+}
+
+func (p *priceProvider) GetPrice() objects.Price {
+	var (
+		rate float64
+		err  error
+	)
+
+	switch p.factory.cfg.Source {
+	case SourceMid:
+		rate, err = p.mid()
+	case SourceLast:
+		rate, err = p.last()
+	case SourceVWAP:
+		rate, err = p.vwap()
+	}
+
+	if err != nil {
+		p.factory.log.Warnf("No DEX price for %s from %s: %v",
+			p.market.DisplayName(), p.source.DisplayName(), err)
+		return objects.Price{}
+	}
+
+	return p.market.PriceFromRate(rate)
+}
+
+// mid returns middle of the best bid and ask, both sides of the book
+// must be at least min_depth deep
+func (p *priceProvider) mid() (float64, error) {
+	orders, err := p.db.GetLimitOrders(p.source.Base.ID, p.source.Quote.ID, orderBookLimit)
+	if err != nil {
+		return 0, errors.Annotate(err, "get limit orders")
+	}
+
+	book := mm.NewOrderBook(orders, p.source, p.factory.log)
+	if len(book.Sell) == 0 || len(book.Buy) == 0 {
+		return 0, fmt.Errorf("one side of the book is empty")
+	}
+
+	baseScale := math.Pow10(p.source.Base.Precision)
+	quoteScale := math.Pow10(p.source.Quote.Precision)
+
+	// rates are amount of quote per base
+	ask, askDepth := math.Inf(1), 0.0
+	for _, o := range book.Sell {
+		ask = math.Min(ask, p.source.GetRate(o.SellPrice).Value())
+		askDepth += float64(o.ForSale) / baseScale
+	}
+
+	bid, bidDepth := 0.0, 0.0
+	for _, o := range book.Buy {
+		rate := 1 / p.source.GetRate(o.SellPrice).Value()
+		bid = math.Max(bid, rate)
+		bidDepth += float64(o.ForSale) / quoteScale / rate
+	}
+
+	if min := p.factory.cfg.MinDepth; askDepth < min || bidDepth < min {
+		return 0, fmt.Errorf("book is too thin: bid depth %f, ask depth %f, required %f",
+			bidDepth, askDepth, min)
+	}
+
+	return (bid + ask) / 2, nil
+}
+
+// trades returns fills of the source market within the window, newest first
+func (p *priceProvider) trades(window time.Duration) (objects.MarketTrades, error) {
+	now := p.now()
+
+	// history is requested for inverted market, so that price is
+	// amount of our quote per our base
+	trades, err := p.db.GetTradeHistory(p.source.Quote.Symbol, p.source.Base.Symbol,
+		objects.NewTime(now), objects.NewTime(now.Add(-window)), tradeHistoryLimit)
+	if err != nil {
+		return nil, errors.Annotate(err, "get trade history")
+	}
+
+	if len(trades) == 0 {
+		return nil, fmt.Errorf("no trades in the last %s", window)
+	}
+	if age := now.Sub(trades[0].Date.Time); age > p.factory.maxAge {
+		return nil, fmt.Errorf("last trade is %s old", age.Truncate(time.Second))
+	}
+
+	return trades, nil
+}
+
+func (p *priceProvider) last() (float64, error) {
+	trades, err := p.trades(p.factory.maxAge)
+	if err != nil {
+		return 0, err
+	}
+	return trades[0].Price, nil
+}
+
+// vwap returns volume weighted average price of the window, at least
+// min_depth of base asset must be traded
+func (p *priceProvider) vwap() (float64, error) {
+	trades, err := p.trades(p.factory.window)
+	if err != nil {
+		return 0, err
+	}
+
+	var amount, value float64
+	for _, t := range trades {
+		amount += t.Amount
+		value += t.Amount * t.Price
+	}
+
+	if amount == 0 || amount < p.factory.cfg.MinDepth {
+		return 0, fmt.Errorf("traded volume %f is below %f", amount, p.factory.cfg.MinDepth)
+	}
+
+	return value / amount, nil
+}
@@ -0,0 +1,146 @@
+package dex
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+var (
+	idOTN = *objects.NewGrapheneID("1.3.0")
+	idBTC = *objects.NewGrapheneID("1.3.1")
+
+	assetOTN = objects.Asset{ID: idOTN, Symbol: "OTN", Precision: 8}
+	assetBTC = objects.Asset{ID: idBTC, Symbol: "BTC", Precision: 8}
+
+	marketOTNBTC = mm.Market{Base: assetOTN, Quote: assetBTC}
+
+	now = time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+)
+
+type fakeDB struct {
+	api.DatabaseAPI
+	orders objects.LimitOrders
+	trades objects.MarketTrades
+}
+
+func (db *fakeDB) GetLimitOrders(base, quote objects.GrapheneObject, limit int) (objects.LimitOrders, error) {
+	return db.orders, nil
+}
+
+func (db *fakeDB) GetTradeHistory(base, quote string, start, stop objects.Time, limit int) (objects.MarketTrades, error) {
+	var res objects.MarketTrades
+	for _, t := range db.trades {
+		if !t.Date.After(start.Time) && !t.Date.Before(stop.Time) {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
+
+// order selling amount of asset at rate of quote per base
+func sellOrder(amount float64, rate float64) objects.LimitOrder {
+	return objects.LimitOrder{
+		ForSale: objects.Int64(amount * 1e8),
+		SellPrice: objects.Price{
+			Base:  objects.AssetAmount{Asset: idOTN, Amount: objects.Int64(amount * 1e8)},
+			Quote: objects.AssetAmount{Asset: idBTC, Amount: objects.Int64(amount * rate * 1e8)},
+		},
+	}
+}
+
+func buyOrder(amount float64, rate float64) objects.LimitOrder {
+	return objects.LimitOrder{
+		ForSale: objects.Int64(amount * rate * 1e8),
+		SellPrice: objects.Price{
+			Base:  objects.AssetAmount{Asset: idBTC, Amount: objects.Int64(amount * rate * 1e8)},
+			Quote: objects.AssetAmount{Asset: idOTN, Amount: objects.Int64(amount * 1e8)},
+		},
+	}
+}
+
+func trade(age time.Duration, amount, price float64) objects.MarketTrade {
+	return objects.MarketTrade{
+		Date:   objects.NewTime(now.Add(-age)),
+		Amount: amount,
+		Price:  price,
+		Value:  amount * price,
+	}
+}
+
+func newTestProvider(t *testing.T, cfg *Config, db *fakeDB) *priceProvider {
+	f, err := NewFactory(cfg, nil, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	return &priceProvider{
+		db:      db,
+		market:  &marketOTNBTC,
+		source:  &marketOTNBTC,
+		factory: f.(*priceProviderFactory),
+		now:     func() time.Time { return now },
+	}
+}
+
+func rate(p objects.Price) float64 {
+	return marketOTNBTC.GetRate(p).Value()
+}
+
+func TestUnknownSource(t *testing.T) {
+	_, err := NewFactory(&Config{Source: "median"}, nil, zap.NewNop().Sugar())
+	assert.Error(t, err)
+}
+
+func TestMid(t *testing.T) {
+	db := &fakeDB{orders: objects.LimitOrders{
+		sellOrder(100, 0.0012),
+		sellOrder(100, 0.0011),
+		buyOrder(50, 0.0009),
+		buyOrder(100, 0.0008),
+	}}
+
+	p := newTestProvider(t, &Config{Source: SourceMid, MinDepth: 100}, db)
+	assert.InDelta(t, 0.001, rate(p.GetPrice()), 1e-9)
+
+	// bid side holds only 150 OTN
+	p = newTestProvider(t, &Config{Source: SourceMid, MinDepth: 160}, db)
+	assert.False(t, p.GetPrice().Valid())
+
+	db.orders = db.orders[:2]
+	p = newTestProvider(t, &Config{Source: SourceMid}, db)
+	assert.False(t, p.GetPrice().Valid())
+}
+
+func TestLast(t *testing.T) {
+	db := &fakeDB{trades: objects.MarketTrades{
+		trade(10*time.Minute, 5, 0.0011),
+		trade(20*time.Minute, 5, 0.0010),
+	}}
+
+	p := newTestProvider(t, &Config{Source: SourceLast, MaxAge: 3600}, db)
+	assert.InDelta(t, 0.0011, rate(p.GetPrice()), 1e-9)
+
+	p = newTestProvider(t, &Config{Source: SourceLast, MaxAge: 300}, db)
+	assert.False(t, p.GetPrice().Valid())
+}
+
+func TestVWAP(t *testing.T) {
+	db := &fakeDB{trades: objects.MarketTrades{
+		trade(1*time.Minute, 30, 0.0012),
+		trade(2*time.Minute, 10, 0.0008),
+		trade(2*time.Hour, 1000, 0.0100),
+	}}
+
+	p := newTestProvider(t, &Config{Source: SourceVWAP, MaxAge: 300, Window: 600, MinDepth: 40}, db)
+	assert.InDelta(t, 0.0011, rate(p.GetPrice()), 1e-9)
+
+	// not enough volume in the window
+	p = newTestProvider(t, &Config{Source: SourceVWAP, MaxAge: 300, Window: 600, MinDepth: 50}, db)
+	assert.False(t, p.GetPrice().Valid())
+}
@@ -0,0 +1,457 @@
+package mm
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	ScheduleTWAP = "twap"
+	ScheduleVWAP = "vwap"
+
+	SideSell = "sell"
+	SideBuy  = "buy"
+
+	executionTradeLimit = 100
+	executionTradePages = 10
+)
+
+// ExecutionConfig works a parent order instead of making market. Child
+// limit orders are sliced from it by schedule.
+type ExecutionConfig struct {
+	// sell or buy base asset
+	Side string `json:"side"`
+	// Parent order size in base asset units
+	Amount float64 `json:"amount"`
+	// twap spreads amount evenly over duration,
+	// vwap executes participation share of market volume
+	Schedule string `json:"schedule"`
+	// Duration of twap schedule in seconds
+	Duration int `json:"duration"`
+	// Share of market volume for vwap schedule, e.g. 0.1
+	Participation float64 `json:"participation"`
+	// Child order price is at most this fraction worse than reference price
+	MaxDeviation float64 `json:"max_deviation"`
+	// Never sell below or buy above this price, quote per base, zero disables
+	LimitPrice float64 `json:"limit_price"`
+	// Smallest child order in base asset units, 1% of amount by default
+	MinChild float64 `json:"min_child"`
+	// File keeping progress across restarts
+	State string `json:"state"`
+}
+
+// childOrder is the last placed child order
+type childOrder struct {
+	// Amount for sale, as seen on the book at the last check
+	Remaining objects.Int64 `json:"remaining"`
+	// Order price, quote per base
+	Rate       float64   `json:"rate"`
+	Expiration time.Time `json:"expiration"`
+}
+
+type executionState struct {
+	Started time.Time `json:"started"`
+	// Filled base asset amount
+	Executed float64 `json:"executed"`
+	// Quote asset amount received or paid at child prices
+	Value float64 `json:"value"`
+	// Base asset traded on the market since start, for vwap
+	Volume        float64     `json:"volume"`
+	VolumeChecked time.Time   `json:"volume_checked"`
+	Child         *childOrder `json:"child"`
+	Done          bool        `json:"done"`
+}
+
+// ExecutionProgress reports how much of the parent order is filled
+type ExecutionProgress struct {
+	Side     string    `json:"side"`
+	Amount   float64   `json:"amount"`
+	Executed float64   `json:"executed"`
+	Percent  float64   `json:"percent"`
+	Target   float64   `json:"target"`
+	AvgPrice float64   `json:"avg_price"`
+	Started  time.Time `json:"started"`
+	Done     bool      `json:"done"`
+}
+
+func (p *ExecutionProgress) String() string {
+	return fmt.Sprintf("%s %f of %f (%.2f%%), target %f, average price %f",
+		p.Side, p.Executed, p.Amount, p.Percent, p.Target, p.AvgPrice)
+}
+
+var (
+	executionMetricsOnce sync.Once
+	executionMutex       sync.Mutex
+	executionMetrics     = make(map[string]ExecutionProgress)
+)
+
+func publishExecutionMetrics() {
+	expvar.Publish("executions", expvar.Func(func() interface{} {
+		executionMutex.Lock()
+		defer executionMutex.Unlock()
+
+		res := make(map[string]ExecutionProgress, len(executionMetrics))
+		for k, v := range executionMetrics {
+			res[k] = v
+		}
+		return res
+	}))
+}
+
+// execution keeps parent order state, used by worker goroutine only
+type execution struct {
+	cfg   *ExecutionConfig
+	state *executionState
+}
+
+func newExecution(cfg *ExecutionConfig) *execution {
+	if cfg == nil {
+		return nil
+	}
+	executionMetricsOnce.Do(publishExecutionMetrics)
+	return &execution{cfg: cfg, state: &executionState{}}
+}
+
+func (e *execution) load() error {
+	s := &executionState{}
+	ok, err := loadState(e.cfg.State, s)
+	if err != nil {
+		return errors.Annotate(err, "load execution state")
+	}
+	if ok {
+		e.state = s
+	}
+	return nil
+}
+
+func (e *execution) save() error {
+	return errors.Annotate(saveState(e.cfg.State, e.state), "save execution state")
+}
+
+// target returns base amount which should be executed by now
+func (e *execution) target(now time.Time) float64 {
+	s := e.state
+	var target float64
+	switch e.cfg.Schedule {
+	case ScheduleVWAP:
+		target = e.cfg.Participation * s.Volume
+	default:
+		elapsed := now.Sub(s.Started).Seconds() / float64(e.cfg.Duration)
+		target = e.cfg.Amount * math.Max(elapsed, 0)
+	}
+	return math.Min(target, e.cfg.Amount)
+}
+
+func (e *execution) minChild() float64 {
+	if e.cfg.MinChild <= 0 {
+		return e.cfg.Amount / 100
+	}
+	return e.cfg.MinChild
+}
+
+// childRate returns child order price, reference rate worsened by
+// max deviation and limited by limit price
+func (e *execution) childRate(rate float64) float64 {
+	if e.cfg.Side == SideSell {
+		rate *= 1 - e.cfg.MaxDeviation
+		if rate < e.cfg.LimitPrice {
+			rate = e.cfg.LimitPrice
+		}
+	} else {
+		rate *= 1 + e.cfg.MaxDeviation
+		if e.cfg.LimitPrice > 0 && rate > e.cfg.LimitPrice {
+			rate = e.cfg.LimitPrice
+		}
+	}
+	return rate
+}
+
+// progress returns current progress, target is computed for now
+func (e *execution) progress(now time.Time) ExecutionProgress {
+	s := e.state
+	p := ExecutionProgress{
+		Side:     e.cfg.Side,
+		Amount:   e.cfg.Amount,
+		Executed: s.Executed,
+		Percent:  100 * s.Executed / e.cfg.Amount,
+		Started:  s.Started,
+		Done:     s.Done,
+	}
+	if !s.Started.IsZero() {
+		p.Target = e.target(now)
+	}
+	if s.Executed > 0 {
+		p.AvgPrice = s.Value / s.Executed
+	}
+	return p
+}
+
+// LoadExecutionProgress reads progress of the market execution from its
+// state file, nil is returned for markets without execution
+func LoadExecutionProgress(cfg *MarketConfig, now time.Time) (*ExecutionProgress, error) {
+	if cfg.Execution == nil {
+		return nil, nil
+	}
+
+	e := &execution{cfg: cfg.Execution, state: &executionState{}}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	p := e.progress(now)
+	return &p, nil
+}
+
+// soldAsset is the asset of child orders for sale
+func (m *MarketMaker) soldAsset() *objects.Asset {
+	if m.execution.cfg.Side == SideSell {
+		return &m.market.Base
+	}
+	return &m.market.Quote
+}
+
+// accountFills adds part of the child order which left the book since
+// the last check. remaining is amount for sale of own orders on the book.
+func (m *MarketMaker) accountFills(remaining objects.Int64, now time.Time) {
+	s := m.execution.state
+	child := s.Child
+	if child == nil {
+		return
+	}
+
+	filled := child.Remaining - remaining
+	if remaining == 0 && !child.Expiration.After(now) {
+		// expired, fills after the last check are unknown
+		filled = 0
+	}
+	if filled > 0 {
+		amount := m.soldAsset().GetRate(objects.AssetAmount{Asset: m.soldAsset().ID, Amount: filled})
+		if m.execution.cfg.Side == SideSell {
+			s.Executed += amount
+			s.Value += amount * child.Rate
+		} else {
+			s.Executed += amount / child.Rate
+			s.Value += amount
+		}
+	}
+
+	child.Remaining = remaining
+	if remaining == 0 {
+		s.Child = nil
+	}
+}
+
+// updateVolume adds market volume traded since the last check
+func (m *MarketMaker) updateVolume(now time.Time) error {
+	s := m.execution.state
+	dbAPI, err := m.rpc.DatabaseAPI()
+	if err != nil {
+		return err
+	}
+
+	since := s.VolumeChecked
+	if since.IsZero() {
+		since = s.Started
+	}
+
+	// newest trades come first, pages are requested until since is reached
+	start := now
+	for page := 0; page < executionTradePages; page++ {
+		trades, err := dbAPI.GetTradeHistory(m.market.Quote.Symbol, m.market.Base.Symbol,
+			objects.NewTime(start), objects.NewTime(since), executionTradeLimit)
+		if err != nil {
+			return errors.Annotate(err, "get trade history")
+		}
+		for _, t := range trades {
+			if t.Date.After(since) {
+				s.Volume += t.Amount
+			}
+		}
+		if len(trades) < executionTradeLimit {
+			break
+		}
+		start = trades[len(trades)-1].Date.Add(-time.Second)
+	}
+
+	s.VolumeChecked = now
+	return nil
+}
+
+// childOp creates child order of amount base asset at rate
+func (m *MarketMaker) childOp(amount, rate float64, expiration time.Time) *objects.LimitOrderCreateOperation {
+	op := &objects.LimitOrderCreateOperation{
+		Seller:       m.account.ID,
+		AmountToSell: m.market.Base.CreateAmount(amount),
+		MinToReceive: m.market.Quote.CreateAmount(amount * rate),
+		FillOrKill:   false,
+		Expiration:   objects.NewTime(expiration),
+		Extensions:   objects.Extensions{},
+	}
+	if m.execution.cfg.Side == SideBuy {
+		op.AmountToSell, op.MinToReceive = op.MinToReceive, op.AmountToSell
+	}
+	return op
+}
+
+// execute accounts fills of the child order and replaces it when the
+// schedule is ahead of it, price moved or it is about to expire
+func (m *MarketMaker) execute(ctx context.Context, t time.Time) {
+	e := m.execution
+	s := e.state
+	if s.Done {
+		return
+	}
+	if s.Started.IsZero() {
+		s.Started = t
+		s.VolumeChecked = t
+		m.log.Infof("Starting %s execution: %s %f %s", e.cfg.Schedule, e.cfg.Side, e.cfg.Amount, m.market.Base.Symbol)
+	}
+	defer func() {
+		p := e.progress(t)
+		executionMutex.Lock()
+		executionMetrics[m.market.DisplayName()] = p
+		executionMutex.Unlock()
+
+		if err := e.save(); err != nil {
+			m.log.Errorf("%v", err)
+		}
+	}()
+
+	orderBook, err := m.loadOrderBook()
+	if err != nil {
+		m.log.Errorf("Failed to load order book: %v", err)
+		return
+	}
+
+	remaining := objects.Int64(orderBook.SellAmount())
+	if e.cfg.Side == SideBuy {
+		remaining = objects.Int64(orderBook.BuyAmount())
+	}
+	executed := s.Executed
+	m.accountFills(remaining, t)
+	if s.Executed > executed {
+		p := e.progress(t)
+		m.log.Infof("Execution progress: %s", p.String())
+	}
+
+	left := e.cfg.Amount - s.Executed
+	if m.market.Base.CreateAmount(left).Amount <= orderAmountThreshold {
+		s.Done = true
+		p := e.progress(t)
+		m.log.Infof("Execution is complete: %s", p.String())
+		if err := m.CancelOrders(ctx, "execution complete"); err != nil {
+			m.log.Errorf("Failed to cancel orders: %v", err)
+		}
+		return
+	}
+
+	if e.cfg.Schedule == ScheduleVWAP {
+		if err := m.updateVolume(t); err != nil {
+			m.log.Errorf("Failed to update market volume: %v", err)
+		}
+	}
+
+	price := m.priceProvider.GetPrice()
+	rate := m.market.GetRate(price).Value()
+	if rate == 0 {
+		m.log.Error("Failed to get price")
+		if err := m.CancelOrders(ctx, "no price"); err != nil {
+			m.log.Errorf("Failed to cancel orders: %v", err)
+		}
+		return
+	}
+
+	childRate := e.childRate(rate)
+	behind := e.target(t) - s.Executed
+	minChild := e.minChild()
+	pending := 0.0
+	if s.Child != nil {
+		pending = m.soldAsset().GetRate(objects.AssetAmount{Asset: m.soldAsset().ID, Amount: s.Child.Remaining})
+		if e.cfg.Side == SideBuy {
+			pending /= s.Child.Rate
+		}
+	}
+
+	// keep the child if it still matches the schedule and the price
+	if s.Child != nil &&
+		behind-pending < minChild &&
+		math.Abs(childRate-s.Child.Rate)/s.Child.Rate < m.cfg.Market.Threshold &&
+		s.Child.Expiration.After(t.Add(m.refreshInterval)) {
+		return
+	}
+	if behind < minChild && s.Child == nil {
+		return
+	}
+
+	m.balanceMutex.Lock()
+	defer m.balanceMutex.Unlock()
+
+	if err := m.updateBalances(); err != nil {
+		m.log.Errorf("Failed to update balances: %v", err)
+		return
+	}
+
+	ops := m.createCancelOrders(orderBook)
+	expiration := t.Add(m.orderDuration)
+	var op *objects.LimitOrderCreateOperation
+	if behind >= minChild {
+		op = m.childOp(behind, childRate, expiration)
+
+		available := m.baseBalance.Amount
+		if e.cfg.Side == SideBuy {
+			available = m.quoteBalance.Amount
+		}
+		if op.AmountToSell.Amount > available+remaining {
+			m.log.Warnf("Insufficient balance for child order of %f %s", behind, m.market.Base.Symbol)
+			op = m.childOp(behind*float64(available+remaining)/float64(op.AmountToSell.Amount), childRate, expiration)
+		}
+		if op.AmountToSell.Amount > orderAmountThreshold && op.MinToReceive.Amount > orderAmountThreshold {
+			ops = append(ops, op)
+		} else {
+			op = nil
+		}
+	}
+	if len(ops) == 0 {
+		return
+	}
+
+	reason := fmt.Sprintf("%s execution", e.cfg.Schedule)
+	if err := m.broadcast(ctx, reason, ops...); err != nil {
+		m.log.Errorf("Failed to update child order: %v", err)
+		return
+	}
+
+	s.Child = nil
+	if op != nil {
+		s.Child = &childOrder{Remaining: op.AmountToSell.Amount, Rate: childRate, Expiration: expiration}
+	}
+}
+
+// stopExecution accounts child order fills before orders are cancelled
+// on shutdown, so that the cancelled child is not counted as filled
+func (m *MarketMaker) stopExecution() error {
+	if m.execution == nil || m.execution.state.Child == nil {
+		return nil
+	}
+
+	orderBook, err := m.loadOrderBook()
+	if err != nil {
+		return errors.Annotate(err, "loadOrderBook")
+	}
+
+	remaining := objects.Int64(orderBook.SellAmount())
+	if m.execution.cfg.Side == SideBuy {
+		remaining = objects.Int64(orderBook.BuyAmount())
+	}
+	now := m.clock.Now()
+	m.accountFills(remaining, now)
+	m.execution.state.Child = nil
+	return m.execution.save()
+}
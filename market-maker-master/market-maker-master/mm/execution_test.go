@@ -0,0 +1,125 @@
+package mm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func TestExecutionTarget(t *testing.T) {
+	start := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	e := newExecution(&ExecutionConfig{Side: SideSell, Amount: 1000, Schedule: ScheduleTWAP, Duration: 100})
+	e.state.Started = start
+
+	assert.Equal(t, 0.0, e.target(start.Add(-time.Second)))
+	assert.InDelta(t, 250, e.target(start.Add(25*time.Second)), 1e-9)
+	assert.Equal(t, 1000.0, e.target(start.Add(time.Hour)))
+	assert.Equal(t, 10.0, e.minChild())
+
+	e = newExecution(&ExecutionConfig{Side: SideBuy, Amount: 1000, Schedule: ScheduleVWAP, Participation: 0.1})
+	e.state.Volume = 5000
+	assert.InDelta(t, 500, e.target(start), 1e-9)
+	e.state.Volume = 50000
+	assert.Equal(t, 1000.0, e.target(start))
+}
+
+func TestExecutionChildRate(t *testing.T) {
+	sell := newExecution(&ExecutionConfig{Side: SideSell, MaxDeviation: 0.01, LimitPrice: 0.0001})
+	assert.InDelta(t, 0.0001188, sell.childRate(0.00012), 1e-12)
+	assert.Equal(t, 0.0001, sell.childRate(0.0001))
+
+	buy := newExecution(&ExecutionConfig{Side: SideBuy, MaxDeviation: 0.01, LimitPrice: 0.0001})
+	assert.InDelta(t, 0.0000909, buy.childRate(0.00009), 1e-12)
+	assert.Equal(t, 0.0001, buy.childRate(0.0001))
+
+	buy.cfg.LimitPrice = 0
+	assert.InDelta(t, 0.000202, buy.childRate(0.0002), 1e-12)
+}
+
+func TestExecutionFills(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &ExecutionConfig{Side: SideSell, Amount: 1000, Schedule: ScheduleTWAP, Duration: 100}
+	m := newTestMaker(MarketConfig{Execution: cfg})
+	s := m.execution.state
+
+	op := m.childOp(300, 0.0001, now.Add(time.Minute))
+	assert.Equal(t, m.market.Base.ID, op.AmountToSell.Asset)
+	assert.Equal(t, objects.Int64(300e8), op.AmountToSell.Amount)
+	assert.Equal(t, objects.Int64(0.03e8), op.MinToReceive.Amount)
+	s.Child = &childOrder{Remaining: op.AmountToSell.Amount, Rate: 0.0001, Expiration: now.Add(time.Minute)}
+
+	// partial fill
+	m.accountFills(200e8, now)
+	assert.InDelta(t, 100, s.Executed, 1e-9)
+	assert.Equal(t, objects.Int64(200e8), s.Child.Remaining)
+
+	// the rest is filled
+	m.accountFills(0, now)
+	assert.InDelta(t, 300, s.Executed, 1e-9)
+	assert.Nil(t, s.Child)
+
+	// expired child is not a fill
+	s.Child = &childOrder{Remaining: 100e8, Rate: 0.0002, Expiration: now}
+	m.accountFills(0, now)
+	assert.InDelta(t, 300, s.Executed, 1e-9)
+
+	p := m.execution.progress(now)
+	assert.InDelta(t, 30, p.Percent, 1e-9)
+	assert.InDelta(t, 0.0001, p.AvgPrice, 1e-12)
+}
+
+func TestExecutionBuyFills(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	cfg := &ExecutionConfig{Side: SideBuy, Amount: 1000, Schedule: ScheduleTWAP, Duration: 100}
+	m := newTestMaker(MarketConfig{Execution: cfg})
+	s := m.execution.state
+
+	op := m.childOp(500, 0.0002, now.Add(time.Minute))
+	assert.Equal(t, m.market.Quote.ID, op.AmountToSell.Asset)
+	assert.Equal(t, objects.Int64(0.1e8), op.AmountToSell.Amount)
+	assert.Equal(t, objects.Int64(500e8), op.MinToReceive.Amount)
+	s.Child = &childOrder{Remaining: op.AmountToSell.Amount, Rate: 0.0002, Expiration: now.Add(time.Minute)}
+
+	m.accountFills(0.04e8, now)
+	assert.InDelta(t, 300, s.Executed, 1e-6)
+	assert.InDelta(t, 0.06, s.Value, 1e-12)
+}
+
+func TestExecutionProgressPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "execution")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	market := MarketConfig{Execution: &ExecutionConfig{
+		Side: SideSell, Amount: 1000, Schedule: ScheduleTWAP, Duration: 100,
+		State: filepath.Join(dir, "execution.json"),
+	}}
+
+	p, err := LoadExecutionProgress(&market, now)
+	require.NoError(t, err)
+	assert.True(t, p.Started.IsZero())
+
+	e := newExecution(market.Execution)
+	e.state.Started = now
+	e.state.Executed = 200
+	e.state.Value = 0.03
+	require.NoError(t, e.save())
+
+	p, err = LoadExecutionProgress(&market, now.Add(50*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 200.0, p.Executed)
+	assert.InDelta(t, 500, p.Target, 1e-9)
+	assert.InDelta(t, 0.00015, p.AvgPrice, 1e-12)
+
+	p, err = LoadExecutionProgress(&MarketConfig{}, now)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+}
@@ -0,0 +1,380 @@
+package mm
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	gridBuy  = "buy"
+	gridSell = "sell"
+
+	// order is matched to level if its price is within this part of the step
+	gridPriceTolerance = 0.25
+)
+
+// GridConfig places orders at fixed price levels instead of around
+// the reference price. Prices are amounts of quote per base.
+type GridConfig struct {
+	Low    float64 `json:"low"`
+	High   float64 `json:"high"`
+	Levels int     `json:"levels"`
+	// Levels are spaced by equal ratio instead of equal difference
+	Geometric bool `json:"geometric"`
+	// Order size in base asset units
+	Amount float64 `json:"amount"`
+	// Price used to place the initial grid, middle of the order book when zero
+	Start float64 `json:"start"`
+	// File keeping grid state across restarts
+	State string `json:"state"`
+}
+
+// prices returns level prices from low to high
+func (c *GridConfig) prices() []float64 {
+	res := make([]float64, c.Levels)
+	for i := range res {
+		x := float64(i) / float64(c.Levels-1)
+		if c.Geometric {
+			res[i] = c.Low * math.Pow(c.High/c.Low, x)
+		} else {
+			res[i] = c.Low + (c.High-c.Low)*x
+		}
+	}
+	return res
+}
+
+// gridLevel is an order which should be on the book at level price
+type gridLevel struct {
+	// buy, sell or empty for the level next to the last fill
+	Side string `json:"side"`
+	// Expiration of the placed order, zero if it was not placed
+	Expiration time.Time `json:"expiration"`
+}
+
+func (l *gridLevel) placed(now time.Time) bool {
+	return l.Side != "" && l.Expiration.After(now)
+}
+
+type gridState struct {
+	Prices []float64    `json:"prices"`
+	Levels []*gridLevel `json:"levels"`
+	Fills  int          `json:"fills"`
+}
+
+// newGridState puts buys below start price, sells above it and leaves
+// the level closest to start empty
+func newGridState(prices []float64, start float64) *gridState {
+	s := &gridState{Prices: prices, Levels: make([]*gridLevel, len(prices))}
+	gap := 0
+	for i, p := range prices {
+		if math.Abs(p-start) < math.Abs(prices[gap]-start) {
+			gap = i
+		}
+	}
+	for i := range prices {
+		l := &gridLevel{}
+		switch {
+		case i < gap:
+			l.Side = gridBuy
+		case i > gap:
+			l.Side = gridSell
+		}
+		s.Levels[i] = l
+	}
+	return s
+}
+
+func loadGridState(path string) (*gridState, error) {
+	s := &gridState{}
+	if ok, err := loadState(path, s); err != nil || !ok {
+		return nil, err
+	}
+	if len(s.Prices) != len(s.Levels) {
+		return nil, fmt.Errorf("Grid state %s is inconsistent", path)
+	}
+	return s, nil
+}
+
+// matches tells if state was created for the same levels
+func (s *gridState) matches(prices []float64) bool {
+	if len(s.Prices) != len(prices) {
+		return false
+	}
+	for i, p := range prices {
+		if math.Abs(s.Prices[i]-p) > p*1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+// level returns index of the level at rate, -1 if rate is between levels
+func (s *gridState) level(rate float64) int {
+	for i, p := range s.Prices {
+		step := 0.0
+		if i > 0 {
+			step = p - s.Prices[i-1]
+		} else if len(s.Prices) > 1 {
+			step = s.Prices[1] - p
+		}
+		if math.Abs(rate-p) <= step*gridPriceTolerance {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyFills flips placed orders missing from the book to the opposite side
+// one level away. open maps level index to side of its order on the book.
+// Returns number of fills.
+func (s *gridState) applyFills(open map[int]string, now time.Time) int {
+	var placed int
+	var buys, sells []int
+	for i, l := range s.Levels {
+		if !l.placed(now) {
+			continue
+		}
+		placed++
+		if open[i] == l.Side {
+			continue
+		}
+		if l.Side == gridBuy {
+			buys = append(buys, i)
+		} else {
+			sells = append(sells, i)
+		}
+	}
+
+	// price can not fill both sides at once, orders were cancelled
+	if len(buys) > 0 && len(sells) > 0 && len(buys)+len(sells) == placed {
+		for _, i := range append(buys, sells...) {
+			s.Levels[i].Expiration = time.Time{}
+		}
+		return 0
+	}
+
+	// buys are filled from the top, sells from the bottom
+	for j := len(buys) - 1; j >= 0; j-- {
+		s.flip(buys[j], buys[j]+1, gridSell)
+	}
+	for _, i := range sells {
+		s.flip(i, i-1, gridBuy)
+	}
+
+	fills := len(buys) + len(sells)
+	s.Fills += fills
+	return fills
+}
+
+func (s *gridState) flip(filled, next int, side string) {
+	s.Levels[filled].Side = ""
+	s.Levels[filled].Expiration = time.Time{}
+	if next >= 0 && next < len(s.Levels) && s.Levels[next].Side == "" {
+		s.Levels[next].Side = side
+		s.Levels[next].Expiration = time.Time{}
+	}
+}
+
+// grid keeps state of grid mode, used by worker goroutine only
+type grid struct {
+	cfg   *GridConfig
+	state *gridState
+}
+
+func newGrid(cfg *GridConfig) *grid {
+	if cfg == nil {
+		return nil
+	}
+	return &grid{cfg: cfg}
+}
+
+// load reads saved state, it must be removed when levels are reconfigured
+func (g *grid) load() error {
+	s, err := loadGridState(g.cfg.State)
+	if err != nil {
+		return errors.Annotate(err, "load grid state")
+	}
+	if s != nil && !s.matches(g.cfg.prices()) {
+		return fmt.Errorf("Grid state %s was saved for other levels, remove it to place a new grid", g.cfg.State)
+	}
+	g.state = s
+	return nil
+}
+
+func (g *grid) save() error {
+	if g.state == nil {
+		return nil
+	}
+	return errors.Annotate(saveState(g.cfg.State, g.state), "save grid state")
+}
+
+// reset marks all orders as not placed after they were cancelled
+func (g *grid) reset() error {
+	if g == nil || g.state == nil {
+		return nil
+	}
+	for _, l := range g.state.Levels {
+		l.Expiration = time.Time{}
+	}
+	return g.save()
+}
+
+// midPrice returns middle of the best bid and ask of the whole order book
+func (m *MarketMaker) midPrice() (float64, error) {
+	dbAPI, err := m.rpc.DatabaseAPI()
+	if err != nil {
+		return 0, err
+	}
+
+	orders, err := dbAPI.GetLimitOrders(m.market.Base.ID, m.market.Quote.ID, orderBookDepth)
+	if err != nil {
+		return 0, err
+	}
+
+	book := NewOrderBook(orders, &m.market, m.log)
+	var ask, bid float64
+	for _, o := range book.Sell {
+		if r := m.market.GetRate(o.SellPrice).Value(); ask == 0 || r < ask {
+			ask = r
+		}
+	}
+	for _, o := range book.Buy {
+		if r := 1 / m.market.GetRate(o.SellPrice).Value(); r > bid {
+			bid = r
+		}
+	}
+	if ask == 0 || bid == 0 {
+		return 0, fmt.Errorf("Order book has no bids or asks, set grid start price")
+	}
+	return (ask + bid) / 2, nil
+}
+
+// gridOrder creates order of the level
+func (m *MarketMaker) gridOrder(side string, rate float64, expiration time.Time) *objects.LimitOrderCreateOperation {
+	amount := m.cfg.Market.Grid.Amount
+	base := m.market.Base.CreateAmount(amount)
+	quote := m.market.Quote.CreateAmount(amount * rate)
+
+	op := &objects.LimitOrderCreateOperation{
+		Seller:       m.account.ID,
+		AmountToSell: base,
+		MinToReceive: quote,
+		FillOrKill:   false,
+		Expiration:   objects.NewTime(expiration),
+		Extensions:   objects.Extensions{},
+	}
+	if side == gridBuy {
+		op.AmountToSell, op.MinToReceive = quote, base
+	}
+	return op
+}
+
+// makeGrid places missing grid orders and re-creates the ones about to expire
+func (m *MarketMaker) makeGrid(ctx context.Context, t time.Time) {
+	g := m.grid
+	if g.state == nil {
+		start := g.cfg.Start
+		if start == 0 {
+			var err error
+			if start, err = m.midPrice(); err != nil {
+				m.log.Errorf("Failed to get grid start price: %v", err)
+				return
+			}
+		}
+		m.log.Infof("Placing grid of %d levels from %f to %f around %f",
+			g.cfg.Levels, g.cfg.Low, g.cfg.High, start)
+		g.state = newGridState(g.cfg.prices(), start)
+	}
+	s := g.state
+
+	orderBook, err := m.loadOrderBook()
+	if err != nil {
+		m.log.Errorf("Failed to load order book: %v", err)
+		return
+	}
+
+	// own orders at grid levels, other orders are cancelled
+	var cancelOps []objects.Operation
+	open := make(map[int]string)
+	refresh := make(map[int]bool)
+	for _, o := range orderBook.Orders() {
+		side, rate := gridSell, m.market.GetRate(o.SellPrice).Value()
+		if o.SellPrice.Base.Asset == m.market.Quote.ID {
+			side, rate = gridBuy, 1/rate
+		}
+
+		i := s.level(rate)
+		if i < 0 || open[i] != "" || s.Levels[i].Side != side {
+			cancelOps = append(cancelOps, objects.NewLimitOrderCancelOperation(o.ID, o.Seller))
+			continue
+		}
+		open[i] = side
+		s.Levels[i].Expiration = o.Expiration.Time
+		if o.Expiration.Before(t.Add(m.refreshInterval)) {
+			refresh[i] = true
+			cancelOps = append(cancelOps, objects.NewLimitOrderCancelOperation(o.ID, o.Seller))
+		}
+	}
+
+	if fills := s.applyFills(open, t); fills > 0 {
+		m.log.Infof("Grid orders filled: %d, total fills: %d", fills, s.Fills)
+	}
+
+	m.balanceMutex.Lock()
+	defer m.balanceMutex.Unlock()
+
+	if err := m.updateBalances(); err != nil {
+		m.log.Errorf("Failed to update balances: %v", err)
+		return
+	}
+	baseLeft, quoteLeft := m.baseBalance.Amount, m.quoteBalance.Amount
+
+	expiration := t.Add(m.orderDuration)
+	var createOps []objects.Operation
+	var created []int
+	for i, l := range s.Levels {
+		if l.Side == "" || (open[i] != "" && !refresh[i]) {
+			continue
+		}
+
+		op := m.gridOrder(l.Side, s.Prices[i], expiration)
+		left := &quoteLeft
+		if l.Side == gridSell {
+			left = &baseLeft
+		}
+		if refresh[i] {
+			// funds of the cancelled order are returned in the same transaction
+			*left += op.AmountToSell.Amount
+		}
+		if op.AmountToSell.Amount > *left {
+			m.log.Warnf("Insufficient balance for grid %s order at %f", l.Side, s.Prices[i])
+			l.Expiration = time.Time{}
+			continue
+		}
+		*left -= op.AmountToSell.Amount
+
+		createOps = append(createOps, op)
+		created = append(created, i)
+	}
+
+	ops := append(cancelOps, createOps...)
+	if len(ops) > 0 {
+		if err := m.broadcast(ctx, "grid", ops...); err != nil {
+			m.log.Errorf("Failed to update grid: %v", err)
+			created = nil
+		}
+	}
+	for _, i := range created {
+		s.Levels[i].Expiration = expiration
+	}
+
+	if err := g.save(); err != nil {
+		m.log.Errorf("%v", err)
+	}
+}
@@ -0,0 +1,139 @@
+package mm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func gridSides(s *gridState) []string {
+	res := make([]string, len(s.Levels))
+	for i, l := range s.Levels {
+		res[i] = l.Side
+	}
+	return res
+}
+
+func placeAll(s *gridState, expiration time.Time) map[int]string {
+	open := make(map[int]string)
+	for i, l := range s.Levels {
+		if l.Side != "" {
+			l.Expiration = expiration
+			open[i] = l.Side
+		}
+	}
+	return open
+}
+
+func TestGridPrices(t *testing.T) {
+	c := &GridConfig{Low: 1, High: 2, Levels: 5}
+	assert.Equal(t, []float64{1, 1.25, 1.5, 1.75, 2}, c.prices())
+
+	c = &GridConfig{Low: 1, High: 16, Levels: 5, Geometric: true}
+	prices := c.prices()
+	for i, p := range []float64{1, 2, 4, 8, 16} {
+		assert.InDelta(t, p, prices[i], 1e-9)
+	}
+}
+
+func TestGridState(t *testing.T) {
+	s := newGridState([]float64{1, 2, 3, 4, 5}, 3.2)
+	assert.Equal(t, []string{"buy", "buy", "", "sell", "sell"}, gridSides(s))
+
+	assert.Equal(t, 1, s.level(2.1))
+	assert.Equal(t, -1, s.level(2.5))
+	assert.Equal(t, 0, s.level(0.9))
+	assert.Equal(t, -1, s.level(6))
+}
+
+func TestGridFills(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	s := newGridState([]float64{1, 2, 3, 4, 5, 6}, 3)
+	open := placeAll(s, now.Add(time.Hour))
+	assert.Equal(t, 0, s.applyFills(open, now))
+
+	// price went down through two buys
+	delete(open, 1)
+	delete(open, 0)
+	assert.Equal(t, 2, s.applyFills(open, now))
+	assert.Equal(t, []string{"", "sell", "sell", "sell", "sell", "sell"}, gridSides(s))
+	assert.Equal(t, 2, s.Fills)
+
+	// new orders are placed, then price comes back up
+	open = placeAll(s, now.Add(time.Hour))
+	delete(open, 1)
+	assert.Equal(t, 1, s.applyFills(open, now))
+	assert.Equal(t, []string{"buy", "", "sell", "sell", "sell", "sell"}, gridSides(s))
+
+	// expired orders are not fills
+	open = placeAll(s, now.Add(time.Hour))
+	delete(open, 5)
+	assert.Equal(t, 0, s.applyFills(open, now.Add(2*time.Hour)))
+	assert.Equal(t, "sell", s.Levels[5].Side)
+}
+
+func TestGridCancelledOutside(t *testing.T) {
+	now := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	s := newGridState([]float64{1, 2, 3, 4, 5}, 3)
+	placeAll(s, now.Add(time.Hour))
+
+	// all orders gone at once
+	assert.Equal(t, 0, s.applyFills(map[int]string{}, now))
+	assert.Equal(t, []string{"buy", "buy", "", "sell", "sell"}, gridSides(s))
+	for _, l := range s.Levels {
+		assert.False(t, l.placed(now))
+	}
+}
+
+func TestGridStatePersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grid")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := &GridConfig{Low: 1, High: 5, Levels: 5, Amount: 10, State: filepath.Join(dir, "grid.json")}
+	g := newGrid(cfg)
+	require.NoError(t, g.load())
+	assert.Nil(t, g.state)
+
+	exp := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+	g.state = newGridState(cfg.prices(), 2)
+	g.state.Levels[0].Expiration = exp
+	g.state.Fills = 3
+	require.NoError(t, g.save())
+
+	g = newGrid(cfg)
+	require.NoError(t, g.load())
+	require.NotNil(t, g.state)
+	assert.Equal(t, []string{"buy", "", "sell", "sell", "sell"}, gridSides(g.state))
+	assert.True(t, exp.Equal(g.state.Levels[0].Expiration))
+	assert.Equal(t, 3, g.state.Fills)
+
+	require.NoError(t, g.reset())
+	require.NoError(t, g.load())
+	assert.True(t, g.state.Levels[0].Expiration.IsZero())
+
+	cfg.High = 6
+	assert.Error(t, newGrid(cfg).load())
+}
+
+func TestGridOrder(t *testing.T) {
+	m := newTestMaker(MarketConfig{Grid: &GridConfig{Amount: 100}})
+	exp := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	sell := m.gridOrder(gridSell, 0.0002, exp)
+	assert.Equal(t, m.market.Base.ID, sell.AmountToSell.Asset)
+	assert.Equal(t, objects.Int64(100e8), sell.AmountToSell.Amount)
+	assert.Equal(t, objects.Int64(0.02e8), sell.MinToReceive.Amount)
+
+	buy := m.gridOrder(gridBuy, 0.0001, exp)
+	assert.Equal(t, m.market.Quote.ID, buy.AmountToSell.Asset)
+	assert.Equal(t, objects.Int64(0.01e8), buy.AmountToSell.Amount)
+	assert.Equal(t, objects.Int64(100e8), buy.MinToReceive.Amount)
+}
@@ -1,6 +1,8 @@
 package mm
 
 import (
+	"context"
+	"fmt"
 	"math"
 	"math/big"
 	"sync"
@@ -9,6 +11,8 @@ import (
 	"github.com/juju/errors"
 	"github.com/shopspring/decimal"
 
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 	"github.com/opentradingnetworkfoundation/otn-go/api"
 	"github.com/opentradingnetworkfoundation/otn-go/objects"
 	"github.com/opentradingnetworkfoundation/otn-go/wallet"
@@ -20,88 +24,270 @@ type Config struct {
 	UpdateInterval time.Duration
 	Account        string
 	FeeReserve     decimal.Decimal
+	DeadMan        *DeadManConfig
+	Journal        *journal.Journal
+	Notifier       *notify.Notifier
+	// Optional, pauses quoting of bitassets near margin call
+	Collateral *CollateralManager
+	// Optional, real time is used by default
+	Clock Clock
+	// Optional, chain asset cache is used by default
+	Assets AssetLookup
 }
 
 const (
 	orderBookDepth       = 50
 	orderAmountThreshold = 10 // do not create orders with less than this amount
+	cancelPollInterval   = time.Second
+	// consecutive failed broadcasts operators are notified of
+	broadcastFailureLimit = 3
 )
 
 type MarketMaker struct {
 	rpc           api.BitsharesAPI
 	log           *zap.SugaredLogger
-	assetCache    *api.AssetCache
+	assetCache    AssetLookup
+	clock         Clock
 	cfg           *Config
 	balanceMutex  *sync.Mutex
 	feeAsset      objects.GrapheneID
 	wallet        wallet.Wallet
 	factory       PriceProviderFactory
 	market        Market
-	ticker        *time.Ticker
 	account       *objects.Account
 	baseBalance   objects.AssetAmount
 	quoteBalance  objects.AssetAmount
 	priceProvider PriceProvider
 	orderDuration time.Duration
+	// orders are re-created at least this often, even if price did not change
+	refreshInterval time.Duration
+	cancel          context.CancelFunc
+	done            chan struct{}
+	// used by worker goroutine only
+	rnd        *randomizer
+	rebalancer *rebalancer
+	grid       *grid
+	execution  *execution
+	sizer      *sizer
+	schedule   *schedule
+	// market config with profile in force applied
+	params MarketConfig
 
 	// Mutable
 	lastPrice        float64
 	lastMarketUpdate time.Time
+	failedBroadcasts int
+	// orders are cancelled because of a position near margin call
+	collateralPaused bool
 }
 
 func (m *MarketMaker) Market() *Market {
 	return &m.market
 }
 
-func (m *MarketMaker) worker() error {
+// marketName is the market as written in journal
+func (m *MarketMaker) marketName() string {
+	return m.cfg.Market.Base + "/" + m.cfg.Market.Quote
+}
+
+func (m *MarketMaker) worker(ctx context.Context) {
+	defer close(m.done)
+
 	// TODO: subscribe on market change (m.onMarketChange)
-	for t := range m.ticker.C {
-		m.makeMarket(t)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case t := <-m.clock.After(m.rnd.interval(m.cfg.UpdateInterval)):
+			m.makeMarket(ctx, t)
+		}
 	}
+}
 
-	return nil
+// broadcast signs and sends operations, giving up when ctx is done.
+// The transaction may still get into a block after that.
+// reason is recorded in journal together with operations.
+func (m *MarketMaker) broadcast(ctx context.Context, reason string, ops ...objects.Operation) error {
+	return m.broadcastRecord(ctx, journal.Record{Reason: reason}, ops...)
+}
+
+// broadcastRecord is broadcast with extra journal fields in rec
+func (m *MarketMaker) broadcastRecord(ctx context.Context, rec journal.Record, ops ...objects.Operation) error {
+	type broadcastResult struct {
+		txID string
+		err  error
+	}
+
+	result := make(chan broadcastResult, 1)
+	go func() {
+		txID, err := m.rpc.SignAndBroadcast(m.wallet.GetKeys(), &m.feeAsset, ops...)
+		result <- broadcastResult{txID, err}
+	}()
+
+	rec.Account = m.cfg.Account
+	rec.Market = m.marketName()
+
+	var r broadcastResult
+	select {
+	case r = <-result:
+		m.record(rec, ops, r.txID, r.err)
+	case <-ctx.Done():
+		r.err = ctx.Err()
+		// transaction may still be included, its result is recorded when known
+		pending := rec
+		pending.Pending = true
+		m.record(pending, ops, "", r.err)
+		go func() {
+			late := <-result
+			m.record(rec, ops, late.txID, late.err)
+		}()
+	}
+
+	if r.err == nil {
+		m.failedBroadcasts = 0
+	} else if m.failedBroadcasts++; m.failedBroadcasts >= broadcastFailureLimit {
+		m.notify(notify.EventBroadcastFailing, notify.SeverityError, "",
+			fmt.Sprintf("%d broadcasts failed in a row, last: %v", m.failedBroadcasts, r.err))
+	}
+
+	return r.err
 }
 
-func (m *MarketMaker) CancelOrders() error {
+// record writes broadcast result to journal
+func (m *MarketMaker) record(rec journal.Record, ops []objects.Operation, txID string, err error) {
+	if jErr := m.cfg.Journal.Record(rec, ops, txID, err); jErr != nil {
+		m.log.Errorf("Failed to write journal: %v", jErr)
+	}
+}
+
+// notify posts event of this market to webhooks
+func (m *MarketMaker) notify(eventType, severity, asset, message string) {
+	m.cfg.Notifier.Notify(notify.Event{
+		Type:     eventType,
+		Severity: severity,
+		Market:   m.marketName(),
+		Asset:    asset,
+		Message:  message,
+	})
+}
+
+// CancelOrders removes all orders of the account on this market
+func (m *MarketMaker) CancelOrders(ctx context.Context, reason string) error {
+	_, err := m.cancelOrders(ctx, reason)
+	return err
+}
+
+// cancelOrders returns number of orders it tried to cancel
+func (m *MarketMaker) cancelOrders(ctx context.Context, reason string) (int, error) {
 	orderBook, err := m.loadOrderBook()
 	if err != nil {
-		return errors.Annotate(err, "loadOrderBook")
+		return 0, errors.Annotate(err, "loadOrderBook")
 	}
 
 	orderBook.Log(&m.market)
 
 	cancelOps := m.createCancelOrders(orderBook)
 	if len(cancelOps) > 0 {
-		_, err = api.SignAndBroadcast(m.rpc, m.wallet.GetKeys(), m.feeAsset, cancelOps...)
-		if err != nil {
-			return errors.Annotate(err, "SignAndBroadcast")
+		if err := m.broadcast(ctx, reason, cancelOps...); err != nil {
+			return len(cancelOps), errors.Annotate(err, "SignAndBroadcast")
 		}
 	}
 
-	return nil
+	return len(cancelOps), nil
+}
+
+// cancelAndConfirm cancels orders until the account has none of them left
+// on the market
+func (m *MarketMaker) cancelAndConfirm(ctx context.Context) error {
+	for {
+		count, err := m.cancelOrders(ctx, "shutdown")
+		if err != nil {
+			m.log.Errorf("Failed to cancel orders: %v", err)
+		} else if count == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Annotatef(ctx.Err(), "orders are still open")
+		case <-m.clock.After(cancelPollInterval):
+		}
+	}
 }
 
-func (m *MarketMaker) makeMarket(t time.Time) {
+func (m *MarketMaker) makeMarket(ctx context.Context, t time.Time) {
+	// balances may be needed to save a position near margin call
+	for _, asset := range []string{m.cfg.Market.Base, m.cfg.Market.Quote} {
+		if m.cfg.Collateral.Paused(asset) {
+			if !m.collateralPaused {
+				m.log.Warnf("Position of %s is near margin call, quoting paused", asset)
+				if err := m.CancelOrders(ctx, "collateral"); err != nil {
+					m.log.Errorf("Failed to cancel orders: %v", err)
+				} else {
+					m.collateralPaused = true
+				}
+			}
+			m.lastPrice = 0
+			return
+		}
+	}
+	if m.collateralPaused {
+		m.log.Infof("Collateral is restored, quoting resumed")
+		m.collateralPaused = false
+	}
+
+	if m.grid != nil {
+		m.makeGrid(ctx, t)
+		return
+	}
+	if m.execution != nil {
+		m.execute(ctx, t)
+		return
+	}
+
 	price := m.priceProvider.GetPrice()
 	rate := m.market.GetRate(price).Value()
 
 	// if failed to get price, remove all active orders
 	if rate == 0 {
 		m.log.Error("Failed to get price")
-		m.CancelOrders()
+		m.notify(notify.EventProviderDown, notify.SeverityError, "", "no price, orders are cancelled")
+		if err := m.CancelOrders(ctx, "no price"); err != nil {
+			m.log.Errorf("Failed to cancel orders: %v", err)
+		}
 		return
 	}
 
 	m.log.Infof("Price: %f, inverse: %f", rate, 1/rate)
+	switched := m.updateProfile(t)
+
+	// orders are re-created on the next tick with rebalanced inventory
+	if m.rebalancer != nil && m.rebalance(ctx, rate, t) {
+		m.lastPrice = rate
+		m.lastMarketUpdate = time.Time{}
+		return
+	}
 	change := math.Abs(m.lastPrice-rate) / rate
 
 	// if price change is less than threshold and orders are not expired, skip update
-	// we use m.orderDuration/2 to give us some time to update market before orders will expire
-	if change < m.cfg.Market.Threshold && m.lastMarketUpdate.Add(m.orderDuration/2).After(time.Now()) {
+	// refreshInterval is less than m.orderDuration to give us some time to update market before orders will expire
+	if !switched && change < m.params.Threshold && m.lastMarketUpdate.Add(m.refreshInterval).After(t) {
 		m.log.Debug("Price change is within threshold, skipping update")
 		return
 	}
 
+	reason := "expiration refresh"
+	switch {
+	case m.lastPrice == 0:
+		reason = "initial orders"
+	case switched:
+		reason = "profile " + m.schedule.status.Active
+	case change >= m.params.Threshold:
+		reason = fmt.Sprintf("price moved %.2f%%", change*100)
+	case m.cfg.DeadMan != nil:
+		reason = "dead-man heartbeat"
+	}
+
 	orderBook, err := m.loadOrderBook()
 	if err != nil {
 		m.log.Errorf("Failed to load order book: %v", err)
@@ -114,6 +300,8 @@ func (m *MarketMaker) makeMarket(t time.Time) {
 	if err := m.updateBalances(); err != nil {
 		m.log.Errorf("Failed to update balances: %v", err)
 		// continue anyway
+	} else if m.cfg.Market.LowBalance != nil {
+		m.checkBalances(orderBook)
 	}
 
 	cancelOps := m.createCancelOrders(orderBook)
@@ -126,10 +314,10 @@ func (m *MarketMaker) makeMarket(t time.Time) {
 	ops := append(cancelOps, createOps...)
 
 	if len(ops) > 0 {
-		_, err = api.SignAndBroadcast(m.rpc, m.wallet.GetKeys(), m.feeAsset, ops...)
-
-		if err != nil {
+		if err := m.broadcast(ctx, reason, ops...); err != nil {
 			m.log.Errorf("Failed to update market: %v", err)
+			// retry on the next tick instead of waiting for refresh
+			return
 		}
 	}
 
@@ -144,18 +332,23 @@ func (m *MarketMaker) dumpOrders(orders objects.LimitOrders) {
 	}
 }
 
+// loadOrderBook returns own orders on this market. They are read from the
+// account, the market order book is depth limited and may not reach them.
 func (m *MarketMaker) loadOrderBook() (OrderBook, error) {
 	dbAPI, err := m.rpc.DatabaseAPI()
 	if err != nil {
 		return OrderBook{}, err
 	}
 
-	orders, err := dbAPI.GetLimitOrders(m.market.Base.ID, m.market.Quote.ID, orderBookDepth)
+	accounts, err := dbAPI.GetFullAccounts(m.account.ID)
 	if err != nil {
 		return OrderBook{}, err
 	}
+	if len(accounts) == 0 {
+		return OrderBook{}, fmt.Errorf("Account %s not found", m.account.ID)
+	}
 
-	return NewOrderBook(FilterBySeller(orders, m.account.ID), &m.market, m.log), nil
+	return NewOrderBook(FilterByMarket(accounts[0].LimitOrders, &m.market), &m.market, m.log), nil
 }
 
 func (m *MarketMaker) createCancelOrders(orderBook OrderBook) []objects.Operation {
@@ -182,7 +375,8 @@ func (m *MarketMaker) createOrders(price objects.Price, orderBook OrderBook) ([]
 		new(big.Float).SetUint64(uint64(price.Base.Amount)),
 		new(big.Float).SetUint64(uint64(price.Quote.Amount)))
 
-	orderCount := new(big.Float).SetInt64(int64(m.cfg.Market.OrderCount))
+	count := m.rnd.orderCount(m.params.OrderCount)
+	orderCount := new(big.Float).SetInt64(int64(count))
 
 	baseAvailable := new(big.Float).SetUint64(uint64(m.baseBalance.Amount) + orderBook.SellAmount())
 	quoteAvailable := new(big.Float).SetUint64(uint64(m.quoteBalance.Amount) + orderBook.BuyAmount())
@@ -197,8 +391,10 @@ func (m *MarketMaker) createOrders(price objects.Price, orderBook OrderBook) ([]
 	}
 
 	quoteAvailable.Mul(quoteAvailable, rate)
-	baseLimit := new(big.Float).SetUint64(uint64(m.market.Base.CreateAmount(m.cfg.Market.Amount).Amount))
-	quoteLimit := baseLimit
+	baseLimit, quoteLimit, err := m.orderVolume(baseAvailable, quoteAvailable)
+	if err != nil {
+		return nil, err
+	}
 
 	if baseLimit.Cmp(baseAvailable) > 0 {
 		baseLimit = baseAvailable
@@ -208,8 +404,13 @@ func (m *MarketMaker) createOrders(price objects.Price, orderBook OrderBook) ([]
 		quoteLimit = quoteAvailable
 	}
 
-	spread := m.cfg.Market.Spread
-	expiration := objects.NewTime(time.Now().Add(m.orderDuration))
+	spread := m.params.Spread
+	expiration := objects.NewTime(m.clock.Now().Add(m.orderDuration))
+
+	// market fees are taken from received amounts, prices are moved away
+	// so that spread is kept after fees
+	baseFee := big.NewFloat(1 - MarketFee(&m.market.Base))
+	quoteFee := big.NewFloat(1 - MarketFee(&m.market.Quote))
 
 	sellOrderVolume := new(big.Float).Quo(baseLimit, orderCount)
 	buyOrderVolume := new(big.Float).Quo(quoteLimit, orderCount)
@@ -222,13 +423,23 @@ func (m *MarketMaker) createOrders(price objects.Price, orderBook OrderBook) ([]
 
 	var ops []objects.Operation
 
-	for i := 0; i < m.cfg.Market.OrderCount; i++ {
-		spreadValue := big.NewFloat(1.0 + spread/2)
+	// randomized sizes keep total volume of each side
+	sellWeights := m.rnd.weights(count)
+	buyWeights := m.rnd.weights(count)
+	spreadUnit := m.cfg.Market.SpreadStep
+	if spreadUnit == 0 {
+		spreadUnit = m.params.Spread
+	}
+
+	for i := 0; i < count; i++ {
+		spreadValue := big.NewFloat(1.0 + (spread+m.rnd.spreadOffset(spreadUnit))/2)
 
 		{
-			sellAmount, _ := sellOrderVolume.Uint64()
-			recvAmountFloat := new(big.Float).Quo(sellOrderVolume, rate)
+			sellVolume := new(big.Float).Mul(sellOrderVolume, big.NewFloat(sellWeights[i]))
+			sellAmount, _ := sellVolume.Uint64()
+			recvAmountFloat := new(big.Float).Quo(sellVolume, rate)
 			recvAmountFloat.Mul(recvAmountFloat, spreadValue)
+			recvAmountFloat.Quo(recvAmountFloat, quoteFee)
 			recvAmount, _ := recvAmountFloat.Uint64()
 
 			if sellAmount > orderAmountThreshold && recvAmount > orderAmountThreshold {
@@ -253,10 +464,12 @@ func (m *MarketMaker) createOrders(price objects.Price, orderBook OrderBook) ([]
 		}
 
 		{
-			sellAmountFloat := new(big.Float).Quo(buyOrderVolume, rate)
+			buyVolume := new(big.Float).Mul(buyOrderVolume, big.NewFloat(buyWeights[i]))
+			sellAmountFloat := new(big.Float).Quo(buyVolume, rate)
 			sellAmountFloat.Quo(sellAmountFloat, spreadValue)
+			sellAmountFloat.Mul(sellAmountFloat, baseFee)
 			sellAmount, _ := sellAmountFloat.Uint64()
-			recvAmount, _ := buyOrderVolume.Uint64()
+			recvAmount, _ := buyVolume.Uint64()
 
 			if sellAmount > orderAmountThreshold && recvAmount > orderAmountThreshold {
 				buyOrder := &objects.LimitOrderCreateOperation{
@@ -302,6 +515,10 @@ func (m *MarketMaker) loadObjects() error {
 
 	m.account = acc
 
+	if m.assetCache == nil {
+		m.assetCache = api.NewAssetCache(dbAPI)
+	}
+
 	base := m.assetCache.GetBySymbol(m.cfg.Market.Base)
 	if base == nil {
 		return errors.NotFoundf("Asset %s", m.cfg.Market.Base)
@@ -345,31 +562,137 @@ func (m *MarketMaker) updateBalances() error {
 	return nil
 }
 
-func (m *MarketMaker) Start() error {
-	m.ticker = time.NewTicker(m.cfg.UpdateInterval)
+// checkBalances notifies when balance of an asset together with own orders
+// falls below configured level
+func (m *MarketMaker) checkBalances(orderBook OrderBook) {
+	low := m.cfg.Market.LowBalance
+	check := func(asset *objects.Asset, amount uint64, limit float64) {
+		total := asset.GetRate(objects.AssetAmount{Asset: asset.ID, Amount: objects.Int64(amount)})
+		if limit > 0 && total < limit {
+			m.notify(notify.EventLowBalance, notify.SeverityWarning, asset.Symbol,
+				fmt.Sprintf("%s balance %f is below %f", asset.Symbol, total, limit))
+		}
+	}
+
+	check(&m.market.Base, uint64(m.baseBalance.Amount)+orderBook.SellAmount(), low.Base)
+	check(&m.market.Quote, uint64(m.quoteBalance.Amount)+orderBook.BuyAmount(), low.Quote)
+}
+
+// Load reads account and market assets from the chain
+func (m *MarketMaker) Load() error {
+	return m.loadObjects()
+}
+
+// OpenOrders returns orders of the account on this market
+func (m *MarketMaker) OpenOrders() (OrderBook, error) {
+	return m.loadOrderBook()
+}
+
+// Balances returns current account balances of market assets
+func (m *MarketMaker) Balances() (base, quote objects.AssetAmount, err error) {
+	m.balanceMutex.Lock()
+	defer m.balanceMutex.Unlock()
+
+	if err = m.updateBalances(); err != nil {
+		return
+	}
+
+	return m.baseBalance, m.quoteBalance, nil
+}
 
+func (m *MarketMaker) Start() error {
 	if err := m.loadObjects(); err != nil {
 		return err
 	}
 
-	if err := m.updateBalances(); err != nil {
+	if err := m.market.Authorize(m.account); err != nil {
 		return err
 	}
 
-	pp, err := m.factory.GetProvider(&m.market)
-	if err != nil {
+	if err := m.updateBalances(); err != nil {
 		return err
 	}
-	m.priceProvider = pp
 
-	go m.worker()
+	if err := m.restoreRebalanceBudget(m.clock.Now()); err != nil {
+		m.log.Warnf("Failed to restore rebalance budget: %v", err)
+	}
+
+	if m.execution != nil {
+		if err := m.execution.load(); err != nil {
+			return err
+		}
+	}
+
+	// grid does not need price
+	if m.grid != nil {
+		if err := m.grid.load(); err != nil {
+			return err
+		}
+	} else {
+		pp, err := m.factory.GetProvider(&m.market)
+		if err != nil {
+			return err
+		}
+		m.priceProvider = pp
+
+		if m.sizer, err = m.newSizer(); err != nil {
+			return err
+		}
+		if m.schedule, err = newSchedule(m.cfg.Market.Schedule); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.done = make(chan struct{})
+
+	go m.worker(ctx)
 	return nil
 }
 
-func (m *MarketMaker) Stop() {
-	if m.ticker != nil {
-		m.ticker.Stop()
+// Stop stops quoting, cancels all open orders and waits until they are gone
+// from the order book. ctx limits the whole procedure.
+func (m *MarketMaker) Stop(ctx context.Context) error {
+	if m.cancel == nil {
+		return nil
+	}
+
+	m.cancel()
+	m.cancel = nil
+
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "wait for worker")
+	}
+
+	if err := m.stopExecution(); err != nil {
+		m.log.Errorf("Failed to save execution progress: %v", err)
 	}
+	if err := m.cancelAndConfirm(ctx); err != nil {
+		return err
+	}
+	return m.grid.reset()
+}
+
+// Pause stops quoting but leaves placed orders on the book, e.g. while
+// service switches to another API node. Orders expire on their own.
+func (m *MarketMaker) Pause(ctx context.Context) error {
+	if m.cancel == nil {
+		return nil
+	}
+
+	m.cancel()
+	m.cancel = nil
+
+	select {
+	case <-m.done:
+	case <-ctx.Done():
+		return errors.Annotate(ctx.Err(), "wait for worker")
+	}
+
+	return nil
 }
 
 func NewMarketMaker(
@@ -380,20 +703,34 @@ func NewMarketMaker(
 	logger *zap.SugaredLogger,
 	balanceMutex *sync.Mutex,
 ) *MarketMaker {
-	dbAPI, err := rpc.DatabaseAPI()
-	if err != nil {
-		logger.Fatalf("Unable to get database API")
+	clock := cfg.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+
+	orderDuration := time.Duration(cfg.Market.Expiration) * time.Second
+	refreshInterval := orderDuration / 2
+	if cfg.DeadMan != nil {
+		orderDuration = time.Duration(cfg.DeadMan.Expiration) * time.Second
+		refreshInterval = time.Duration(cfg.DeadMan.Heartbeat) * time.Second
 	}
 
 	return &MarketMaker{
-		rpc:           rpc,
-		log:           logger.With("base", cfg.Market.Base, "quote", cfg.Market.Quote),
-		assetCache:    api.NewAssetCache(dbAPI),
-		cfg:           cfg,
-		balanceMutex:  balanceMutex,
-		wallet:        wallet,
-		factory:       factory,
-		feeAsset:      *objects.NewGrapheneID("1.3.0"),
-		orderDuration: time.Duration(cfg.Market.Expiration) * time.Second,
+		rpc:             rpc,
+		log:             logger.With("base", cfg.Market.Base, "quote", cfg.Market.Quote),
+		assetCache:      cfg.Assets,
+		clock:           clock,
+		cfg:             cfg,
+		balanceMutex:    balanceMutex,
+		wallet:          wallet,
+		factory:         factory,
+		feeAsset:        *objects.NewGrapheneID("1.3.0"),
+		orderDuration:   orderDuration,
+		refreshInterval: refreshInterval,
+		rnd:             newRandomizer(cfg.Market.Randomize),
+		rebalancer:      newRebalancer(cfg.Market.Rebalance),
+		grid:            newGrid(cfg.Market.Grid),
+		execution:       newExecution(cfg.Market.Execution),
+		params:          cfg.Market,
 	}
 }
@@ -2,10 +2,18 @@ package mm
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/opentradingnetworkfoundation/otn-go/objects"
 )
 
+const (
+	// asset flag enabling market_fee_percent
+	chargeMarketFee = 0x01
+	// market_fee_percent of 100%
+	fullPercent = 10000
+)
+
 type Market struct {
 	Base  objects.Asset
 	Quote objects.Asset
@@ -41,3 +49,79 @@ func (m *Market) GetRate(price objects.Price) objects.Rate {
 
 	return objects.Rate(0)
 }
+
+// PriceFromRate converts amount of quote asset per one base asset to price
+func (m *Market) PriceFromRate(rate float64) objects.Price {
+	baseAmount := math.Pow10(m.Base.Precision)
+	quoteAmount := math.Round(rate * math.Pow10(m.Quote.Precision))
+
+	return objects.Price{
+		Base: objects.AssetAmount{
+			Asset:  m.Base.ID,
+			Amount: objects.Int64(baseAmount),
+		},
+		Quote: objects.AssetAmount{
+			Asset:  m.Quote.ID,
+			Amount: objects.Int64(quoteAmount),
+		},
+	}
+}
+
+// MarketFee returns fraction of received amount of the asset taken by
+// its issuer. max_market_fee cap is not applied, so the fee of large
+// orders may be overestimated.
+func MarketFee(asset *objects.Asset) float64 {
+	if asset.Options.Flags&chargeMarketFee == 0 {
+		return 0
+	}
+	return float64(asset.Options.MarketFeePercent) / fullPercent
+}
+
+// Authorize returns error if the chain would reject orders of account on
+// this market because of whitelist or blacklist rules of its assets
+func (m *Market) Authorize(account *objects.Account) error {
+	for _, pair := range [][2]*objects.Asset{{&m.Base, &m.Quote}, {&m.Quote, &m.Base}} {
+		sell, receive := pair[0], pair[1]
+		if err := authorizeAsset(account, sell); err != nil {
+			return err
+		}
+
+		if containsID(sell.Options.BlacklistMarkets, receive.ID) {
+			return fmt.Errorf("Issuer of %s blacklisted market with %s", sell.Symbol, receive.Symbol)
+		}
+		if len(sell.Options.WhitelistMarkets) > 0 && !containsID(sell.Options.WhitelistMarkets, receive.ID) {
+			return fmt.Errorf("Issuer of %s did not whitelist market with %s", sell.Symbol, receive.Symbol)
+		}
+	}
+	return nil
+}
+
+// authorizeAsset checks if account may hold the asset, like the chain does:
+// blacklisted by any authority is rejected, otherwise account must be
+// whitelisted by one of them if the asset has any
+func authorizeAsset(account *objects.Account, asset *objects.Asset) error {
+	for _, id := range account.BlacklistingAccounts {
+		if containsID(asset.Options.BlacklistAuthorities, id) {
+			return fmt.Errorf("Account %s is blacklisted by %s authority %s", account.Name, asset.Symbol, id)
+		}
+	}
+
+	if len(asset.Options.WhitelistAuthorities) == 0 {
+		return nil
+	}
+	for _, id := range account.WhitelistingAccounts {
+		if containsID(asset.Options.WhitelistAuthorities, id) {
+			return nil
+		}
+	}
+	return fmt.Errorf("Account %s is not whitelisted by any %s authority", account.Name, asset.Symbol)
+}
+
+func containsID(ids objects.GrapheneIDs, id objects.GrapheneID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,480 @@
+// Package mmtest has in-memory fakes of the chain API and clock for
+// market maker tests
+package mmtest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+	"github.com/opentradingnetworkfoundation/otn-go/wallet"
+)
+
+// Chain is an in-memory chain with accounts, balances and limit orders.
+// Orders are not matched, tests fill them with Fill, so fill-or-kill orders
+// fail the transaction. Methods of the API which are not implemented panic.
+type Chain struct {
+	api.BitsharesAPI
+
+	mutex    sync.Mutex
+	assets   map[string]*objects.Asset
+	accounts map[string]*objects.Account
+	balances map[string]map[string]objects.Int64
+	orders   []*objects.LimitOrder
+	nextID   int
+	// market history by BASE/QUOTE as requested from GetTradeHistory
+	trades map[string]objects.MarketTrades
+	// bitasset data by its id
+	bitassets map[string]*objects.BitAssetData
+	calls     []*objects.CallOrder
+
+	// BroadcastErr fails every transaction when set
+	BroadcastErr error
+	// Transactions lists operations of every broadcast transaction,
+	// including failed ones
+	Transactions [][]objects.Operation
+}
+
+func NewChain() *Chain {
+	return &Chain{
+		assets:    make(map[string]*objects.Asset),
+		accounts:  make(map[string]*objects.Account),
+		balances:  make(map[string]map[string]objects.Int64),
+		trades:    make(map[string]objects.MarketTrades),
+		bitassets: make(map[string]*objects.BitAssetData),
+	}
+}
+
+// AddAsset registers asset, its id is assigned if empty
+func (c *Chain) AddAsset(symbol string, precision int) *objects.Asset {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	a := &objects.Asset{
+		ID:        *objects.NewGrapheneID(objects.ObjectID(fmt.Sprintf("1.3.%d", len(c.assets)))),
+		Symbol:    symbol,
+		Precision: precision,
+	}
+	c.assets[symbol] = a
+	return a
+}
+
+// AddBitasset registers asset backed by another one. feed is amount of
+// backing asset per unit, maintenance is collateral ratio, e.g. 1.75.
+func (c *Chain) AddBitasset(symbol string, precision int, backing string, feed, maintenance float64) *objects.Asset {
+	a := c.AddAsset(symbol, precision)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	data := &objects.BitAssetData{
+		ID: *objects.NewGrapheneID(objects.ObjectID(fmt.Sprintf("2.4.%d", len(c.bitassets)))),
+	}
+	data.CurrentFeed.MaintenanceCollateralRatio = objects.UInt16(maintenance * 1000)
+	a.BitassetDataID = data.ID
+	c.bitassets[data.ID.String()] = data
+	c.setFeed(a, c.assets[backing], feed)
+	return a
+}
+
+// SetFeed changes settlement price of bitasset
+func (c *Chain) SetFeed(symbol, backing string, feed float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.setFeed(c.assets[symbol], c.assets[backing], feed)
+}
+
+func (c *Chain) setFeed(asset, backing *objects.Asset, feed float64) {
+	c.bitassets[asset.BitassetDataID.String()].CurrentFeed.SettlementPrice = objects.Price{
+		Base:  asset.CreateAmount(1),
+		Quote: backing.CreateAmount(feed),
+	}
+}
+
+// AddCallOrder opens debt position of account, amounts are in asset units
+func (c *Chain) AddCallOrder(account, symbol, backing string, debt, collateral float64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	asset, coll := c.assets[symbol], c.assets[backing]
+	c.calls = append(c.calls, &objects.CallOrder{
+		ID:         *objects.NewGrapheneID(objects.ObjectID(fmt.Sprintf("1.8.%d", len(c.calls)))),
+		Borrower:   c.accounts[account].ID,
+		Debt:       asset.CreateAmount(debt).Amount,
+		Collateral: coll.CreateAmount(collateral).Amount,
+		CallPrice:  objects.Price{Base: coll.CreateAmount(collateral), Quote: asset.CreateAmount(debt)},
+	})
+}
+
+// CallOrder returns debt position of account in satoshi
+func (c *Chain) CallOrder(account, symbol string) (debt, collateral objects.Int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if o := c.findCall(c.accounts[account].ID, c.assets[symbol].ID); o != nil {
+		return o.Debt, o.Collateral
+	}
+	return 0, 0
+}
+
+func (c *Chain) findCall(account, asset objects.GrapheneID) *objects.CallOrder {
+	for _, o := range c.calls {
+		if o.Borrower == account && o.CallPrice.Quote.Asset == asset {
+			return o
+		}
+	}
+	return nil
+}
+
+// AddAccount registers account with balances in asset units
+func (c *Chain) AddAccount(name string, balances map[string]float64) *objects.Account {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	acc := &objects.Account{
+		ID:   *objects.NewGrapheneID(objects.ObjectID(fmt.Sprintf("1.2.%d", 100+len(c.accounts)))),
+		Name: name,
+	}
+	c.accounts[name] = acc
+	c.balances[acc.ID.String()] = make(map[string]objects.Int64)
+	for symbol, amount := range balances {
+		a := c.assets[symbol]
+		c.balances[acc.ID.String()][a.ID.String()] = a.CreateAmount(amount).Amount
+	}
+	return acc
+}
+
+// GetBySymbol implements mm.AssetLookup
+func (c *Chain) GetBySymbol(symbol string) *objects.Asset {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.assets[symbol]
+}
+
+// GetByID implements mm.CollateralAssets
+func (c *Chain) GetByID(id objects.GrapheneObject) *objects.Asset {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, a := range c.assets {
+		if a.ID.Id() == id.Id() {
+			return a
+		}
+	}
+	return nil
+}
+
+// Balance returns account balance in satoshi
+func (c *Chain) Balance(account, symbol string) objects.Int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.balances[c.accounts[account].ID.String()][c.assets[symbol].ID.String()]
+}
+
+// SetBalance changes account balance, amount is in satoshi
+func (c *Chain) SetBalance(account, symbol string, amount objects.Int64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.balances[c.accounts[account].ID.String()][c.assets[symbol].ID.String()] = amount
+}
+
+// Orders returns copy of all open orders
+func (c *Chain) Orders() objects.LimitOrders {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	res := make(objects.LimitOrders, 0, len(c.orders))
+	for _, o := range c.orders {
+		res = append(res, *o)
+	}
+	return res
+}
+
+// Fill sells amount of the order at its price, filled order is removed
+func (c *Chain) Fill(id objects.GrapheneID, amount objects.Int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	i := c.find(id)
+	if i < 0 {
+		return fmt.Errorf("Order %s not found", id)
+	}
+	o := c.orders[i]
+	if amount > o.ForSale {
+		amount = o.ForSale
+	}
+
+	received := objects.Int64(float64(amount) * float64(o.SellPrice.Quote.Amount) / float64(o.SellPrice.Base.Amount))
+	c.balances[o.Seller.String()][o.SellPrice.Quote.Asset.String()] += received
+	o.ForSale -= amount
+	if o.ForSale == 0 {
+		c.orders = append(c.orders[:i], c.orders[i+1:]...)
+	}
+	return nil
+}
+
+// Expire removes orders which expired by now and returns their funds
+func (c *Chain) Expire(now objects.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	orders := c.orders[:0]
+	for _, o := range c.orders {
+		if o.Expiration.After(now.Time) {
+			orders = append(orders, o)
+		} else {
+			c.balances[o.Seller.String()][o.SellPrice.Base.Asset.String()] += o.ForSale
+		}
+	}
+	c.orders = orders
+}
+
+func (c *Chain) find(id objects.GrapheneID) int {
+	for i, o := range c.orders {
+		if o.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddTrade adds trade to history of base/quote market, trades must be
+// added oldest first
+func (c *Chain) AddTrade(base, quote string, trade objects.MarketTrade) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := base + "/" + quote
+	c.trades[key] = append(c.trades[key], trade)
+}
+
+func (c *Chain) Connect() error {
+	return nil
+}
+
+func (c *Chain) Close() error {
+	return nil
+}
+
+func (c *Chain) DatabaseAPI() (api.DatabaseAPI, error) {
+	return &database{chain: c}, nil
+}
+
+// SignAndBroadcast applies operations all at once, like a transaction.
+// Only limit order create and cancel and call order update are supported.
+func (c *Chain) SignAndBroadcast(keys wallet.Keys, feeAsset objects.GrapheneObject, ops ...objects.Operation) (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.Transactions = append(c.Transactions, ops)
+	if c.BroadcastErr != nil {
+		return "", c.BroadcastErr
+	}
+
+	// apply to copies, so that failed transaction changes nothing
+	balances := make(map[string]map[string]objects.Int64, len(c.balances))
+	for acc, b := range c.balances {
+		balances[acc] = make(map[string]objects.Int64, len(b))
+		for asset, amount := range b {
+			balances[acc][asset] = amount
+		}
+	}
+	orders := append([]*objects.LimitOrder(nil), c.orders...)
+	nextID := c.nextID
+	calls := make(map[*objects.CallOrder]objects.CallOrder)
+
+	for _, op := range ops {
+		switch op := op.(type) {
+		case *objects.LimitOrderCreateOperation:
+			if op.FillOrKill {
+				return "", fmt.Errorf("Fill or kill order is not filled")
+			}
+			seller, asset := op.Seller.String(), op.AmountToSell.Asset.String()
+			if balances[seller][asset] < op.AmountToSell.Amount {
+				return "", fmt.Errorf("Insufficient balance of %s: %d < %d",
+					asset, balances[seller][asset], op.AmountToSell.Amount)
+			}
+			balances[seller][asset] -= op.AmountToSell.Amount
+			orders = append(orders, &objects.LimitOrder{
+				ID:         *objects.NewGrapheneID(objects.ObjectID(fmt.Sprintf("1.7.%d", nextID))),
+				Expiration: op.Expiration,
+				Seller:     op.Seller,
+				ForSale:    op.AmountToSell.Amount,
+				SellPrice:  objects.Price{Base: op.AmountToSell, Quote: op.MinToReceive},
+			})
+			nextID++
+
+		case *objects.LimitOrderCancelOperation:
+			found := false
+			for i, o := range orders {
+				if o.ID == op.Order {
+					balances[o.Seller.String()][o.SellPrice.Base.Asset.String()] += o.ForSale
+					orders = append(orders[:i:i], orders[i+1:]...)
+					found = true
+					break
+				}
+			}
+			if !found {
+				return "", fmt.Errorf("Limit order %s does not exist", op.Order)
+			}
+
+		case *objects.CallOrderUpdateOperation:
+			account := op.FundingAccount.String()
+			o := c.findCall(op.FundingAccount, op.DeltaDebt.Asset)
+			if o == nil {
+				return "", fmt.Errorf("Call order of %s does not exist", account)
+			}
+			next, ok := calls[o]
+			if !ok {
+				next = *o
+			}
+			collateral, debt := op.DeltaCollateral.Asset.String(), op.DeltaDebt.Asset.String()
+			// debt is repaid from balance, borrowed debt is received
+			if balances[account][collateral] < op.DeltaCollateral.Amount || balances[account][debt] < -op.DeltaDebt.Amount {
+				return "", fmt.Errorf("Insufficient balance for call order update")
+			}
+			if next.Collateral+op.DeltaCollateral.Amount < 0 || next.Debt+op.DeltaDebt.Amount < 0 {
+				return "", fmt.Errorf("Call order update exceeds position")
+			}
+			balances[account][collateral] -= op.DeltaCollateral.Amount
+			balances[account][debt] += op.DeltaDebt.Amount
+			next.Collateral += op.DeltaCollateral.Amount
+			next.Debt += op.DeltaDebt.Amount
+			calls[o] = next
+
+		default:
+			return "", fmt.Errorf("Operation %T is not supported", op)
+		}
+	}
+
+	for o, next := range calls {
+		*o = next
+	}
+	c.balances = balances
+	c.orders = orders
+	c.nextID = nextID
+	return fmt.Sprintf("tx%d", len(c.Transactions)), nil
+}
+
+type database struct {
+	api.DatabaseAPI
+	chain *Chain
+}
+
+func (d *database) GetAccountByName(name string) (*objects.Account, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	acc, ok := d.chain.accounts[name]
+	if !ok {
+		return nil, fmt.Errorf("Account %s not found", name)
+	}
+	return acc, nil
+}
+
+func (d *database) GetAccountBalances(account objects.GrapheneObject, assets ...objects.GrapheneObject) ([]objects.AssetAmount, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	balances, ok := d.chain.balances[string(account.Id())]
+	if !ok {
+		return nil, fmt.Errorf("Account %s not found", account.Id())
+	}
+
+	res := make([]objects.AssetAmount, 0, len(assets))
+	for _, a := range assets {
+		res = append(res, objects.AssetAmount{
+			Asset:  *objects.NewGrapheneID(a.Id()),
+			Amount: balances[string(a.Id())],
+		})
+	}
+	return res, nil
+}
+
+// GetFullAccounts returns accounts with all their limit orders
+func (d *database) GetFullAccounts(accounts ...objects.GrapheneObject) (objects.FullAccountInfos, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	var res objects.FullAccountInfos
+	for _, id := range accounts {
+		var info *objects.FullAccountInfo
+		for _, acc := range d.chain.accounts {
+			if acc.ID.Id() == id.Id() {
+				info = &objects.FullAccountInfo{Account: *acc}
+			}
+		}
+		if info == nil {
+			return nil, fmt.Errorf("Account %s not found", id.Id())
+		}
+		for _, o := range d.chain.orders {
+			if o.Seller.Id() == id.Id() {
+				info.LimitOrders = append(info.LimitOrders, *o)
+			}
+		}
+		res = append(res, *info)
+	}
+	return res, nil
+}
+
+func (d *database) GetLimitOrders(base, quote objects.GrapheneObject, limit int) (objects.LimitOrders, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	var res objects.LimitOrders
+	for _, o := range d.chain.orders {
+		sell, recv := o.SellPrice.Base.Asset.Id(), o.SellPrice.Quote.Asset.Id()
+		if (sell == base.Id() && recv == quote.Id()) || (sell == quote.Id() && recv == base.Id()) {
+			res = append(res, *o)
+		}
+	}
+	if len(res) > limit {
+		res = res[:limit]
+	}
+	return res, nil
+}
+
+func (d *database) GetObjects(ids ...objects.GrapheneObject) ([]interface{}, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	res := make([]interface{}, 0, len(ids))
+	for _, id := range ids {
+		data, ok := d.chain.bitassets[string(id.Id())]
+		if !ok {
+			return nil, fmt.Errorf("Object %s not found", id.Id())
+		}
+		res = append(res, *data)
+	}
+	return res, nil
+}
+
+func (d *database) GetCallOrders(asset objects.GrapheneObject, limit int) (objects.CallOrders, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	var res objects.CallOrders
+	for _, o := range d.chain.calls {
+		if o.CallPrice.Quote.Asset.Id() == asset.Id() && len(res) < limit {
+			res = append(res, *o)
+		}
+	}
+	return res, nil
+}
+
+// GetTradeHistory returns trades between stop and start, newest first
+func (d *database) GetTradeHistory(base, quote string, start, stop objects.Time, limit int) (objects.MarketTrades, error) {
+	d.chain.mutex.Lock()
+	defer d.chain.mutex.Unlock()
+
+	var res objects.MarketTrades
+	trades := d.chain.trades[base+"/"+quote]
+	for i := len(trades) - 1; i >= 0 && len(res) < limit; i-- {
+		t := trades[i]
+		if !t.Date.After(start.Time) && !t.Date.Before(stop.Time) {
+			res = append(res, t)
+		}
+	}
+	return res, nil
+}
@@ -48,6 +48,18 @@ func FilterByAsset(orders objects.LimitOrders, asset objects.GrapheneID) objects
 	return result
 }
 
+// FilterByMarket returns orders selling either asset of the market for the other one
+func FilterByMarket(orders objects.LimitOrders, market *Market) objects.LimitOrders {
+	var result objects.LimitOrders
+	for _, order := range orders {
+		sell, recv := order.SellPrice.Base.Asset, order.SellPrice.Quote.Asset
+		if (sell == market.Base.ID && recv == market.Quote.ID) || (sell == market.Quote.ID && recv == market.Base.ID) {
+			result = append(result, order)
+		}
+	}
+	return result
+}
+
 func FilterBySeller(orders objects.LimitOrders, seller objects.GrapheneID) objects.LimitOrders {
 	var result objects.LimitOrders
 	for _, order := range orders {
@@ -0,0 +1,462 @@
+package mm
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	defaultQualityInterval  = 60   // seconds
+	defaultQualityBand      = 0.02 // fraction of mid
+	defaultQualityRetention = 30   // days
+	qualityBookDepth        = 100
+	hourFormat              = "2006-01-02T15"
+
+	PeriodHour = "hour"
+	PeriodDay  = "day"
+)
+
+// QualityConfig enables sampling of own orders and the public book for
+// market quality reports
+type QualityConfig struct {
+	// Seconds between samples
+	Interval int `json:"interval"`
+	// Depth is counted within this fraction of mid price
+	Band float64 `json:"band"`
+	// Days hourly statistics are kept for
+	Retention int `json:"retention"`
+	// File keeping statistics across restarts
+	State string `json:"state"`
+}
+
+// qualityBucket sums samples of one market and hour
+type qualityBucket struct {
+	Samples int `json:"samples"`
+	// Samples with own orders on both sides
+	Up int `json:"up"`
+	// Sum of own spreads of up samples
+	Spread float64 `json:"spread"`
+	// Sums of base asset within the band
+	BidDepth     float64 `json:"bid_depth"`
+	AskDepth     float64 `json:"ask_depth"`
+	BookBidDepth float64 `json:"book_bid_depth"`
+	BookAskDepth float64 `json:"book_ask_depth"`
+}
+
+func (b *qualityBucket) add(o *qualityBucket) {
+	b.Samples += o.Samples
+	b.Up += o.Up
+	b.Spread += o.Spread
+	b.BidDepth += o.BidDepth
+	b.AskDepth += o.AskDepth
+	b.BookBidDepth += o.BookBidDepth
+	b.BookAskDepth += o.BookAskDepth
+}
+
+// QualityRow is market quality of one market and period
+type QualityRow struct {
+	Market string    `json:"market"`
+	Period string    `json:"period"`
+	Start  time.Time `json:"start"`
+	// Number of samples and share of the period they cover
+	Samples  int     `json:"samples"`
+	Coverage float64 `json:"coverage"`
+	// Share of samples with own orders on both sides
+	Uptime float64 `json:"uptime"`
+	// Average own spread while up, fraction of own mid
+	Spread float64 `json:"spread"`
+	// Average own and whole book base asset within the band around mid
+	BidDepth     float64 `json:"bid_depth"`
+	AskDepth     float64 `json:"ask_depth"`
+	BookBidDepth float64 `json:"book_bid_depth"`
+	BookAskDepth float64 `json:"book_ask_depth"`
+}
+
+var qualityColumns = []string{"market", "period", "start", "samples", "coverage", "uptime",
+	"spread", "bid_depth", "ask_depth", "book_bid_depth", "book_ask_depth"}
+
+func (r *QualityRow) record() []string {
+	f := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return []string{r.Market, r.Period, r.Start.Format(time.RFC3339), strconv.Itoa(r.Samples),
+		f(r.Coverage), f(r.Uptime), f(r.Spread), f(r.BidDepth), f(r.AskDepth), f(r.BookBidDepth), f(r.BookAskDepth)}
+}
+
+// WriteQualityCSV writes rows with a header line
+func WriteQualityCSV(w io.Writer, rows []QualityRow) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(qualityColumns); err != nil {
+		return err
+	}
+	for i := range rows {
+		if err := cw.Write(rows[i].record()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// QualityReporter samples markets and keeps hourly statistics, it is
+// served over HTTP as JSON (/quality) and CSV (/quality.csv)
+type QualityReporter struct {
+	cfg       *QualityConfig
+	log       *zap.SugaredLogger
+	interval  time.Duration
+	band      float64
+	retention time.Duration
+
+	mutex sync.Mutex
+	// market name to hour (hourFormat) to bucket
+	hours map[string]map[string]*qualityBucket
+}
+
+func NewQualityReporter(cfg *QualityConfig, log *zap.SugaredLogger) (*QualityReporter, error) {
+	q := &QualityReporter{
+		cfg:       cfg,
+		log:       log,
+		interval:  time.Duration(cfg.Interval) * time.Second,
+		band:      cfg.Band,
+		retention: time.Duration(cfg.Retention) * 24 * time.Hour,
+		hours:     make(map[string]map[string]*qualityBucket),
+	}
+	if cfg.Interval <= 0 {
+		q.interval = defaultQualityInterval * time.Second
+	}
+	if q.band <= 0 {
+		q.band = defaultQualityBand
+	}
+	if cfg.Retention <= 0 {
+		q.retention = defaultQualityRetention * 24 * time.Hour
+	}
+
+	if cfg.State != "" {
+		if _, err := loadState(cfg.State, &q.hours); err != nil {
+			return nil, errors.Annotate(err, "load quality state")
+		}
+	}
+	return q, nil
+}
+
+// LoadQualityReport reads statistics saved by the service
+func LoadQualityReport(cfg *QualityConfig) (*QualityReporter, error) {
+	if cfg.State == "" {
+		return nil, errors.New("Quality state file is not configured")
+	}
+	return NewQualityReporter(cfg, zap.NewNop().Sugar())
+}
+
+// Save writes statistics to the state file, if configured
+func (q *QualityReporter) Save() error {
+	if q.cfg.State == "" {
+		return nil
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return errors.Annotate(saveState(q.cfg.State, q.hours), "save quality state")
+}
+
+// Run samples markets every interval until ctx is done. Markets whose
+// assets or order book can not be loaded are sampled as down.
+func (q *QualityReporter) Run(ctx context.Context, rpc api.BitsharesAPI, account string, markets []MarketConfig) {
+	ticker := time.NewTicker(q.interval)
+	defer ticker.Stop()
+
+	var (
+		seller  *objects.Account
+		resolve = make(map[string]*Market)
+		saved   time.Time
+	)
+	for {
+		now := time.Now()
+		db, err := rpc.DatabaseAPI()
+		if err == nil && seller == nil {
+			if seller, err = db.GetAccountByName(account); err == nil && seller == nil {
+				err = errors.NotFoundf("Account %s", account)
+			}
+		}
+		if err != nil {
+			q.log.Errorf("Failed to sample market quality: %v", err)
+		}
+
+		var assets *api.AssetCache
+		if err == nil {
+			assets = api.NewAssetCache(db)
+		}
+		for _, cfg := range markets {
+			name := cfg.Base + "/" + cfg.Quote
+			if err != nil {
+				q.Sample(name, nil, objects.GrapheneID{}, nil, now)
+				continue
+			}
+
+			market := resolve[name]
+			if market == nil {
+				base, quote := assets.GetBySymbol(cfg.Base), assets.GetBySymbol(cfg.Quote)
+				if base != nil && quote != nil {
+					market = &Market{Base: *base, Quote: *quote}
+					resolve[name] = market
+				}
+			}
+
+			var orders objects.LimitOrders
+			if market != nil {
+				var bookErr error
+				if orders, bookErr = db.GetLimitOrders(market.Base.ID, market.Quote.ID, qualityBookDepth); bookErr != nil {
+					q.log.Warnf("Failed to load order book of %s: %v", name, bookErr)
+					q.Sample(name, nil, seller.ID, nil, now)
+					continue
+				}
+			}
+			q.Sample(name, market, seller.ID, orders, now)
+		}
+
+		// statistics are saved once an hour
+		if hour := now.Truncate(time.Hour); !hour.Equal(saved) {
+			if !saved.IsZero() {
+				if err := q.Save(); err != nil {
+					q.log.Errorf("%v", err)
+				}
+			}
+			saved = hour
+		}
+
+		select {
+		case <-ctx.Done():
+			if err := q.Save(); err != nil {
+				q.log.Errorf("%v", err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sample adds the book of the market at t to statistics. Nil market or
+// book without both sides counts as down.
+func (q *QualityReporter) Sample(name string, market *Market, seller objects.GrapheneID, orders objects.LimitOrders, t time.Time) {
+	s := &qualityBucket{Samples: 1}
+	if market != nil {
+		q.measure(s, market, seller, orders)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	hours := q.hours[name]
+	if hours == nil {
+		hours = make(map[string]*qualityBucket)
+		q.hours[name] = hours
+	}
+	hour := t.UTC().Format(hourFormat)
+	b := hours[hour]
+	if b == nil {
+		b = &qualityBucket{}
+		hours[hour] = b
+		q.expire(t)
+	}
+	b.add(s)
+}
+
+func (q *QualityReporter) measure(s *qualityBucket, market *Market, seller objects.GrapheneID, orders objects.LimitOrders) {
+	book := NewOrderBook(orders, market, q.log)
+	// rates are amount of quote per base
+	askRate := func(o objects.LimitOrder) float64 {
+		return market.GetRate(o.SellPrice).Value()
+	}
+	bidRate := func(o objects.LimitOrder) float64 {
+		return 1 / market.GetRate(o.SellPrice).Value()
+	}
+
+	ask, ownAsk := math.Inf(1), math.Inf(1)
+	for _, o := range book.Sell {
+		ask = math.Min(ask, askRate(o))
+		if o.Seller == seller {
+			ownAsk = math.Min(ownAsk, askRate(o))
+		}
+	}
+	bid, ownBid := 0.0, 0.0
+	for _, o := range book.Buy {
+		bid = math.Max(bid, bidRate(o))
+		if o.Seller == seller {
+			ownBid = math.Max(ownBid, bidRate(o))
+		}
+	}
+	if len(book.Sell) == 0 || len(book.Buy) == 0 {
+		return
+	}
+
+	if ownBid > 0 && !math.IsInf(ownAsk, 1) {
+		s.Up = 1
+		s.Spread = (ownAsk - ownBid) / ((ownAsk + ownBid) / 2)
+	}
+
+	mid := (ask + bid) / 2
+	low, high := mid*(1-q.band), mid*(1+q.band)
+	baseScale := math.Pow10(market.Base.Precision)
+	quoteScale := math.Pow10(market.Quote.Precision)
+	for _, o := range book.Sell {
+		if rate := askRate(o); rate <= high {
+			amount := float64(o.ForSale) / baseScale
+			s.BookAskDepth += amount
+			if o.Seller == seller {
+				s.AskDepth += amount
+			}
+		}
+	}
+	for _, o := range book.Buy {
+		if rate := bidRate(o); rate >= low {
+			amount := float64(o.ForSale) / quoteScale / rate
+			s.BookBidDepth += amount
+			if o.Seller == seller {
+				s.BidDepth += amount
+			}
+		}
+	}
+}
+
+// expire removes hours older than retention
+func (q *QualityReporter) expire(now time.Time) {
+	oldest := now.UTC().Add(-q.retention).Format(hourFormat)
+	for _, hours := range q.hours {
+		for hour := range hours {
+			if hour < oldest {
+				delete(hours, hour)
+			}
+		}
+	}
+}
+
+// Report returns statistics by hour or day, oldest first. Empty market
+// selects all of them, zero times are not checked.
+func (q *QualityReporter) Report(market, period string, since, until time.Time) ([]QualityRow, error) {
+	var length time.Duration
+	switch period {
+	case PeriodHour:
+		length = time.Hour
+	case PeriodDay:
+		length = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("Unknown period '%s', expected %s or %s", period, PeriodHour, PeriodDay)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	type key struct {
+		market string
+		start  time.Time
+	}
+	buckets := make(map[key]*qualityBucket)
+	for name, hours := range q.hours {
+		if market != "" && market != name {
+			continue
+		}
+		for hour, b := range hours {
+			t, err := time.Parse(hourFormat, hour)
+			if err != nil {
+				continue
+			}
+			k := key{name, t.Truncate(length)}
+			if buckets[k] == nil {
+				buckets[k] = &qualityBucket{}
+			}
+			buckets[k].add(b)
+		}
+	}
+
+	rows := []QualityRow{}
+	for k, b := range buckets {
+		if (!since.IsZero() && !k.start.Add(length).After(since)) || (!until.IsZero() && !k.start.Before(until)) {
+			continue
+		}
+		row := QualityRow{
+			Market:   k.market,
+			Period:   period,
+			Start:    k.start,
+			Samples:  b.Samples,
+			Coverage: math.Min(1, float64(b.Samples)*q.interval.Seconds()/length.Seconds()),
+		}
+		if b.Samples > 0 {
+			n := float64(b.Samples)
+			row.Uptime = float64(b.Up) / n
+			row.BidDepth, row.AskDepth = b.BidDepth/n, b.AskDepth/n
+			row.BookBidDepth, row.BookAskDepth = b.BookBidDepth/n, b.BookAskDepth/n
+		}
+		if b.Up > 0 {
+			row.Spread = b.Spread / float64(b.Up)
+		}
+		rows = append(rows, row)
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		if !rows[i].Start.Equal(rows[j].Start) {
+			return rows[i].Start.Before(rows[j].Start)
+		}
+		return rows[i].Market < rows[j].Market
+	})
+	return rows, nil
+}
+
+// ServeHTTP serves report as JSON, or as CSV if path ends with .csv.
+// Query parameters: market (e.g. OTN/BTC), period (hour or day, default
+// day), since and until (RFC3339).
+func (q *QualityReporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	period := params.Get("period")
+	if period == "" {
+		period = PeriodDay
+	}
+
+	var since, until time.Time
+	var err error
+	if s := params.Get("since"); s != "" {
+		if since, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid since: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := params.Get("until"); s != "" {
+		if until, err = time.Parse(time.RFC3339, s); err != nil {
+			http.Error(w, "Invalid until: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	rows, err := q.Report(params.Get("market"), period, since, until)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if len(r.URL.Path) > 4 && r.URL.Path[len(r.URL.Path)-4:] == ".csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="quality-%s.csv"`, period))
+		if err := WriteQualityCSV(w, rows); err != nil {
+			q.log.Errorf("Failed to write quality report: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(rows); err != nil {
+		q.log.Errorf("Failed to write quality report: %v", err)
+	}
+}
@@ -0,0 +1,177 @@
+package mm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm/mmtest"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func TestQualityReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quality")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	chain := mmtest.NewChain()
+	otn := chain.AddAsset("OTN", 8)
+	btc := chain.AddAsset("BTC", 8)
+	maker := chain.AddAccount("maker", map[string]float64{"OTN": 10000, "BTC": 1})
+	other := chain.AddAccount("other", map[string]float64{"OTN": 10000})
+	place := func(seller *objects.Account, sell, receive objects.AssetAmount) {
+		_, err := chain.SignAndBroadcast(nil, nil, &objects.LimitOrderCreateOperation{
+			Seller:       seller.ID,
+			AmountToSell: sell,
+			MinToReceive: receive,
+			Expiration:   objects.NewTime(time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)),
+		})
+		require.NoError(t, err)
+	}
+	// own ask at 0.0001 and bid at 0.000099, other asks at 0.000101
+	// and 0.00011, the last one is out of the band
+	place(maker, otn.CreateAmount(1000), btc.CreateAmount(0.1))
+	place(maker, btc.CreateAmount(0.099), otn.CreateAmount(1000))
+	place(other, otn.CreateAmount(500), btc.CreateAmount(0.0505))
+	place(other, otn.CreateAmount(1000), btc.CreateAmount(0.11))
+
+	cfg := &QualityConfig{Interval: 1800, State: filepath.Join(dir, "quality.json")}
+	q, err := NewQualityReporter(cfg, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	market := &Market{Base: *otn, Quote: *btc}
+	now := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	q.Sample("OTN/BTC", market, maker.ID, chain.Orders(), now)
+	// assets not found
+	q.Sample("OTN/BTC", nil, maker.ID, nil, now.Add(30*time.Minute))
+	q.Sample("OTN/BTC", market, maker.ID, chain.Orders(), now.Add(2*time.Hour))
+	// book without own orders
+	q.Sample("OTN/ETH", market, other.ID, chain.Orders(), now)
+
+	rows, err := q.Report("OTN/BTC", PeriodHour, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	r := rows[0]
+	assert.Equal(t, now, r.Start)
+	assert.Equal(t, 2, r.Samples)
+	assert.Equal(t, 1.0, r.Coverage)
+	assert.Equal(t, 0.5, r.Uptime)
+	assert.InDelta(t, 0.000001/0.0000995, r.Spread, 1e-9)
+	assert.InDelta(t, 500, r.BidDepth, 1e-6)
+	assert.InDelta(t, 500, r.AskDepth, 1e-6)
+	assert.InDelta(t, 500, r.BookBidDepth, 1e-6)
+	assert.InDelta(t, 750, r.BookAskDepth, 1e-6)
+
+	rows, err = q.Report("", PeriodDay, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, "OTN/BTC", rows[0].Market)
+	assert.Equal(t, 3, rows[0].Samples)
+	assert.InDelta(t, 2.0/3, rows[0].Uptime, 1e-9)
+	assert.InDelta(t, 3*1800.0/86400, rows[0].Coverage, 1e-9)
+	assert.Equal(t, "OTN/ETH", rows[1].Market)
+	assert.Equal(t, 0.0, rows[1].Uptime)
+	assert.InDelta(t, 1500, rows[1].BookAskDepth, 1e-6)
+
+	rows, err = q.Report("OTN/BTC", PeriodHour, now.Add(time.Hour), time.Time{})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, now.Add(2*time.Hour), rows[0].Start)
+
+	_, err = q.Report("", "week", time.Time{}, time.Time{})
+	assert.Error(t, err)
+
+	// statistics survive restart
+	require.NoError(t, q.Save())
+	q, err = LoadQualityReport(cfg)
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("GET", "/quality?period=hour&market=OTN/BTC", nil))
+	require.Equal(t, 200, w.Code)
+	var served []QualityRow
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &served))
+	assert.Len(t, served, 2)
+
+	w = httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("GET", "/quality.csv?market=OTN/ETH", nil))
+	require.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/csv", w.Header().Get("Content-Type"))
+	lines := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Equal(t, strings.Join(qualityColumns, ","), lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], "OTN/ETH,day,2018-06-01T00:00:00Z,1,"), lines[1])
+
+	w = httptest.NewRecorder()
+	q.ServeHTTP(w, httptest.NewRequest("GET", "/quality?since=yesterday", nil))
+	assert.Equal(t, 400, w.Code)
+}
+
+// noAccountChain finds no account and returns no error, like some nodes do
+type noAccountChain struct {
+	*mmtest.Chain
+}
+
+func (c noAccountChain) DatabaseAPI() (api.DatabaseAPI, error) {
+	db, err := c.Chain.DatabaseAPI()
+	return noAccountDB{db}, err
+}
+
+type noAccountDB struct {
+	api.DatabaseAPI
+}
+
+func (noAccountDB) GetAccountByName(name string) (*objects.Account, error) {
+	return nil, nil
+}
+
+func TestQualityRunSamplesDown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quality")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	q, err := NewQualityReporter(&QualityConfig{State: filepath.Join(dir, "quality.json")}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	// one round is sampled before cancellation is seen
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	q.Run(ctx, noAccountChain{mmtest.NewChain()}, "maker", []MarketConfig{{Base: "OTN", Quote: "BTC"}})
+
+	rows, err := q.Report("OTN/BTC", PeriodHour, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, rows, 1)
+	assert.Equal(t, 1, rows[0].Samples)
+	assert.Equal(t, 0.0, rows[0].Uptime)
+}
+
+func TestQualityRetention(t *testing.T) {
+	q, err := NewQualityReporter(&QualityConfig{Retention: 1}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	now := time.Date(2018, 6, 1, 10, 0, 0, 0, time.UTC)
+	q.Sample("OTN/BTC", nil, objects.GrapheneID{}, nil, now)
+	q.Sample("OTN/BTC", nil, objects.GrapheneID{}, nil, now.Add(23*time.Hour))
+	q.Sample("OTN/BTC", nil, objects.GrapheneID{}, nil, now.Add(25*time.Hour))
+
+	rows, err := q.Report("", PeriodHour, time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, rows, 2)
+	assert.Equal(t, now.Add(23*time.Hour), rows[0].Start)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteQualityCSV(&buf, rows))
+	assert.Equal(t, 3, strings.Count(buf.String(), "\n"))
+}
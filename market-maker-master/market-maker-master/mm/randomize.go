@@ -0,0 +1,92 @@
+package mm
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RandomizeConfig makes order ladder less regular. Zero value of every
+// field disables that kind of randomization.
+type RandomizeConfig struct {
+	// Seed of the random generator, current time is used when zero
+	Seed int64 `json:"seed"`
+	// Order size deviation, 0.3 gives sizes from 70% to 130% of average.
+	// Total volume still equals amount.
+	Size float64 `json:"size"`
+	// Extra spread of every level as a fraction of spread_step (or of
+	// spread if step is zero). Levels are only moved away from the price.
+	Spread float64 `json:"spread"`
+	// Update interval deviation, 0.2 gives intervals from 80% to 120%
+	Jitter float64 `json:"jitter"`
+	// Minimum number of levels, random count up to orders is used
+	MinOrders int `json:"min_orders"`
+}
+
+// randomizer varies order ladder. Nil randomizer keeps the ladder regular.
+type randomizer struct {
+	cfg *RandomizeConfig
+	rnd *rand.Rand
+}
+
+func newRandomizer(cfg *RandomizeConfig) *randomizer {
+	if cfg == nil {
+		return nil
+	}
+
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &randomizer{cfg: cfg, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// deviation returns uniform random value in [-max, max)
+func (r *randomizer) deviation(max float64) float64 {
+	return max * (2*r.rnd.Float64() - 1)
+}
+
+// orderCount returns number of levels between min_orders and max
+func (r *randomizer) orderCount(max int) int {
+	if r == nil || r.cfg.MinOrders <= 0 || r.cfg.MinOrders >= max {
+		return max
+	}
+	return r.cfg.MinOrders + r.rnd.Intn(max-r.cfg.MinOrders+1)
+}
+
+// weights returns n order size multipliers summing to n, so that
+// volume of the whole side stays the same
+func (r *randomizer) weights(n int) []float64 {
+	w := make([]float64, n)
+	if r == nil || r.cfg.Size <= 0 {
+		for i := range w {
+			w[i] = 1
+		}
+		return w
+	}
+
+	sum := 0.0
+	for i := range w {
+		w[i] = 1 + r.deviation(r.cfg.Size)
+		sum += w[i]
+	}
+	for i := range w {
+		w[i] *= float64(n) / sum
+	}
+	return w
+}
+
+// spreadOffset returns extra spread for a level
+func (r *randomizer) spreadOffset(unit float64) float64 {
+	if r == nil || r.cfg.Spread <= 0 {
+		return 0
+	}
+	return r.cfg.Spread * unit * r.rnd.Float64()
+}
+
+// interval returns update interval with jitter
+func (r *randomizer) interval(d time.Duration) time.Duration {
+	if r == nil || r.cfg.Jitter <= 0 {
+		return d
+	}
+	return time.Duration(float64(d) * (1 + r.deviation(r.cfg.Jitter)))
+}
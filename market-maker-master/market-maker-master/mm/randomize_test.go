@@ -0,0 +1,124 @@
+package mm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func TestRandomizerNil(t *testing.T) {
+	var r *randomizer
+	assert.Equal(t, 5, r.orderCount(5))
+	assert.Equal(t, []float64{1, 1, 1}, r.weights(3))
+	assert.Equal(t, 0.0, r.spreadOffset(0.01))
+	assert.Equal(t, 3*time.Second, r.interval(3*time.Second))
+}
+
+func TestRandomizerBounds(t *testing.T) {
+	r := newRandomizer(&RandomizeConfig{Seed: 42, Size: 0.3, Spread: 0.5, Jitter: 0.2, MinOrders: 2})
+
+	for i := 0; i < 100; i++ {
+		n := r.orderCount(5)
+		assert.True(t, n >= 2 && n <= 5, "order count %d", n)
+
+		sum := 0.0
+		for _, w := range r.weights(n) {
+			assert.True(t, w > 0)
+			sum += w
+		}
+		assert.InDelta(t, float64(n), sum, 1e-9)
+
+		offset := r.spreadOffset(0.01)
+		assert.True(t, offset >= 0 && offset < 0.005, "offset %f", offset)
+
+		d := r.interval(10 * time.Second)
+		assert.True(t, d >= 8*time.Second && d <= 12*time.Second, "interval %s", d)
+	}
+}
+
+func TestRandomizerSeed(t *testing.T) {
+	cfg := &RandomizeConfig{Seed: 7, Size: 0.3}
+	assert.Equal(t, newRandomizer(cfg).weights(4), newRandomizer(cfg).weights(4))
+}
+
+func newTestMaker(cfg MarketConfig) *MarketMaker {
+	otn := objects.Asset{ID: *objects.NewGrapheneID("1.3.0"), Symbol: "OTN", Precision: 8}
+	btc := objects.Asset{ID: *objects.NewGrapheneID("1.3.1"), Symbol: "BTC", Precision: 8}
+
+	return &MarketMaker{
+		cfg:          &Config{Market: cfg},
+		log:          zap.NewNop().Sugar(),
+		clock:        realClock{},
+		market:       Market{Base: otn, Quote: btc},
+		account:      &objects.Account{ID: *objects.NewGrapheneID("1.2.17")},
+		feeAsset:     otn.ID,
+		baseBalance:  otn.CreateAmount(10000),
+		quoteBalance: btc.CreateAmount(10),
+		rnd:          newRandomizer(cfg.Randomize),
+		rebalancer:   newRebalancer(cfg.Rebalance),
+		execution:    newExecution(cfg.Execution),
+		params:       cfg,
+	}
+}
+
+func TestCreateOrdersRandomized(t *testing.T) {
+	cfg := MarketConfig{
+		Spread:     0.02,
+		SpreadStep: 0.01,
+		Amount:     1000,
+		OrderCount: 5,
+		Expiration: 60,
+		Randomize:  &RandomizeConfig{Seed: 1, Size: 0.5, Spread: 0.5, MinOrders: 3},
+	}
+
+	m := newTestMaker(cfg)
+	price := m.market.PriceFromRate(0.0001)
+
+	for i := 0; i < 20; i++ {
+		ops, err := m.createOrders(price, OrderBook{})
+		require.NoError(t, err)
+
+		var sells, buys int
+		var sold uint64
+		sizes := make(map[objects.Int64]bool)
+		for _, op := range ops {
+			o := op.(*objects.LimitOrderCreateOperation)
+			if o.AmountToSell.Asset == m.market.Base.ID {
+				sells++
+				sold += uint64(o.AmountToSell.Amount)
+				sizes[o.AmountToSell.Amount] = true
+
+				// never tighter than configured spread
+				rate := float64(o.MinToReceive.Amount) / float64(o.AmountToSell.Amount)
+				assert.True(t, rate >= 0.0001*(1+cfg.Spread/2)*0.9999, "sell rate %g", rate)
+			} else {
+				buys++
+			}
+		}
+
+		assert.Equal(t, sells, buys)
+		assert.True(t, sells >= 3 && sells <= 5, "levels %d", sells)
+		assert.True(t, sold <= uint64(cfg.Amount*1e8), "sold %d", sold)
+		assert.True(t, sold >= uint64(cfg.Amount*1e8)-uint64(sells), "sold %d", sold)
+		assert.Len(t, sizes, sells, "sizes must differ")
+	}
+
+	// same seed gives the same ladder
+	amounts := func(ops []objects.Operation) (res []objects.Int64) {
+		for _, op := range ops {
+			o := op.(*objects.LimitOrderCreateOperation)
+			res = append(res, o.AmountToSell.Amount, o.MinToReceive.Amount)
+		}
+		return
+	}
+	first, err := newTestMaker(cfg).createOrders(price, OrderBook{})
+	require.NoError(t, err)
+	second, err := newTestMaker(cfg).createOrders(price, OrderBook{})
+	require.NoError(t, err)
+	assert.Equal(t, amounts(first), amounts(second))
+}
@@ -0,0 +1,219 @@
+package mm
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/juju/errors"
+
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	defaultRebalanceTarget = 0.5
+	rebalanceReason        = "rebalance"
+)
+
+// RebalanceConfig enables taker orders which bring inventory back to target
+// when it drifts too far for passive quoting to fix
+type RebalanceConfig struct {
+	// Target share of base asset in inventory value, 0.5 by default
+	Target float64 `json:"target"`
+	// Base share deviation from target which triggers rebalance, e.g. 0.2
+	Limit float64 `json:"limit"`
+	// Maximum deviation of taker order price from reference price
+	MaxSlippage float64 `json:"max_slippage"`
+	// Maximum amount of base asset traded per UTC day
+	DailyBudget float64 `json:"daily_budget"`
+	// Use fill-or-kill orders, otherwise unfilled rest of the order stays
+	// on the book until the next refresh
+	FillOrKill bool `json:"fill_or_kill"`
+}
+
+func (c *RebalanceConfig) target() float64 {
+	if c.Target <= 0 {
+		return defaultRebalanceTarget
+	}
+	return c.Target
+}
+
+// rebalancer keeps daily budget, used by worker goroutine only
+type rebalancer struct {
+	cfg *RebalanceConfig
+	// start of the UTC day budget is spent for
+	day time.Time
+	// base asset traded during the day, in asset units
+	spent float64
+}
+
+func newRebalancer(cfg *RebalanceConfig) *rebalancer {
+	if cfg == nil {
+		return nil
+	}
+	return &rebalancer{cfg: cfg}
+}
+
+// trade returns amount of base asset to sell (positive) or to buy (negative)
+// to bring inventory back to target. base and quote are in asset units,
+// rate is amount of quote per base.
+func (r *rebalancer) trade(base, quote, rate float64) float64 {
+	value := base*rate + quote
+	if value <= 0 || rate <= 0 {
+		return 0
+	}
+
+	excess := base*rate/value - r.cfg.target()
+	if math.Abs(excess) <= r.cfg.Limit {
+		return 0
+	}
+	return excess * value / rate
+}
+
+// budget returns base asset amount which can still be traded today
+func (r *rebalancer) budget(now time.Time) float64 {
+	day := now.UTC().Truncate(24 * time.Hour)
+	if !day.Equal(r.day) {
+		r.day = day
+		r.spent = 0
+	}
+	return math.Max(r.cfg.DailyBudget-r.spent, 0)
+}
+
+// rebalanceOrder creates marketable order selling (amount > 0) or buying base
+// asset, price is the reference rate worsened by max slippage
+func (m *MarketMaker) rebalanceOrder(amount, rate float64, expiration time.Time) *objects.LimitOrderCreateOperation {
+	cfg := m.cfg.Market.Rebalance
+	base, quote := &m.market.Base, &m.market.Quote
+
+	var sell, receive objects.AssetAmount
+	if amount > 0 {
+		sell = base.CreateAmount(amount)
+		receive = quote.CreateAmount(amount * rate * (1 - cfg.MaxSlippage))
+	} else {
+		sell = quote.CreateAmount(-amount * rate)
+		receive = base.CreateAmount(-amount * (1 - cfg.MaxSlippage))
+	}
+
+	if sell.Amount <= orderAmountThreshold || receive.Amount <= orderAmountThreshold {
+		return nil
+	}
+
+	return &objects.LimitOrderCreateOperation{
+		Seller:       m.account.ID,
+		AmountToSell: sell,
+		MinToReceive: receive,
+		FillOrKill:   cfg.FillOrKill,
+		Expiration:   objects.NewTime(expiration),
+		Extensions:   objects.Extensions{},
+	}
+}
+
+// rebalance sends taker order if inventory is beyond the limit. Own orders
+// are cancelled in the same transaction, so that they are not matched and
+// are re-created with new balances. Returns true if order was sent, failed
+// transaction changes nothing and quoting goes on.
+func (m *MarketMaker) rebalance(ctx context.Context, rate float64, t time.Time) bool {
+	orderBook, err := m.loadOrderBook()
+	if err != nil {
+		m.log.Errorf("Failed to load order book: %v", err)
+		return false
+	}
+
+	m.balanceMutex.Lock()
+	defer m.balanceMutex.Unlock()
+
+	if err := m.updateBalances(); err != nil {
+		m.log.Errorf("Failed to update balances: %v", err)
+		return false
+	}
+
+	base := m.market.Base.GetRate(objects.AssetAmount{
+		Asset:  m.market.Base.ID,
+		Amount: m.baseBalance.Amount + objects.Int64(orderBook.SellAmount())})
+	quote := m.market.Quote.GetRate(objects.AssetAmount{
+		Asset:  m.market.Quote.ID,
+		Amount: m.quoteBalance.Amount + objects.Int64(orderBook.BuyAmount())})
+
+	amount := m.rebalancer.trade(base, quote, rate)
+	if amount == 0 {
+		return false
+	}
+
+	budget := m.rebalancer.budget(t)
+	if budget <= 0 {
+		m.log.Warnf("Inventory is off target but daily rebalance budget is spent")
+		return false
+	}
+	if math.Abs(amount) > budget {
+		amount = math.Copysign(budget, amount)
+	}
+
+	op := m.rebalanceOrder(amount, rate, t.Add(m.orderDuration))
+	if op == nil {
+		return false
+	}
+
+	m.log.Infof("Rebalancing inventory base=%f quote=%f: trade %f %s at rate %f",
+		base, quote, -amount, m.market.Base.Symbol, rate)
+
+	ops := append(m.createCancelOrders(orderBook), op)
+	rec := journal.Record{Reason: rebalanceReason, RefPrice: rate}
+	if err := m.broadcastRecord(ctx, rec, ops...); err != nil {
+		m.log.Errorf("Rebalance failed: %v", err)
+		return false
+	}
+
+	m.rebalancer.spent += m.baseAmount(op)
+	return true
+}
+
+// baseAmount returns base asset amount of the order in asset units
+func (m *MarketMaker) baseAmount(op *objects.LimitOrderCreateOperation) float64 {
+	if op.AmountToSell.Asset == m.market.Base.ID {
+		return m.market.Base.GetRate(op.AmountToSell)
+	}
+	return m.market.Base.GetRate(op.MinToReceive)
+}
+
+// restoreRebalanceBudget counts today's rebalance trades from journal,
+// so that restart does not renew the budget
+func (m *MarketMaker) restoreRebalanceBudget(now time.Time) error {
+	path := m.cfg.Journal.Path()
+	if m.rebalancer == nil || path == "" {
+		return nil
+	}
+
+	m.rebalancer.budget(now)
+	filter := &journal.Filter{
+		Since:   m.rebalancer.day,
+		Type:    journal.OperationType(&objects.LimitOrderCreateOperation{}),
+		Account: m.cfg.Account,
+		Market:  m.marketName(),
+	}
+
+	var spent float64
+	err := journal.Query(path, filter, func(e *journal.Entry, line []byte) bool {
+		if e.Reason != rebalanceReason || e.Result != journal.ResultOK {
+			return true
+		}
+
+		var op objects.LimitOrderCreateOperation
+		if err := json.Unmarshal(e.Operation, &op); err != nil {
+			return true
+		}
+		spent += m.baseAmount(&op)
+		return true
+	})
+	if err != nil {
+		return errors.Annotate(err, "read journal")
+	}
+
+	m.rebalancer.spent = spent
+	if spent > 0 {
+		m.log.Infof("%f %s of daily rebalance budget is already spent", spent, m.market.Base.Symbol)
+	}
+	return nil
+}
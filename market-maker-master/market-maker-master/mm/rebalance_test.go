@@ -0,0 +1,99 @@
+package mm
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func TestRebalancerTrade(t *testing.T) {
+	r := newRebalancer(&RebalanceConfig{Limit: 0.2, DailyBudget: 1000})
+
+	// 1 BTC worth of base and 10 BTC: buy base for 4.5 BTC
+	assert.InDelta(t, -45000, r.trade(10000, 10, 0.0001), 1e-6)
+	// within limit
+	assert.Equal(t, 0.0, r.trade(60000, 4, 0.0001))
+	// too much base: sell it
+	assert.InDelta(t, 40000, r.trade(100000, 2, 0.0001), 1e-6)
+	assert.Equal(t, 0.0, r.trade(0, 0, 0.0001))
+}
+
+func TestRebalancerBudget(t *testing.T) {
+	r := newRebalancer(&RebalanceConfig{Limit: 0.2, DailyBudget: 1000})
+	day := time.Date(2018, 7, 1, 23, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, 1000.0, r.budget(day))
+	r.spent = 800
+	assert.Equal(t, 200.0, r.budget(day.Add(30*time.Minute)))
+	r.spent = 1200
+	assert.Equal(t, 0.0, r.budget(day))
+
+	// new UTC day renews the budget
+	assert.Equal(t, 1000.0, r.budget(day.Add(time.Hour)))
+	assert.Equal(t, 0.0, r.spent)
+}
+
+func TestRebalanceOrder(t *testing.T) {
+	m := newTestMaker(MarketConfig{
+		Expiration: 60,
+		Rebalance:  &RebalanceConfig{Limit: 0.2, MaxSlippage: 0.01, DailyBudget: 1000, FillOrKill: true},
+	})
+	exp := time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+
+	sell := m.rebalanceOrder(500, 0.0001, exp)
+	require.NotNil(t, sell)
+	assert.Equal(t, m.market.Base.ID, sell.AmountToSell.Asset)
+	assert.Equal(t, objects.Int64(500e8), sell.AmountToSell.Amount)
+	assert.Equal(t, objects.Int64(0.0495e8), sell.MinToReceive.Amount)
+	assert.True(t, sell.FillOrKill)
+
+	buy := m.rebalanceOrder(-500, 0.0001, exp)
+	require.NotNil(t, buy)
+	assert.Equal(t, m.market.Quote.ID, buy.AmountToSell.Asset)
+	assert.Equal(t, objects.Int64(0.05e8), buy.AmountToSell.Amount)
+	assert.Equal(t, objects.Int64(495e8), buy.MinToReceive.Amount)
+	assert.Equal(t, 495.0, m.baseAmount(buy))
+
+	// dust
+	assert.Nil(t, m.rebalanceOrder(1e-8, 0.0001, exp))
+}
+
+func TestRestoreRebalanceBudget(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebalance")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	j, err := journal.New(&journal.Config{Path: filepath.Join(dir, "journal.jsonl")}, "market-maker")
+	require.NoError(t, err)
+	defer j.Close()
+
+	m := newTestMaker(MarketConfig{
+		Base:      "OTN",
+		Quote:     "BTC",
+		Rebalance: &RebalanceConfig{Limit: 0.2, MaxSlippage: 0.01, DailyBudget: 1000},
+	})
+	m.cfg.Account = "maker"
+	m.cfg.Journal = j
+
+	rec := journal.Record{Account: "maker", Market: "OTN/BTC", Reason: rebalanceReason, RefPrice: 0.0001}
+	exp := time.Now()
+	sell := m.rebalanceOrder(300, 0.0001, exp)
+	buy := m.rebalanceOrder(-100, 0.0001, exp)
+	require.NoError(t, j.Record(rec, []objects.Operation{sell, buy}, "abc", nil))
+	// failed and regular orders are not counted
+	require.NoError(t, j.Record(rec, []objects.Operation{sell}, "", assert.AnError))
+	rec.Reason = "initial orders"
+	require.NoError(t, j.Record(rec, []objects.Operation{sell}, "def", nil))
+
+	require.NoError(t, m.restoreRebalanceBudget(time.Now()))
+	assert.InDelta(t, 399, m.rebalancer.spent, 1e-9)
+	assert.InDelta(t, 601, m.rebalancer.budget(time.Now()), 1e-9)
+}
@@ -0,0 +1,178 @@
+package route
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	DefaultMaxHops = 3
+	DefaultMaxAge  = 10 * time.Minute
+)
+
+type Config struct {
+	// Maximum number of quotes chained for one price
+	MaxHops int `json:"max_hops"`
+	// Quotes older than this many seconds are not used
+	MaxAge int `json:"max_age"`
+}
+
+// QuoteSource is a price provider which can list pairs it knows. Assets
+// of routed markets are passed, so that source can include them.
+type QuoteSource interface {
+	Quotes(assets []objects.Asset) []Quote
+}
+
+// RouteInfo is published in price_routes metric for every market
+type RouteInfo struct {
+	Path    []string  `json:"path"`
+	Sources []string  `json:"sources"`
+	Hops    int       `json:"hops"`
+	Rate    float64   `json:"rate"`
+	Oldest  time.Time `json:"oldest"`
+	Error   string    `json:"error,omitempty"`
+}
+
+var (
+	metricsOnce  sync.Once
+	metricsMutex sync.Mutex
+	routeMetrics = make(map[string]RouteInfo)
+)
+
+func publishMetrics() {
+	expvar.Publish("price_routes", expvar.Func(func() interface{} {
+		metricsMutex.Lock()
+		defer metricsMutex.Unlock()
+
+		res := make(map[string]RouteInfo, len(routeMetrics))
+		for k, v := range routeMetrics {
+			res[k] = v
+		}
+		return res
+	}))
+}
+
+type priceProviderFactory struct {
+	sources []QuoteSource
+	log     *zap.SugaredLogger
+	maxHops int
+	maxAge  time.Duration
+	now     func() time.Time
+
+	mutex   sync.Mutex
+	markets []*mm.Market
+	routes  map[string]string
+}
+
+func NewFactory(cfg *Config, sources []QuoteSource, log *zap.SugaredLogger) mm.PriceProviderFactory {
+	metricsOnce.Do(publishMetrics)
+
+	maxHops := DefaultMaxHops
+	if cfg.MaxHops > 0 {
+		maxHops = cfg.MaxHops
+	}
+	maxAge := DefaultMaxAge
+	if cfg.MaxAge > 0 {
+		maxAge = time.Duration(cfg.MaxAge) * time.Second
+	}
+
+	return &priceProviderFactory{
+		sources: sources,
+		log:     log,
+		maxHops: maxHops,
+		maxAge:  maxAge,
+		now:     time.Now,
+		routes:  make(map[string]string),
+	}
+}
+
+// PriceProviderFactory interface
+func (f *priceProviderFactory) GetProvider(market *mm.Market) (mm.PriceProvider, error) {
+	f.mutex.Lock()
+	f.markets = append(f.markets, market)
+	f.mutex.Unlock()
+
+	return &priceProvider{market: market, factory: f}, nil
+}
+
+// quotes collects fresh quotes of all sources
+func (f *priceProviderFactory) quotes() []Quote {
+	f.mutex.Lock()
+	assets := make([]objects.Asset, 0, 2*len(f.markets))
+	for _, m := range f.markets {
+		assets = append(assets, m.Base, m.Quote)
+	}
+	f.mutex.Unlock()
+
+	oldest := f.now().Add(-f.maxAge)
+
+	var res []Quote
+	for _, s := range f.sources {
+		for _, q := range s.Quotes(assets) {
+			if q.Time.After(oldest) {
+				res = append(res, q)
+			}
+		}
+	}
+	return res
+}
+
+// report logs route when it changes and publishes it in metrics
+func (f *priceProviderFactory) report(market *mm.Market, r *Route, err error) {
+	name := market.DisplayName()
+	info := RouteInfo{}
+	desc := ""
+	if err != nil {
+		info.Error = err.Error()
+		desc = info.Error
+	} else {
+		info.Path = r.Path()
+		info.Hops = len(r.Hops)
+		info.Rate = r.Rate()
+		info.Oldest = r.Oldest()
+		for _, h := range r.Hops {
+			info.Sources = append(info.Sources, h.Source)
+		}
+		desc = r.String()
+	}
+
+	metricsMutex.Lock()
+	routeMetrics[name] = info
+	metricsMutex.Unlock()
+
+	f.mutex.Lock()
+	changed := f.routes[name] != desc
+	f.routes[name] = desc
+	f.mutex.Unlock()
+
+	if !changed {
+		return
+	}
+	if err != nil {
+		f.log.Warnf("No price route for %s: %v", name, err)
+	} else {
+		f.log.Infof("Price route for %s: %s", name, desc)
+	}
+}
+
+type priceProvider struct {
+	market  *mm.Market
+	factory *priceProviderFactory
+}
+
+func (p *priceProvider) GetPrice() objects.Price {
+	f := p.factory
+	r, err := Find(f.quotes(), p.market.Base.Symbol, p.market.Quote.Symbol, f.maxHops)
+	f.report(p.market, r, err)
+	if err != nil {
+		return objects.Price{}
+	}
+
+	return p.market.PriceFromRate(r.Rate())
+}
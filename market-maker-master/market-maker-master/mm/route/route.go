@@ -0,0 +1,129 @@
+// Package route prices markets without direct quote by chaining pairs known
+// to price providers, e.g. OTN/BTC from Coinmarketcap and EURX/OTN from feed.
+package route
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Quote is amount of Quote asset per one Base asset
+type Quote struct {
+	Base   string
+	Quote  string
+	Rate   float64
+	Time   time.Time
+	Source string
+}
+
+func (q Quote) inverse() Quote {
+	return Quote{Base: q.Quote, Quote: q.Base, Rate: 1 / q.Rate, Time: q.Time, Source: q.Source}
+}
+
+// Route is a chain of quotes, each hop starts where the previous one ends
+type Route struct {
+	Hops []Quote
+}
+
+// Rate returns amount of the last quote asset per one first base asset
+func (r *Route) Rate() float64 {
+	rate := 1.0
+	for _, h := range r.Hops {
+		rate *= h.Rate
+	}
+	return rate
+}
+
+// Oldest returns time of the oldest quote on the route
+func (r *Route) Oldest() time.Time {
+	var oldest time.Time
+	for i, h := range r.Hops {
+		if i == 0 || h.Time.Before(oldest) {
+			oldest = h.Time
+		}
+	}
+	return oldest
+}
+
+// Path returns assets along the route
+func (r *Route) Path() []string {
+	if len(r.Hops) == 0 {
+		return nil
+	}
+	path := []string{r.Hops[0].Base}
+	for _, h := range r.Hops {
+		path = append(path, h.Quote)
+	}
+	return path
+}
+
+// String formats route as OTN -cmc-> BTC -feed-> EURX
+func (r *Route) String() string {
+	if len(r.Hops) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString(r.Hops[0].Base)
+	for _, h := range r.Hops {
+		fmt.Fprintf(&b, " -%s-> %s", h.Source, h.Quote)
+	}
+	return b.String()
+}
+
+// better reports whether route a is more reliable than b: it has fewer
+// hops or the same number of hops and fresher oldest quote
+func better(a, b []Quote) bool {
+	if b == nil || len(a) != len(b) {
+		return b == nil || len(a) < len(b)
+	}
+	ra, rb := Route{a}, Route{b}
+	return ra.Oldest().After(rb.Oldest())
+}
+
+// Find returns the most reliable route from base to quote using at most
+// maxHops quotes. Every quote can be used in both directions.
+func Find(quotes []Quote, base, quote string, maxHops int) (*Route, error) {
+	edges := make(map[string][]Quote)
+	for _, q := range quotes {
+		if q.Rate <= 0 || q.Base == q.Quote {
+			continue
+		}
+		edges[q.Base] = append(edges[q.Base], q)
+		edges[q.Quote] = append(edges[q.Quote], q.inverse())
+	}
+
+	var best []Quote
+	visited := map[string]bool{base: true}
+	path := make([]Quote, 0, maxHops)
+
+	var walk func(from string)
+	walk = func(from string) {
+		if from == quote {
+			if better(path, best) {
+				best = append([]Quote(nil), path...)
+			}
+			return
+		}
+		// longer routes cannot beat the best one
+		if len(path) == maxHops || (best != nil && len(path) >= len(best)) {
+			return
+		}
+		for _, e := range edges[from] {
+			if visited[e.Quote] {
+				continue
+			}
+			visited[e.Quote] = true
+			path = append(path, e)
+			walk(e.Quote)
+			path = path[:len(path)-1]
+			visited[e.Quote] = false
+		}
+	}
+	walk(base)
+
+	if best == nil {
+		return nil, fmt.Errorf("No route from %s to %s within %d hops", base, quote, maxHops)
+	}
+	return &Route{Hops: best}, nil
+}
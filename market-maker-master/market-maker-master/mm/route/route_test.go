@@ -0,0 +1,112 @@
+package route
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+var now = time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)
+
+func quote(base, quote string, rate float64, age time.Duration, source string) Quote {
+	return Quote{Base: base, Quote: quote, Rate: rate, Time: now.Add(-age), Source: source}
+}
+
+func TestFindFewestHops(t *testing.T) {
+	quotes := []Quote{
+		quote("OTN", "BTC", 0.0001, 0, "cmc"),
+		quote("ETH", "BTC", 0.05, 0, "cmc"),
+		quote("EURX", "OTN", 5, 0, "blockchain"),
+		quote("EURX", "ETH", 0.0003, time.Minute, "other"),
+	}
+
+	r, err := Find(quotes, "OTN", "EURX", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"OTN", "EURX"}, r.Path())
+	assert.InDelta(t, 0.2, r.Rate(), 1e-12)
+	assert.Equal(t, "OTN -blockchain-> EURX", r.String())
+
+	r, err = Find(quotes, "BTC", "EURX", 3)
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(r.Hops))
+	assert.InDelta(t, 10000/5.0, r.Rate(), 1e-9)
+}
+
+func TestFindFreshest(t *testing.T) {
+	quotes := []Quote{
+		quote("OTN", "BTC", 0.0001, time.Minute, "cmc"),
+		quote("BTC", "USD", 6000, time.Hour, "cmc"),
+		quote("OTN", "ETH", 0.002, time.Minute, "cmc"),
+		quote("ETH", "USD", 300, 2*time.Minute, "cmc"),
+	}
+
+	r, err := Find(quotes, "OTN", "USD", 3)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"OTN", "ETH", "USD"}, r.Path())
+	assert.Equal(t, now.Add(-2*time.Minute), r.Oldest())
+}
+
+func TestFindMaxHops(t *testing.T) {
+	quotes := []Quote{
+		quote("A", "B", 2, 0, "x"),
+		quote("B", "C", 2, 0, "x"),
+		quote("C", "D", 2, 0, "x"),
+	}
+
+	_, err := Find(quotes, "A", "D", 2)
+	assert.Error(t, err)
+
+	r, err := Find(quotes, "D", "A", 3)
+	require.NoError(t, err)
+	assert.InDelta(t, 0.125, r.Rate(), 1e-12)
+}
+
+type fakeSource []Quote
+
+func (s fakeSource) Quotes(assets []objects.Asset) []Quote {
+	return s
+}
+
+func TestProvider(t *testing.T) {
+	market := mm.Market{
+		Base:  objects.Asset{ID: *objects.NewGrapheneID("1.3.0"), Symbol: "OTN", Precision: 8},
+		Quote: objects.Asset{ID: *objects.NewGrapheneID("1.3.5"), Symbol: "EURX", Precision: 4},
+	}
+
+	cmc := fakeSource{
+		quote("OTN", "BTC", 0.0001, time.Minute, "cmc"),
+		quote("EUR", "BTC", 0.0002, time.Minute, "cmc"),
+	}
+	chain := fakeSource{
+		quote("EURX", "BTC", 0.0002, time.Hour, "blockchain"),
+	}
+
+	f := NewFactory(&Config{MaxAge: 600}, []QuoteSource{cmc, chain}, zap.NewNop().Sugar()).(*priceProviderFactory)
+	f.now = func() time.Time { return now }
+
+	p, err := f.GetProvider(&market)
+	require.NoError(t, err)
+
+	// feed quote is too old
+	assert.False(t, p.GetPrice().Valid())
+
+	chain[0].Time = now
+	price := p.GetPrice()
+	require.True(t, price.Valid())
+	assert.InDelta(t, 0.5, market.GetRate(price).Value(), 1e-9)
+
+	var routes map[string]RouteInfo
+	require.NoError(t, json.Unmarshal([]byte(expvar.Get("price_routes").String()), &routes))
+	info := routes["OTN/EURX"]
+	assert.Equal(t, []string{"OTN", "BTC", "EURX"}, info.Path)
+	assert.Equal(t, []string{"cmc", "blockchain"}, info.Sources)
+	assert.Equal(t, 2, info.Hops)
+}
@@ -0,0 +1,575 @@
+package mm_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/market-maker/mm/mmtest"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+	"github.com/opentradingnetworkfoundation/otn-go/wallet"
+)
+
+const updateInterval = 10 * time.Second
+
+type fakeWallet struct {
+	wallet.Wallet
+}
+
+func (fakeWallet) GetKeys() wallet.Keys {
+	var keys wallet.Keys
+	return keys
+}
+
+// fakePrices provides manually set rates by market name, zero means no price
+type fakePrices struct {
+	mutex sync.Mutex
+	rates map[string]float64
+}
+
+func (f *fakePrices) GetProvider(market *mm.Market) (mm.PriceProvider, error) {
+	return &fakePrice{prices: f, market: market}, nil
+}
+
+func (f *fakePrices) set(market string, rate float64) {
+	f.mutex.Lock()
+	f.rates[market] = rate
+	f.mutex.Unlock()
+}
+
+type fakePrice struct {
+	prices *fakePrices
+	market *mm.Market
+}
+
+func (p *fakePrice) GetPrice() objects.Price {
+	p.prices.mutex.Lock()
+	defer p.prices.mutex.Unlock()
+
+	rate := p.prices.rates[p.market.DisplayName()]
+	if rate == 0 {
+		return objects.Price{}
+	}
+	return p.market.PriceFromRate(rate)
+}
+
+type scenario struct {
+	t     *testing.T
+	chain *mmtest.Chain
+	clock *mmtest.Clock
+	price *fakePrices
+	maker *mm.MarketMaker
+}
+
+func scenarioMarket() mm.MarketConfig {
+	return mm.MarketConfig{
+		Base:       "OTN",
+		Quote:      "BTC",
+		Spread:     0.02,
+		SpreadStep: 0.01,
+		Threshold:  0.01,
+		Expiration: 60,
+		Amount:     1000,
+		OrderCount: 2,
+	}
+}
+
+func newScenario(t *testing.T, market mm.MarketConfig, balances map[string]float64) *scenario {
+	return newScenarioNotifier(t, market, balances, nil)
+}
+
+// newScenarioNotifier is newScenario posting events to notifier
+func newScenarioNotifier(t *testing.T, market mm.MarketConfig, balances map[string]float64, notifier *notify.Notifier) *scenario {
+	chain := mmtest.NewChain()
+	chain.AddAsset("OTN", 8)
+	chain.AddAsset("BTC", 8)
+	chain.AddAccount("maker", balances)
+	return startScenario(t, market, chain, notifier)
+}
+
+// startScenario runs market maker of account "maker" on prepared chain
+func startScenario(t *testing.T, market mm.MarketConfig, chain *mmtest.Chain, notifier *notify.Notifier) *scenario {
+	s := &scenario{
+		t:     t,
+		chain: chain,
+		clock: mmtest.NewClock(time.Date(2018, 7, 1, 12, 0, 0, 0, time.UTC)),
+		price: &fakePrices{rates: map[string]float64{"OTN/BTC": 0.0001}},
+	}
+
+	cfg := &mm.Config{
+		Market:         market,
+		UpdateInterval: updateInterval,
+		Account:        "maker",
+		Clock:          s.clock,
+		Assets:         chain,
+		Notifier:       notifier,
+	}
+	s.maker = mm.NewMarketMaker(cfg, chain, fakeWallet{}, s.price, zap.NewNop().Sugar(), &sync.Mutex{})
+	require.NoError(t, s.maker.Start())
+	return s
+}
+
+// tick runs one market update and waits until it is done
+func (s *scenario) tick() {
+	require.True(s.t, s.clock.WaitTimers(1, time.Second), "worker is not waiting")
+	s.clock.Advance(updateInterval)
+	require.True(s.t, s.clock.WaitTimers(1, time.Second), "market update did not finish")
+}
+
+// stop cancels orders, poll interval of the cancel loop is driven by the clock
+func (s *scenario) stop() {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.maker.Stop(context.Background())
+	}()
+
+	for {
+		select {
+		case err := <-done:
+			require.NoError(s.t, err)
+			return
+		case <-time.After(time.Millisecond):
+			s.clock.Advance(time.Second)
+		}
+	}
+}
+
+func (s *scenario) txCount() int {
+	return len(s.chain.Transactions)
+}
+
+// sides counts open orders selling base and quote
+func (s *scenario) sides() (sells, buys int) {
+	for _, o := range s.chain.Orders() {
+		if o.SellPrice.Base.Asset == s.maker.Market().Base.ID {
+			sells++
+		} else {
+			buys++
+		}
+	}
+	return
+}
+
+// bestAsk returns the lowest sell price, quote per base
+func (s *scenario) bestAsk() float64 {
+	market := s.maker.Market()
+	best := 0.0
+	for _, o := range s.chain.Orders() {
+		if o.SellPrice.Base.Asset == market.Base.ID {
+			if r := market.GetRate(o.SellPrice).Value(); best == 0 || r < best {
+				best = r
+			}
+		}
+	}
+	return best
+}
+
+func TestScenarioInitialOrders(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	require.Equal(t, 1, s.txCount())
+	sells, buys := s.sides()
+	assert.Equal(t, 2, sells)
+	assert.Equal(t, 2, buys)
+	assert.InDelta(t, 0.0001*1.01, s.bestAsk(), 1e-9)
+	assert.Equal(t, objects.Int64(9000e8), s.chain.Balance("maker", "OTN"))
+}
+
+func TestScenarioThresholdSkip(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	orders := s.chain.Orders()
+
+	// 0.5% move is below threshold
+	s.price.set("OTN/BTC", 0.0001005)
+	s.tick()
+	assert.Equal(t, 1, s.txCount())
+	assert.Equal(t, orders, s.chain.Orders())
+}
+
+func TestScenarioPriceMove(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	s.price.set("OTN/BTC", 0.00011)
+	s.tick()
+
+	require.Equal(t, 2, s.txCount())
+	// 4 cancels and 4 new orders in one transaction
+	assert.Len(t, s.chain.Transactions[1], 8)
+	sells, buys := s.sides()
+	assert.Equal(t, 2, sells)
+	assert.Equal(t, 2, buys)
+	assert.InDelta(t, 0.00011*1.01, s.bestAsk(), 1e-9)
+}
+
+func TestScenarioExpirationRefresh(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	first := s.chain.Orders()
+
+	// refresh interval is half of 60s expiration
+	s.tick()
+	s.tick()
+	assert.Equal(t, 1, s.txCount())
+
+	s.tick()
+	require.Equal(t, 2, s.txCount())
+	orders := s.chain.Orders()
+	require.Len(t, orders, 4)
+	assert.NotEqual(t, first[0].ID, orders[0].ID)
+	assert.True(t, orders[0].Expiration.After(first[0].Expiration.Time))
+}
+
+func TestScenarioInsufficientBalance(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 500, "BTC": 0})
+	defer s.stop()
+
+	s.tick()
+	require.Equal(t, 1, s.txCount())
+	sells, buys := s.sides()
+	assert.Equal(t, 2, sells)
+	assert.Equal(t, 0, buys)
+	// volume is limited by balance
+	assert.Equal(t, objects.Int64(0), s.chain.Balance("maker", "OTN"))
+}
+
+func TestScenarioBroadcastFailure(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.chain.BroadcastErr = fmt.Errorf("node is down")
+	s.tick()
+	assert.Equal(t, 1, s.txCount())
+	assert.Empty(t, s.chain.Orders())
+
+	// retried on the next tick, not after refresh interval
+	s.chain.BroadcastErr = nil
+	s.tick()
+	assert.Equal(t, 2, s.txCount())
+	assert.Len(t, s.chain.Orders(), 4)
+}
+
+func TestScenarioRebalanceFailure(t *testing.T) {
+	market := scenarioMarket()
+	market.Rebalance = &mm.RebalanceConfig{Limit: 0.2, MaxSlippage: 0.01, DailyBudget: 50000, FillOrKill: true}
+	s := newScenario(t, market, map[string]float64{"OTN": 100000, "BTC": 1})
+	defer s.stop()
+
+	// fill-or-kill order is rejected with the whole transaction, orders
+	// are placed anyway
+	s.tick()
+	require.Equal(t, 2, s.txCount())
+	assert.Len(t, s.chain.Transactions[0], 1)
+	assert.Len(t, s.chain.Orders(), 4)
+
+	// rebalance is retried, orders stay until price moves
+	s.tick()
+	assert.Equal(t, 3, s.txCount())
+	assert.Len(t, s.chain.Orders(), 4)
+
+	s.price.set("OTN/BTC", 0.00011)
+	s.tick()
+	assert.Equal(t, 5, s.txCount())
+	assert.InDelta(t, 0.00011*1.01, s.bestAsk(), 1e-9)
+}
+
+func TestScenarioNoPrice(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	require.Len(t, s.chain.Orders(), 4)
+
+	s.price.set("OTN/BTC", 0)
+	s.tick()
+	assert.Empty(t, s.chain.Orders())
+	assert.Equal(t, objects.Int64(10000e8), s.chain.Balance("maker", "OTN"))
+}
+
+func TestScenarioStopCancels(t *testing.T) {
+	s := newScenario(t, scenarioMarket(), map[string]float64{"OTN": 10000, "BTC": 1})
+
+	s.tick()
+	require.Len(t, s.chain.Orders(), 4)
+
+	s.stop()
+	assert.Empty(t, s.chain.Orders())
+	assert.Equal(t, objects.Int64(1e8), s.chain.Balance("maker", "BTC"))
+}
+
+// newDeepBookChain has account "other" with count sells and count buys
+// priced ahead of maker orders around 0.0001
+func newDeepBookChain(t *testing.T, count int) *mmtest.Chain {
+	chain := mmtest.NewChain()
+	otn := chain.AddAsset("OTN", 8)
+	btc := chain.AddAsset("BTC", 8)
+	other := chain.AddAccount("other", map[string]float64{"OTN": 1e6, "BTC": 100})
+	chain.AddAccount("maker", map[string]float64{"OTN": 10000, "BTC": 1})
+
+	expiration := objects.NewTime(time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC))
+	for i := 0; i < count; i++ {
+		_, err := chain.SignAndBroadcast(nil, &otn.ID,
+			&objects.LimitOrderCreateOperation{
+				Seller:       other.ID,
+				AmountToSell: otn.CreateAmount(10),
+				MinToReceive: btc.CreateAmount(10 * 0.000101),
+				Expiration:   expiration,
+				Extensions:   objects.Extensions{},
+			},
+			&objects.LimitOrderCreateOperation{
+				Seller:       other.ID,
+				AmountToSell: btc.CreateAmount(10 * 0.000099),
+				MinToReceive: otn.CreateAmount(10),
+				Expiration:   expiration,
+				Extensions:   objects.Extensions{},
+			})
+		require.NoError(t, err)
+	}
+	return chain
+}
+
+// ownOrders counts open orders of the maker account
+func (s *scenario) ownOrders() int {
+	db, err := s.chain.DatabaseAPI()
+	require.NoError(s.t, err)
+	maker, err := db.GetAccountByName("maker")
+	require.NoError(s.t, err)
+
+	count := 0
+	for _, o := range s.chain.Orders() {
+		if o.Seller == maker.ID {
+			count++
+		}
+	}
+	return count
+}
+
+func TestScenarioGridBehindDeepBook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "grid")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	market := mm.MarketConfig{
+		Base:       "OTN",
+		Quote:      "BTC",
+		Expiration: 60,
+		Grid: &mm.GridConfig{
+			Low:    0.00008,
+			High:   0.00012,
+			Levels: 5,
+			Amount: 100,
+			Start:  0.0001,
+			State:  filepath.Join(dir, "grid.json"),
+		},
+	}
+	s := startScenario(t, market, newDeepBookChain(t, 30), nil)
+	defer s.stop()
+	s.tick()
+	require.Equal(t, 4, s.ownOrders())
+
+	// grid orders are behind 60 orders of other account, none of them is filled
+	txs := s.txCount()
+	s.tick()
+	s.tick()
+	assert.Equal(t, 4, s.ownOrders())
+	assert.Equal(t, txs, s.txCount())
+}
+
+func TestScenarioStopCancelsBehindDeepBook(t *testing.T) {
+	s := startScenario(t, scenarioMarket(), newDeepBookChain(t, 30), nil)
+	s.tick()
+	require.Equal(t, 4, s.ownOrders())
+
+	s.stop()
+	assert.Equal(t, 0, s.ownOrders())
+	assert.Len(t, s.chain.Orders(), 60)
+}
+
+func TestScenarioProfileSwitch(t *testing.T) {
+	market := scenarioMarket()
+	market.Expiration = 3600
+	market.Schedule = &mm.ScheduleConfig{Profiles: []mm.ProfileConfig{
+		{Name: "quiet", Start: "0 0 * * *", Spread: 0.04},
+		{Name: "busy", Start: "1 12 * * *", OrderCount: 1},
+	}}
+	s := newScenario(t, market, map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	require.Equal(t, 1, s.txCount())
+	assert.InDelta(t, 0.0001*1.02, s.bestAsk(), 1e-9)
+
+	// switched at 12:01 without price change
+	for i := 0; i < 5; i++ {
+		s.tick()
+	}
+	assert.Equal(t, 2, s.txCount())
+	assert.InDelta(t, 0.0001*1.01, s.bestAsk(), 1e-9)
+	sells, buys := s.sides()
+	assert.Equal(t, 1, sells)
+	assert.Equal(t, 1, buys)
+
+	s.tick()
+	assert.Equal(t, 2, s.txCount())
+}
+
+func TestScenarioNotifications(t *testing.T) {
+	var mutex sync.Mutex
+	var events []notify.Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e notify.Event
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		mutex.Lock()
+		events = append(events, e)
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	notifier, err := notify.New(&notify.Config{Webhooks: []notify.WebhookConfig{{URL: server.URL}}},
+		"market-maker", zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	market := scenarioMarket()
+	market.LowBalance = &mm.LowBalanceConfig{Base: 20000, Quote: 0.5}
+	s := newScenarioNotifier(t, market, map[string]float64{"OTN": 10000, "BTC": 1}, notifier)
+
+	s.chain.BroadcastErr = fmt.Errorf("node is down")
+	s.tick()
+	s.tick()
+	s.tick()
+	s.chain.BroadcastErr = nil
+	s.price.set("OTN/BTC", 0)
+	s.tick()
+	s.stop()
+	notifier.Close()
+
+	var types []string
+	for _, e := range events {
+		assert.Equal(t, "OTN/BTC", e.Market)
+		types = append(types, e.Type)
+	}
+	// low balance is deduplicated
+	assert.Equal(t, []string{notify.EventLowBalance, notify.EventBroadcastFailing, notify.EventProviderDown}, types)
+	assert.Equal(t, "OTN", events[0].Asset)
+}
+
+// sideVolumes sums open orders of each side in base asset units
+func (s *scenario) sideVolumes() (sell, buy float64) {
+	market := s.maker.Market()
+	for _, o := range s.chain.Orders() {
+		if o.SellPrice.Base.Asset == market.Base.ID {
+			sell += market.Base.GetRate(objects.AssetAmount{Asset: market.Base.ID, Amount: o.ForSale})
+		} else {
+			buy += market.Base.GetRate(objects.AssetAmount{Asset: market.Base.ID, Amount: o.SellPrice.Quote.Amount})
+		}
+	}
+	return
+}
+
+func TestScenarioNotionalSizing(t *testing.T) {
+	market := scenarioMarket()
+	market.Amount = 0
+	market.Sizing = &mm.SizingConfig{Value: 500, Currency: "USD", MaxAmount: 1500}
+
+	s := newScenario(t, market, map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.price.set("OTN/USD", 0.5)
+	s.tick()
+	sell, buy := s.sideVolumes()
+	assert.InDelta(t, 1000, sell, 1e-6)
+	assert.InDelta(t, 1000, buy, 1e-3)
+
+	// OTN got cheaper in USD, volume is clamped
+	s.price.set("OTN/USD", 0.1)
+	s.price.set("OTN/BTC", 0.00002)
+	s.tick()
+	sell, _ = s.sideVolumes()
+	assert.InDelta(t, 1500, sell, 1e-6)
+
+	// previous volume is kept without currency price
+	s.price.set("OTN/USD", 0)
+	s.price.set("OTN/BTC", 0.0001)
+	s.tick()
+	sell, _ = s.sideVolumes()
+	assert.InDelta(t, 1500, sell, 1e-6)
+}
+
+func TestScenarioBalanceSizing(t *testing.T) {
+	market := scenarioMarket()
+	market.Amount = 0
+	market.Sizing = &mm.SizingConfig{Balance: 0.1, MinAmount: 200}
+
+	s := newScenario(t, market, map[string]float64{"OTN": 10000, "BTC": 0.1})
+	defer s.stop()
+
+	s.tick()
+	sell, buy := s.sideVolumes()
+	assert.InDelta(t, 1000, sell, 1e-6)
+	// 0.1 BTC is 1000 OTN, 10% is below min amount
+	assert.InDelta(t, 200, buy, 1e-3)
+}
+
+func TestScenarioSizingProfileAmount(t *testing.T) {
+	market := scenarioMarket()
+	market.Amount = 0
+	market.Expiration = 3600
+	market.Sizing = &mm.SizingConfig{Balance: 0.1}
+	market.Schedule = &mm.ScheduleConfig{Profiles: []mm.ProfileConfig{
+		{Name: "quiet", Start: "0 0 * * *", Spread: 0.04},
+		{Name: "busy", Start: "1 12 * * *", Amount: 300},
+	}}
+	s := newScenario(t, market, map[string]float64{"OTN": 10000, "BTC": 1})
+	defer s.stop()
+
+	s.tick()
+	sell, _ := s.sideVolumes()
+	assert.InDelta(t, 1000, sell, 1e-6)
+
+	// profile amount replaces sizing at 12:01
+	for i := 0; i < 5; i++ {
+		s.tick()
+	}
+	sell, buy := s.sideVolumes()
+	assert.InDelta(t, 300, sell, 1e-6)
+	assert.InDelta(t, 300, buy, 1e-3)
+}
+
+func TestScenarioMarketFee(t *testing.T) {
+	chain := mmtest.NewChain()
+	chain.AddAsset("OTN", 8)
+	btc := chain.AddAsset("BTC", 8)
+	chain.AddAccount("maker", map[string]float64{"OTN": 10000, "BTC": 1})
+	// 1% fee on BTC received by sell orders
+	btc.Options.Flags = 0x01
+	btc.Options.MarketFeePercent = 100
+
+	s := startScenario(t, scenarioMarket(), chain, nil)
+	defer s.stop()
+
+	s.tick()
+	require.Len(t, s.chain.Orders(), 4)
+	assert.InDelta(t, 0.0001*1.01/0.99, s.bestAsk(), 1e-10)
+}
@@ -0,0 +1,251 @@
+package mm
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+// DefaultProfile is reported while no profile has started yet
+const DefaultProfile = "default"
+
+// ScheduleConfig switches ladder parameters by time of day and week
+type ScheduleConfig struct {
+	// IANA time zone of profile schedules, e.g. Europe/Berlin, UTC if empty
+	Timezone string          `json:"timezone"`
+	Profiles []ProfileConfig `json:"profiles"`
+}
+
+// ProfileConfig overrides market parameters from the time it starts until
+// another profile starts. Zero values keep parameters of the market.
+type ProfileConfig struct {
+	Name string `json:"name"`
+	// Cron expression of profile start: minute hour day month weekday,
+	// e.g. "0 9 * * 1-5" starts it at 9:00 on weekdays
+	Start      string  `json:"start"`
+	Spread     float64 `json:"spread"`
+	Amount     float64 `json:"amount"`
+	OrderCount int     `json:"orders"`
+	Threshold  float64 `json:"threshold"`
+}
+
+// apply returns market parameters with profile overrides, nil profile
+// keeps them as is
+func (p *ProfileConfig) apply(c MarketConfig) MarketConfig {
+	if p == nil {
+		return c
+	}
+	if p.Spread > 0 {
+		c.Spread = p.Spread
+	}
+	if p.Amount > 0 {
+		c.Amount = p.Amount
+	}
+	if p.OrderCount > 0 {
+		c.OrderCount = p.OrderCount
+	}
+	if p.Threshold > 0 {
+		c.Threshold = p.Threshold
+	}
+	return c
+}
+
+// ProfileStatus reports profile in force and the next switch
+type ProfileStatus struct {
+	Active string    `json:"active"`
+	Since  time.Time `json:"since"`
+	Next   string    `json:"next"`
+	NextAt time.Time `json:"next_at"`
+}
+
+func (s *ProfileStatus) String() string {
+	res := s.Active
+	if !s.Since.IsZero() {
+		res += " since " + s.Since.Format(time.RFC3339)
+	}
+	if !s.NextAt.IsZero() {
+		res += fmt.Sprintf(", next %s at %s", s.Next, s.NextAt.Format(time.RFC3339))
+	}
+	return res
+}
+
+var (
+	profileMetricsOnce sync.Once
+	profileMutex       sync.Mutex
+	profileMetrics     = make(map[string]ProfileStatus)
+)
+
+func publishProfileMetrics() {
+	expvar.Publish("profiles", expvar.Func(func() interface{} {
+		profileMutex.Lock()
+		defer profileMutex.Unlock()
+
+		res := make(map[string]ProfileStatus, len(profileMetrics))
+		for k, v := range profileMetrics {
+			res[k] = v
+		}
+		return res
+	}))
+}
+
+// schedule finds profile in force, used by worker goroutine only
+type schedule struct {
+	loc      *time.Location
+	profiles []ProfileConfig
+	starts   []*cronSpec
+	status   ProfileStatus
+	// profile in force, nil if none has started yet
+	active *ProfileConfig
+	// profile is not looked up again until this time
+	until time.Time
+}
+
+func newSchedule(cfg *ScheduleConfig) (*schedule, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+
+	loc, err := time.LoadLocation(cfg.Timezone)
+	if err != nil {
+		return nil, errors.Annotatef(err, "load time zone %q", cfg.Timezone)
+	}
+
+	s := &schedule{loc: loc, profiles: cfg.Profiles}
+	for _, p := range cfg.Profiles {
+		spec, err := parseCron(p.Start)
+		if err != nil {
+			return nil, errors.Annotatef(err, "profile %s", p.Name)
+		}
+		s.starts = append(s.starts, spec)
+	}
+	profileMetricsOnce.Do(publishProfileMetrics)
+	return s, nil
+}
+
+// at returns profile in force at t, nil if none has started yet. Of
+// profiles starting at the same time the first one is used.
+func (s *schedule) at(t time.Time) (*ProfileConfig, ProfileStatus) {
+	t = t.In(s.loc)
+
+	var active *ProfileConfig
+	status := ProfileStatus{Active: DefaultProfile}
+	for i, start := range s.starts {
+		if since := start.prev(t); !since.IsZero() && (active == nil || since.After(status.Since)) {
+			active = &s.profiles[i]
+			status.Active, status.Since = active.Name, since
+		}
+		if next := start.next(t); !next.IsZero() && (status.NextAt.IsZero() || next.Before(status.NextAt)) {
+			status.Next, status.NextAt = s.profiles[i].Name, next
+		}
+	}
+	return active, status
+}
+
+// MarketProfile returns profile status of the market at now, nil if market
+// has no schedule
+func MarketProfile(cfg *MarketConfig, now time.Time) (*ProfileStatus, error) {
+	s, err := newSchedule(cfg.Schedule)
+	if s == nil || err != nil {
+		return nil, err
+	}
+	_, status := s.at(now)
+	return &status, nil
+}
+
+// updateProfile applies profile in force at t to ladder parameters,
+// returns true if it has switched since the previous call
+func (m *MarketMaker) updateProfile(t time.Time) bool {
+	s := m.schedule
+	if s == nil || t.Before(s.until) {
+		return false
+	}
+
+	profile, status := s.at(t)
+	prev := s.status.Active
+	s.status = status
+	s.until = status.NextAt
+	if s.until.IsZero() {
+		s.until = t.AddDate(cronSearchYears, 0, 0)
+	}
+
+	profileMutex.Lock()
+	profileMetrics[m.marketName()] = status
+	profileMutex.Unlock()
+
+	if prev == status.Active {
+		return false
+	}
+
+	s.active = profile
+	m.params = profile.apply(m.cfg.Market)
+	m.log.Infof("Switched to profile %s: spread=%g amount=%g orders=%d threshold=%g, next %s at %s",
+		status.Active, m.params.Spread, m.params.Amount, m.params.OrderCount, m.params.Threshold,
+		status.Next, status.NextAt.Format(time.RFC3339))
+
+	// the first profile is not a switch, orders are not placed yet
+	return prev != ""
+}
+
+// amount returns amount of the profile in force, zero if it keeps amount
+// of the market
+func (s *schedule) amount() float64 {
+	if s == nil || s.active == nil {
+		return 0
+	}
+	return s.active.Amount
+}
+
+func (c *ScheduleConfig) validate(path string, market *MarketConfig, errs *ValidationErrors) {
+	field := func(name string) string {
+		return path + "." + name
+	}
+
+	if _, err := time.LoadLocation(c.Timezone); err != nil {
+		errs.Add(field("timezone"), fmt.Sprintf("unknown time zone %q", c.Timezone),
+			`use IANA name, e.g. "Europe/Berlin"`)
+	}
+	if len(c.Profiles) == 0 {
+		errs.Add(field("profiles"), "is empty", "add at least one profile or remove schedule")
+	}
+
+	names := make(map[string]bool, len(c.Profiles))
+	for i, p := range c.Profiles {
+		pfield := func(name string) string {
+			return fmt.Sprintf("%s.profiles[%d].%s", path, i, name)
+		}
+
+		switch {
+		case p.Name == "":
+			errs.Add(pfield("name"), "is empty", "name is shown in logs and status")
+		case p.Name == DefaultProfile || names[p.Name]:
+			errs.Add(pfield("name"), fmt.Sprintf("%q is already used", p.Name), "use unique names")
+		}
+		names[p.Name] = true
+
+		if spec, err := parseCron(p.Start); err != nil {
+			errs.Add(pfield("start"), err.Error(), `use "minute hour day month weekday", e.g. "0 9 * * 1-5"`)
+		} else if spec.next(time.Now()).IsZero() {
+			errs.Add(pfield("start"), fmt.Sprintf("%q never matches", p.Start), "")
+		}
+
+		if p.Spread < 0 || p.Spread >= 1 {
+			errs.Add(pfield("spread"), fmt.Sprintf("must be in range [0, 1), got %g", p.Spread),
+				"spread is a fraction of price, use 0.05 for 5%")
+		}
+		if p.Amount < 0 {
+			errs.Add(pfield("amount"), fmt.Sprintf("must not be negative, got %g", p.Amount), "")
+		}
+		if p.OrderCount < 0 {
+			errs.Add(pfield("orders"), fmt.Sprintf("must not be negative, got %d", p.OrderCount), "")
+		} else if r := market.Randomize; r != nil && p.OrderCount > 0 && r.MinOrders > p.OrderCount {
+			errs.Add(pfield("orders"), fmt.Sprintf("must be at least randomize.min_orders (%d), got %d", r.MinOrders, p.OrderCount), "")
+		}
+		if p.Threshold < 0 || p.Threshold >= 1 {
+			errs.Add(pfield("threshold"), fmt.Sprintf("must be in range [0, 1), got %g", p.Threshold),
+				"threshold is a fraction of price change that triggers update, use 0.01 for 1%")
+		}
+	}
+}
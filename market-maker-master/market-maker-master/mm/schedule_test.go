@@ -0,0 +1,96 @@
+package mm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCron(t *testing.T) {
+	c, err := parseCron("*/15 8-18/2 * * 1-5")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1|1<<15|1<<30|1<<45), c.minute)
+	assert.Equal(t, uint64(1<<8|1<<10|1<<12|1<<14|1<<16|1<<18), c.hour)
+	assert.Equal(t, uint64(0x3e), c.dow)
+
+	// Sunday is 0 or 7
+	c, err = parseCron("0 0 * * 7")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1|1<<7), c.dow)
+
+	for _, expr := range []string{"", "0 9 * *", "60 * * * *", "0 9 * * 1-8", "0 9 * * 5-1", "*/0 * * * *", "a * * * *"} {
+		_, err := parseCron(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestCronNextPrev(t *testing.T) {
+	at := func(s string) time.Time {
+		v, err := time.Parse("2006-01-02 15:04", s)
+		require.NoError(t, err)
+		return v
+	}
+	// Friday
+	now := at("2018-06-01 17:30")
+
+	for _, c := range []struct {
+		expr, next, prev string
+	}{
+		{"0 9 * * 1-5", "2018-06-04 09:00", "2018-06-01 09:00"},
+		{"30 17 * * *", "2018-06-02 17:30", "2018-06-01 17:30"},
+		{"*/20 * * * *", "2018-06-01 17:40", "2018-06-01 17:20"},
+		{"0 0 * * 6,0", "2018-06-02 00:00", "2018-05-27 00:00"},
+		{"0 12 1 * *", "2018-07-01 12:00", "2018-06-01 12:00"},
+		// day of month or weekday
+		{"0 12 15 * 1", "2018-06-04 12:00", "2018-05-28 12:00"},
+		{"0 0 29 2 *", "2020-02-29 00:00", "2016-02-29 00:00"},
+	} {
+		spec, err := parseCron(c.expr)
+		require.NoError(t, err)
+		assert.Equal(t, at(c.next), spec.next(now), "next %s", c.expr)
+		assert.Equal(t, at(c.prev), spec.prev(now), "prev %s", c.expr)
+	}
+
+	spec, err := parseCron("0 0 31 2 *")
+	require.NoError(t, err)
+	assert.True(t, spec.next(now).IsZero())
+	assert.True(t, spec.prev(now).IsZero())
+}
+
+func TestScheduleAt(t *testing.T) {
+	s, err := newSchedule(&ScheduleConfig{
+		Timezone: "Asia/Tokyo",
+		Profiles: []ProfileConfig{
+			{Name: "day", Start: "0 9 * * 1-5", Spread: 0.01},
+			{Name: "weekend", Start: "0 18 * * 5", Spread: 0.05, OrderCount: 2},
+			{Name: "night", Start: "0 18 * * 1-5", Spread: 0.03},
+		},
+	})
+	require.NoError(t, err)
+	tokyo, err := time.LoadLocation("Asia/Tokyo")
+	require.NoError(t, err)
+
+	// Friday 10:00 in Tokyo
+	p, status := s.at(time.Date(2018, 6, 1, 1, 0, 0, 0, time.UTC))
+	require.NotNil(t, p)
+	assert.Equal(t, "day", status.Active)
+	assert.Equal(t, time.Date(2018, 6, 1, 9, 0, 0, 0, tokyo), status.Since)
+	// weekend and night start at the same time, the first one listed wins
+	assert.Equal(t, "weekend", status.Next)
+	assert.Equal(t, time.Date(2018, 6, 1, 18, 0, 0, 0, tokyo), status.NextAt)
+
+	// Sunday
+	p, status = s.at(time.Date(2018, 6, 3, 12, 0, 0, 0, tokyo))
+	assert.Equal(t, "weekend", status.Active)
+	assert.Equal(t, "day", status.Next)
+	assert.Equal(t, time.Date(2018, 6, 4, 9, 0, 0, 0, tokyo), status.NextAt)
+
+	market := MarketConfig{Spread: 0.02, Amount: 100, OrderCount: 5, Threshold: 0.01}
+	params := p.apply(market)
+	assert.Equal(t, 0.05, params.Spread)
+	assert.Equal(t, 2, params.OrderCount)
+	assert.Equal(t, 100.0, params.Amount)
+	assert.Equal(t, market, (*ProfileConfig)(nil).apply(market))
+}
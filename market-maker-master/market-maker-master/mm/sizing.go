@@ -0,0 +1,130 @@
+package mm
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+
+	"github.com/juju/errors"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+// SizingConfig sets volume per side in a reference currency or as a share
+// of available balance instead of fixed amount of base asset. Volume is
+// converted on every update.
+type SizingConfig struct {
+	// Volume per side in currency units, e.g. 5000
+	Value float64 `json:"value"`
+	// Chain asset or currency known to the price provider, e.g. USD
+	Currency string `json:"currency"`
+	// Volume per side as a share of available balance of that side, e.g. 0.25
+	Balance float64 `json:"balance"`
+	// Limits of volume per side in base asset units, zero disables
+	MinAmount float64 `json:"min_amount"`
+	MaxAmount float64 `json:"max_amount"`
+}
+
+// clamp applies min and max amount
+func (c *SizingConfig) clamp(amount float64) float64 {
+	if c.MaxAmount > 0 && amount > c.MaxAmount {
+		amount = c.MaxAmount
+	}
+	if amount < c.MinAmount {
+		amount = c.MinAmount
+	}
+	return amount
+}
+
+// sizer converts notional volume to base asset, used by worker goroutine only
+type sizer struct {
+	cfg *SizingConfig
+	// market of base asset priced in currency
+	market   Market
+	provider PriceProvider
+	// last converted volume is used while currency price is missing
+	last float64
+}
+
+// newSizer creates price provider of base asset in sizing currency
+func (m *MarketMaker) newSizer() (*sizer, error) {
+	cfg := m.cfg.Market.Sizing
+	if cfg == nil {
+		return nil, nil
+	}
+
+	s := &sizer{cfg: cfg}
+	if cfg.Value == 0 || cfg.Currency == m.market.Base.Symbol {
+		return s, nil
+	}
+	if cfg.Currency == m.market.Quote.Symbol {
+		s.market = m.market
+		s.provider = m.priceProvider
+		return s, nil
+	}
+
+	// currency may be off chain, e.g. USD
+	currency := objects.Asset{Symbol: cfg.Currency, Precision: m.market.Base.Precision}
+	if a := m.assetCache.GetBySymbol(cfg.Currency); a != nil {
+		currency = *a
+	}
+	s.market = Market{Base: m.market.Base, Quote: currency}
+
+	p, err := m.factory.GetProvider(&s.market)
+	if err != nil {
+		return nil, errors.Annotatef(err, "price provider for %s", s.market.DisplayName())
+	}
+	s.provider = p
+	return s, nil
+}
+
+// notional returns volume per side in base asset units
+func (s *sizer) notional() (float64, error) {
+	if s.provider == nil {
+		return s.cfg.Value, nil
+	}
+
+	rate := s.market.GetRate(s.provider.GetPrice()).Value()
+	if rate == 0 {
+		if s.last > 0 {
+			return s.last, fmt.Errorf("No price of %s, using previous volume", s.market.DisplayName())
+		}
+		return 0, fmt.Errorf("No price of %s", s.market.DisplayName())
+	}
+
+	s.last = s.cfg.Value / rate
+	return s.last, nil
+}
+
+// orderVolume returns volume per side in base asset satoshi. Available
+// volumes of both sides are in base asset satoshi as well. Amount of the
+// profile in force replaces sizing.
+func (m *MarketMaker) orderVolume(baseAvailable, quoteAvailable *big.Float) (sell, buy *big.Float, err error) {
+	unit := math.Pow10(m.market.Base.Precision)
+	if m.sizer == nil || m.schedule.amount() > 0 {
+		amount := new(big.Float).SetUint64(uint64(m.market.Base.CreateAmount(m.params.Amount).Amount))
+		return amount, amount, nil
+	}
+
+	cfg := m.sizer.cfg
+	var sellAmount, buyAmount float64
+	if cfg.Value > 0 {
+		amount, err := m.sizer.notional()
+		if amount == 0 {
+			return nil, nil, err
+		} else if err != nil {
+			m.log.Warnf("%v", err)
+		}
+		sellAmount, buyAmount = amount, amount
+	} else {
+		base, _ := baseAvailable.Float64()
+		quote, _ := quoteAvailable.Float64()
+		sellAmount = cfg.Balance * base / unit
+		buyAmount = cfg.Balance * quote / unit
+	}
+
+	sellAmount, buyAmount = cfg.clamp(sellAmount), cfg.clamp(buyAmount)
+	m.log.Debugf("Volume per side: sell=%f buy=%f %s", sellAmount, buyAmount, m.market.Base.Symbol)
+
+	return big.NewFloat(math.Floor(sellAmount * unit)), big.NewFloat(math.Floor(buyAmount * unit)), nil
+}
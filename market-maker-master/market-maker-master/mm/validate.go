@@ -0,0 +1,354 @@
+package mm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+// minExpiration is the shortest order expiration in seconds which leaves
+// time to re-create orders before they expire
+const minExpiration = 10
+
+// ValidationError describes single configuration problem
+type ValidationError struct {
+	// Path of the field in configuration, e.g. markets[1].spread
+	Field      string
+	Message    string
+	Suggestion string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Suggestion == "" {
+		return fmt.Sprintf("%s: %s", e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (%s)", e.Field, e.Message, e.Suggestion)
+}
+
+// ValidationErrors collects all problems found in configuration
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	lines := make([]string, 0, len(e)+1)
+	lines = append(lines, fmt.Sprintf("%d configuration problem(s):", len(e)))
+	for _, err := range e {
+		lines = append(lines, "  "+err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (e *ValidationErrors) Add(field, message, suggestion string) {
+	*e = append(*e, &ValidationError{Field: field, Message: message, Suggestion: suggestion})
+}
+
+// Err returns nil if no problems were found
+func (e ValidationErrors) Err() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// AssetLookup finds assets by symbol, api.AssetCache implements it
+type AssetLookup interface {
+	GetBySymbol(symbol string) *objects.Asset
+}
+
+// Validate checks market parameters, path is used as prefix of field names
+func (c *MarketConfig) Validate(path string, errs *ValidationErrors) {
+	field := func(name string) string {
+		return path + "." + name
+	}
+
+	if c.Base == "" {
+		errs.Add(field("base"), "is empty", `set asset symbol, e.g. "OTN"`)
+	}
+	if c.Quote == "" {
+		errs.Add(field("quote"), "is empty", `set asset symbol, e.g. "BTC"`)
+	}
+	if c.Base != "" && c.Base == c.Quote {
+		errs.Add(field("quote"), fmt.Sprintf("is the same as base (%s)", c.Base), "use different assets")
+	}
+
+	// grid and execution do not use ladder parameters
+	if c.Grid != nil && c.Execution != nil {
+		errs.Add(field("execution"), "can not be used together with grid", "configure them on different markets")
+	}
+	if c.Schedule != nil && (c.Grid != nil || c.Execution != nil) {
+		errs.Add(field("schedule"), "can only be used by ladder markets", "remove schedule from grid and execution markets")
+	}
+	if c.Grid != nil {
+		c.Grid.validate(field("grid"), errs)
+		c.validateExpiration(field("expiration"), errs)
+		return
+	}
+	if c.Execution != nil {
+		c.Execution.validate(field("execution"), errs)
+		c.validateExpiration(field("expiration"), errs)
+		if c.Threshold < 0 || c.Threshold >= 1 {
+			errs.Add(field("threshold"), fmt.Sprintf("must be in range [0, 1), got %g", c.Threshold),
+				"child order is re-created when its price moves by this fraction")
+		}
+		return
+	}
+
+	if c.OrderCount < 1 {
+		errs.Add(field("orders"), fmt.Sprintf("must be at least 1, got %d", c.OrderCount),
+			"no orders would be created")
+	}
+	if c.Sizing != nil {
+		c.Sizing.validate(field("sizing"), errs)
+	} else if c.Amount <= 0 {
+		errs.Add(field("amount"), fmt.Sprintf("must be positive, got %g", c.Amount),
+			"set volume per side in base asset units")
+	}
+
+	if c.Spread <= 0 {
+		errs.Add(field("spread"), fmt.Sprintf("must be positive, got %g", c.Spread),
+			"orders would be placed at or through the reference price")
+	} else if c.Spread >= 1 {
+		errs.Add(field("spread"), fmt.Sprintf("must be less than 1, got %g", c.Spread),
+			"spread is a fraction of price, use 0.05 for 5%")
+	}
+	if c.SpreadStep < 0 {
+		errs.Add(field("spread_step"), fmt.Sprintf("must not be negative, got %g", c.SpreadStep),
+			"outer orders would be placed closer to the reference price than inner ones")
+	}
+
+	if c.Threshold < 0 || c.Threshold >= 1 {
+		errs.Add(field("threshold"), fmt.Sprintf("must be in range [0, 1), got %g", c.Threshold),
+			"threshold is a fraction of price change that triggers update, use 0.01 for 1%")
+	}
+
+	c.validateExpiration(field("expiration"), errs)
+
+	if c.Schedule != nil {
+		c.Schedule.validate(field("schedule"), c, errs)
+	}
+
+	if r := c.Randomize; r != nil {
+		if r.Size < 0 || r.Size >= 1 {
+			errs.Add(field("randomize.size"), fmt.Sprintf("must be in range [0, 1), got %g", r.Size),
+				"size is a fraction of average order size, use 0.3 for 30%")
+		}
+		if r.Spread < 0 || r.Spread >= 1 {
+			errs.Add(field("randomize.spread"), fmt.Sprintf("must be in range [0, 1), got %g", r.Spread),
+				"spread is a fraction of spread_step, use 0.5 for 50%")
+		}
+		if r.Jitter < 0 || r.Jitter >= 1 {
+			errs.Add(field("randomize.jitter"), fmt.Sprintf("must be in range [0, 1), got %g", r.Jitter),
+				"jitter is a fraction of update interval, use 0.2 for 20%")
+		}
+		if r.MinOrders < 0 || r.MinOrders > c.OrderCount {
+			errs.Add(field("randomize.min_orders"), fmt.Sprintf("must be in range [0, %d], got %d", c.OrderCount, r.MinOrders),
+				"min_orders can not exceed orders")
+		}
+	}
+
+	if r := c.Rebalance; r != nil {
+		if r.Target < 0 || r.Target >= 1 {
+			errs.Add(field("rebalance.target"), fmt.Sprintf("must be in range [0, 1), got %g", r.Target),
+				"target is a share of base asset in inventory value, use 0.5 for equal value")
+		}
+		if r.Limit <= 0 || r.Limit >= 1 {
+			errs.Add(field("rebalance.limit"), fmt.Sprintf("must be in range (0, 1), got %g", r.Limit),
+				"limit is a deviation of base share from target, use 0.2 for 20%")
+		}
+		if r.MaxSlippage <= 0 || r.MaxSlippage >= 1 {
+			errs.Add(field("rebalance.max_slippage"), fmt.Sprintf("must be in range (0, 1), got %g", r.MaxSlippage),
+				"slippage is a fraction of reference price, use 0.01 for 1%")
+		}
+		if r.DailyBudget <= 0 {
+			errs.Add(field("rebalance.daily_budget"), fmt.Sprintf("must be positive, got %g", r.DailyBudget),
+				"set maximum base asset amount traded per day")
+		}
+	}
+
+	if l := c.LowBalance; l != nil {
+		if l.Base < 0 {
+			errs.Add(field("low_balance.base"), fmt.Sprintf("must not be negative, got %g", l.Base), "")
+		}
+		if l.Quote < 0 {
+			errs.Add(field("low_balance.quote"), fmt.Sprintf("must not be negative, got %g", l.Quote), "")
+		}
+	}
+}
+
+func (c *MarketConfig) validateExpiration(field string, errs *ValidationErrors) {
+	if c.Expiration < minExpiration {
+		errs.Add(field, fmt.Sprintf("must be at least %d seconds, got %d", minExpiration, c.Expiration),
+			"orders would expire before they are re-created")
+	}
+}
+
+func (c *SizingConfig) validate(path string, errs *ValidationErrors) {
+	field := func(name string) string {
+		return path + "." + name
+	}
+
+	switch {
+	case c.Value < 0:
+		errs.Add(field("value"), fmt.Sprintf("must not be negative, got %g", c.Value), "")
+	case c.Balance < 0 || c.Balance > 1:
+		errs.Add(field("balance"), fmt.Sprintf("must be in range [0, 1], got %g", c.Balance),
+			"balance is a share of available balance, use 0.25 for 25%")
+	case (c.Value > 0) == (c.Balance > 0):
+		errs.Add(path, "exactly one of value and balance must be set",
+			`use "value" with "currency" for notional volume or "balance" for a share of balance`)
+	case c.Value > 0 && c.Currency == "":
+		errs.Add(field("currency"), "is empty", `set reference currency, e.g. "USD"`)
+	}
+
+	if c.MinAmount < 0 {
+		errs.Add(field("min_amount"), fmt.Sprintf("must not be negative, got %g", c.MinAmount), "")
+	}
+	if c.MaxAmount < 0 || (c.MaxAmount > 0 && c.MaxAmount < c.MinAmount) {
+		errs.Add(field("max_amount"), fmt.Sprintf("must be zero or not less than min_amount, got %g", c.MaxAmount), "")
+	}
+}
+
+func (c *GridConfig) validate(path string, errs *ValidationErrors) {
+	field := func(name string) string {
+		return path + "." + name
+	}
+
+	if c.Low <= 0 {
+		errs.Add(field("low"), fmt.Sprintf("must be positive, got %g", c.Low), "set the lowest price, quote per base")
+	}
+	if c.High <= c.Low {
+		errs.Add(field("high"), fmt.Sprintf("must be greater than low (%g), got %g", c.Low, c.High), "")
+	}
+	if c.Levels < 2 {
+		errs.Add(field("levels"), fmt.Sprintf("must be at least 2, got %d", c.Levels),
+			"levels include both low and high prices")
+	}
+	if c.Amount <= 0 {
+		errs.Add(field("amount"), fmt.Sprintf("must be positive, got %g", c.Amount),
+			"set order size in base asset units")
+	}
+	if c.Start != 0 && (c.Start < c.Low || c.Start > c.High) {
+		errs.Add(field("start"), fmt.Sprintf("must be between low and high, got %g", c.Start),
+			"use 0 to start from the middle of the order book")
+	}
+	if c.State == "" {
+		errs.Add(field("state"), "is empty", "set file path to keep grid state across restarts")
+	}
+}
+
+func (c *ExecutionConfig) validate(path string, errs *ValidationErrors) {
+	field := func(name string) string {
+		return path + "." + name
+	}
+
+	if c.Side != SideSell && c.Side != SideBuy {
+		errs.Add(field("side"), fmt.Sprintf("must be %q or %q, got %q", SideSell, SideBuy, c.Side), "side refers to base asset")
+	}
+	if c.Amount <= 0 {
+		errs.Add(field("amount"), fmt.Sprintf("must be positive, got %g", c.Amount),
+			"set parent order size in base asset units")
+	}
+	switch c.Schedule {
+	case ScheduleTWAP:
+		if c.Duration <= 0 {
+			errs.Add(field("duration"), fmt.Sprintf("must be positive, got %d", c.Duration),
+				"set schedule length in seconds, e.g. 604800 for a week")
+		}
+	case ScheduleVWAP:
+		if c.Participation <= 0 || c.Participation > 1 {
+			errs.Add(field("participation"), fmt.Sprintf("must be in range (0, 1], got %g", c.Participation),
+				"participation is a share of market volume, use 0.1 for 10%")
+		}
+	default:
+		errs.Add(field("schedule"), fmt.Sprintf("must be %q or %q, got %q", ScheduleTWAP, ScheduleVWAP, c.Schedule), "")
+	}
+	if c.MaxDeviation < 0 || c.MaxDeviation >= 1 {
+		errs.Add(field("max_deviation"), fmt.Sprintf("must be in range [0, 1), got %g", c.MaxDeviation),
+			"deviation is a fraction of reference price, use 0.01 for 1%")
+	}
+	if c.LimitPrice < 0 {
+		errs.Add(field("limit_price"), fmt.Sprintf("must not be negative, got %g", c.LimitPrice), "use 0 to disable")
+	}
+	if c.MinChild < 0 || c.MinChild > c.Amount {
+		errs.Add(field("min_child"), fmt.Sprintf("must be in range [0, amount], got %g", c.MinChild), "")
+	}
+	if c.State == "" {
+		errs.Add(field("state"), "is empty", "set file path to keep execution progress across restarts")
+	}
+}
+
+// ValidateMarkets checks parameters of every market and, if assets is not nil,
+// that market assets exist on chain
+func ValidateMarkets(markets []MarketConfig, assets AssetLookup) ValidationErrors {
+	var errs ValidationErrors
+	seen := make(map[string]int)
+
+	for i := range markets {
+		c := &markets[i]
+		path := fmt.Sprintf("markets[%d]", i)
+		c.Validate(path, &errs)
+
+		name := c.Base + "/" + c.Quote
+		if j, ok := seen[name]; ok {
+			errs.Add(path, fmt.Sprintf("market %s is already configured in markets[%d]", name, j),
+				"remove one of them")
+		} else {
+			seen[name] = i
+		}
+	}
+
+	if assets != nil {
+		validateAssets(markets, assets, &errs)
+	}
+
+	return errs
+}
+
+// ValidateMarketAccess checks that account can place orders on every
+// market, i.e. whitelist and blacklist rules of market assets allow it
+func ValidateMarketAccess(markets []MarketConfig, account *objects.Account, assets AssetLookup) ValidationErrors {
+	var errs ValidationErrors
+	for i := range markets {
+		base, quote := assets.GetBySymbol(markets[i].Base), assets.GetBySymbol(markets[i].Quote)
+		if base == nil || quote == nil {
+			// reported by ValidateMarkets
+			continue
+		}
+
+		market := Market{Base: *base, Quote: *quote}
+		if err := market.Authorize(account); err != nil {
+			errs.Add(fmt.Sprintf("markets[%d]", i), fmt.Sprintf("orders would be rejected: %v", err),
+				"ask the issuer to whitelist the account or remove the market")
+		}
+	}
+	return errs
+}
+
+func validateAssets(markets []MarketConfig, assets AssetLookup, errs *ValidationErrors) {
+	known := make(map[string]bool)
+	exists := func(symbol string) bool {
+		found, ok := known[symbol]
+		if !ok {
+			found = assets.GetBySymbol(symbol) != nil
+			known[symbol] = found
+		}
+		return found
+	}
+
+	check := func(field, symbol string) {
+		if symbol == "" || exists(symbol) {
+			return
+		}
+
+		suggestion := "check that asset exists on chain"
+		if upper := strings.ToUpper(symbol); upper != symbol && exists(upper) {
+			suggestion = fmt.Sprintf("did you mean %q?", upper)
+		}
+		errs.Add(field, fmt.Sprintf("unknown asset %q", symbol), suggestion)
+	}
+
+	for i := range markets {
+		check(fmt.Sprintf("markets[%d].base", i), markets[i].Base)
+		check(fmt.Sprintf("markets[%d].quote", i), markets[i].Quote)
+	}
+}
@@ -0,0 +1,186 @@
+package mm_test
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+type assetMap map[string]*objects.Asset
+
+func (a assetMap) GetBySymbol(symbol string) *objects.Asset {
+	return a[symbol]
+}
+
+func validMarket() mm.MarketConfig {
+	return mm.MarketConfig{
+		Base:       "OTN",
+		Quote:      "BTC",
+		Spread:     0.05,
+		Threshold:  0.01,
+		Expiration: 120,
+		Amount:     60000,
+		OrderCount: 3,
+		SpreadStep: 0.02,
+	}
+}
+
+func fields(errs mm.ValidationErrors) []string {
+	var result []string
+	for _, e := range errs {
+		result = append(result, e.Field)
+	}
+	return result
+}
+
+func TestValidateMarketsValid(t *testing.T) {
+	errs := mm.ValidateMarkets([]mm.MarketConfig{validMarket()}, nil)
+	assert.Empty(t, errs)
+	assert.NoError(t, errs.Err())
+}
+
+func TestValidateMarketsCollectsAll(t *testing.T) {
+	m := validMarket()
+	m.OrderCount = 0
+	m.Spread = -0.1
+	m.Threshold = 1.5
+	m.Expiration = 0
+
+	errs := mm.ValidateMarkets([]mm.MarketConfig{validMarket(), m}, nil)
+	assert.Equal(t, []string{
+		"markets[1].orders",
+		"markets[1].spread",
+		"markets[1].threshold",
+		"markets[1].expiration",
+		"markets[1]",
+	}, fields(errs))
+	assert.Error(t, errs.Err())
+}
+
+func TestValidateMarketsAssets(t *testing.T) {
+	assets := assetMap{
+		"OTN": &objects.Asset{Symbol: "OTN"},
+		"BTC": &objects.Asset{Symbol: "BTC"},
+	}
+
+	m := validMarket()
+	m.Quote = "btc"
+	n := validMarket()
+	n.Base = "XYZ"
+
+	errs := mm.ValidateMarkets([]mm.MarketConfig{m, n}, assets)
+	if assert.Len(t, errs, 2) {
+		assert.Equal(t, "markets[0].quote", errs[0].Field)
+		assert.Equal(t, `did you mean "BTC"?`, errs[0].Suggestion)
+		assert.Equal(t, "markets[1].base", errs[1].Field)
+	}
+}
+
+func TestValidateGrid(t *testing.T) {
+	m := mm.MarketConfig{
+		Base:       "OTN",
+		Quote:      "UIA",
+		Expiration: 3600,
+		Grid:       &mm.GridConfig{Low: 1, High: 2, Levels: 10, Amount: 100, State: "grid.json"},
+	}
+	assert.Empty(t, mm.ValidateMarkets([]mm.MarketConfig{m}, nil))
+
+	m.Grid = &mm.GridConfig{Low: 2, High: 1, Levels: 1, Start: 3}
+	errs := mm.ValidateMarkets([]mm.MarketConfig{m}, nil)
+	assert.Equal(t, []string{
+		"markets[0].grid.high",
+		"markets[0].grid.levels",
+		"markets[0].grid.amount",
+		"markets[0].grid.start",
+		"markets[0].grid.state",
+	}, fields(errs))
+}
+
+func TestValidateSizing(t *testing.T) {
+	m := validMarket()
+	m.Amount = 0
+	m.Sizing = &mm.SizingConfig{Value: 5000, Currency: "USD", MinAmount: 100, MaxAmount: 50000}
+	assert.Empty(t, mm.ValidateMarkets([]mm.MarketConfig{m}, nil))
+
+	m.Sizing = &mm.SizingConfig{Value: 5000, Balance: 0.2, MinAmount: 100, MaxAmount: 10}
+	assert.Equal(t, []string{
+		"markets[0].sizing",
+		"markets[0].sizing.max_amount",
+	}, fields(mm.ValidateMarkets([]mm.MarketConfig{m}, nil)))
+
+	m.Sizing = &mm.SizingConfig{Value: 5000}
+	assert.Equal(t, []string{"markets[0].sizing.currency"}, fields(mm.ValidateMarkets([]mm.MarketConfig{m}, nil)))
+}
+
+func TestValidateLowBalance(t *testing.T) {
+	m := validMarket()
+	m.LowBalance = &mm.LowBalanceConfig{Base: 1000, Quote: -1}
+	assert.Equal(t, []string{"markets[0].low_balance.quote"}, fields(mm.ValidateMarkets([]mm.MarketConfig{m}, nil)))
+}
+
+func TestValidateRandomize(t *testing.T) {
+	m := validMarket()
+	m.Randomize = &mm.RandomizeConfig{Size: 0.3, Spread: 0.5, Jitter: 0.2, MinOrders: 2}
+	assert.Empty(t, mm.ValidateMarkets([]mm.MarketConfig{m}, nil))
+
+	// levels randomized by a whole step may swap with the next one
+	m.Randomize = &mm.RandomizeConfig{Spread: 1}
+	assert.Equal(t, []string{"markets[0].randomize.spread"}, fields(mm.ValidateMarkets([]mm.MarketConfig{m}, nil)))
+	m.Randomize = &mm.RandomizeConfig{Spread: -0.1}
+	assert.Equal(t, []string{"markets[0].randomize.spread"}, fields(mm.ValidateMarkets([]mm.MarketConfig{m}, nil)))
+}
+
+func TestValidateSchedule(t *testing.T) {
+	m := validMarket()
+	m.Schedule = &mm.ScheduleConfig{Timezone: "Europe/Berlin", Profiles: []mm.ProfileConfig{
+		{Name: "day", Start: "0 9 * * 1-5", Spread: 0.01},
+		{Name: "night", Start: "0 18 * * 1-5", Amount: 50, OrderCount: 2},
+	}}
+	assert.Empty(t, mm.ValidateMarkets([]mm.MarketConfig{m}, nil))
+
+	m.Schedule = &mm.ScheduleConfig{Timezone: "Mars/Olympus", Profiles: []mm.ProfileConfig{
+		{Name: "day", Start: "0 9 * *", Spread: 1},
+		{Name: "day", Start: "0 0 31 2 *", Threshold: -0.1},
+	}}
+	assert.Equal(t, []string{
+		"markets[0].schedule.timezone",
+		"markets[0].schedule.profiles[0].start",
+		"markets[0].schedule.profiles[0].spread",
+		"markets[0].schedule.profiles[1].name",
+		"markets[0].schedule.profiles[1].start",
+		"markets[0].schedule.profiles[1].threshold",
+	}, fields(mm.ValidateMarkets([]mm.MarketConfig{m}, nil)))
+}
+
+func TestValidateMarketAccess(t *testing.T) {
+	issuer := *objects.NewGrapheneID("1.2.50")
+	other := *objects.NewGrapheneID("1.2.51")
+	otn := &objects.Asset{ID: *objects.NewGrapheneID("1.3.0"), Symbol: "OTN"}
+	btc := &objects.Asset{ID: *objects.NewGrapheneID("1.3.1"), Symbol: "BTC"}
+	uia := &objects.Asset{ID: *objects.NewGrapheneID("1.3.2"), Symbol: "UIA"}
+	uia.Options.WhitelistAuthorities = objects.GrapheneIDs{issuer}
+	uia.Options.WhitelistMarkets = objects.GrapheneIDs{otn.ID}
+	assets := assetMap{"OTN": otn, "BTC": btc, "UIA": uia}
+
+	markets := []mm.MarketConfig{
+		{Base: "OTN", Quote: "BTC"},
+		{Base: "UIA", Quote: "OTN"},
+		{Base: "UIA", Quote: "BTC"},
+	}
+	account := &objects.Account{Name: "maker", WhitelistingAccounts: objects.GrapheneIDs{issuer}}
+	errs := mm.ValidateMarketAccess(markets, account, assets)
+	assert.Equal(t, []string{"markets[2]"}, fields(errs))
+	assert.Contains(t, errs[0].Message, "Issuer of UIA did not whitelist market with BTC")
+
+	account = &objects.Account{Name: "maker", WhitelistingAccounts: objects.GrapheneIDs{other}}
+	errs = mm.ValidateMarketAccess(markets[:2], account, assets)
+	assert.Equal(t, []string{"markets[1]"}, fields(errs))
+	assert.Contains(t, errs[0].Message, "Account maker is not whitelisted by any UIA authority")
+
+	btc.Options.BlacklistAuthorities = objects.GrapheneIDs{other}
+	account = &objects.Account{Name: "maker", BlacklistingAccounts: objects.GrapheneIDs{other}}
+	assert.Equal(t, []string{"markets[0]"}, fields(mm.ValidateMarketAccess(markets[:1], account, assets)))
+}
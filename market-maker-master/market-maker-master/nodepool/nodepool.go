@@ -0,0 +1,433 @@
+// Package nodepool watches health of several API nodes and picks the one
+// service should be connected to. Nodes are scored by latency, head block
+// freshness and error rate. When active node stalls or falls behind the
+// others, pool fails over to the best healthy node and notifies subscribers.
+package nodepool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultProbeInterval = 5  // seconds
+	defaultProbeTimeout  = 3  // seconds
+	defaultMaxHeadAge    = 30 // seconds
+	defaultMaxBlockLag   = 5
+	defaultMaxFailures   = 3
+
+	// weight of the latest probe in moving averages
+	ewmaWeight = 0.2
+	// node with higher error rate is not used
+	maxErrorRate = 0.5
+
+	// score penalties, lower score is better
+	blockLagPenalty  = 500 * time.Millisecond
+	errorRatePenalty = 5 * time.Second
+)
+
+// Addresses is a list of node websocket URLs. In JSON it is either
+// a single string or an array of strings.
+type Addresses []string
+
+func (a *Addresses) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*a = nil
+		} else {
+			*a = Addresses{single}
+		}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("Node address must be a string or an array of strings")
+	}
+	*a = list
+	return nil
+}
+
+// ExpandEnv replaces ${var} in every address
+func (a Addresses) ExpandEnv() Addresses {
+	res := make(Addresses, len(a))
+	for i := range a {
+		res[i] = os.ExpandEnv(a[i])
+	}
+	return res
+}
+
+func (a Addresses) String() string {
+	return fmt.Sprint([]string(a))
+}
+
+type Config struct {
+	// Seconds between probes of every node
+	ProbeInterval int `json:"probe_interval"`
+	// Seconds to wait for node response
+	ProbeTimeout int `json:"probe_timeout"`
+	// Node is stalled if its head block is older than this many seconds
+	MaxHeadAge int `json:"max_head_age"`
+	// Node is behind if its head is this many blocks behind the best node
+	MaxBlockLag int `json:"max_block_lag"`
+	// Node is unhealthy after this many probes failed in a row
+	MaxFailures int `json:"max_failures"`
+}
+
+func (c *Config) withDefaults() Config {
+	res := Config{}
+	if c != nil {
+		res = *c
+	}
+	if res.ProbeInterval <= 0 {
+		res.ProbeInterval = defaultProbeInterval
+	}
+	if res.ProbeTimeout <= 0 {
+		res.ProbeTimeout = defaultProbeTimeout
+	}
+	if res.MaxHeadAge <= 0 {
+		res.MaxHeadAge = defaultMaxHeadAge
+	}
+	if res.MaxBlockLag <= 0 {
+		res.MaxBlockLag = defaultMaxBlockLag
+	}
+	if res.MaxFailures <= 0 {
+		res.MaxFailures = defaultMaxFailures
+	}
+	return res
+}
+
+type EventType int
+
+const (
+	// EventFailover means active node was replaced by Event.To,
+	// services should pause and reconnect
+	EventFailover EventType = iota
+	// EventUnavailable means active node is unhealthy and there is no
+	// healthy node to fail over to, services should pause
+	EventUnavailable
+	// EventRecovered means active node Event.To is healthy again
+	EventRecovered
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventFailover:
+		return "failover"
+	case EventUnavailable:
+		return "unavailable"
+	case EventRecovered:
+		return "recovered"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+type Event struct {
+	Type EventType
+	From string
+	To   string
+	// Why previous node was abandoned
+	Reason string
+}
+
+// NodeStatus is a snapshot of node health
+type NodeStatus struct {
+	URL       string
+	Active    bool
+	Healthy   bool
+	Head      Head
+	Latency   time.Duration
+	ErrorRate float64
+	Score     time.Duration
+	// Why node is unhealthy
+	Reason string
+}
+
+type node struct {
+	url       string
+	head      Head
+	latency   time.Duration
+	errorRate float64
+	lastErr   error
+	// probes failed in a row
+	failures int
+	probed   bool
+
+	// evaluated on every round
+	healthy bool
+	score   time.Duration
+	reason  string
+}
+
+func (n *node) update(head *Head, latency time.Duration, err error) {
+	n.lastErr = err
+	if err != nil {
+		n.failures++
+		n.errorRate += ewmaWeight * (1 - n.errorRate)
+		return
+	}
+
+	n.failures = 0
+	n.head = *head
+	n.errorRate -= ewmaWeight * n.errorRate
+	if !n.probed {
+		n.latency = latency
+	} else {
+		n.latency += time.Duration(ewmaWeight * float64(latency-n.latency))
+	}
+	n.probed = true
+}
+
+type Manager struct {
+	nodes  []*node
+	cfg    Config
+	prober Prober
+	log    *zap.SugaredLogger
+	now    func() time.Time
+
+	mutex     sync.Mutex
+	active    int
+	available bool
+	handlers  []func(Event)
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func New(addrs Addresses, cfg *Config, log *zap.SugaredLogger) (*Manager, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("No nodes configured")
+	}
+
+	nodes := make([]*node, len(addrs))
+	for i, url := range addrs {
+		nodes[i] = &node{url: url}
+	}
+
+	return &Manager{
+		nodes:     nodes,
+		cfg:       cfg.withDefaults(),
+		prober:    NewProber(),
+		log:       log,
+		now:       time.Now,
+		available: true,
+	}, nil
+}
+
+// Subscribe adds handler called on every pool event. Handlers are called
+// from pool goroutine and should not block.
+func (m *Manager) Subscribe(handler func(Event)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.handlers = append(m.handlers, handler)
+}
+
+// Active returns address of the node service should use
+func (m *Manager) Active() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.nodes[m.active].url
+}
+
+// Status returns health of every node
+func (m *Manager) Status() []NodeStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	res := make([]NodeStatus, len(m.nodes))
+	for i, n := range m.nodes {
+		res[i] = NodeStatus{
+			URL:       n.url,
+			Active:    i == m.active,
+			Healthy:   n.healthy,
+			Head:      n.head,
+			Latency:   n.latency,
+			ErrorRate: n.errorRate,
+			Score:     n.score,
+			Reason:    n.reason,
+		}
+	}
+	return res
+}
+
+// Start probes all nodes, selects the best one and starts watching them
+func (m *Manager) Start() {
+	m.probe()
+
+	m.mutex.Lock()
+	m.evaluate()
+	if best := m.best(-1); best >= 0 {
+		m.active = best
+	} else {
+		m.available = false
+		m.log.Warnf("No healthy API node, using %s", m.nodes[m.active].url)
+	}
+	m.log.Infof("Using API node %s", m.nodes[m.active].url)
+	m.mutex.Unlock()
+
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.worker()
+}
+
+func (m *Manager) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	<-m.done
+}
+
+func (m *Manager) worker() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(time.Duration(m.cfg.ProbeInterval) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// check runs single probe round and fails over if needed
+func (m *Manager) check() {
+	m.probe()
+
+	m.mutex.Lock()
+	m.evaluate()
+	events := m.decide()
+	handlers := m.handlers
+	m.mutex.Unlock()
+
+	for _, e := range events {
+		switch e.Type {
+		case EventFailover:
+			m.log.Warnf("API node %s failed (%s), switching to %s", e.From, e.Reason, e.To)
+		case EventUnavailable:
+			m.log.Errorf("API node %s failed (%s), no healthy node to switch to", e.From, e.Reason)
+		case EventRecovered:
+			m.log.Infof("API node %s recovered", e.To)
+		}
+
+		for _, h := range handlers {
+			h(e)
+		}
+	}
+}
+
+// probe queries all nodes concurrently
+func (m *Manager) probe() {
+	timeout := time.Duration(m.cfg.ProbeTimeout) * time.Second
+
+	var wg sync.WaitGroup
+	for _, n := range m.nodes {
+		wg.Add(1)
+		go func(n *node) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			start := time.Now()
+			head, err := m.prober.Probe(ctx, n.url)
+			latency := time.Since(start)
+
+			m.mutex.Lock()
+			n.update(head, latency, err)
+			m.mutex.Unlock()
+		}(n)
+	}
+	wg.Wait()
+}
+
+// evaluate updates health and score of every node
+func (m *Manager) evaluate() {
+	var bestHead uint32
+	for _, n := range m.nodes {
+		if n.failures < m.cfg.MaxFailures && n.probed && n.head.Number > bestHead {
+			bestHead = n.head.Number
+		}
+	}
+
+	now := m.now()
+	maxAge := time.Duration(m.cfg.MaxHeadAge) * time.Second
+
+	for _, n := range m.nodes {
+		n.healthy = false
+		n.score = 0
+
+		lag := bestHead - n.head.Number
+		age := now.Sub(n.head.Time)
+
+		switch {
+		case n.failures >= m.cfg.MaxFailures:
+			n.reason = fmt.Sprintf("probe failed: %v", n.lastErr)
+		case !n.probed:
+			n.reason = "not probed"
+		case age > maxAge:
+			n.reason = fmt.Sprintf("head block is %s old", age.Truncate(time.Second))
+		case lag > uint32(m.cfg.MaxBlockLag):
+			n.reason = fmt.Sprintf("%d blocks behind", lag)
+		case n.errorRate >= maxErrorRate:
+			n.reason = fmt.Sprintf("error rate %.0f%%", n.errorRate*100)
+		default:
+			n.reason = ""
+			n.healthy = true
+			n.score = n.latency +
+				time.Duration(lag)*blockLagPenalty +
+				time.Duration(n.errorRate*float64(errorRatePenalty))
+		}
+	}
+}
+
+// best returns index of the healthy node with the lowest score, skipping
+// node at index skip. Returns -1 if there is no healthy node.
+func (m *Manager) best(skip int) int {
+	best := -1
+	for i, n := range m.nodes {
+		if i == skip || !n.healthy {
+			continue
+		}
+		if best < 0 || n.score < m.nodes[best].score {
+			best = i
+		}
+	}
+	return best
+}
+
+// decide switches active node if it is unhealthy. Healthy node is kept
+// even if another one scores better to avoid needless reconnects.
+func (m *Manager) decide() []Event {
+	active := m.nodes[m.active]
+	if active.healthy {
+		if !m.available {
+			m.available = true
+			return []Event{{Type: EventRecovered, To: active.url}}
+		}
+		return nil
+	}
+
+	if best := m.best(m.active); best >= 0 {
+		m.active = best
+		m.available = true
+		return []Event{{Type: EventFailover, From: active.url, To: m.nodes[best].url, Reason: active.reason}}
+	}
+
+	if m.available {
+		m.available = false
+		return []Event{{Type: EventUnavailable, From: active.url, Reason: active.reason}}
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package nodepool
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// fakeNode is in-process websocket node answering get_dynamic_global_properties
+type fakeNode struct {
+	*httptest.Server
+
+	mutex    sync.Mutex
+	head     Head
+	down     bool
+	upgrader websocket.Upgrader
+}
+
+func newFakeNode(t *testing.T, number uint32, headTime time.Time) *fakeNode {
+	n := &fakeNode{head: Head{Number: number, Time: headTime}}
+	n.Server = httptest.NewServer(http.HandlerFunc(n.serve))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *fakeNode) URL() string {
+	return "ws" + strings.TrimPrefix(n.Server.URL, "http")
+}
+
+func (n *fakeNode) set(number uint32, headTime time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.head = Head{Number: number, Time: headTime}
+}
+
+func (n *fakeNode) setDown(down bool) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.down = down
+}
+
+func (n *fakeNode) serve(w http.ResponseWriter, r *http.Request) {
+	n.mutex.Lock()
+	down, head := n.down, n.head
+	n.mutex.Unlock()
+
+	if down {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := n.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	var req rpcRequest
+	if err := conn.ReadJSON(&req); err != nil {
+		return
+	}
+
+	result, _ := json.Marshal(&dynamicGlobalProperties{
+		HeadBlockNumber: head.Number,
+		Time:            head.Time.UTC().Format(headTimeFormat),
+	})
+	raw := json.RawMessage(result)
+	conn.WriteJSON(&rpcResponse{ID: req.ID, Result: &raw})
+}
+
+type recorder struct {
+	mutex  sync.Mutex
+	events []Event
+}
+
+func (r *recorder) handle(e Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) take() []Event {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	res := r.events
+	r.events = nil
+	return res
+}
+
+func newTestManager(t *testing.T, nodes ...*fakeNode) (*Manager, *recorder) {
+	addrs := make(Addresses, len(nodes))
+	for i, n := range nodes {
+		addrs[i] = n.URL()
+	}
+
+	m, err := New(addrs, &Config{ProbeInterval: 3600, ProbeTimeout: 2, MaxHeadAge: 30, MaxBlockLag: 5}, zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	rec := &recorder{}
+	m.Subscribe(rec.handle)
+	return m, rec
+}
+
+func TestAddressesUnmarshal(t *testing.T) {
+	var cfg struct {
+		Single Addresses `json:"single"`
+		List   Addresses `json:"list"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(`{"single": "ws://a", "list": ["ws://b", "ws://c"]}`), &cfg))
+	assert.Equal(t, Addresses{"ws://a"}, cfg.Single)
+	assert.Equal(t, Addresses{"ws://b", "ws://c"}, cfg.List)
+
+	assert.Error(t, json.Unmarshal([]byte(`{"list": 1}`), &cfg))
+}
+
+func TestStartPicksHealthyNode(t *testing.T) {
+	now := time.Now()
+	stalled := newFakeNode(t, 100, now.Add(-time.Minute))
+	behind := newFakeNode(t, 190, now)
+	good := newFakeNode(t, 200, now)
+
+	m, rec := newTestManager(t, stalled, behind, good)
+	m.Start()
+	defer m.Stop()
+
+	assert.Equal(t, good.URL(), m.Active())
+	assert.Empty(t, rec.take())
+
+	status := m.Status()
+	require.Len(t, status, 3)
+	assert.False(t, status[0].Healthy)
+	assert.Contains(t, status[0].Reason, "old")
+	assert.False(t, status[1].Healthy)
+	assert.Equal(t, "10 blocks behind", status[1].Reason)
+	assert.True(t, status[2].Healthy)
+	assert.True(t, status[2].Active)
+}
+
+func TestFailoverWhenActiveStalls(t *testing.T) {
+	now := time.Now()
+	a := newFakeNode(t, 200, now)
+	b := newFakeNode(t, 200, now)
+
+	m, rec := newTestManager(t, a, b)
+	m.nodes[1].errorRate = 0.3 // make first node preferred
+	m.Start()
+	defer m.Stop()
+	require.Equal(t, a.URL(), m.Active())
+
+	// healthy node is kept
+	m.check()
+	assert.Empty(t, rec.take())
+
+	// first node stops producing blocks while second one goes on
+	m.now = func() time.Time { return now.Add(time.Minute) }
+	b.set(220, now.Add(time.Minute))
+	m.check()
+
+	events := rec.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, EventFailover, events[0].Type)
+	assert.Equal(t, a.URL(), events[0].From)
+	assert.Equal(t, b.URL(), events[0].To)
+	assert.Contains(t, events[0].Reason, "head block is 1m0s old")
+	assert.Equal(t, b.URL(), m.Active())
+}
+
+func TestFailoverWhenActiveFallsBehind(t *testing.T) {
+	now := time.Now()
+	a := newFakeNode(t, 200, now)
+	b := newFakeNode(t, 200, now)
+
+	m, rec := newTestManager(t, a, b)
+	m.nodes[1].errorRate = 0.3
+	m.Start()
+	defer m.Stop()
+
+	b.set(210, now)
+	m.check()
+
+	events := rec.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, EventFailover, events[0].Type)
+	assert.Equal(t, "10 blocks behind", events[0].Reason)
+	assert.Equal(t, b.URL(), m.Active())
+}
+
+func TestUnavailableAndRecovered(t *testing.T) {
+	now := time.Now()
+	a := newFakeNode(t, 200, now)
+	b := newFakeNode(t, 200, now)
+
+	m, rec := newTestManager(t, a, b)
+	m.nodes[1].errorRate = 0.3
+	m.Start()
+	defer m.Stop()
+
+	a.setDown(true)
+	b.setDown(true)
+	for i := 1; i < defaultMaxFailures; i++ {
+		m.check()
+	}
+	assert.Empty(t, rec.take())
+	m.check()
+
+	events := rec.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, EventUnavailable, events[0].Type)
+	assert.Equal(t, a.URL(), events[0].From)
+	assert.Contains(t, events[0].Reason, "probe failed")
+
+	// no repeated events while still down
+	m.check()
+	assert.Empty(t, rec.take())
+
+	a.setDown(false)
+	m.check()
+
+	events = rec.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, EventRecovered, events[0].Type)
+	assert.Equal(t, a.URL(), events[0].To)
+}
+
+func TestSingleFailedProbeKeepsNode(t *testing.T) {
+	now := time.Now()
+	a := newFakeNode(t, 200, now)
+	b := newFakeNode(t, 200, now)
+
+	m, rec := newTestManager(t, a, b)
+	m.cfg.MaxFailures = 2
+	m.nodes[1].errorRate = 0.3
+	m.Start()
+	defer m.Stop()
+
+	// failure in between successful probes is tolerated
+	a.setDown(true)
+	m.check()
+	a.setDown(false)
+	m.check()
+	a.setDown(true)
+	m.check()
+	assert.Empty(t, rec.take())
+	assert.Equal(t, a.URL(), m.Active())
+
+	m.check()
+	events := rec.take()
+	require.Len(t, events, 1)
+	assert.Equal(t, EventFailover, events[0].Type)
+	assert.Equal(t, b.URL(), events[0].To)
+}
+
+func TestFlappingNodeIsNotUsed(t *testing.T) {
+	now := time.Now()
+	a := newFakeNode(t, 200, now)
+
+	m, _ := newTestManager(t, a)
+	m.Start()
+	defer m.Stop()
+
+	for i := 0; i < 5; i++ {
+		a.setDown(true)
+		m.check()
+	}
+	a.setDown(false)
+	m.check()
+
+	status := m.Status()
+	assert.False(t, status[0].Healthy)
+	assert.Contains(t, status[0].Reason, "error rate")
+}
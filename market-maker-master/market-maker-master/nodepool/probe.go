@@ -0,0 +1,98 @@
+package nodepool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/juju/errors"
+)
+
+// chain time format used by graphene nodes
+const headTimeFormat = "2006-01-02T15:04:05"
+
+// Head is the head block reported by node
+type Head struct {
+	Number uint32
+	Time   time.Time
+}
+
+// Prober queries head block of the node
+type Prober interface {
+	Probe(ctx context.Context, url string) (*Head, error)
+}
+
+type rpcRequest struct {
+	ID     int           `json:"id"`
+	Method string        `json:"method"`
+	Params []interface{} `json:"params"`
+}
+
+type rpcResponse struct {
+	ID     int              `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  *json.RawMessage `json:"error"`
+}
+
+type dynamicGlobalProperties struct {
+	HeadBlockNumber uint32 `json:"head_block_number"`
+	Time            string `json:"time"`
+}
+
+// wsProber opens new websocket connection for every probe and
+// calls get_dynamic_global_properties
+type wsProber struct {
+	dialer websocket.Dialer
+}
+
+// NewProber returns prober talking websocket JSON-RPC to the node
+func NewProber() Prober {
+	return &wsProber{}
+}
+
+func (p *wsProber) Probe(ctx context.Context, url string) (*Head, error) {
+	conn, _, err := p.dialer.DialContext(ctx, url, nil)
+	if err != nil {
+		return nil, errors.Annotate(err, "dial")
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetWriteDeadline(deadline)
+		conn.SetReadDeadline(deadline)
+	}
+
+	req := rpcRequest{
+		ID:     1,
+		Method: "call",
+		Params: []interface{}{"database", "get_dynamic_global_properties", []interface{}{}},
+	}
+	if err := conn.WriteJSON(&req); err != nil {
+		return nil, errors.Annotate(err, "send request")
+	}
+
+	var resp rpcResponse
+	if err := conn.ReadJSON(&resp); err != nil {
+		return nil, errors.Annotate(err, "read response")
+	}
+	if resp.Error != nil {
+		return nil, fmt.Errorf("Node returned error: %s", string(*resp.Error))
+	}
+	if resp.Result == nil {
+		return nil, fmt.Errorf("Node returned empty result")
+	}
+
+	var props dynamicGlobalProperties
+	if err := json.Unmarshal(*resp.Result, &props); err != nil {
+		return nil, errors.Annotate(err, "parse global properties")
+	}
+
+	t, err := time.ParseInLocation(headTimeFormat, props.Time, time.UTC)
+	if err != nil {
+		return nil, errors.Annotate(err, "parse head block time")
+	}
+
+	return &Head{Number: props.HeadBlockNumber, Time: t}, nil
+}
@@ -0,0 +1,368 @@
+// Package notify posts service events to webhooks, so that operators learn
+// about halted markets or failing broadcasts without watching logs.
+// Payloads are generic JSON, Slack or Telegram messages.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+)
+
+// Event types
+const (
+	EventMarketHalted      = "market_halted"
+	EventProviderDown      = "price_provider_down"
+	EventLowBalance        = "low_balance"
+	EventConfigReloaded    = "config_reloaded"
+	EventBroadcastFailing  = "broadcast_failing"
+	EventFeedPublishFailed = "feed_publish_failed"
+	EventCollateralLow     = "collateral_low"
+	EventMarginCall        = "margin_call"
+)
+
+// Severities, in increasing order
+const (
+	SeverityInfo    = "info"
+	SeverityWarning = "warning"
+	SeverityError   = "error"
+)
+
+// Webhook payload formats
+const (
+	FormatJSON     = "json"
+	FormatSlack    = "slack"
+	FormatTelegram = "telegram"
+)
+
+const (
+	defaultDedup     = 600 // seconds
+	defaultTimeout   = 10  // seconds
+	defaultRateLimit = 20  // events per minute
+	queueSize        = 100
+)
+
+var severities = map[string]int{
+	SeverityInfo:    0,
+	SeverityWarning: 1,
+	SeverityError:   2,
+}
+
+type Config struct {
+	Webhooks []WebhookConfig `json:"webhooks"`
+	// Seconds the same event is not posted again for
+	Dedup int `json:"dedup"`
+	// Timeout of a webhook call in seconds
+	Timeout int `json:"timeout"`
+}
+
+type WebhookConfig struct {
+	Name string `json:"name"`
+	// Environment variables are expanded, so that tokens stay out of config
+	URL string `json:"url"`
+	// json, slack or telegram
+	Format string `json:"format"`
+	// Telegram chat to post to
+	ChatID string `json:"chat_id"`
+	// Event types posted to this webhook, all if empty
+	Events []string `json:"events"`
+	// Events less severe than this are not posted
+	MinSeverity string `json:"min_severity"`
+	// Events posted per minute at most, the rest is dropped
+	RateLimit int `json:"rate_limit"`
+}
+
+// Event is posted as is in json format
+type Event struct {
+	Time     time.Time `json:"time"`
+	Service  string    `json:"service"`
+	Type     string    `json:"type"`
+	Severity string    `json:"severity"`
+	Market   string    `json:"market,omitempty"`
+	Asset    string    `json:"asset,omitempty"`
+	Message  string    `json:"message"`
+	// Same events not posted since the previous one
+	Suppressed int `json:"suppressed,omitempty"`
+}
+
+// key identifies the same event for deduplication
+func (e *Event) key() string {
+	return e.Type + "|" + e.Market + "|" + e.Asset
+}
+
+// text is the message of chat payloads
+func (e *Event) text() string {
+	subject := e.Service
+	if e.Market != "" {
+		subject += " " + e.Market
+	}
+	if e.Asset != "" {
+		subject += " " + e.Asset
+	}
+
+	text := fmt.Sprintf("[%s] %s %s: %s", strings.ToUpper(e.Severity), subject, e.Type, e.Message)
+	if e.Suppressed > 0 {
+		text += fmt.Sprintf(" (%d more since last notice)", e.Suppressed)
+	}
+	return text
+}
+
+type webhook struct {
+	cfg         WebhookConfig
+	url         string
+	events      map[string]bool
+	minSeverity int
+	rateLimit   int
+	// times of events posted within the last minute
+	sent []time.Time
+}
+
+func newWebhook(cfg WebhookConfig) (*webhook, error) {
+	w := &webhook{
+		cfg:       cfg,
+		url:       os.ExpandEnv(cfg.URL),
+		events:    make(map[string]bool, len(cfg.Events)),
+		rateLimit: cfg.RateLimit,
+	}
+	if w.url == "" {
+		return nil, errors.New("URL is empty")
+	}
+
+	switch cfg.Format {
+	case "":
+		w.cfg.Format = FormatJSON
+	case FormatJSON, FormatSlack:
+	case FormatTelegram:
+		if cfg.ChatID == "" {
+			return nil, errors.New("chat_id is required by telegram format")
+		}
+	default:
+		return nil, fmt.Errorf("Unknown format %q", cfg.Format)
+	}
+
+	if cfg.MinSeverity != "" {
+		level, ok := severities[cfg.MinSeverity]
+		if !ok {
+			return nil, fmt.Errorf("Unknown min_severity %q", cfg.MinSeverity)
+		}
+		w.minSeverity = level
+	}
+	if w.rateLimit <= 0 {
+		w.rateLimit = defaultRateLimit
+	}
+
+	for _, e := range cfg.Events {
+		w.events[e] = true
+	}
+	return w, nil
+}
+
+func (w *webhook) String() string {
+	if w.cfg.Name != "" {
+		return w.cfg.Name
+	}
+	return w.cfg.Format + " webhook"
+}
+
+// accepts routes event by type and severity
+func (w *webhook) accepts(e *Event) bool {
+	if len(w.events) > 0 && !w.events[e.Type] {
+		return false
+	}
+	return severities[e.Severity] >= w.minSeverity
+}
+
+// allow returns false if the webhook posted rateLimit events within
+// the last minute
+func (w *webhook) allow(now time.Time) bool {
+	n := 0
+	for _, t := range w.sent {
+		if now.Sub(t) < time.Minute {
+			w.sent[n] = t
+			n++
+		}
+	}
+	w.sent = w.sent[:n]
+
+	if len(w.sent) >= w.rateLimit {
+		return false
+	}
+	w.sent = append(w.sent, now)
+	return true
+}
+
+func (w *webhook) payload(e *Event) ([]byte, error) {
+	switch w.cfg.Format {
+	case FormatSlack:
+		return json.Marshal(map[string]string{"text": e.text()})
+	case FormatTelegram:
+		return json.Marshal(map[string]string{"chat_id": w.cfg.ChatID, "text": e.text()})
+	default:
+		return json.Marshal(e)
+	}
+}
+
+type dedupEntry struct {
+	posted     time.Time
+	suppressed int
+}
+
+// Notifier posts events in background. Nil notifier discards everything,
+// so services do not check if notifications are configured.
+type Notifier struct {
+	service  string
+	log      *zap.SugaredLogger
+	webhooks []*webhook
+	dedup    time.Duration
+	http     *http.Client
+	now      func() time.Time
+
+	mutex  sync.Mutex
+	seen   map[string]*dedupEntry
+	closed bool
+	queue  chan *Event
+	done   chan struct{}
+}
+
+func New(cfg *Config, service string, log *zap.SugaredLogger) (*Notifier, error) {
+	if len(cfg.Webhooks) == 0 {
+		return nil, errors.New("No webhooks configured")
+	}
+
+	n := &Notifier{
+		service: service,
+		log:     log,
+		dedup:   time.Duration(cfg.Dedup) * time.Second,
+		http:    &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+		now:     time.Now,
+		seen:    make(map[string]*dedupEntry),
+		queue:   make(chan *Event, queueSize),
+		done:    make(chan struct{}),
+	}
+	if cfg.Dedup <= 0 {
+		n.dedup = defaultDedup * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		n.http.Timeout = defaultTimeout * time.Second
+	}
+
+	for i, wc := range cfg.Webhooks {
+		w, err := newWebhook(wc)
+		if err != nil {
+			return nil, errors.Annotatef(err, "webhooks[%d]", i)
+		}
+		n.webhooks = append(n.webhooks, w)
+	}
+
+	go n.worker()
+	return n, nil
+}
+
+// Notify queues event for posting without waiting for webhooks. The same
+// event (type, market and asset) is posted at most once per dedup period,
+// the number of suppressed ones is posted with the next one.
+func (n *Notifier) Notify(e Event) {
+	if n == nil {
+		return
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.closed {
+		return
+	}
+
+	now := n.now()
+	if e.Time.IsZero() {
+		e.Time = now
+	}
+	if e.Severity == "" {
+		e.Severity = SeverityInfo
+	}
+	e.Service = n.service
+
+	key := e.key()
+	if d := n.seen[key]; d != nil && now.Sub(d.posted) < n.dedup {
+		d.suppressed++
+		return
+	} else if d != nil {
+		e.Suppressed = d.suppressed
+	}
+
+	select {
+	case n.queue <- &e:
+		n.seen[key] = &dedupEntry{posted: now}
+	default:
+		n.log.Warnf("Notification queue is full, dropped %s event", e.Type)
+	}
+}
+
+// Close posts queued events and stops the notifier
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+
+	n.mutex.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mutex.Unlock()
+
+	<-n.done
+}
+
+func (n *Notifier) worker() {
+	defer close(n.done)
+
+	for e := range n.queue {
+		for _, w := range n.webhooks {
+			if !w.accepts(e) {
+				continue
+			}
+			if !w.allow(n.now()) {
+				n.log.Warnw("Webhook rate limit reached, event dropped", "webhook", w.String(), "event", e.Type)
+				continue
+			}
+			if err := n.post(w, e); err != nil {
+				n.log.Errorw(fmt.Sprintf("Failed to post event: %v", err), "webhook", w.String(), "event", e.Type)
+			}
+		}
+	}
+}
+
+func (n *Notifier) post(w *webhook, e *Event) error {
+	data, err := w.payload(e)
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.http.Post(w.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// URL may contain token
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("Webhook returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+// receiver records bodies posted to each path
+type receiver struct {
+	*httptest.Server
+	mutex  sync.Mutex
+	bodies map[string][]map[string]interface{}
+}
+
+func newReceiver(t *testing.T) *receiver {
+	r := &receiver{bodies: make(map[string][]map[string]interface{})}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		data, _ := ioutil.ReadAll(req.Body)
+		var body map[string]interface{}
+		if err := json.Unmarshal(data, &body); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		r.bodies[req.URL.Path] = append(r.bodies[req.URL.Path], body)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) posted(path string) []map[string]interface{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.bodies[path]
+}
+
+// newTestNotifier returns notifier with clock moved by the returned function
+func newTestNotifier(t *testing.T, cfg *Config) (*Notifier, func(time.Duration)) {
+	n, err := New(cfg, "market-maker", zap.NewNop().Sugar())
+	require.NoError(t, err)
+
+	var mutex sync.Mutex
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	n.now = func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		now = now.Add(d)
+	}
+	return n, advance
+}
+
+func TestFormatsAndRouting(t *testing.T) {
+	r := newReceiver(t)
+	os.Setenv("NOTIFY_TEST_TOKEN", "secret")
+	defer os.Unsetenv("NOTIFY_TEST_TOKEN")
+
+	n, _ := newTestNotifier(t, &Config{Webhooks: []WebhookConfig{
+		{URL: r.URL + "/json"},
+		{URL: r.URL + "/slack", Format: FormatSlack, MinSeverity: SeverityError},
+		{URL: r.URL + "/bot${NOTIFY_TEST_TOKEN}/sendMessage", Format: FormatTelegram, ChatID: "-100",
+			Events: []string{EventLowBalance}},
+	}})
+
+	n.Notify(Event{Type: EventMarketHalted, Severity: SeverityError, Market: "OTN/BTC", Message: "failed to start"})
+	n.Notify(Event{Type: EventLowBalance, Severity: SeverityWarning, Market: "OTN/BTC", Asset: "BTC", Message: "0.1 left"})
+	n.Notify(Event{Type: EventConfigReloaded, Message: "restarting"})
+	n.Close()
+
+	posted := r.posted("/json")
+	require.Len(t, posted, 3)
+	assert.Equal(t, "market-maker", posted[0]["service"])
+	assert.Equal(t, EventMarketHalted, posted[0]["type"])
+	assert.Equal(t, "OTN/BTC", posted[0]["market"])
+	assert.Equal(t, SeverityInfo, posted[2]["severity"])
+
+	slack := r.posted("/slack")
+	require.Len(t, slack, 1)
+	assert.Equal(t, "[ERROR] market-maker OTN/BTC market_halted: failed to start", slack[0]["text"])
+
+	telegram := r.posted("/botsecret/sendMessage")
+	require.Len(t, telegram, 1)
+	assert.Equal(t, "-100", telegram[0]["chat_id"])
+	assert.Equal(t, "[WARNING] market-maker OTN/BTC BTC low_balance: 0.1 left", telegram[0]["text"])
+}
+
+func TestDedup(t *testing.T) {
+	r := newReceiver(t)
+	n, advance := newTestNotifier(t, &Config{Dedup: 60, Webhooks: []WebhookConfig{{URL: r.URL}}})
+
+	down := Event{Type: EventProviderDown, Severity: SeverityError, Market: "OTN/BTC", Message: "no price"}
+	n.Notify(down)
+	n.Notify(down)
+	advance(30 * time.Second)
+	n.Notify(down)
+	// other market is not the same event
+	n.Notify(Event{Type: EventProviderDown, Market: "OTN/ETH"})
+	advance(31 * time.Second)
+	n.Notify(down)
+	n.Close()
+
+	posted := r.posted("/")
+	require.Len(t, posted, 3)
+	assert.Nil(t, posted[0]["suppressed"])
+	assert.Equal(t, "OTN/ETH", posted[1]["market"])
+	assert.Equal(t, 2.0, posted[2]["suppressed"])
+}
+
+func TestRateLimit(t *testing.T) {
+	r := newReceiver(t)
+	n, advance := newTestNotifier(t, &Config{Webhooks: []WebhookConfig{
+		{URL: r.URL + "/limited", RateLimit: 2},
+		{URL: r.URL + "/default"},
+	}})
+
+	for _, market := range []string{"A/B", "C/D", "E/F"} {
+		n.Notify(Event{Type: EventMarketHalted, Market: market})
+	}
+	// wait until worker is done with queued events before moving clock
+	for len(r.posted("/default")) < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	advance(time.Minute)
+	n.Notify(Event{Type: EventMarketHalted, Market: "G/H"})
+	n.Close()
+
+	assert.Len(t, r.posted("/limited"), 3)
+	assert.Len(t, r.posted("/default"), 4)
+}
+
+func TestInvalidConfig(t *testing.T) {
+	_, err := New(&Config{}, "faucet", zap.NewNop().Sugar())
+	assert.Error(t, err)
+
+	for _, w := range []WebhookConfig{
+		{},
+		{URL: "http://localhost", Format: "xml"},
+		{URL: "http://localhost", Format: FormatTelegram},
+		{URL: "http://localhost", MinSeverity: "fatal"},
+	} {
+		_, err := New(&Config{Webhooks: []WebhookConfig{w}}, "faucet", zap.NewNop().Sugar())
+		assert.Error(t, err, "%+v", w)
+	}
+}
+
+func TestNilNotifier(t *testing.T) {
+	var n *Notifier
+	n.Notify(Event{Type: EventConfigReloaded})
+	n.Close()
+}
@@ -0,0 +1,198 @@
+package recorder
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/juju/errors"
+)
+
+const (
+	fileMode  = 0640
+	dirMode   = 0750
+	dayFormat = "2006-01-02"
+	fileExt   = ".jsonl.gz"
+	// snapshots are long lines
+	maxLineSize = 64 << 20
+)
+
+// dayWriter writes snapshots of one market to the file of their UTC day.
+// Every run starts a new file (2018-06-01.jsonl.gz, 2018-06-01.1.jsonl.gz,
+// ...), gzip stream left unfinished by a killed process is never appended to.
+type dayWriter struct {
+	dir  string
+	day  string
+	file *os.File
+	gz   *gzip.Writer
+}
+
+func newDayWriter(dir, market string) *dayWriter {
+	return &dayWriter{dir: filepath.Join(dir, market)}
+}
+
+func (w *dayWriter) write(s *Snapshot) error {
+	day := s.Time.UTC().Format(dayFormat)
+	if day != w.day {
+		if err := w.close(); err != nil {
+			return err
+		}
+		if err := w.open(day); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if _, err := w.gz.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	// snapshot is readable even if process is killed
+	return w.gz.Flush()
+}
+
+func (w *dayWriter) open(day string) error {
+	if err := os.MkdirAll(w.dir, dirMode); err != nil {
+		return errors.Annotate(err, "create data directory")
+	}
+
+	var f *os.File
+	for n := 0; f == nil; n++ {
+		var err error
+		f, err = os.OpenFile(filepath.Join(w.dir, fileName(day, n)), os.O_EXCL|os.O_CREATE|os.O_WRONLY, fileMode)
+		if err != nil && !os.IsExist(err) {
+			return errors.Annotate(err, "open data file")
+		}
+	}
+
+	w.file = f
+	w.gz = gzip.NewWriter(f)
+	w.day = day
+	return nil
+}
+
+func (w *dayWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+
+	err := w.gz.Close()
+	if cErr := w.file.Close(); err == nil {
+		err = cErr
+	}
+	w.file, w.gz, w.day = nil, nil, ""
+	return err
+}
+
+// fileName returns name of n-th file of the day, the first one has no number
+func fileName(day string, n int) string {
+	if n == 0 {
+		return day + fileExt
+	}
+	return day + "." + strconv.Itoa(n) + fileExt
+}
+
+// parseFileName is the reverse of fileName
+func parseFileName(name string) (time.Time, int, error) {
+	if !strings.HasSuffix(name, fileExt) {
+		return time.Time{}, 0, fmt.Errorf("Not a data file: %s", name)
+	}
+	base := strings.TrimSuffix(name, fileExt)
+
+	n := 0
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		var err error
+		if n, err = strconv.Atoi(base[i+1:]); err != nil || n <= 0 {
+			return time.Time{}, 0, fmt.Errorf("Not a data file: %s", name)
+		}
+		base = base[:i]
+	}
+
+	day, err := time.Parse(dayFormat, base)
+	return day, n, err
+}
+
+type dataFile struct {
+	path string
+	day  time.Time
+	n    int
+}
+
+// Files returns data files of the market (BASE-QUOTE directory) for days
+// between since and until inclusive, oldest first. Zero times are not
+// checked.
+func Files(dir, market string, since, until time.Time) ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, market, "*"+fileExt))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []dataFile
+	for _, path := range paths {
+		day, n, err := parseFileName(filepath.Base(path))
+		if err != nil {
+			continue
+		}
+		if !since.IsZero() && !day.Add(24*time.Hour).After(since) {
+			continue
+		}
+		if !until.IsZero() && day.After(until) {
+			continue
+		}
+		files = append(files, dataFile{path: path, day: day, n: n})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].day.Equal(files[j].day) {
+			return files[i].day.Before(files[j].day)
+		}
+		return files[i].n < files[j].n
+	})
+
+	var res []string
+	for _, f := range files {
+		res = append(res, f.path)
+	}
+	return res, nil
+}
+
+// ReadFile calls fn for every snapshot of the file until it returns false
+func ReadFile(path string, fn func(s *Snapshot) bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return errors.Annotatef(err, "read %s", path)
+	}
+	defer gz.Close()
+
+	scanner := bufio.NewScanner(gz)
+	scanner.Buffer(make([]byte, 0, 1<<20), maxLineSize)
+	for scanner.Scan() {
+		s := &Snapshot{}
+		if err := json.Unmarshal(scanner.Bytes(), s); err != nil {
+			return errors.Annotatef(err, "parse %s", path)
+		}
+		if !fn(s) {
+			return nil
+		}
+	}
+	// file of a killed process ends with an unfinished gzip member
+	if err := scanner.Err(); err != nil && errors.Cause(err) != io.ErrUnexpectedEOF {
+		return errors.Annotatef(err, "read %s", path)
+	}
+	return nil
+}
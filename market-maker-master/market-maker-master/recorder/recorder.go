@@ -0,0 +1,326 @@
+// Package recorder takes snapshots of DEX order books and fills at a fixed
+// interval and stores them in gzipped JSON lines files, one per market and
+// UTC day and run, e.g. OTN-BTC/2018-06-01.jsonl.gz.
+package recorder
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/juju/errors"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm"
+	"github.com/opentradingnetworkfoundation/otn-go/api"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+const (
+	defaultInterval = 10  // seconds
+	defaultDepth    = 300 // orders, the node does not return more
+	// fills requested at once, older pages are requested until the
+	// previous snapshot, the rest is lost if market is busier
+	tradeHistoryLimit = 100
+	tradeHistoryPages = 10
+)
+
+type Config struct {
+	// Markets to record, BASE/QUOTE
+	Markets []string `json:"markets"`
+	// Seconds between snapshots
+	Interval int `json:"interval"`
+	// Orders requested per market
+	Depth int `json:"depth"`
+	// Directory of data files
+	Dir string `json:"dir"`
+}
+
+// Order is a single limit order of the book
+type Order struct {
+	ID     string `json:"id"`
+	Seller string `json:"seller"`
+	// Quote per base
+	Price float64 `json:"price"`
+	// Base asset units
+	Amount     float64   `json:"amount"`
+	Expiration time.Time `json:"expiration"`
+}
+
+// Fill is a trade as reported by market history
+type Fill struct {
+	Time     time.Time `json:"time"`
+	Sequence int64     `json:"sequence"`
+	// Quote per base
+	Price float64 `json:"price"`
+	// Base asset units
+	Amount float64 `json:"amount"`
+	// Quote asset units
+	Value float64 `json:"value"`
+}
+
+// Snapshot is a single line of data file
+type Snapshot struct {
+	Time   time.Time `json:"time"`
+	Market string    `json:"market"`
+	// Orders selling base, best first
+	Asks []Order `json:"asks"`
+	// Orders buying base, best first
+	Bids []Order `json:"bids"`
+	// Fills since the previous snapshot, newest first
+	Fills []Fill `json:"fills"`
+}
+
+type market struct {
+	name   string
+	market *mm.Market
+	writer *dayWriter
+	// fills of the previous snapshot, history is requested with overlap
+	seen map[string]bool
+	last time.Time
+}
+
+// Recorder writes snapshots of configured markets
+type Recorder struct {
+	cfg      *Config
+	log      *zap.SugaredLogger
+	interval time.Duration
+	depth    int
+	now      func() time.Time
+	// optional, chain asset cache is used by default
+	assets mm.AssetLookup
+
+	mutex   sync.Mutex
+	rpc     api.BitsharesAPI
+	markets []*market
+}
+
+func New(cfg *Config, rpc api.BitsharesAPI, log *zap.SugaredLogger) (*Recorder, error) {
+	if cfg.Dir == "" {
+		return nil, errors.New("Data directory is not set")
+	}
+	if len(cfg.Markets) == 0 {
+		return nil, errors.New("No markets configured")
+	}
+
+	r := &Recorder{
+		cfg:      cfg,
+		log:      log,
+		interval: time.Duration(cfg.Interval) * time.Second,
+		depth:    cfg.Depth,
+		now:      time.Now,
+		rpc:      rpc,
+	}
+	if cfg.Interval <= 0 {
+		r.interval = defaultInterval * time.Second
+	}
+	if r.depth <= 0 {
+		r.depth = defaultDepth
+	}
+	return r, nil
+}
+
+// SetRPC moves recorder to another node connection
+func (r *Recorder) SetRPC(rpc api.BitsharesAPI) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.rpc = rpc
+}
+
+// load finds market assets, it is done once
+func (r *Recorder) load(db api.DatabaseAPI) error {
+	if r.markets != nil {
+		return nil
+	}
+
+	assets := r.assets
+	if assets == nil {
+		assets = api.NewAssetCache(db)
+	}
+
+	var markets []*market
+	for _, name := range r.cfg.Markets {
+		parts := strings.Split(name, "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid market '%s', expected BASE/QUOTE", name)
+		}
+		base := assets.GetBySymbol(parts[0])
+		if base == nil {
+			return errors.NotFoundf("Asset %s", parts[0])
+		}
+		quote := assets.GetBySymbol(parts[1])
+		if quote == nil {
+			return errors.NotFoundf("Asset %s", parts[1])
+		}
+
+		markets = append(markets, &market{
+			name:   name,
+			market: &mm.Market{Base: *base, Quote: *quote},
+			writer: newDayWriter(r.cfg.Dir, parts[0]+"-"+parts[1]),
+		})
+	}
+
+	r.markets = markets
+	return nil
+}
+
+// Record takes and writes snapshot of every market
+func (r *Recorder) Record() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	db, err := r.rpc.DatabaseAPI()
+	if err != nil {
+		return errors.Annotate(err, "get database API")
+	}
+	if err := r.load(db); err != nil {
+		return errors.Annotate(err, "load markets")
+	}
+
+	for _, m := range r.markets {
+		s, err := r.snapshot(db, m)
+		if err != nil {
+			r.log.Errorf("Failed to take snapshot of %s: %v", m.name, err)
+			continue
+		}
+		if err := m.writer.write(s); err != nil {
+			return errors.Annotatef(err, "write snapshot of %s", m.name)
+		}
+	}
+	return nil
+}
+
+// Run records markets every interval until ctx is done
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := r.Record(); err != nil {
+			r.log.Errorf("Failed to record markets: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close finishes data files
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var firstErr error
+	for _, m := range r.markets {
+		if err := m.writer.close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (r *Recorder) snapshot(db api.DatabaseAPI, m *market) (*Snapshot, error) {
+	now := r.now()
+	orders, err := db.GetLimitOrders(m.market.Base.ID, m.market.Quote.ID, r.depth)
+	if err != nil {
+		return nil, errors.Annotate(err, "get limit orders")
+	}
+
+	s := &Snapshot{Time: now.UTC(), Market: m.name, Asks: []Order{}, Bids: []Order{}}
+	baseScale := math.Pow10(m.market.Base.Precision)
+	quoteScale := math.Pow10(m.market.Quote.Precision)
+	for _, o := range orders {
+		rate := m.market.GetRate(o.SellPrice).Value()
+		if rate == 0 {
+			continue
+		}
+
+		order := Order{
+			ID:         o.ID.String(),
+			Seller:     o.Seller.String(),
+			Expiration: o.Expiration.Time.UTC(),
+		}
+		if o.SellPrice.Base.Asset == m.market.Base.ID {
+			order.Price = rate
+			order.Amount = float64(o.ForSale) / baseScale
+			s.Asks = append(s.Asks, order)
+		} else {
+			order.Price = 1 / rate
+			order.Amount = float64(o.ForSale) / quoteScale / order.Price
+			s.Bids = append(s.Bids, order)
+		}
+	}
+	sort.SliceStable(s.Asks, func(i, j int) bool { return s.Asks[i].Price < s.Asks[j].Price })
+	sort.SliceStable(s.Bids, func(i, j int) bool { return s.Bids[i].Price > s.Bids[j].Price })
+
+	if s.Fills, err = r.fills(db, m, now); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// fills returns trades since the previous snapshot, the first snapshot
+// takes trades of the last interval
+func (r *Recorder) fills(db api.DatabaseAPI, m *market, now time.Time) ([]Fill, error) {
+	since := m.last
+	if since.IsZero() {
+		since = now.Add(-r.interval)
+	}
+
+	// history is requested for inverted market, so that price is
+	// amount of quote per base, newest trades come first
+	fills := []Fill{}
+	seen := make(map[string]bool)
+	start := now
+	for page := 0; ; page++ {
+		if page == tradeHistoryPages {
+			r.log.Warnf("%s has more than %d fills since %s, some are not recorded",
+				m.name, tradeHistoryPages*tradeHistoryLimit, since.Format(time.RFC3339))
+			break
+		}
+		trades, err := db.GetTradeHistory(m.market.Quote.Symbol, m.market.Base.Symbol,
+			objects.NewTime(start), objects.NewTime(since.Add(-time.Second)), tradeHistoryLimit)
+		if err != nil {
+			return nil, errors.Annotate(err, "get trade history")
+		}
+		for _, t := range trades {
+			key := fmt.Sprintf("%d/%d", t.Sequence, t.Date.Unix())
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if m.seen[key] {
+				continue
+			}
+			fills = append(fills, Fill{
+				Time:     t.Date.Time.UTC(),
+				Sequence: t.Sequence,
+				Price:    t.Price,
+				Amount:   t.Amount,
+				Value:    t.Value,
+			})
+		}
+		if len(trades) < tradeHistoryLimit {
+			break
+		}
+		// the next page starts at the second of the oldest trade, trades
+		// of that second already taken are skipped above
+		last := trades[len(trades)-1].Date.Time
+		if last.Before(start) {
+			start = last
+		} else {
+			start = start.Add(-time.Second)
+		}
+	}
+
+	m.seen = seen
+	m.last = now
+	return fills, nil
+}
@@ -0,0 +1,172 @@
+package recorder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/opentradingnetworkfoundation/market-maker/mm/mmtest"
+	"github.com/opentradingnetworkfoundation/otn-go/objects"
+)
+
+func placeOrder(t *testing.T, chain *mmtest.Chain, seller *objects.Account, sell, receive objects.AssetAmount) {
+	_, err := chain.SignAndBroadcast(nil, nil, &objects.LimitOrderCreateOperation{
+		Seller:       seller.ID,
+		AmountToSell: sell,
+		MinToReceive: receive,
+		Expiration:   objects.NewTime(time.Date(2018, 7, 1, 0, 0, 0, 0, time.UTC)),
+	})
+	require.NoError(t, err)
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	chain := mmtest.NewChain()
+	otn := chain.AddAsset("OTN", 8)
+	btc := chain.AddAsset("BTC", 8)
+	maker := chain.AddAccount("maker", map[string]float64{"OTN": 10000, "BTC": 1})
+
+	// asks at 0.0001 and 0.00011, bid of 1000 OTN at 0.00009
+	placeOrder(t, chain, maker, otn.CreateAmount(2000), btc.CreateAmount(0.22))
+	placeOrder(t, chain, maker, otn.CreateAmount(1000), btc.CreateAmount(0.1))
+	placeOrder(t, chain, maker, btc.CreateAmount(0.09), otn.CreateAmount(1000))
+
+	now := time.Date(2018, 6, 1, 23, 59, 55, 0, time.UTC)
+	chain.AddTrade("BTC", "OTN", objects.MarketTrade{
+		Sequence: 1, Date: objects.NewTime(now.Add(-time.Minute)), Price: 0.0001, Amount: 50, Value: 0.005})
+	chain.AddTrade("BTC", "OTN", objects.MarketTrade{
+		Sequence: 2, Date: objects.NewTime(now.Add(-5 * time.Second)), Price: 0.0001, Amount: 100, Value: 0.01})
+
+	r, err := New(&Config{Markets: []string{"OTN/BTC"}, Dir: dir}, chain, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	r.assets = chain
+	r.now = func() time.Time { return now }
+
+	require.NoError(t, r.Record())
+	// trade of the same second as the previous snapshot is not repeated
+	now = now.Add(10 * time.Second)
+	chain.AddTrade("BTC", "OTN", objects.MarketTrade{
+		Sequence: 3, Date: objects.NewTime(now.Add(-time.Second)), Price: 0.00011, Amount: 10, Value: 0.0011})
+	require.NoError(t, r.Record())
+	require.NoError(t, r.Close())
+
+	files, err := Files(dir, "OTN-BTC", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Equal(t, []string{
+		filepath.Join(dir, "OTN-BTC", "2018-06-01.jsonl.gz"),
+		filepath.Join(dir, "OTN-BTC", "2018-06-02.jsonl.gz"),
+	}, files)
+
+	var snapshots []*Snapshot
+	for _, path := range files {
+		require.NoError(t, ReadFile(path, func(s *Snapshot) bool {
+			snapshots = append(snapshots, s)
+			return true
+		}))
+	}
+	require.Len(t, snapshots, 2)
+
+	s := snapshots[0]
+	assert.Equal(t, "OTN/BTC", s.Market)
+	require.Len(t, s.Asks, 2)
+	assert.InDelta(t, 0.0001, s.Asks[0].Price, 1e-12)
+	assert.InDelta(t, 1000, s.Asks[0].Amount, 1e-6)
+	assert.InDelta(t, 0.00011, s.Asks[1].Price, 1e-12)
+	assert.Equal(t, maker.ID.String(), s.Asks[0].Seller)
+	require.Len(t, s.Bids, 1)
+	assert.InDelta(t, 0.00009, s.Bids[0].Price, 1e-12)
+	assert.InDelta(t, 1000, s.Bids[0].Amount, 1e-6)
+	// only the last interval is taken on start
+	require.Len(t, s.Fills, 1)
+	assert.Equal(t, int64(2), s.Fills[0].Sequence)
+
+	require.Len(t, snapshots[1].Fills, 1)
+	assert.Equal(t, int64(3), snapshots[1].Fills[0].Sequence)
+
+	files, err = Files(dir, "OTN-BTC", time.Date(2018, 6, 2, 12, 0, 0, 0, time.UTC), time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
+
+func TestRecorderPagesFills(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	chain := mmtest.NewChain()
+	chain.AddAsset("OTN", 8)
+	chain.AddAsset("BTC", 8)
+
+	// more fills than a page, many of them in the same second
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < 250; i++ {
+		chain.AddTrade("BTC", "OTN", objects.MarketTrade{
+			Sequence: int64(i + 1), Date: objects.NewTime(now.Add(-time.Duration(5-i/50) * time.Second)),
+			Price: 0.0001, Amount: 1, Value: 0.0001})
+	}
+
+	r, err := New(&Config{Markets: []string{"OTN/BTC"}, Dir: dir}, chain, zap.NewNop().Sugar())
+	require.NoError(t, err)
+	r.assets = chain
+	r.now = func() time.Time { return now }
+	require.NoError(t, r.Record())
+	require.NoError(t, r.Close())
+
+	var fills []Fill
+	require.NoError(t, ReadFile(filepath.Join(dir, "OTN-BTC", "2018-06-01.jsonl.gz"), func(s *Snapshot) bool {
+		fills = append(fills, s.Fills...)
+		return true
+	}))
+	require.Len(t, fills, 250)
+	sequences := make(map[int64]bool)
+	for _, f := range fills {
+		sequences[f.Sequence] = true
+	}
+	assert.Len(t, sequences, 250)
+}
+
+func TestRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recorder")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2018, 6, 1, 12, 0, 0, 0, time.UTC)
+	// the first runs are killed without closing the file
+	for i := 0; i < 12; i++ {
+		w := newDayWriter(dir, "OTN-BTC")
+		require.NoError(t, w.write(&Snapshot{Time: now.Add(time.Duration(i) * time.Minute), Market: "OTN/BTC"}))
+		require.NoError(t, w.write(&Snapshot{Time: now.Add(time.Duration(i)*time.Minute + time.Second), Market: "OTN/BTC"}))
+		if i < 11 {
+			require.NoError(t, w.file.Close())
+		} else {
+			require.NoError(t, w.close())
+		}
+	}
+
+	files, err := Files(dir, "OTN-BTC", time.Time{}, time.Time{})
+	require.NoError(t, err)
+	require.Len(t, files, 12)
+	assert.Equal(t, filepath.Join(dir, "OTN-BTC", "2018-06-01.jsonl.gz"), files[0])
+	assert.Equal(t, filepath.Join(dir, "OTN-BTC", "2018-06-01.11.jsonl.gz"), files[11])
+
+	var times []time.Time
+	for _, path := range files {
+		require.NoError(t, ReadFile(path, func(s *Snapshot) bool {
+			times = append(times, s.Time)
+			return true
+		}))
+	}
+	require.Len(t, times, 24)
+	for i, tm := range times {
+		assert.Equal(t, now.Add(time.Duration(i/2)*time.Minute+time.Duration(i%2)*time.Second), tm)
+	}
+}
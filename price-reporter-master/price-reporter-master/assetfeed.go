@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/opentradingnetworkfoundation/otn-go/coinmarketcap"
@@ -29,7 +30,8 @@ type AssetFeedConfig struct {
 }
 
 type PricePublisher interface {
-	PublishPrice(assetID, publisher string, price float64) error
+	// reason explains where price comes from, it is recorded in journal
+	PublishPrice(assetID, publisher string, price float64, reason string) error
 }
 
 type AssetFeed struct {
@@ -106,8 +108,9 @@ func (c *AssetFeed) worker(ticker *time.Ticker) {
 func (p *AssetFeed) reportSinus(now time.Time) {
 	for _, params := range p.cfg.Sinusoid {
 		price := GetSinusoidPrice(&params, now)
+		reason := fmt.Sprintf("sinusoid %f..%f, period %ds", params.Min, params.Max, params.Period)
 		for _, publisher := range p.cfg.Publishers {
-			p.publisher.PublishPrice(params.Asset, publisher, price)
+			p.publisher.PublishPrice(params.Asset, publisher, price, reason)
 		}
 	}
 }
@@ -161,8 +164,12 @@ func (c *AssetFeed) reportCoinmarketcap(now time.Time) {
 		}
 
 		if price != 0 {
+			reason := fmt.Sprintf("coinmarketcap interval %ds, OTN/BTC %f", c.cfg.Interval, coreBtcPrice)
+			if c.filterBtc != nil {
+				reason += " (filtered)"
+			}
 			for _, publisher := range c.cfg.Publishers {
-				c.publisher.PublishPrice(asset.Asset, publisher, price)
+				c.publisher.PublishPrice(asset.Asset, publisher, price, reason)
 			}
 		}
 	}
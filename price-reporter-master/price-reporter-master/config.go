@@ -3,9 +3,12 @@ package main
 import (
 	"encoding/json"
 	"io/ioutil"
-	"os"
 
 	"github.com/juju/errors"
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/keystore"
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 	"github.com/opentradingnetworkfoundation/otn-go/secrets"
 	"go.uber.org/zap"
 )
@@ -15,9 +18,13 @@ type PriceReporterConfig struct {
 	Logger             zap.Config             `json:"logger"`
 	AssetFeeds         []AssetFeedConfig      `json:"feeds"`
 	Keys               []string               `json:"keys"`
-	TrustedNode        string                 `json:"trusted_node"`
+	TrustedNode        nodepool.Addresses     `json:"trusted_node"`
+	NodePool           *nodepool.Config       `json:"node_pool"`
 	Publishers         []string               `json:"publishers"`
 	Secrets            *secrets.StorageConfig `json:"secrets"`
+	Keystore           *keystore.Config       `json:"keystore"`
+	Journal            *journal.Config        `json:"journal"`
+	Notify             *notify.Config         `json:"notify"`
 }
 
 func LoadConfig(filename string, cfg *PriceReporterConfig) error {
@@ -54,6 +61,15 @@ func LoadConfig(filename string, cfg *PriceReporterConfig) error {
 		cfg.Keys = append(cfg.Keys, keys...)
 	}
 
-	cfg.TrustedNode = os.ExpandEnv(cfg.TrustedNode)
+	if cfg.Keystore != nil {
+		keys, err := keystore.ReadKeys(cfg.Keystore)
+		if err != nil {
+			return errors.Annotate(err, "read keystore")
+		}
+
+		cfg.Keys = append(cfg.Keys, keys...)
+	}
+
+	cfg.TrustedNode = cfg.TrustedNode.ExpandEnv()
 	return nil
 }
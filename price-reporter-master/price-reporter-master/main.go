@@ -7,6 +7,7 @@ import (
 	"os/signal"
 	"syscall"
 
+	"github.com/opentradingnetworkfoundation/market-maker/nodepool"
 	"github.com/opentradingnetworkfoundation/otn-go/api"
 	"github.com/opentradingnetworkfoundation/otn-go/wallet"
 )
@@ -22,7 +23,19 @@ func main() {
 		log.Fatalln("Failed to load configuration:", err)
 	}
 
-	rpcConn := api.NewConnection(cfg.TrustedNode)
+	lg, err := cfg.Logger.Build()
+	if err != nil {
+		log.Fatal("Unable to create logger: ", err)
+	}
+	pool, err := nodepool.New(cfg.TrustedNode, cfg.NodePool, lg.Sugar())
+	if err != nil {
+		log.Fatal("Unable to create node pool: ", err)
+	}
+	pool.Start()
+	defer pool.Stop()
+
+	node := pool.Active()
+	rpcConn := api.NewConnection(node)
 	rpc := api.New(rpcConn)
 	wallet := wallet.NewWallet()
 	if err := wallet.AddPrivateKeys(cfg.Keys); err != nil {
@@ -33,16 +46,49 @@ func main() {
 		log.Fatal("Unable to create price reporter: ", err)
 	}
 	if err := rpcConn.Connect(); err != nil {
-		log.Fatalf("Unable to open connection to API node %s: %v", cfg.TrustedNode, err)
+		log.Fatalf("Unable to open connection to API node %s: %v", node, err)
 	}
 
-	// wait for signal
+	// pool handlers must not block, events are handled below
+	events := make(chan nodepool.Event, 16)
+	pool.Subscribe(func(e nodepool.Event) {
+		select {
+		case events <- e:
+		default:
+			log.Printf("Dropped node pool event %s", e.Type)
+		}
+	})
+
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
 
-	select {
-	case <-signalChan:
+	// stop publishing while node is unhealthy, reconnect on failover
+	for {
+		select {
+		case <-signalChan:
+			// waits for publishing in progress
+			pr.Pause()
+			if err := pr.journal.Close(); err != nil {
+				log.Printf("Failed to close journal: %v", err)
+			}
+			pr.notifier.Close()
+			return
+		case e := <-events:
+			switch {
+			case e.Type == nodepool.EventUnavailable:
+				pr.Pause()
+			case e.To == node:
+				pr.Resume()
+			default:
+				rpc.Close()
+				node = e.To
+				rpcConn = api.NewConnection(node)
+				rpc = api.New(rpcConn)
+				pr.SetRPC(rpc)
+				if err := rpcConn.Connect(); err != nil {
+					log.Printf("Unable to open connection to API node %s: %v", node, err)
+				}
+			}
+		}
 	}
-
-	pr.Stop()
 }
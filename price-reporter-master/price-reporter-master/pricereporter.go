@@ -5,6 +5,8 @@ import (
 	"sync"
 
 	"github.com/juju/errors"
+	"github.com/opentradingnetworkfoundation/market-maker/journal"
+	"github.com/opentradingnetworkfoundation/market-maker/notify"
 	"github.com/opentradingnetworkfoundation/otn-go/coinmarketcap"
 	"github.com/opentradingnetworkfoundation/otn-go/api"
 	"github.com/opentradingnetworkfoundation/otn-go/objects"
@@ -19,12 +21,18 @@ type PriceReporter struct {
 	assetCache *api.AssetCache
 	cfg        []AssetFeedConfig
 	log        *zap.SugaredLogger
+	journal    *journal.Journal
+	notifier   *notify.Notifier
 
 	// mutable state
 	coreAsset *objects.Asset
 	mutex     sync.Mutex
 	feeds     []*AssetFeed
 	connected bool
+	// API node is unhealthy, publishing waits for it to recover
+	paused bool
+	// publisher account names by id, journal records names like other services
+	accountNames map[string]string
 }
 
 func (p *PriceReporter) Start() {
@@ -59,12 +67,39 @@ func (p *PriceReporter) Stop() {
 	p.connected = false
 }
 
-func (p *PriceReporter) PublishPrice(assetID string, publisher string, price float64) (err error) {
+// Pause stops publishing until Resume or login to another node
+func (p *PriceReporter) Pause() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.paused = true
+}
+
+// Resume continues publishing after node recovered
+func (p *PriceReporter) Resume() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.paused = false
+}
+
+// SetRPC moves reporter to connection with another node. Publishing
+// resumes on login to that node.
+func (p *PriceReporter) SetRPC(rpc api.BitsharesAPI) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.Stop()
+	p.paused = false
+	p.rpc = rpc
+	p.assetCache = api.NewAssetCache(rpc)
+	rpc.RegisterCallback(p.loginEventsHandler)
+}
+
+func (p *PriceReporter) PublishPrice(assetID string, publisher string, price float64, reason string) (err error) {
 	{
 		// check if connected
 		p.mutex.Lock()
 		defer p.mutex.Unlock()
-		if p.connected == false {
+		if p.connected == false || p.paused {
 			return nil
 		}
 	}
@@ -86,17 +121,54 @@ func (p *PriceReporter) PublishPrice(assetID string, publisher string, price flo
 	op.Feed.SettlementPrice.Set(asset, p.coreAsset, rate)
 	op.Feed.CoreExchangeRate.Set(asset, p.coreAsset, rate*1.05)
 
-	_, err = p.rpc.SignAndBroadcast(p.wallet.GetKeys(), &p.coreAsset.ID, op)
+	txID, err := p.rpc.SignAndBroadcast(p.wallet.GetKeys(), &p.coreAsset.ID, op)
+
+	rec := journal.Record{Account: p.accountName(publisherID), Asset: assetID, Reason: reason}
+	if jErr := p.journal.Record(rec, []objects.Operation{op}, txID, err); jErr != nil {
+		p.log.Errorf("Failed to write journal: %v", jErr)
+	}
 
 	if err != nil {
 		err = errors.Annotate(err, "Failed to broadcast transaction")
 		p.log.Errorf("%v", err.Error())
+		p.notifier.Notify(notify.Event{
+			Type:     notify.EventFeedPublishFailed,
+			Severity: notify.SeverityError,
+			Asset:    assetID,
+			Message:  fmt.Sprintf("feed %f from %s not published: %v", price, publisher, err),
+		})
 		return err
 	}
 
 	return nil
 }
 
+// accountName returns name of the publisher account, id if lookup fails.
+// Caller holds the mutex.
+func (p *PriceReporter) accountName(publisher *objects.GrapheneID) string {
+	id := publisher.String()
+	if name, ok := p.accountNames[id]; ok {
+		return name
+	}
+
+	db, err := p.rpc.DatabaseAPI()
+	if err != nil {
+		p.log.Errorf("Failed to get name of account %s: %v", id, err)
+		return id
+	}
+	accounts, err := db.GetFullAccounts(publisher)
+	if err != nil || len(accounts) == 0 {
+		p.log.Errorf("Failed to get name of account %s: %v", id, err)
+		return id
+	}
+
+	if p.accountNames == nil {
+		p.accountNames = make(map[string]string)
+	}
+	p.accountNames[id] = accounts[0].Account.Name
+	return accounts[0].Account.Name
+}
+
 func NewPriceReporter(rpc api.BitsharesAPI, wallet wallet.Wallet, cfg *PriceReporterConfig) (*PriceReporter, error) {
 	l, err := cfg.Logger.Build()
 	if err != nil {
@@ -105,6 +177,20 @@ func NewPriceReporter(rpc api.BitsharesAPI, wallet wallet.Wallet, cfg *PriceRepo
 	cmc := coinmarketcap.NewProClient(
 		&coinmarketcap.Options{URL: cfg.CoinmarketcapProxy})
 
+	var j *journal.Journal
+	if cfg.Journal != nil {
+		if j, err = journal.New(cfg.Journal, "price-reporter"); err != nil {
+			return nil, err
+		}
+	}
+
+	var n *notify.Notifier
+	if cfg.Notify != nil {
+		if n, err = notify.New(cfg.Notify, "price-reporter", l.Sugar()); err != nil {
+			return nil, err
+		}
+	}
+
 	pr := &PriceReporter{
 		rpc:        rpc,
 		log:        l.Sugar(),
@@ -112,6 +198,8 @@ func NewPriceReporter(rpc api.BitsharesAPI, wallet wallet.Wallet, cfg *PriceRepo
 		wallet:     wallet,
 		cfg:        cfg.AssetFeeds,
 		assetCache: api.NewAssetCache(rpc),
+		journal:    j,
+		notifier:   n,
 	}
 
 	rpc.RegisterCallback(pr.loginEventsHandler)